@@ -3,17 +3,12 @@ package box
 // box gets information about the currently installed VM
 
 import (
-	"errors"
 	"fmt"
+	"io"
 	"math"
-	"os"
-	"regexp"
 	"strconv"
 	"time"
 
-	semver "github.com/blang/semver/v4"
-
-	"naksu/box/vboxmanage"
 	"naksu/config"
 	"naksu/constants"
 	"naksu/host"
@@ -23,11 +18,14 @@ import (
 )
 
 const (
-	boxName           = "NaksuAbittiKTP"
+	// legacyBoxName is the name of the box installed before multiple boxes were
+	// supported. New boxes are named legacyBoxName-version (see newBoxName()).
+	legacyBoxName     = "NaksuAbittiKTP"
 	boxOSType         = "Debian"
-	boxFinalImageSize = 55 * 1024 // VDI disk size in megs
-	boxVRamSize       = 24        // Video RAM size in megs
+	boxFinalImageSize = 55 * 1024 // Minimum VDI disk size in megs, see config.GetVMDiskSizeGB()
 	boxSnapshotName   = "Installed"
+	// boxSharedFolderName is the name of the shared folder (ktp-jako) in the VM
+	boxSharedFolderName = "media_usb1"
 )
 
 func calculateBoxCPUs() (int, error) {
@@ -62,165 +60,161 @@ func calculateBoxMemory() (uint64, error) {
 	return freeVMMemory, nil
 }
 
-// CreateNewBox creates new VM using the given imagePath
-func CreateNewBox(boxType string, boxVersion string) error {
-	if mebroutines.ExistsFile(mebroutines.GetVDIImagePath()) {
-		err := os.Remove(mebroutines.GetVDIImagePath())
-		if err != nil {
-			return fmt.Errorf("could not remove old vdi file %s: %v", mebroutines.GetVDIImagePath(), err)
-		}
-		log.Debug("Removed existing VDI file %s", mebroutines.GetVDIImagePath())
-	}
+// CreateNewBox creates new VM using the raw disk image read from image (imageSize bytes).
+// The new VM is named after its version and it becomes the active box. The installed
+// boxes are not touched: an existing box with the same version is replaced only by
+// RemoveOldBoxes() after the new box has been created. If creating the new VM fails,
+// the VM and its disk are removed.
+func CreateNewBox(boxType string, boxVersion string, image io.Reader, imageSize uint64) error {
+	hypervisor := getHypervisor()
 
-	calculatedBoxCPUs, err := calculateBoxCPUs()
+	name, err := newAvailableBoxName(hypervisor, boxVersion, time.Now())
 	if err != nil {
 		return err
 	}
 
-	calculatedBoxMemory, errMemory := calculateBoxMemory()
-	if errMemory != nil {
-		return errMemory
-	}
+	diskPath := hypervisor.DiskImagePath(name)
 
-	log.Debug(fmt.Sprintf("Calculated new VM specs - CPUs: %d, Memory: %d", calculatedBoxCPUs, calculatedBoxMemory))
-
-	createCommands := []vboxmanage.VBoxCommand{
-		{"convertfromraw", mebroutines.GetImagePath(), mebroutines.GetVDIImagePath(), "--format", "VDI"},
-		{"modifyhd", mebroutines.GetVDIImagePath(), "--resize", fmt.Sprintf("%d", boxFinalImageSize)},
-		{"createvm", "--name", boxName, "--register"},
-		{
-			"modifyvm", boxName,
-			"--pae", "on",
-			"--cpus", fmt.Sprintf("%d", calculatedBoxCPUs),
-			"--memory", fmt.Sprintf("%d", calculatedBoxMemory),
-			"--vram", fmt.Sprintf("%d", boxVRamSize),
-			"--acpi", "on",
-			"--ioapic", "on",
-			"--ostype", boxOSType,
-			"--firmware", "efi",
-			"--audio", "none",
-		},
-		{
-			"guestproperty", "set", boxName,
-			"boxType", boxType,
-		},
-		{
-			"guestproperty", "set", boxName,
-			"boxVersion", boxVersion,
-		},
-		{
-			"sharedfolder", "add", boxName,
-			"--name", "media_usb1",
-			"--hostpath", mebroutines.GetMebshareDirectory(),
-		},
-		{
-			"storagectl", boxName,
-			"--add", "sata",
-			"--name", "SATA Controller",
-		},
-		{
-			"storageattach", boxName,
-			"--storagectl", "SATA Controller",
-			"--port", "0",
-			"--device", "0",
-			"--type", "hdd",
-			"--medium", mebroutines.GetVDIImagePath(),
-		},
-		{
-			"setextradata", boxName,
-			"GUI/RestrictedCloseActions",
-			"SaveState,PowerOffRestoringSnapshot",
-		},
+	spec, err := newVMSpec(name, diskPath, boxType, boxVersion)
+	if err != nil {
+		return err
 	}
 
-	v6_1String := "6.1.0"
-	v6_1, err := semver.Make(v6_1String)
-	if err != nil {
-		return fmt.Errorf("hard-coded version string %s could not be converted to sematic version object", v6_1String)
+	spec.SnapshotName = boxSnapshotName
+
+	// A failed or interrupted install is rolled back so that a half-created VM or
+	// disk is not left behind
+	journal := newInstallJournal(mebroutines.GetInstallJournalPath(), spec)
+
+	return runInstallSteps(journal, newInstallSteps(hypervisor, journal, func() error {
+		return hypervisor.ImportDisk(image, imageSize, diskPath, int(spec.DiskSizeGB*1024))
+	}))
+}
+
+// RestoreBox creates a new VM using the disk of a backup written by WriteDiskClone().
+// The backup does not tell the type and version of the server so they are given by
+// the caller. The restored VM becomes the active box. Returns the name of the new VM.
+// A failed or interrupted restore is rolled back like an install, see CreateNewBox().
+func RestoreBox(backupPath string, boxType string, boxVersion string) (string, error) {
+	hypervisor := getHypervisor()
+	name := newRestoredBoxName(time.Now())
+	diskPath := hypervisor.DiskImagePath(name)
+
+	if mebroutines.ExistsFile(diskPath) {
+		return "", fmt.Errorf("disk image file %s already exists", diskPath)
 	}
 
-	vBoxVersion, err := vboxmanage.GetVBoxManageVersion()
+	spec, err := newVMSpec(name, diskPath, boxType, boxVersion)
 	if err != nil {
-		log.Debug(fmt.Sprintf("Could not get VBoxManage version: %v", err))
-		return err
+		return "", err
 	}
 
-	if vBoxVersion.LT(v6_1) {
-		createCommands = append(createCommands, vboxmanage.VBoxCommand{"modifyvm", boxName, "--clipboard", "bidirectional"})
-	} else {
-		createCommands = append(createCommands, vboxmanage.VBoxCommand{"modifyvm", boxName, "--clipboard-mode", "bidirectional"})
+	if boxVersion == "" {
+		delete(spec.Properties, "boxVersion")
 	}
 
-	createCommands = append(createCommands, vboxmanage.VBoxCommand{"snapshot", boxName, "take", boxSnapshotName})
+	log.Debug(fmt.Sprintf("Restoring server %s from backup %s", name, backupPath))
+
+	// There is no snapshot as the restored server contains the exams of the backup
+	journal := newInstallJournal(mebroutines.GetInstallJournalPath(), spec)
+	journal.Restore = true
 
-	err = vboxmanage.RunCommands(createCommands)
+	err = runInstallSteps(journal, newInstallSteps(hypervisor, journal, func() error {
+		return hypervisor.ImportVMDK(backupPath, diskPath)
+	}))
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	vboxmanage.ResetVBoxResponseCache()
-
-	return nil
+	return name, nil
 }
 
-// StartCurrentBox starts currently installed VM
-func StartCurrentBox() error {
-	startCommands := []vboxmanage.VBoxCommand{
-		{"modifyvm", boxName, "--nic1", "bridged"},
-		{"modifyvm", boxName, "--bridgeadapter1", config.GetExtNic()},
-		{"modifyvm", boxName, "--nictype1", config.GetNic()},
-		{"startvm", boxName, "--type", "gui"},
+// newVMSpec returns the settings of a new VM using the disk at diskPath
+func newVMSpec(name string, diskPath string, boxType string, boxVersion string) (VMSpec, error) {
+	resources, err := GetResources()
+	if err != nil {
+		return VMSpec{}, err
 	}
 
-	return vboxmanage.RunCommands(startCommands)
+	log.Debug(fmt.Sprintf("New VM specs - CPUs: %d, Memory: %d, Video memory: %d, Disk: %d GB", resources.CPUs, resources.MemoryMB, resources.VRamMB, resources.DiskSizeGB))
+
+	return VMSpec{
+		Name:             name,
+		OSType:           boxOSType,
+		CPUs:             resources.CPUs,
+		MemoryMB:         resources.MemoryMB,
+		VRamMB:           resources.VRamMB,
+		DiskSizeGB:       resources.DiskSizeGB,
+		DiskPath:         diskPath,
+		SharedFolderName: boxSharedFolderName,
+		SharedFolderPath: mebroutines.GetMebshareDirectory(),
+		Properties: map[string]string{
+			"boxType":      boxType,
+			"boxVersion":   boxVersion,
+			"boxInstalled": strconv.FormatInt(time.Now().Unix(), 10),
+		},
+	}, nil
 }
 
-// RestoreSnapshot returns installed VM to fresh state (to the snapshot taken just after the install)
-func RestoreSnapshot() error {
-	restoreCommands := []vboxmanage.VBoxCommand{
-		{"snapshot", boxName, "restore", boxSnapshotName},
-	}
+// GetNewBoxDiskSpace returns the disk space needed in each directory for creating a
+// new box of the given version from a raw image of imageSize bytes (see CreateNewBox())
+func GetNewBoxDiskSpace(boxVersion string, imageSize uint64) map[string]uint64 {
+	hypervisor := getHypervisor()
 
-	return vboxmanage.RunCommands(restoreCommands)
+	return hypervisor.ImportDiskSpace(hypervisor.DiskImagePath(newBoxName(boxVersion)), imageSize)
 }
 
-// RemoveCurrentBox deletes currently installed VM
-func RemoveCurrentBox() error {
-	removeCommands := []vboxmanage.VBoxCommand{
-		{"unregistervm", boxName, "--delete"},
-	}
+// GetSharedFolderName returns the name of the folder shared with the VMs (see
+// mebroutines.GetMebshareDirectory())
+func GetSharedFolderName() string {
+	return boxSharedFolderName
+}
 
-	return vboxmanage.RunCommands(removeCommands)
+// GetInstalledSnapshotName returns the name of the snapshot taken just after the install
+func GetInstalledSnapshotName() string {
+	return boxSnapshotName
 }
 
-// WriteDiskClone creates a disk clone of the first disk of the current VM
-func WriteDiskClone(clonePath string) error {
-	diskUUID := getDiskUUID()
-	if diskUUID == "" {
-		return fmt.Errorf("could not get disk uuid")
-	}
+// GetDiskSize returns the minimum size of the disk of a VM in bytes. The raw image
+// must not be larger than this. The disk of a new VM may be larger, see GetResources().
+func GetDiskSize() uint64 {
+	return boxFinalImageSize * 1024 * 1024
+}
 
-	vBoxManageOutput, err := vboxmanage.RunCommand(vboxmanage.VBoxCommand{"clonemedium", diskUUID, clonePath, "--format", "VMDK"})
+// StartCurrentBox starts the active VM
+func StartCurrentBox() error {
+	return getHypervisor().StartVM(getActiveBoxName(), NetworkSpec{
+		HostInterface: config.GetExtNic(),
+		NicType:       config.GetNic(),
+	})
+}
 
-	if err != nil {
-		return err
-	}
+// RestoreSnapshot returns installed VM to fresh state (to the snapshot taken just after the install)
+func RestoreSnapshot() error {
+	return getHypervisor().RestoreSnapshot(getActiveBoxName(), boxSnapshotName)
+}
 
-	// Check whether clone was successful or not
-	matched, errRe := regexp.MatchString("Clone medium created in format 'VMDK'", vBoxManageOutput)
-	if errRe != nil || !matched {
-		// Failure
-		log.Debug("VBoxManage output does not report successful clone in format 'VMDK'")
-		return errors.New("could not get correct response from vboxmanage")
-	}
+// CompactCurrentDisk releases the unused blocks of the base disk of the stopped active VM,
+// e.g. after RestoreSnapshot()
+func CompactCurrentDisk() error {
+	return getHypervisor().CompactDisk(getActiveBoxName())
+}
+
+// RemoveCurrentBox deletes the active VM
+func RemoveCurrentBox() error {
+	return getHypervisor().RemoveVM(getActiveBoxName())
+}
 
-	// Detach media from VirtualBox disk management
-	_, errCloseMedium := vboxmanage.RunCommand(vboxmanage.VBoxCommand{"closemedium", clonePath})
-	return errCloseMedium
+// WriteDiskClone creates a disk clone of the first disk of the current VM. If split is true
+// the clone is written as a split VMDK made of 2 GB extents. The percentage of the work done
+// is reported to progressCallbackFn.
+func WriteDiskClone(clonePath string, split bool, progressCallbackFn func(int)) error {
+	return getHypervisor().CloneDisk(getActiveBoxName(), clonePath, split, progressCallbackFn)
 }
 
 // StartEnvironmentStatusUpdate starts periodically updating given
-// environmentStatus.BoxInstalled and .BoxRunning values
+// environmentStatus.BoxInstalled and .BoxRunning values and the state returned by
+// GetLastState()
 func StartEnvironmentStatusUpdate(environmentStatus *constants.EnvironmentStatus, tickerDuration time.Duration) {
 	ticker := time.NewTicker(tickerDuration)
 
@@ -228,18 +222,14 @@ func StartEnvironmentStatusUpdate(environmentStatus *constants.EnvironmentStatus
 		for {
 			<-ticker.C
 
-			boxInstalled, boxInstalledErr := Installed()
-			if boxInstalledErr != nil {
-				log.Debug(fmt.Sprintf("Could not query whether VM is installed: %v", boxInstalledErr))
+			state, stateErr := GetState()
+			if stateErr != nil {
+				log.Debug(fmt.Sprintf("Could not query VM state: %v", stateErr))
+				setLastState(VMStateUnknown)
 			} else {
-				environmentStatus.BoxInstalled = (boxInstalledErr == nil) && boxInstalled
-			}
-
-			boxRunning, boxRunningErr := Running()
-			if boxRunningErr != nil {
-				log.Debug(fmt.Sprintf("Could not query whether VM is running: %v", boxRunningErr))
-			} else {
-				environmentStatus.BoxRunning = (boxRunningErr == nil) && boxRunning
+				setLastState(state)
+				environmentStatus.BoxInstalled = state != VMStateNotInstalled
+				environmentStatus.BoxRunning = state.IsRunning()
 			}
 		}
 	}()
@@ -247,7 +237,7 @@ func StartEnvironmentStatusUpdate(environmentStatus *constants.EnvironmentStatus
 
 // Installed returns true if we have box installed, otherwise false
 func Installed() (bool, error) {
-	isInstalled, err := vboxmanage.IsVMInstalled(boxName)
+	isInstalled, err := getHypervisor().IsInstalled(getActiveBoxName())
 
 	if err != nil {
 		log.Debug(fmt.Sprintf("box.Installed() could not detect whether VM is installed: %v", err))
@@ -257,7 +247,7 @@ func Installed() (bool, error) {
 }
 
 func Running() (bool, error) {
-	isRunning, err := vboxmanage.IsVMRunning(boxName)
+	isRunning, err := getHypervisor().IsRunning(getActiveBoxName())
 
 	if err != nil {
 		log.Debug(fmt.Sprintf("box.Running() could not detect whether VM is running: %v", err))
@@ -268,21 +258,25 @@ func Running() (bool, error) {
 
 // GetType returns the box type (e.g. "digabi/ktp-qa") of the current VM
 func GetType() string {
-	return vboxmanage.GetVMProperty(boxName, "boxType")
+	return getHypervisor().GetProperty(getActiveBoxName(), "boxType")
 }
 
 // GetTypeLegend returns an user-readable type legend of the current VM
 func GetTypeLegend() string {
-	if TypeIsAbitti() {
-		return xlate.Get("Abitti server")
-	}
+	return GetTypeLegendOf(GetType())
+}
 
-	if TypeIsMatriculationExam() {
+// GetTypeLegendOf returns an user-readable legend of the given box type
+func GetTypeLegendOf(boxType string) string {
+	switch boxType {
+	case constants.AbittiBoxType:
+		return xlate.Get("Abitti server")
+	case constants.MatriculationExamBoxType:
 		return xlate.Get("Matric Exam server")
 	}
 
 	// Unknown box type
-	log.Debug(fmt.Sprintf("Warning: We have a type string '%s' which does not resolve to Abitti/Matriculation box type (GetTypeLegend)", GetType()))
+	log.Debug(fmt.Sprintf("Warning: We have a type string '%s' which does not resolve to Abitti/Matriculation box type (GetTypeLegend)", boxType))
 	return "-"
 }
 
@@ -302,43 +296,21 @@ func TypeIsMatriculationExam() bool {
 
 // GetVersion returns the version string (e.g. "SERVER7108X v69") of the current VM
 func GetVersion() string {
-	return vboxmanage.GetVMProperty(boxName, "boxVersion")
-}
-
-// getDiskUUID returns the VirtualBox UUID for the image of the current VM
-func getDiskUUID() string {
-	return vboxmanage.GetVMInfoByRegexp(boxName, "\"SATA Controller-ImageUUID-0-0\"=\"(.*?)\"")
+	return getHypervisor().GetProperty(getActiveBoxName(), "boxVersion")
 }
 
 // GetDiskLocation returns the full path of the current VM disk image.
 func GetDiskLocation() string {
-	return vboxmanage.GetVMInfoByRegexp(boxName, "\"SATA Controller-0-0\"=\"(.*)\"")
+	return getHypervisor().DiskLocation(getActiveBoxName())
 }
 
 // GetLogDir returns the full path of VirtualBox log directory
 func GetLogDir() string {
-	return vboxmanage.GetVMInfoByRegexp(boxName, "LogFldr=\"(.*)\"")
+	return getHypervisor().LogDir(getActiveBoxName())
 }
 
 // MediumSizeOnDisk returns the size of the current VM disk image on disk
 // (= the expected size of a VM backup) in megabytes.
 func MediumSizeOnDisk(location string) (uint64, error) {
-	// According to documentation, showmediuminfo should also accept a disk uuid
-	// as a parameter, but that doesn't seem to be the case. To be safe, we'll
-	// use the location of the disk instead.
-
-	mediumInfo, err := vboxmanage.RunCommand([]string{"showmediuminfo", location})
-
-	if err != nil {
-		log.Debug(fmt.Sprintf("Could not get medium info to calculate its size: %v", err))
-		return 0, errors.New("failed to get medium size: could not execute vboxmanage")
-	}
-
-	sizeOnDiskRE := regexp.MustCompile(`Size on disk:\s+(\d+)\s+MBytes`)
-	result := sizeOnDiskRE.FindStringSubmatch(mediumInfo)
-	if len(result) > 1 {
-		size := result[1]
-		return strconv.ParseUint(size, 10, 64)
-	}
-	return 0, errors.New("failed to get medium size: no regex matches")
+	return getHypervisor().DiskSizeOnDisk(location)
 }
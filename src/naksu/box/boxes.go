@@ -0,0 +1,265 @@
+package box
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"naksu/config"
+	"naksu/log"
+	"naksu/mebroutines"
+)
+
+// boxesKeptForRollback is the number of older boxes of the same type kept when a new box
+// is installed. The user can roll back to these boxes.
+const boxesKeptForRollback = 1
+
+// Info describes an installed exam server VM
+type Info struct {
+	Name    string
+	Type    string
+	Version string
+	// Installed is the time of installation. It is zero for boxes installed before
+	// multiple boxes were supported.
+	Installed time.Time
+	Active    bool
+}
+
+// newBoxName returns the VM name of a box with the given version
+func newBoxName(boxVersion string) string {
+	return fmt.Sprintf("%s-%s", legacyBoxName, boxVersion)
+}
+
+// newAvailableBoxName returns the VM name of a new box with the given version. If the
+// version is already installed the new box is named after the install time as well so
+// that the installed box is kept until the new one has been created (see RemoveOldBoxes()).
+func newAvailableBoxName(hypervisor Hypervisor, boxVersion string, installTime time.Time) (string, error) {
+	name := newBoxName(boxVersion)
+
+	isInstalled, err := hypervisor.IsInstalled(name)
+	if err != nil {
+		return "", err
+	}
+
+	if isInstalled || mebroutines.ExistsFile(hypervisor.DiskImagePath(name)) {
+		name = newBoxName(boxVersion + "-" + installTime.Format("20060102-150405"))
+		log.Debug(fmt.Sprintf("Server version %s exists, installing it as %s", boxVersion, name))
+	}
+
+	return name, nil
+}
+
+// newRestoredBoxName returns the VM name of a box restored from a backup at the given time
+func newRestoredBoxName(restoreTime time.Time) string {
+	return newBoxName("restored-" + restoreTime.Format("20060102-150405"))
+}
+
+// isNaksuBoxName returns true if the VM has been created by Naksu
+func isNaksuBoxName(name string) bool {
+	return name == legacyBoxName || strings.HasPrefix(name, legacyBoxName+"-")
+}
+
+// getActiveBoxName returns the name of the VM selected by the user
+func getActiveBoxName() string {
+	activeBox := config.GetActiveBox()
+	if activeBox == "" {
+		return legacyBoxName
+	}
+
+	return activeBox
+}
+
+// ListBoxes returns all installed boxes, the most recently installed first
+func ListBoxes() ([]Info, error) {
+	hypervisor := getHypervisor()
+
+	vmNames, err := hypervisor.ListVMs()
+	if err != nil {
+		return nil, err
+	}
+
+	activeBoxName := getActiveBoxName()
+	boxes := []Info{}
+
+	for _, vmName := range vmNames {
+		if !isNaksuBoxName(vmName) {
+			continue
+		}
+
+		boxInfo := Info{
+			Name:    vmName,
+			Type:    hypervisor.GetProperty(vmName, "boxType"),
+			Version: hypervisor.GetProperty(vmName, "boxVersion"),
+			Active:  vmName == activeBoxName,
+		}
+
+		installed, err := strconv.ParseInt(hypervisor.GetProperty(vmName, "boxInstalled"), 10, 64)
+		if err == nil {
+			boxInfo.Installed = time.Unix(installed, 0)
+		}
+
+		boxes = append(boxes, boxInfo)
+	}
+
+	sort.SliceStable(boxes, func(i, j int) bool {
+		return boxes[i].Installed.After(boxes[j].Installed)
+	})
+
+	return boxes, nil
+}
+
+// SetActiveBox selects the box used by the other functions of this package
+func SetActiveBox(name string) error {
+	if !isNaksuBoxName(name) {
+		return fmt.Errorf("%s is not a naksu server", name)
+	}
+
+	isInstalled, err := getHypervisor().IsInstalled(name)
+	if err != nil {
+		return fmt.Errorf("could not detect whether server %s is installed: %v", name, err)
+	}
+
+	if !isInstalled {
+		return fmt.Errorf("server %s is not installed", name)
+	}
+
+	log.Debug(fmt.Sprintf("Changing active box to %s", name))
+	config.SetActiveBox(name)
+
+	return nil
+}
+
+// GetPreviousBox returns the box of the same type as the active box which was
+// installed before the active box
+func GetPreviousBox() (Info, error) {
+	boxes, err := ListBoxes()
+	if err != nil {
+		return Info{}, err
+	}
+
+	var activeBox *Info
+	for n := range boxes {
+		if boxes[n].Active {
+			activeBox = &boxes[n]
+		}
+	}
+
+	if activeBox == nil {
+		return Info{}, errors.New("there is no active server")
+	}
+
+	for _, boxInfo := range boxes {
+		if !boxInfo.Active && boxInfo.Type == activeBox.Type && boxInfo.Installed.Before(activeBox.Installed) {
+			return boxInfo, nil
+		}
+	}
+
+	return Info{}, errors.New("there is no previous version of the server")
+}
+
+// RollbackToPreviousBox makes the previously installed box of the same type active
+func RollbackToPreviousBox() (Info, error) {
+	isRunning, err := IsAnyBoxRunning()
+	if err != nil {
+		return Info{}, err
+	}
+
+	if isRunning {
+		return Info{}, errors.New("please stop the server before rolling back")
+	}
+
+	previousBox, err := GetPreviousBox()
+	if err != nil {
+		return Info{}, err
+	}
+
+	return previousBox, SetActiveBox(previousBox.Name)
+}
+
+// IsAnyBoxRunning returns true if any of the installed boxes is running
+func IsAnyBoxRunning() (bool, error) {
+	boxes, err := ListBoxes()
+	if err != nil {
+		return false, err
+	}
+
+	for _, boxInfo := range boxes {
+		isRunning, err := getHypervisor().IsRunning(boxInfo.Name)
+		if err != nil {
+			return false, err
+		}
+
+		if isRunning {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// RemoveOldBoxes removes the boxes replaced by the active box, which is a newly
+// installed box. This is the last step of an install so the old boxes are kept if the
+// install fails. The boxes of the same type and version as the active box are removed.
+// Of the other boxes of the same type only boxesKeptForRollback most recently installed
+// ones are left.
+func RemoveOldBoxes() error {
+	boxes, err := ListBoxes()
+	if err != nil {
+		return err
+	}
+
+	var activeBox *Info
+	for n := range boxes {
+		if boxes[n].Active {
+			activeBox = &boxes[n]
+		}
+	}
+
+	if activeBox == nil {
+		return errors.New("there is no active server")
+	}
+
+	keptBoxes := 0
+	for _, boxInfo := range boxes {
+		if boxInfo.Active || boxInfo.Type != activeBox.Type {
+			continue
+		}
+
+		if boxInfo.Version != activeBox.Version && keptBoxes < boxesKeptForRollback {
+			keptBoxes++
+			continue
+		}
+
+		log.Debug(fmt.Sprintf("Removing old server %s (%s %s)", boxInfo.Name, boxInfo.Type, boxInfo.Version))
+		err = getHypervisor().RemoveVM(boxInfo.Name)
+		if err != nil {
+			return fmt.Errorf("could not remove old server %s: %v", boxInfo.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// RemoveAllBoxes removes all installed boxes
+func RemoveAllBoxes() error {
+	boxes, err := ListBoxes()
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, boxInfo := range boxes {
+		err = getHypervisor().RemoveVM(boxInfo.Name)
+		if err != nil {
+			log.Debug(fmt.Sprintf("Could not remove server %s: %v", boxInfo.Name, err))
+			lastErr = err
+		}
+	}
+
+	config.SetActiveBox("")
+
+	return lastErr
+}
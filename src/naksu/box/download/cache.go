@@ -0,0 +1,226 @@
+package download
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"naksu/config"
+	"naksu/log"
+	"naksu/mebroutines"
+)
+
+const (
+	cachedImagePrefix = "ktp-etcher-"
+	cachedImageSuffix = ".zip"
+	// cachedImageKeySeparator separates the version from the source key in the name of
+	// a cached image. The sanitized version cannot contain it.
+	cachedImageKeySeparator = "-"
+	// cachedImageKeyLength is the number of hex digits of the source URL digest in the
+	// name of a cached image
+	cachedImageKeyLength = 12
+)
+
+// CachedImage is a server image stored in the image cache
+type CachedImage struct {
+	Version  string
+	Path     string
+	Size     uint64
+	LastUsed time.Time
+}
+
+// GetImageCacheDirectory returns the path of the image cache (~/ktp/image-cache)
+func GetImageCacheDirectory() string {
+	return filepath.Join(mebroutines.GetKtpDirectory(), "image-cache")
+}
+
+// GetCachedImagePath returns the path of the cached server image zip of the given
+// version downloaded from url. The images of different sources (Abitti and each exam,
+// whose URL contains the passphrase hash) are kept apart even if they have the same
+// version string.
+func GetCachedImagePath(url string, version string) string {
+	return filepath.Join(GetImageCacheDirectory(), cachedImagePrefix+SanitizeBoxVersionString(version)+cachedImageKeySeparator+getCachedImageKey(url)+cachedImageSuffix)
+}
+
+// getCachedImageKey returns the part of the cached image name identifying the source
+// of the image. The URL is hashed so that the passphrase hash is not visible in the name.
+func getCachedImageKey(url string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(url)))[:cachedImageKeyLength]
+}
+
+// parseCachedImageName returns the version of the cached image with the given file
+// name. Images cached before the images were keyed by their source have no key.
+func parseCachedImageName(name string) (string, bool) {
+	if !strings.HasPrefix(name, cachedImagePrefix) || !strings.HasSuffix(name, cachedImageSuffix) {
+		return "", false
+	}
+
+	version := strings.TrimSuffix(strings.TrimPrefix(name, cachedImagePrefix), cachedImageSuffix)
+	separatorIndex := strings.LastIndex(version, cachedImageKeySeparator)
+	if separatorIndex >= 0 {
+		version = version[:separatorIndex]
+	}
+
+	return version, version != ""
+}
+
+func ensureImageCacheDirectoryExists() error {
+	if mebroutines.ExistsDir(GetImageCacheDirectory()) {
+		return nil
+	}
+
+	err := mebroutines.CreateDir(GetImageCacheDirectory())
+	if err != nil {
+		return fmt.Errorf("could not create image cache directory %s: %v", GetImageCacheDirectory(), err)
+	}
+
+	return nil
+}
+
+// isImageCached returns true if the image is in the cache. An image is moved to the
+// cache only after it has been downloaded completely, see downloadFileResumable().
+func isImageCached(imagePath string) bool {
+	return mebroutines.ExistsFile(imagePath)
+}
+
+// touchCachedImage marks the image as used. The least recently used images
+// are removed first by CollectImageCacheGarbage().
+func touchCachedImage(imagePath string) {
+	now := time.Now()
+	err := os.Chtimes(imagePath, now, now)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not update modification time of cached image %s: %v", imagePath, err))
+	}
+}
+
+func removeCachedImage(imagePath string) {
+	if mebroutines.ExistsFile(imagePath) {
+		err := os.Remove(imagePath)
+		if err != nil {
+			log.Debug(fmt.Sprintf("Could not remove cached image file %s: %v", imagePath, err))
+		}
+	}
+
+	removePartialDownload(imagePath)
+}
+
+// removeLegacyServerImage removes the image zip stored by previous Naksu versions
+func removeLegacyServerImage() {
+	if mebroutines.ExistsFile(mebroutines.GetZipImagePath()) {
+		log.Debug(fmt.Sprintf("Removing legacy server image %s", mebroutines.GetZipImagePath()))
+		err := os.Remove(mebroutines.GetZipImagePath())
+		if err != nil {
+			log.Debug(fmt.Sprintf("Could not remove legacy server image: %v", err))
+		}
+	}
+}
+
+// ListCachedImages returns the images in the image cache, most recently used first
+func ListCachedImages() ([]CachedImage, error) {
+	if !mebroutines.ExistsDir(GetImageCacheDirectory()) {
+		return []CachedImage{}, nil
+	}
+
+	files, err := ioutil.ReadDir(GetImageCacheDirectory())
+	if err != nil {
+		return nil, fmt.Errorf("could not read image cache directory: %v", err)
+	}
+
+	images := []CachedImage{}
+	for _, file := range files {
+		version, ok := parseCachedImageName(file.Name())
+		imagePath := filepath.Join(GetImageCacheDirectory(), file.Name())
+		if file.IsDir() || !ok || !isImageCached(imagePath) {
+			continue
+		}
+
+		images = append(images, CachedImage{
+			Version:  version,
+			Path:     imagePath,
+			Size:     uint64(file.Size()),
+			LastUsed: file.ModTime(),
+		})
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].LastUsed.After(images[j].LastUsed)
+	})
+
+	return images, nil
+}
+
+// PurgeImageCache removes the cached images of the given version. If version is
+// empty all cached images and unfinished downloads are removed.
+func PurgeImageCache(version string) error {
+	if version != "" {
+		images, err := ListCachedImages()
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for _, image := range images {
+			if image.Version == SanitizeBoxVersionString(version) {
+				log.Debug(fmt.Sprintf("Purging cached server image %s", image.Path))
+				removeCachedImage(image.Path)
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("server image version %s is not in the cache", version)
+		}
+
+		return nil
+	}
+
+	log.Debug("Purging the image cache")
+	removeLegacyServerImage()
+
+	return mebroutines.RemoveDir(GetImageCacheDirectory())
+}
+
+// CollectImageCacheGarbage removes the least recently used images until the
+// cache satisfies the count and size limits set in the configuration. The most
+// recently used image (i.e. the one just installed) is always kept.
+func CollectImageCacheGarbage() {
+	images, err := ListCachedImages()
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not collect image cache garbage: %v", err))
+		return
+	}
+
+	maxSize := config.GetImageCacheMaxSizeGB() * 1024 * 1024 * 1024
+
+	for _, image := range getImageCacheGarbage(images, config.GetImageCacheMaxImages(), maxSize) {
+		log.Debug(fmt.Sprintf("Removing cached server image version %s (%d bytes)", image.Version, image.Size))
+		removeCachedImage(image.Path)
+	}
+}
+
+// getImageCacheGarbage returns the images (most recently used first) which exceed
+// maxImages or maxSize bytes. Zero limits are not applied. The first image is never
+// returned.
+func getImageCacheGarbage(images []CachedImage, maxImages uint64, maxSize uint64) []CachedImage {
+	garbage := []CachedImage{}
+
+	var totalSize uint64
+	for n, image := range images {
+		totalSize += image.Size
+
+		if n == 0 {
+			continue
+		}
+
+		if (maxImages > 0 && uint64(n) >= maxImages) || (maxSize > 0 && totalSize > maxSize) {
+			garbage = append(garbage, image)
+		}
+	}
+
+	return garbage
+}
@@ -0,0 +1,104 @@
+package download
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetCachedImagePath(t *testing.T) {
+	abittiPath := GetCachedImagePath("https://static.abitti.fi/etcher-usb/ktp-etcher.zip", "SERVER2021X v1")
+	examAPath := GetCachedImagePath("https://static.abitti.fi/etcher-usb/releases/aaaa/ktp-etcher.zip", "SERVER2021X v1")
+	examBPath := GetCachedImagePath("https://static.abitti.fi/etcher-usb/releases/bbbb/ktp-etcher.zip", "SERVER2021X v1")
+
+	if abittiPath == examAPath || examAPath == examBPath || abittiPath == examBPath {
+		t.Errorf("Images of the same version from different URLs share a cache path: %s, %s, %s", abittiPath, examAPath, examBPath)
+	}
+
+	for _, path := range []string{abittiPath, examAPath, examBPath} {
+		version, ok := parseCachedImageName(filepath.Base(path))
+		if !ok || version != "SERVER2021Xv1" {
+			t.Errorf("Cached image name %s gives version '%s' (%v), expected 'SERVER2021Xv1'", filepath.Base(path), version, ok)
+		}
+	}
+}
+
+func TestParseCachedImageName(t *testing.T) {
+	tables := []struct {
+		name    string
+		version string
+		ok      bool
+	}{
+		{"ktp-etcher-SERVER7108X_v69-0123456789ab.zip", "SERVER7108X_v69", true},
+		{"ktp-etcher-SERVER7108X_v69.zip", "SERVER7108X_v69", true},
+		{"ktp-etcher-SERVER7108X_v69-0123456789ab.zip.part", "", false},
+		{"ktp-etcher-.zip", "", false},
+		{"other.zip", "", false},
+	}
+
+	for _, table := range tables {
+		version, ok := parseCachedImageName(table.name)
+		if version != table.version || ok != table.ok {
+			t.Errorf("parseCachedImageName('%s') gives '%s' (%v), expected '%s' (%v)", table.name, version, ok, table.version, table.ok)
+		}
+	}
+}
+
+func TestSameVersionFromOtherURLIsNotCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "naksu-cache-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	imagePath := filepath.Join(dir, filepath.Base(GetCachedImagePath("https://example.com/a/ktp-etcher.zip", "v1")))
+	err = ioutil.WriteFile(imagePath, []byte("cached"), 0600)
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", imagePath, err)
+	}
+
+	if !isImageCached(imagePath) {
+		t.Errorf("Image %s is not cached", imagePath)
+	}
+
+	otherPath := filepath.Join(dir, filepath.Base(GetCachedImagePath("https://example.com/b/ktp-etcher.zip", "v1")))
+	if isImageCached(otherPath) {
+		t.Errorf("Image of the same version from another URL is cached as %s", otherPath)
+	}
+}
+
+func TestGetImageCacheGarbage(t *testing.T) {
+	const gb = 1024 * 1024 * 1024
+
+	images := []CachedImage{
+		{Version: "v3", Size: 6 * gb},
+		{Version: "v2", Size: 5 * gb},
+		{Version: "v1", Size: 5 * gb},
+	}
+
+	tables := []struct {
+		maxImages uint64
+		maxSize   uint64
+		garbage   []string
+	}{
+		{2, 0, []string{"v1"}},
+		{0, 0, []string{}},
+		{1, 0, []string{"v2", "v1"}},
+		{0, 11 * gb, []string{"v1"}},
+		// The newest image is kept although it exceeds the size limit alone
+		{0, 1 * gb, []string{"v2", "v1"}},
+	}
+
+	for _, table := range tables {
+		garbage := []string{}
+		for _, image := range getImageCacheGarbage(images, table.maxImages, table.maxSize) {
+			garbage = append(garbage, image.Version)
+		}
+
+		if strings.Join(garbage, ",") != strings.Join(table.garbage, ",") {
+			t.Errorf("getImageCacheGarbage with %d images and %d bytes gives %v, expected %v", table.maxImages, table.maxSize, garbage, table.garbage)
+		}
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
-	"path/filepath"
 	"regexp"
 	"time"
 
@@ -27,7 +26,10 @@ import (
 // Suppress progress messages if there has been less than 2 seconds from a message
 const progressLastMessageTimeout = 2 * time.Second
 
-// writeCounter implements io.Writer interface (see downloadServerImage, unZipServerImage)
+// zipImageEntryName is the path of the raw disk image inside an etcher zip
+const zipImageEntryName = "ytl/ktp.img"
+
+// writeCounter implements io.Writer interface (see downloadServerImage, OpenServerImage)
 type writeCounter struct {
 	Total              uint64
 	FileSize           uint64
@@ -44,21 +46,16 @@ func (wc *writeCounter) Write(p []byte) (int, error) {
 	wc.Total += uint64(n)
 
 	if time.Now().After(progressLastMessageTime.Add(progressLastMessageTimeout)) {
-		wc.ProgressCallbackFn(wc.ProgressString, int((100*wc.Total)/wc.FileSize))
+		wc.ProgressCallbackFn(wc.ProgressString, percentage(wc.Total, wc.FileSize))
 		progressLastMessageTime = time.Now()
 	}
 
 	return n, nil
 }
 
-// GetServerImagePath returns path to cached server image (~/ktp/naksu_last_image.zip)
-func GetServerImagePath() string {
-	return filepath.Join(mebroutines.GetKtpDirectory(), "naksu_last_image.zip")
-}
-
-func downloadServerImage(url string, progressCallbackFn func(string, int)) error {
-	if mebroutines.ExistsFile(mebroutines.GetZipImagePath()) {
-		err := os.Remove(mebroutines.GetZipImagePath())
+func downloadServerImage(url string, destPath string, progressCallbackFn func(string, int)) error {
+	if mebroutines.ExistsFile(destPath) {
+		err := os.Remove(destPath)
 		if err != nil {
 			return fmt.Errorf("could not remove old image file: %v", err)
 		}
@@ -66,107 +63,118 @@ func downloadServerImage(url string, progressCallbackFn func(string, int)) error
 
 	progressCallbackFn(xlate.Get("Contacting server"), 0)
 	log.Debug(fmt.Sprintf("Starting to download image from '%s'", url))
-	response, errHTTPGet := http.Get(url) // #nosec
 
-	if errHTTPGet != nil {
-		log.Debug(fmt.Sprintf("HTTP GET from url '%s' gives an error: %v", url, errHTTPGet))
-		return errHTTPGet
-	}
-
-	if response.StatusCode != 200 {
-		log.Debug(fmt.Sprintf("HTTP GET from url '%s' gives a status code %d", url, response.StatusCode))
-		return fmt.Errorf("%d", response.StatusCode)
+	err := downloadFileResumable(url, destPath, progressCallbackFn)
+	if err != nil {
+		return err
 	}
 
-	defer response.Body.Close()
-
-	fileSize := uint64(response.ContentLength)
+	progressCallbackFn(xlate.Get("Server image downloaded"), 100)
 
-	progressCallbackFn(xlate.Get("Opening file"), 1)
-	zipFile, errFile := os.OpenFile(mebroutines.GetZipImagePath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if errFile != nil {
-		log.Debug(fmt.Sprintf("Could not open file '%s' for server image zip: %v", mebroutines.GetZipImagePath(), errFile))
-		return errFile
-	}
-	defer zipFile.Close()
+	return nil
+}
 
-	progressCallbackFn(xlate.Get("Downloading server image"), 2)
+// zipImageReader reads the raw disk image from inside the etcher zip
+type zipImageReader struct {
+	zipReader   *zip.ReadCloser
+	imageReader io.ReadCloser
+	reader      io.Reader
+}
 
-	counter := &writeCounter{}
-	counter.ProgressCallbackFn = progressCallbackFn
-	counter.FileSize = fileSize
-	counter.ProgressString = xlate.GetRaw("Downloading server image")
+func (r *zipImageReader) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
 
-	var errCopy error
-	if _, errCopy = io.Copy(zipFile, io.TeeReader(response.Body, counter)); errCopy != nil {
-		return errCopy
+func (r *zipImageReader) Close() error {
+	err := r.imageReader.Close()
+	zipErr := r.zipReader.Close()
+	if err != nil {
+		return err
 	}
 
-	progressCallbackFn(xlate.Get("Server image downloaded"), 100)
+	return zipErr
+}
 
-	return nil
+// OpenServerImage opens the raw disk image (ytl/ktp.img) inside the cached server
+// image zip of the given version downloaded from url. The image is uncompressed while
+// it is read so it never has to be written to the disk. Returns the reader and the
+// uncompressed image size.
+func OpenServerImage(url string, version string, progressCallbackFn func(string, int)) (io.ReadCloser, uint64, error) {
+	return openZipImage(GetCachedImagePath(url, version), progressCallbackFn)
 }
 
-func unZipServerImage(progressCallbackFn func(string, int)) error {
-	r, err := zip.OpenReader(mebroutines.GetZipImagePath())
+// openZipImage opens the raw disk image inside the given etcher zip
+func openZipImage(zipPath string, progressCallbackFn func(string, int)) (io.ReadCloser, uint64, error) {
+	r, err := zip.OpenReader(zipPath)
 	if err != nil {
-		return fmt.Errorf("could not open zip %s: %v", mebroutines.GetZipImagePath(), err)
+		return nil, 0, fmt.Errorf("could not open zip %s: %v", zipPath, err)
 	}
-	defer r.Close()
 
 	for _, file := range r.File {
 		log.Debug(fmt.Sprintf("Etcher zip contains file %s, size %s", file.Name, humanize.Bytes(file.UncompressedSize64)))
 
-		if file.Name == "ytl/ktp.img" {
-
-			fImage, err := os.OpenFile(mebroutines.GetImagePath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-			if err != nil {
-				return fmt.Errorf("could not create image file %s: %v", mebroutines.GetImagePath(), err)
-			}
-
-			defer fImage.Close()
-
+		if file.Name == zipImageEntryName {
 			fZipped, err := file.Open()
 			if err != nil {
-				return fmt.Errorf("could not open file inside the zip: %v", err)
+				_ = r.Close()
+				return nil, 0, fmt.Errorf("could not open file inside the zip: %v", err)
 			}
 
-			defer fZipped.Close()
-
 			progressCallbackFn(xlate.Get("Starting to uncompress raw image"), 1)
 
-			counter := &writeCounter{}
-			counter.ProgressCallbackFn = progressCallbackFn
-			counter.FileSize = file.UncompressedSize64
-			counter.ProgressString = xlate.GetRaw("Uncompressing image...")
-
-			if _, err = io.Copy(fImage, io.TeeReader(fZipped, counter)); err != nil {
-				return err
-			}
-
-			progressCallbackFn(xlate.Get("Uncompressing finished"), 100)
+			return &zipImageReader{
+				zipReader:   r,
+				imageReader: fZipped,
+				reader:      newProgressReader(fZipped, file.UncompressedSize64, xlate.GetRaw("Uncompressing and converting image..."), progressCallbackFn),
+			}, file.UncompressedSize64, nil
 		}
 	}
 
-	return nil
+	_ = r.Close()
+
+	return nil, 0, fmt.Errorf("zip %s does not contain %s", zipPath, zipImageEntryName)
 }
 
-func GetServerImage(url string, progressCallbackFn func(string, int)) error {
-	err := downloadServerImage(url, progressCallbackFn)
+// newProgressReader returns a reader which reports the progress of reading size bytes from reader
+func newProgressReader(reader io.Reader, size uint64, progressString string, progressCallbackFn func(string, int)) io.Reader {
+	counter := &writeCounter{}
+	counter.ProgressCallbackFn = progressCallbackFn
+	counter.FileSize = size
+	counter.ProgressString = progressString
+
+	return io.TeeReader(reader, counter)
+}
+
+// GetServerImage makes sure the image cache contains the server image of the given
+// version from url. If the image is not cached it is downloaded from url. Use
+// OpenServerImage() to read the image.
+func GetServerImage(url string, version string, progressCallbackFn func(string, int)) error {
+	removeLegacyServerImage()
+
+	imagePath := GetCachedImagePath(url, version)
+
+	if isImageCached(imagePath) {
+		log.Debug(fmt.Sprintf("Using cached server image version %s (%s)", version, imagePath))
+		touchCachedImage(imagePath)
+		progressCallbackFn(xlate.Get("Using a previously downloaded server image"), 100)
+		return nil
+	}
+
+	err := ensureImageCacheDirectoryExists()
 	if err != nil {
-		log.Debug(fmt.Sprintf("Failed to download server image from '%s': %v", url, err))
 		return err
 	}
 
-	err = unZipServerImage(progressCallbackFn)
+	err = downloadServerImage(url, imagePath, progressCallbackFn)
 	if err != nil {
-		log.Debug(fmt.Sprintf("Failed to unZipServerImage: %v", err))
+		log.Debug(fmt.Sprintf("Failed to download server image from '%s': %v", url, err))
 		return err
 	}
 
 	return nil
 }
 
+// GetAvailableVersion returns the version string published at versionURL
 func GetAvailableVersion(versionURL string) (string, error) {
 	ensureCloudStatusCacheInitialised()
 
@@ -196,7 +204,7 @@ func GetAvailableVersion(versionURL string) (string, error) {
 			return "", err
 		}
 
-		version = sanitizeBoxVersionString(string(body))
+		version = SanitizeBoxVersionString(string(body))
 
 		errCacheSet := cloudStatusCache.Set(versionURL, version, constants.CloudStatusTimeout)
 		if errCacheSet != nil {
@@ -209,8 +217,8 @@ func GetAvailableVersion(versionURL string) (string, error) {
 	return version, nil
 }
 
-// sanitizeBoxVersionString removes all unallowed characters from box version string
-func sanitizeBoxVersionString(str string) string {
+// SanitizeBoxVersionString removes all unallowed characters from box version string
+func SanitizeBoxVersionString(str string) string {
 	re := regexp.MustCompile(`\W`)
 	return re.ReplaceAllString(str, "")
 }
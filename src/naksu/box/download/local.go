@@ -0,0 +1,170 @@
+package download
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"naksu/log"
+	"naksu/mebroutines"
+	"naksu/xlate"
+)
+
+// zipFileSignature is the magic number at the beginning of a zip file
+var zipFileSignature = []byte("PK\x03\x04")
+
+// localImageReader reads a raw disk image from a local file or a block device
+type localImageReader struct {
+	file   *os.File
+	reader io.Reader
+}
+
+func (r *localImageReader) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
+
+func (r *localImageReader) Close() error {
+	return r.file.Close()
+}
+
+// IsZipFile returns true if the given file is a zip archive
+func IsZipFile(path string) bool {
+	file, err := os.Open(path) // #nosec
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, len(zipFileSignature))
+	_, err = io.ReadFull(file, header)
+
+	return err == nil && bytes.Equal(header, zipFileSignature)
+}
+
+// OpenLocalImage opens a locally supplied server image. The path can be an etcher zip
+// (ktp-etcher.zip), a raw disk image (ktp.img) or a block device of a USB stick written
+// with Etcher (e.g. /dev/sdb or \\.\PhysicalDrive2). Returns the reader and the size
+// of the raw image.
+func OpenLocalImage(path string, progressCallbackFn func(string, int)) (io.ReadCloser, uint64, error) {
+	if IsZipFile(path) {
+		return openZipImage(path, progressCallbackFn)
+	}
+
+	file, err := os.Open(path) // #nosec
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not open image %s: %v", path, err)
+	}
+
+	size, err := getRawImageSize(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, 0, fmt.Errorf("could not get size of image %s: %v", path, err)
+	}
+
+	if size == 0 {
+		_ = file.Close()
+		return nil, 0, fmt.Errorf("image %s is empty", path)
+	}
+
+	log.Debug(fmt.Sprintf("Opened raw image %s, size %d bytes", path, size))
+
+	return &localImageReader{
+		file:   file,
+		reader: newProgressReader(io.LimitReader(file, int64(size)), size, xlate.GetRaw("Converting image..."), progressCallbackFn),
+	}, size, nil
+}
+
+// GetLocalImageVersion returns the version of a locally supplied server image. The
+// version is read from a .ver file next to the image (ktp-etcher.zip -> ktp-etcher.ver,
+// ktp.img.ver or ktp-etcher.ver in the same directory), from a .ver file inside the zip
+// or from a .ver file on a FAT partition of a raw image or a USB stick.
+func GetLocalImageVersion(path string) (string, error) {
+	directory := filepath.Dir(path)
+	candidates := []string{
+		strings.TrimSuffix(path, filepath.Ext(path)) + ".ver",
+		path + ".ver",
+		filepath.Join(directory, "ktp-etcher.ver"),
+	}
+
+	for _, candidate := range candidates {
+		if !mebroutines.ExistsFile(candidate) {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(candidate) // #nosec
+		if err != nil {
+			log.Debug(fmt.Sprintf("Could not read version file %s: %v", candidate, err))
+			continue
+		}
+
+		version := SanitizeBoxVersionString(string(content))
+		if version != "" {
+			log.Debug(fmt.Sprintf("Version of local image %s is '%s' (from %s)", path, version, candidate))
+			return version, nil
+		}
+	}
+
+	if IsZipFile(path) {
+		version, err := getZipImageVersion(path)
+		if err == nil && version != "" {
+			log.Debug(fmt.Sprintf("Version of local image %s is '%s' (from the zip)", path, version))
+			return version, nil
+		}
+	} else {
+		version, err := getLocalRawImageVersion(path)
+		if err == nil {
+			log.Debug(fmt.Sprintf("Version of local image %s is '%s' (from the image)", path, version))
+			return version, nil
+		}
+		log.Debug(fmt.Sprintf("Could not read version from image %s: %v", path, err))
+	}
+
+	return "", errors.New("could not find version file for the image")
+}
+
+// getZipImageVersion returns the contents of the first .ver file inside the zip
+func getZipImageVersion(zipPath string) (string, error) {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	for _, file := range r.File {
+		if !strings.HasSuffix(file.Name, ".ver") {
+			continue
+		}
+
+		fVersion, err := file.Open()
+		if err != nil {
+			return "", err
+		}
+
+		content, err := ioutil.ReadAll(io.LimitReader(fVersion, 1024))
+		_ = fVersion.Close()
+		if err != nil {
+			return "", err
+		}
+
+		return SanitizeBoxVersionString(string(content)), nil
+	}
+
+	return "", nil
+}
+
+// getLocalRawImageVersion returns the version from inside a raw image or a USB stick
+func getLocalRawImageVersion(path string) (string, error) {
+	file, err := os.Open(path) // #nosec
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return getRawImageVersion(file)
+}
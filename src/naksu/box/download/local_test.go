@@ -0,0 +1,106 @@
+package download
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestZip(t *testing.T, zipPath string, files map[string]string) {
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatalf("Could not create zip: %v", err)
+	}
+	defer zipFile.Close()
+
+	zipWriter := zip.NewWriter(zipFile)
+	for name, content := range files {
+		writer, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatalf("Could not add %s to zip: %v", name, err)
+		}
+
+		_, err = writer.Write([]byte(content))
+		if err != nil {
+			t.Fatalf("Could not write %s to zip: %v", name, err)
+		}
+	}
+
+	err = zipWriter.Close()
+	if err != nil {
+		t.Fatalf("Could not close zip: %v", err)
+	}
+}
+
+func TestGetLocalImageVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "naksu-local-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipPath := filepath.Join(dir, "ktp-etcher.zip")
+	writeTestZip(t, zipPath, map[string]string{"ytl/ktp.img": "image", "ytl/ktp.ver": "SERVER2021X\n"})
+
+	version, err := GetLocalImageVersion(zipPath)
+	if err != nil || version != "SERVER2021X" {
+		t.Errorf("Version from the zip should be SERVER2021X, got '%s' (%v)", version, err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "ktp-etcher.ver"), []byte("ABITTI2021S\n"), 0600)
+	if err != nil {
+		t.Fatalf("Could not write version file: %v", err)
+	}
+
+	version, err = GetLocalImageVersion(zipPath)
+	if err != nil || version != "ABITTI2021S" {
+		t.Errorf("Version from the .ver file should be ABITTI2021S, got '%s' (%v)", version, err)
+	}
+
+	imagePath := filepath.Join(dir, "other", "ktp.img")
+	_, err = GetLocalImageVersion(imagePath)
+	if err == nil {
+		t.Errorf("Image without version file should give an error")
+	}
+}
+
+func TestOpenLocalImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "naksu-local-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipPath := filepath.Join(dir, "ktp-etcher.zip")
+	writeTestZip(t, zipPath, map[string]string{"ytl/ktp.img": "zipped image"})
+
+	rawPath := filepath.Join(dir, "ktp.img")
+	err = ioutil.WriteFile(rawPath, []byte("raw image"), 0600)
+	if err != nil {
+		t.Fatalf("Could not write raw image: %v", err)
+	}
+
+	tables := []struct {
+		path    string
+		content string
+	}{
+		{zipPath, "zipped image"},
+		{rawPath, "raw image"},
+	}
+
+	for _, table := range tables {
+		image, size, err := OpenLocalImage(table.path, noProgress)
+		if err != nil {
+			t.Errorf("OpenLocalImage('%s') gives an error: %v", table.path, err)
+			continue
+		}
+
+		content, err := ioutil.ReadAll(image)
+		_ = image.Close()
+		if err != nil || string(content) != table.content || size != uint64(len(table.content)) {
+			t.Errorf("OpenLocalImage('%s') gives '%s' (%d bytes), expected '%s'", table.path, content, size, table.content)
+		}
+	}
+}
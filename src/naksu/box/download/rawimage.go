@@ -0,0 +1,447 @@
+package download
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+const (
+	// rawImageSectorSize is the logical sector size of the raw server images
+	rawImageSectorSize = 512
+	// maxRawImageVersionSize limits the amount of data read from a .ver file in the image
+	maxRawImageVersionSize = 1024
+	// maxFATDirectoryClusters limits the directory clusters read so that a damaged FAT
+	// with a loop does not hang the install
+	maxFATDirectoryClusters = 1024
+	// maxGPTPartitionEntries and maxGPTPartitionEntrySize limit the GPT partition entries
+	// read from an image so that a damaged header does not make us read gigabytes
+	maxGPTPartitionEntries   = 1024
+	maxGPTPartitionEntrySize = 4096
+	// minGPTPartitionEntrySize is the size of a partition entry in the UEFI specification.
+	// Larger entries must be multiples of it.
+	minGPTPartitionEntrySize = 128
+)
+
+// gptSignature is at the beginning of the GPT header in the second sector
+var gptSignature = []byte("EFI PART")
+
+// imagePartition is a partition of a raw disk image
+type imagePartition struct {
+	// Offset is the start of the partition in bytes
+	Offset uint64
+	// Size is the size of the partition in bytes
+	Size uint64
+}
+
+// getRawImageSize returns the size of the raw image in the given file or block device.
+// The size of a regular file is the file size. A block device of a USB stick written
+// with Etcher is larger than the image so the size is read from the partition table
+// of the image.
+func getRawImageSize(file *os.File) (uint64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if info.Mode().IsRegular() {
+		return uint64(info.Size()), nil
+	}
+
+	// Stat() does not give the size of a block device so we seek to the end
+	deviceSize, err := file.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	imageSize, err := getPartitionedImageSize(file)
+	if err != nil {
+		return 0, err
+	}
+
+	if imageSize > uint64(deviceSize) {
+		return 0, fmt.Errorf("partition table gives image size %d bytes which exceeds the device size %d bytes", imageSize, deviceSize)
+	}
+
+	return imageSize, nil
+}
+
+// getPartitionedImageSize returns the size of the disk image from its partition table.
+// A GPT image ends at the backup GPT header recorded in the primary header. An MBR
+// image ends at the end of its last partition.
+func getPartitionedImageSize(r io.ReaderAt) (uint64, error) {
+	header, err := readGPTHeader(r)
+	if err == nil {
+		alternateLBA := binary.LittleEndian.Uint64(header[32:40])
+		if alternateLBA >= math.MaxInt64/rawImageSectorSize {
+			return 0, fmt.Errorf("GPT header has malformed backup header location %d", alternateLBA)
+		}
+		return (alternateLBA + 1) * rawImageSectorSize, nil
+	}
+
+	partitions, err := readMBRPartitions(r)
+	if err != nil {
+		return 0, err
+	}
+
+	var imageSize uint64
+	for _, partition := range partitions {
+		if partition.Offset+partition.Size > imageSize {
+			imageSize = partition.Offset + partition.Size
+		}
+	}
+
+	return imageSize, nil
+}
+
+// readImagePartitions returns the partitions of the disk image from its GPT or MBR
+// partition table
+func readImagePartitions(r io.ReaderAt) ([]imagePartition, error) {
+	header, err := readGPTHeader(r)
+	if err != nil {
+		return readMBRPartitions(r)
+	}
+
+	entriesLBA := binary.LittleEndian.Uint64(header[72:80])
+	entryCount := binary.LittleEndian.Uint32(header[80:84])
+	entrySize := binary.LittleEndian.Uint32(header[84:88])
+
+	if entrySize < minGPTPartitionEntrySize || entrySize%minGPTPartitionEntrySize != 0 || entrySize > maxGPTPartitionEntrySize || entryCount > maxGPTPartitionEntries {
+		return nil, fmt.Errorf("GPT header has malformed partition entries (%d entries of %d bytes)", entryCount, entrySize)
+	}
+
+	if entriesLBA >= math.MaxInt64/rawImageSectorSize {
+		return nil, fmt.Errorf("GPT header has malformed partition entry location %d", entriesLBA)
+	}
+
+	// The size is calculated in 64 bits so that it cannot wrap around
+	entriesSize := uint64(entryCount) * uint64(entrySize)
+	if entriesSize > maxGPTPartitionEntries*maxGPTPartitionEntrySize {
+		return nil, fmt.Errorf("GPT partition entries take %d bytes", entriesSize)
+	}
+
+	entries := make([]byte, entriesSize)
+	_, err = r.ReadAt(entries, int64(entriesLBA*rawImageSectorSize))
+	if err != nil {
+		return nil, fmt.Errorf("could not read GPT partition entries: %v", err)
+	}
+
+	partitions := []imagePartition{}
+	for n := uint64(0); n < uint64(entryCount); n++ {
+		entry := entries[n*uint64(entrySize) : (n+1)*uint64(entrySize)]
+		if bytes.Equal(entry[0:16], make([]byte, 16)) {
+			continue
+		}
+
+		firstLBA := binary.LittleEndian.Uint64(entry[32:40])
+		lastLBA := binary.LittleEndian.Uint64(entry[40:48])
+		if lastLBA < firstLBA {
+			continue
+		}
+
+		partitions = append(partitions, imagePartition{
+			Offset: firstLBA * rawImageSectorSize,
+			Size:   (lastLBA - firstLBA + 1) * rawImageSectorSize,
+		})
+	}
+
+	return partitions, nil
+}
+
+// readGPTHeader returns the primary GPT header of the disk image
+func readGPTHeader(r io.ReaderAt) ([]byte, error) {
+	header := make([]byte, 92)
+	_, err := r.ReadAt(header, rawImageSectorSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not read GPT header: %v", err)
+	}
+
+	if !bytes.Equal(header[0:8], gptSignature) {
+		return nil, errors.New("image has no GPT header")
+	}
+
+	return header, nil
+}
+
+// readMBRPartitions returns the primary partitions of the MBR partition table of the
+// disk image. The protective partition of a GPT image is not returned.
+func readMBRPartitions(r io.ReaderAt) ([]imagePartition, error) {
+	mbr := make([]byte, rawImageSectorSize)
+	_, err := r.ReadAt(mbr, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not read MBR: %v", err)
+	}
+
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, errors.New("image has no partition table")
+	}
+
+	partitions := []imagePartition{}
+	for n := 0; n < 4; n++ {
+		entry := mbr[446+16*n : 446+16*(n+1)]
+		partitionType := entry[4]
+		startLBA := binary.LittleEndian.Uint32(entry[8:12])
+		sectorCount := binary.LittleEndian.Uint32(entry[12:16])
+
+		if partitionType == 0 || partitionType == 0xee || sectorCount == 0 {
+			continue
+		}
+
+		partitions = append(partitions, imagePartition{
+			Offset: uint64(startLBA) * rawImageSectorSize,
+			Size:   uint64(sectorCount) * rawImageSectorSize,
+		})
+	}
+
+	if len(partitions) == 0 {
+		return nil, errors.New("image has no partitions")
+	}
+
+	return partitions, nil
+}
+
+// getRawImageVersion returns the version of a raw disk image from the first .ver file
+// in the root or the ytl directory of a FAT partition of the image
+func getRawImageVersion(r io.ReaderAt) (string, error) {
+	partitions, err := readImagePartitions(r)
+	if err != nil {
+		return "", err
+	}
+
+	for _, partition := range partitions {
+		fat, err := openFATFileSystem(io.NewSectionReader(r, int64(partition.Offset), int64(partition.Size)))
+		if err != nil {
+			continue
+		}
+
+		content, err := fat.readVersionFile()
+		if err != nil {
+			continue
+		}
+
+		version := SanitizeBoxVersionString(string(content))
+		if version != "" {
+			return version, nil
+		}
+	}
+
+	return "", errors.New("image has no version file")
+}
+
+// fatFileSystem reads files from a FAT16 or FAT32 file system
+type fatFileSystem struct {
+	r                 io.ReaderAt
+	bytesPerSector    uint64
+	bytesPerCluster   uint64
+	fatOffset         uint64
+	dataOffset        uint64
+	isFAT32           bool
+	rootDirOffset     uint64
+	rootDirSize       uint64
+	rootDirCluster    uint32
+	endOfChainCluster uint32
+}
+
+type fatDirectoryEntry struct {
+	name         string
+	isDirectory  bool
+	firstCluster uint32
+	size         uint32
+}
+
+func openFATFileSystem(r io.ReaderAt) (*fatFileSystem, error) {
+	bootSector := make([]byte, rawImageSectorSize)
+	_, err := r.ReadAt(bootSector, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if bootSector[510] != 0x55 || bootSector[511] != 0xaa {
+		return nil, errors.New("partition has no boot sector")
+	}
+
+	bytesPerSector := uint64(binary.LittleEndian.Uint16(bootSector[11:13]))
+	sectorsPerCluster := uint64(bootSector[13])
+	reservedSectors := uint64(binary.LittleEndian.Uint16(bootSector[14:16]))
+	fatCount := uint64(bootSector[16])
+	rootEntryCount := uint64(binary.LittleEndian.Uint16(bootSector[17:19]))
+	fatSize := uint64(binary.LittleEndian.Uint16(bootSector[22:24]))
+
+	if bytesPerSector == 0 || bytesPerSector%rawImageSectorSize != 0 || sectorsPerCluster == 0 || fatCount == 0 {
+		return nil, errors.New("partition is not a FAT file system")
+	}
+
+	fs := &fatFileSystem{
+		r:               r,
+		bytesPerSector:  bytesPerSector,
+		bytesPerCluster: bytesPerSector * sectorsPerCluster,
+		fatOffset:       reservedSectors * bytesPerSector,
+	}
+
+	if fatSize == 0 {
+		fs.isFAT32 = true
+		fs.endOfChainCluster = 0x0ffffff8
+		fatSize = uint64(binary.LittleEndian.Uint32(bootSector[36:40]))
+		fs.rootDirCluster = binary.LittleEndian.Uint32(bootSector[44:48])
+	} else {
+		fs.endOfChainCluster = 0xfff8
+		fs.rootDirOffset = (reservedSectors + fatCount*fatSize) * bytesPerSector
+		fs.rootDirSize = rootEntryCount * 32
+	}
+
+	rootDirSectors := (rootEntryCount*32 + bytesPerSector - 1) / bytesPerSector
+	fs.dataOffset = (reservedSectors + fatCount*fatSize + rootDirSectors) * bytesPerSector
+
+	if !bytes.HasPrefix(bootSector[54:], []byte("FAT")) && !bytes.HasPrefix(bootSector[82:], []byte("FAT")) {
+		return nil, errors.New("partition is not a FAT file system")
+	}
+
+	return fs, nil
+}
+
+// readVersionFile returns the contents of the first .ver file in the root directory
+// or in the ytl directory
+func (fs *fatFileSystem) readVersionFile() ([]byte, error) {
+	rootEntries, err := fs.readRootDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	directories := [][]fatDirectoryEntry{rootEntries}
+	for _, entry := range rootEntries {
+		if entry.isDirectory && entry.name == "YTL" {
+			ytlEntries, err := fs.readDirectory(entry.firstCluster)
+			if err == nil {
+				directories = append(directories, ytlEntries)
+			}
+		}
+	}
+
+	for _, entries := range directories {
+		for _, entry := range entries {
+			if !entry.isDirectory && strings.HasSuffix(entry.name, ".VER") {
+				return fs.readFile(entry)
+			}
+		}
+	}
+
+	return nil, errors.New("file system has no version file")
+}
+
+func (fs *fatFileSystem) readRootDirectory() ([]fatDirectoryEntry, error) {
+	if fs.isFAT32 {
+		return fs.readDirectory(fs.rootDirCluster)
+	}
+
+	content := make([]byte, fs.rootDirSize)
+	_, err := fs.r.ReadAt(content, int64(fs.rootDirOffset))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseFATDirectory(content), nil
+}
+
+func (fs *fatFileSystem) readDirectory(firstCluster uint32) ([]fatDirectoryEntry, error) {
+	content, err := fs.readClusterChain(firstCluster, maxFATDirectoryClusters*fs.bytesPerCluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseFATDirectory(content), nil
+}
+
+func (fs *fatFileSystem) readFile(entry fatDirectoryEntry) ([]byte, error) {
+	size := uint64(entry.size)
+	if size > maxRawImageVersionSize {
+		size = maxRawImageVersionSize
+	}
+
+	content, err := fs.readClusterChain(entry.firstCluster, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(content)) > size {
+		content = content[:size]
+	}
+
+	return content, nil
+}
+
+// readClusterChain reads the clusters starting from firstCluster until the end of the
+// chain or until maxSize bytes have been read
+func (fs *fatFileSystem) readClusterChain(firstCluster uint32, maxSize uint64) ([]byte, error) {
+	content := []byte{}
+	cluster := firstCluster
+
+	for cluster >= 2 && cluster < fs.endOfChainCluster && uint64(len(content)) < maxSize {
+		clusterContent := make([]byte, fs.bytesPerCluster)
+		_, err := fs.r.ReadAt(clusterContent, int64(fs.dataOffset+uint64(cluster-2)*fs.bytesPerCluster))
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, clusterContent...)
+
+		cluster, err = fs.getNextCluster(cluster)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return content, nil
+}
+
+func (fs *fatFileSystem) getNextCluster(cluster uint32) (uint32, error) {
+	if fs.isFAT32 {
+		entry := make([]byte, 4)
+		_, err := fs.r.ReadAt(entry, int64(fs.fatOffset+uint64(cluster)*4))
+		return binary.LittleEndian.Uint32(entry) & 0x0fffffff, err
+	}
+
+	entry := make([]byte, 2)
+	_, err := fs.r.ReadAt(entry, int64(fs.fatOffset+uint64(cluster)*2))
+	return uint32(binary.LittleEndian.Uint16(entry)), err
+}
+
+// parseFATDirectory returns the files and directories of the directory. Long file
+// names are not read, the entries are named by their 8.3 names (e.g. KTP.VER).
+func parseFATDirectory(content []byte) []fatDirectoryEntry {
+	entries := []fatDirectoryEntry{}
+
+	for offset := 0; offset+32 <= len(content); offset += 32 {
+		entry := content[offset : offset+32]
+		attributes := entry[11]
+
+		switch {
+		case entry[0] == 0x00:
+			return entries
+		case entry[0] == 0xe5 || attributes&0x0f == 0x0f || attributes&0x08 != 0:
+			// Deleted, long file name or volume label
+			continue
+		}
+
+		name := strings.TrimSpace(string(entry[0:8]))
+		extension := strings.TrimSpace(string(entry[8:11]))
+		if extension != "" {
+			name += "." + extension
+		}
+
+		entries = append(entries, fatDirectoryEntry{
+			name:         name,
+			isDirectory:  attributes&0x10 != 0,
+			firstCluster: uint32(binary.LittleEndian.Uint16(entry[20:22]))<<16 | uint32(binary.LittleEndian.Uint16(entry[26:28])),
+			size:         binary.LittleEndian.Uint32(entry[28:32]),
+		})
+	}
+
+	return entries
+}
@@ -0,0 +1,151 @@
+package download
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// newTestFATImage returns an MBR disk image with a FAT16 partition at sector 2048
+// containing ytl/ktp.ver with the given content
+func newTestFATImage(version string) []byte {
+	const partitionStart = 2048
+	const partitionSectors = 64
+
+	image := make([]byte, (partitionStart+partitionSectors)*rawImageSectorSize)
+
+	mbrEntry := image[446:462]
+	mbrEntry[4] = 0x0e
+	binary.LittleEndian.PutUint32(mbrEntry[8:12], partitionStart)
+	binary.LittleEndian.PutUint32(mbrEntry[12:16], partitionSectors)
+	image[510], image[511] = 0x55, 0xaa
+
+	// One reserved sector, one FAT sector, one root directory sector and one sector per cluster
+	partition := image[partitionStart*rawImageSectorSize:]
+	binary.LittleEndian.PutUint16(partition[11:13], rawImageSectorSize)
+	partition[13] = 1
+	binary.LittleEndian.PutUint16(partition[14:16], 1)
+	partition[16] = 1
+	binary.LittleEndian.PutUint16(partition[17:19], 16)
+	binary.LittleEndian.PutUint16(partition[19:21], partitionSectors)
+	binary.LittleEndian.PutUint16(partition[22:24], 1)
+	copy(partition[54:], "FAT16   ")
+	partition[510], partition[511] = 0x55, 0xaa
+
+	fat := partition[1*rawImageSectorSize:]
+	binary.LittleEndian.PutUint16(fat[2*2:], 0xffff)
+	binary.LittleEndian.PutUint16(fat[3*2:], 0xffff)
+
+	rootDirectory := partition[2*rawImageSectorSize:]
+	copy(rootDirectory[0:11], "YTL        ")
+	rootDirectory[11] = 0x10
+	binary.LittleEndian.PutUint16(rootDirectory[26:28], 2)
+
+	// Cluster 2 is the ytl directory and cluster 3 is ktp.ver
+	ytlDirectory := partition[3*rawImageSectorSize:]
+	copy(ytlDirectory[0:11], "KTP     VER")
+	binary.LittleEndian.PutUint16(ytlDirectory[26:28], 3)
+	binary.LittleEndian.PutUint32(ytlDirectory[28:32], uint32(len(version)))
+
+	copy(partition[4*rawImageSectorSize:], version)
+
+	return image
+}
+
+func TestGetRawImageVersion(t *testing.T) {
+	version, err := getRawImageVersion(bytes.NewReader(newTestFATImage("SERVER2021X v3\n")))
+	if err != nil || version != "SERVER2021Xv3" {
+		t.Errorf("getRawImageVersion gives '%s' (%v), expected 'SERVER2021Xv3'", version, err)
+	}
+
+	_, err = getRawImageVersion(bytes.NewReader(make([]byte, 4096)))
+	if err == nil {
+		t.Errorf("getRawImageVersion of an unpartitioned image should give an error")
+	}
+}
+
+func TestGetPartitionedImageSize(t *testing.T) {
+	mbrImage := newTestFATImage("v1")
+
+	// The image is written to a larger device
+	device := append(mbrImage, make([]byte, 1024*1024)...)
+
+	size, err := getPartitionedImageSize(bytes.NewReader(device))
+	if err != nil || size != uint64(len(mbrImage)) {
+		t.Errorf("getPartitionedImageSize of an MBR image gives %d (%v), expected %d", size, err, len(mbrImage))
+	}
+
+	gptImage := make([]byte, 4*rawImageSectorSize)
+	gptImage[510], gptImage[511] = 0x55, 0xaa
+	gptImage[446+4] = 0xee
+	copy(gptImage[rawImageSectorSize:], gptSignature)
+	binary.LittleEndian.PutUint64(gptImage[rawImageSectorSize+32:], 204799)
+
+	size, err = getPartitionedImageSize(bytes.NewReader(gptImage))
+	if err != nil || size != 204800*rawImageSectorSize {
+		t.Errorf("getPartitionedImageSize of a GPT image gives %d (%v), expected %d", size, err, 204800*rawImageSectorSize)
+	}
+
+	_, err = getPartitionedImageSize(bytes.NewReader(make([]byte, 4096)))
+	if err == nil {
+		t.Errorf("getPartitionedImageSize of an unpartitioned image should give an error")
+	}
+}
+
+// newTestGPTImage returns a GPT disk image with the given partition entry settings
+// and one partition in the first entry
+func newTestGPTImage(entriesLBA uint64, entryCount uint32, entrySize uint32) []byte {
+	image := make([]byte, 64*rawImageSectorSize)
+	image[510], image[511] = 0x55, 0xaa
+	image[446+4] = 0xee
+
+	header := image[rawImageSectorSize:]
+	copy(header, gptSignature)
+	binary.LittleEndian.PutUint64(header[32:40], 63)
+	binary.LittleEndian.PutUint64(header[72:80], entriesLBA)
+	binary.LittleEndian.PutUint32(header[80:84], entryCount)
+	binary.LittleEndian.PutUint32(header[84:88], entrySize)
+
+	if entriesLBA < 64 {
+		entry := image[entriesLBA*rawImageSectorSize:]
+		entry[0] = 1
+		binary.LittleEndian.PutUint64(entry[32:40], 34)
+		binary.LittleEndian.PutUint64(entry[40:48], 62)
+	}
+
+	return image
+}
+
+func TestReadImagePartitionsWithCorruptGPTHeader(t *testing.T) {
+	partitions, err := readImagePartitions(bytes.NewReader(newTestGPTImage(2, 4, 128)))
+	if err != nil || len(partitions) != 1 || partitions[0].Offset != 34*rawImageSectorSize || partitions[0].Size != 29*rawImageSectorSize {
+		t.Errorf("readImagePartitions of a GPT image gives %+v (%v)", partitions, err)
+	}
+
+	tables := []struct {
+		description string
+		entriesLBA  uint64
+		entryCount  uint32
+		entrySize   uint32
+	}{
+		{"entry size wrapping the table size around", 2, 1024, 4 * 1024 * 1024},
+		{"entry size not a multiple of 128", 2, 4, 130},
+		{"too small entry size", 2, 4, 0},
+		{"too many entries", 2, 65536, 128},
+		{"entries beyond the addressable range", 1 << 62, 4, 128},
+	}
+
+	for _, table := range tables {
+		_, err := readImagePartitions(bytes.NewReader(newTestGPTImage(table.entriesLBA, table.entryCount, table.entrySize)))
+		if err == nil {
+			t.Errorf("readImagePartitions of a GPT header with %s should give an error", table.description)
+		}
+	}
+
+	image := newTestGPTImage(2, 4, 128)
+	binary.LittleEndian.PutUint64(image[rawImageSectorSize+32:], 1<<62)
+	_, err = getPartitionedImageSize(bytes.NewReader(image))
+	if err == nil {
+		t.Errorf("getPartitionedImageSize of a GPT header with an overflowing backup header location should give an error")
+	}
+}
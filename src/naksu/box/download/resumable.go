@@ -0,0 +1,343 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"naksu/log"
+	"naksu/mebroutines"
+	"naksu/xlate"
+)
+
+const (
+	// partialSuffix is appended to the path of a download which has not been finished
+	partialSuffix = ".part"
+	// partialInfoSuffix is appended to the path of a file describing the partial download
+	partialInfoSuffix = ".part.json"
+
+	maxDownloadAttempts = 6
+	// downloadIdleTimeout cancels a download if no data has been received in this time
+	downloadIdleTimeout = 60 * time.Second
+)
+
+// downloadRetryDelay returns the time to wait before the given retry attempt (1, 2, ...).
+// This is a variable to allow tests to avoid waiting.
+var downloadRetryDelay = func(attempt int) time.Duration {
+	delay := time.Duration(1<<uint(attempt)) * time.Second
+	if delay > 60*time.Second {
+		return 60 * time.Second
+	}
+	return delay
+}
+
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	},
+}
+
+// transientDownloadError is returned by downloadAttempt() when the download
+// should be retried
+type transientDownloadError struct {
+	err error
+}
+
+func (e *transientDownloadError) Error() string {
+	return e.err.Error()
+}
+
+// partialDownloadInfo is stored next to the partial download to make sure we
+// continue downloading the same file
+type partialDownloadInfo struct {
+	URL string `json:"url"`
+	// Validator is the ETag or Last-Modified value of the file, used as If-Range header
+	Validator string `json:"validator"`
+}
+
+var contentRangeRegexp = regexp.MustCompile(`^bytes (\d+)-\d+/(\d+|\*)$`)
+var unsatisfiedRangeRegexp = regexp.MustCompile(`^bytes \*/(\d+)$`)
+
+// idleTimeoutReader cancels the download if reading from the response body stalls
+type idleTimeoutReader struct {
+	reader io.Reader
+	timer  *time.Timer
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.timer.Reset(downloadIdleTimeout)
+	return n, err
+}
+
+// downloadFileResumable downloads the given URL to destPath. The data is first written
+// to destPath + partialSuffix. If the download is interrupted it is continued from the
+// partial file using HTTP Range requests. Transient errors are retried with an increasing delay.
+func downloadFileResumable(url string, destPath string, progressCallbackFn func(string, int)) error {
+	partPath := destPath + partialSuffix
+	infoPath := destPath + partialInfoSuffix
+
+	info, err := readPartialDownloadInfo(infoPath)
+	if err != nil || info.URL != url {
+		log.Debug(fmt.Sprintf("There is no partial download of '%s', starting from the beginning", url))
+		removePartialDownload(destPath)
+		info = partialDownloadInfo{URL: url}
+	}
+
+	for attempt := 1; attempt <= maxDownloadAttempts; attempt++ {
+		err = downloadAttempt(&info, partPath, infoPath, progressCallbackFn)
+		if err == nil {
+			break
+		}
+
+		var transientErr *transientDownloadError
+		if !errors.As(err, &transientErr) {
+			return err
+		}
+
+		log.Debug(fmt.Sprintf("Download attempt %d/%d of '%s' failed: %v", attempt, maxDownloadAttempts, url, err))
+
+		if attempt < maxDownloadAttempts {
+			delay := downloadRetryDelay(attempt)
+			progressCallbackFn(xlate.Get("Download interrupted, retrying in %d seconds", int(delay.Seconds())), 2)
+			time.Sleep(delay)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("download failed after %d attempts: %v", maxDownloadAttempts, err)
+	}
+
+	err = os.Rename(partPath, destPath)
+	if err != nil {
+		return fmt.Errorf("could not rename %s to %s: %v", partPath, destPath, err)
+	}
+
+	err = os.Remove(infoPath)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not remove partial download info %s: %v", infoPath, err))
+	}
+
+	return nil
+}
+
+// downloadAttempt continues the download from the end of the partial file. The returned
+// error is *transientDownloadError if the download should be retried.
+func downloadAttempt(info *partialDownloadInfo, partPath string, infoPath string, progressCallbackFn func(string, int)) error {
+	offset := getFileSize(partPath)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, "GET", info.URL, nil)
+	if err != nil {
+		return fmt.Errorf("could not create request: %v", err)
+	}
+
+	if offset > 0 {
+		log.Debug(fmt.Sprintf("Resuming download of '%s' from byte %d", info.URL, offset))
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if info.Validator != "" {
+			request.Header.Set("If-Range", info.Validator)
+		}
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		log.Debug(fmt.Sprintf("HTTP GET from url '%s' gives an error: %v", info.URL, err))
+		return &transientDownloadError{err}
+	}
+	defer response.Body.Close()
+
+	var fileSize uint64
+	openFlags := os.O_WRONLY | os.O_CREATE
+
+	switch {
+	case response.StatusCode == http.StatusOK:
+		// The server sends the whole file (no partial download, the file has changed or
+		// the server does not support ranges)
+		offset = 0
+		openFlags |= os.O_TRUNC
+		if response.ContentLength > 0 {
+			fileSize = uint64(response.ContentLength)
+		}
+		info.Validator = getValidator(response)
+		err = writePartialDownloadInfo(infoPath, *info)
+		if err != nil {
+			return err
+		}
+	case response.StatusCode == http.StatusPartialContent:
+		rangeStart, rangeTotal, errRange := parseContentRange(response.Header.Get("Content-Range"))
+		if errRange != nil || rangeStart != offset {
+			removePartialDownload(strings.TrimSuffix(partPath, partialSuffix))
+			return &transientDownloadError{fmt.Errorf("server returned unexpected range '%s' for offset %d", response.Header.Get("Content-Range"), offset)}
+		}
+		fileSize = rangeTotal
+		openFlags |= os.O_APPEND
+		progressCallbackFn(xlate.Get("Resuming download of server image"), percentage(offset, fileSize))
+	case response.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial file may already contain the whole file
+		matches := unsatisfiedRangeRegexp.FindStringSubmatch(response.Header.Get("Content-Range"))
+		if matches != nil {
+			total, errParse := strconv.ParseUint(matches[1], 10, 64)
+			if errParse == nil && total == offset {
+				log.Debug(fmt.Sprintf("Partial download of '%s' is already complete (%d bytes)", info.URL, offset))
+				return nil
+			}
+		}
+		removePartialDownload(strings.TrimSuffix(partPath, partialSuffix))
+		return &transientDownloadError{fmt.Errorf("%d", response.StatusCode)}
+	case response.StatusCode == http.StatusRequestTimeout || response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		log.Debug(fmt.Sprintf("HTTP GET from url '%s' gives a status code %d", info.URL, response.StatusCode))
+		return &transientDownloadError{fmt.Errorf("%d", response.StatusCode)}
+	default:
+		log.Debug(fmt.Sprintf("HTTP GET from url '%s' gives a status code %d", info.URL, response.StatusCode))
+		return fmt.Errorf("%d", response.StatusCode)
+	}
+
+	partFile, err := os.OpenFile(partPath, openFlags, 0600)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not open file '%s' for server image zip: %v", partPath, err))
+		return err
+	}
+	defer func() {
+		_ = partFile.Close() // #nosec
+	}()
+
+	counter := &writeCounter{}
+	counter.ProgressCallbackFn = progressCallbackFn
+	counter.Total = offset
+	counter.FileSize = fileSize
+	counter.ProgressString = xlate.GetRaw("Downloading server image")
+
+	idleTimer := time.AfterFunc(downloadIdleTimeout, cancel)
+	defer idleTimer.Stop()
+	body := &idleTimeoutReader{reader: response.Body, timer: idleTimer}
+
+	_, err = io.Copy(partFile, io.TeeReader(body, counter))
+	if err != nil {
+		return &transientDownloadError{fmt.Errorf("download was interrupted: %v", err)}
+	}
+
+	err = partFile.Sync()
+	if err != nil {
+		return fmt.Errorf("could not write %s: %v", partPath, err)
+	}
+
+	downloadedSize := getFileSize(partPath)
+	if fileSize > 0 && downloadedSize != fileSize {
+		if downloadedSize > fileSize {
+			removePartialDownload(strings.TrimSuffix(partPath, partialSuffix))
+		}
+		return &transientDownloadError{fmt.Errorf("downloaded file size %d does not match expected size %d", downloadedSize, fileSize)}
+	}
+
+	log.Debug(fmt.Sprintf("Downloaded '%s' to %s (%d bytes)", info.URL, partPath, downloadedSize))
+
+	return nil
+}
+
+// parseContentRange returns the start byte and the total size from a Content-Range header
+func parseContentRange(contentRange string) (uint64, uint64, error) {
+	matches := contentRangeRegexp.FindStringSubmatch(contentRange)
+	if matches == nil {
+		return 0, 0, fmt.Errorf("malformed content-range '%s'", contentRange)
+	}
+
+	start, err := strconv.ParseUint(matches[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Total size may be unknown ("*")
+	var total uint64
+	if matches[2] != "*" {
+		total, err = strconv.ParseUint(matches[2], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return start, total, nil
+}
+
+// getValidator returns the value for If-Range header. Weak ETags cannot be
+// used with If-Range so we fall back to Last-Modified.
+func getValidator(response *http.Response) string {
+	etag := response.Header.Get("ETag")
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return response.Header.Get("Last-Modified")
+}
+
+func readPartialDownloadInfo(infoPath string) (partialDownloadInfo, error) {
+	var info partialDownloadInfo
+
+	content, err := ioutil.ReadFile(infoPath) // #nosec
+	if err != nil {
+		return info, err
+	}
+
+	err = json.Unmarshal(content, &info)
+	return info, err
+}
+
+func writePartialDownloadInfo(infoPath string, info partialDownloadInfo) error {
+	content, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(infoPath, content, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write partial download info %s: %v", infoPath, err)
+	}
+
+	return nil
+}
+
+// removePartialDownload removes the partial file and its info file of the given download
+func removePartialDownload(destPath string) {
+	for _, path := range []string{destPath + partialSuffix, destPath + partialInfoSuffix} {
+		if mebroutines.ExistsFile(path) {
+			err := os.Remove(path)
+			if err != nil {
+				log.Debug(fmt.Sprintf("Could not remove partial download file %s: %v", path, err))
+			}
+		}
+	}
+}
+
+func getFileSize(path string) uint64 {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+
+	return uint64(fileInfo.Size())
+}
+
+func percentage(part uint64, total uint64) int {
+	if total == 0 {
+		return 0
+	}
+
+	return int((100 * part) / total)
+}
@@ -0,0 +1,147 @@
+package download
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testImage = bytes.Repeat([]byte("naksu test image "), 64*1024)
+
+func init() {
+	downloadRetryDelay = func(attempt int) time.Duration {
+		return time.Millisecond
+	}
+}
+
+// newFlakyServer returns a test server which cuts the connection after sending
+// cutAfter bytes for the first failCount requests
+func newFlakyServer(t *testing.T, failCount int, cutAfter int) *httptest.Server {
+	requestCount := 0
+	modTime := time.Date(2021, 5, 31, 12, 0, 0, 0, time.UTC)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if requestCount <= failCount {
+			w.Header().Set("Content-Length", strconv.Itoa(len(testImage)))
+			w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+			w.WriteHeader(http.StatusOK)
+			_, err := w.Write(testImage[:cutAfter])
+			if err != nil {
+				t.Errorf("Test server could not write: %v", err)
+			}
+			// Hijack the connection to close it before all the promised bytes have been sent
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				_ = conn.Close()
+			}
+			return
+		}
+
+		http.ServeContent(w, r, "ktp-etcher.zip", modTime, bytes.NewReader(testImage))
+	}))
+}
+
+func noProgress(message string, value int) {}
+
+func getTempDestPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "naksu-download-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+
+	return filepath.Join(dir, "image.zip"), func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestDownloadFileResumableContinuesInterruptedDownload(t *testing.T) {
+	server := newFlakyServer(t, 2, len(testImage)/3)
+	defer server.Close()
+
+	destPath, cleanup := getTempDestPath(t)
+	defer cleanup()
+
+	err := downloadFileResumable(server.URL, destPath, noProgress)
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("Could not read downloaded file: %v", err)
+	}
+
+	if !bytes.Equal(content, testImage) {
+		t.Errorf("Downloaded file has %d bytes, expected %d bytes with the same content", len(content), len(testImage))
+	}
+
+	if getFileSize(destPath+partialSuffix) != 0 || getFileSize(destPath+partialInfoSuffix) != 0 {
+		t.Errorf("Partial download files were not removed")
+	}
+}
+
+func TestDownloadFileResumableGivesUp(t *testing.T) {
+	server := newFlakyServer(t, maxDownloadAttempts, 1024)
+	defer server.Close()
+
+	destPath, cleanup := getTempDestPath(t)
+	defer cleanup()
+
+	err := downloadFileResumable(server.URL, destPath, noProgress)
+	if err == nil {
+		t.Fatalf("Download should fail when all attempts are interrupted")
+	}
+
+	if getFileSize(destPath) != 0 {
+		t.Errorf("Incomplete download should not be renamed to %s", destPath)
+	}
+}
+
+func TestDownloadFileResumableDoesNotRetryNotFound(t *testing.T) {
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	destPath, cleanup := getTempDestPath(t)
+	defer cleanup()
+
+	err := downloadFileResumable(server.URL, destPath, noProgress)
+	if err == nil || err.Error() != "404" {
+		t.Errorf("Expected error 404, got %v", err)
+	}
+
+	if requestCount != 1 {
+		t.Errorf("Expected one request, got %d", requestCount)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tables := []struct {
+		contentRange string
+		start        uint64
+		total        uint64
+		isError      bool
+	}{
+		{"bytes 100-199/1000", 100, 1000, false},
+		{"bytes 0-0/*", 0, 0, false},
+		{"bytes */1000", 0, 0, true},
+		{"", 0, 0, true},
+	}
+
+	for _, table := range tables {
+		start, total, err := parseContentRange(table.contentRange)
+		if start != table.start || total != table.total || (err != nil) != table.isError {
+			t.Errorf("parseContentRange('%s') gives %d, %d, %v", table.contentRange, start, total, err)
+		}
+	}
+}
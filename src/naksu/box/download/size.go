@@ -0,0 +1,149 @@
+package download
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"naksu/log"
+)
+
+// ImageSize tells how much disk space getting a server image needs
+type ImageSize struct {
+	// DownloadSize is the number of bytes still to be downloaded to the image cache
+	DownloadSize uint64
+	// RawSize is the size of the raw disk image (ytl/ktp.img) or zero if it is not known
+	RawSize uint64
+}
+
+// GetServerImageSize returns the size of the server image of the given version at url.
+// The size of the raw image inside the zip is read from the zip directory using HTTP
+// Range requests. If the server does not support them RawSize is zero.
+func GetServerImageSize(url string, version string) (ImageSize, error) {
+	imagePath := GetCachedImagePath(url, version)
+
+	if isImageCached(imagePath) {
+		rawSize, err := getZipImageRawSize(imagePath)
+		return ImageSize{RawSize: rawSize}, err
+	}
+
+	response, err := httpClient.Head(url)
+	if err != nil {
+		return ImageSize{}, fmt.Errorf("could not get size of server image: %v", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK || response.ContentLength <= 0 {
+		return ImageSize{}, fmt.Errorf("could not get size of server image: status %d, content length %d", response.StatusCode, response.ContentLength)
+	}
+
+	zipSize := uint64(response.ContentLength)
+	imageSize := ImageSize{DownloadSize: zipSize}
+
+	// An interrupted download is continued from the partial file
+	partPath := imagePath + partialSuffix
+	info, err := readPartialDownloadInfo(imagePath + partialInfoSuffix)
+	if err == nil && info.URL == url && getFileSize(partPath) <= zipSize {
+		imageSize.DownloadSize -= getFileSize(partPath)
+	}
+
+	if !strings.Contains(response.Header.Get("Accept-Ranges"), "bytes") {
+		log.Debug(fmt.Sprintf("Server of '%s' does not support ranges, the raw image size is not known", url))
+		return imageSize, nil
+	}
+
+	zipReader, err := zip.NewReader(&httpRangeReader{url: url}, int64(zipSize))
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not read zip directory of '%s': %v", url, err))
+		return imageSize, nil
+	}
+
+	imageSize.RawSize, err = findZipImageRawSize(zipReader)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not get raw image size of '%s': %v", url, err))
+	}
+
+	return imageSize, nil
+}
+
+// GetLocalImageSize returns the size of a locally supplied server image (see
+// OpenLocalImage()). Nothing is downloaded.
+func GetLocalImageSize(path string) (ImageSize, error) {
+	if IsZipFile(path) {
+		rawSize, err := getZipImageRawSize(path)
+		return ImageSize{RawSize: rawSize}, err
+	}
+
+	file, err := os.Open(path) // #nosec
+	if err != nil {
+		return ImageSize{}, fmt.Errorf("could not open image %s: %v", path, err)
+	}
+	defer file.Close()
+
+	size, err := getRawImageSize(file)
+	if err != nil {
+		return ImageSize{}, fmt.Errorf("could not get size of image %s: %v", path, err)
+	}
+
+	return ImageSize{RawSize: size}, nil
+}
+
+// getZipImageRawSize returns the uncompressed size of the raw image in the etcher zip
+func getZipImageRawSize(zipPath string) (uint64, error) {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return 0, fmt.Errorf("could not open zip %s: %v", zipPath, err)
+	}
+	defer r.Close()
+
+	return findZipImageRawSize(&r.Reader)
+}
+
+func findZipImageRawSize(r *zip.Reader) (uint64, error) {
+	for _, file := range r.File {
+		if file.Name == zipImageEntryName {
+			return file.UncompressedSize64, nil
+		}
+	}
+
+	return 0, fmt.Errorf("zip does not contain %s", zipImageEntryName)
+}
+
+// httpRangeReader reads parts of a remote file with HTTP Range requests
+type httpRangeReader struct {
+	url string
+}
+
+func (r *httpRangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	request, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not create request: %v", err)
+	}
+
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("range request gives status %d", response.StatusCode)
+	}
+
+	n, err := io.ReadFull(response.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		// The last part of the file is shorter than requested
+		return n, io.EOF
+	}
+
+	return n, err
+}
@@ -0,0 +1,101 @@
+package download
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetServerImageSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "naksu-size-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rawImage := strings.Repeat("naksu raw image ", 10000)
+	zipPath := filepath.Join(dir, "ktp-etcher.zip")
+	writeTestZip(t, zipPath, map[string]string{"ytl/ktp.ver": "SERVER2021X\n", "ytl/ktp.img": rawImage})
+
+	zipContent, err := ioutil.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Could not read zip: %v", err)
+	}
+
+	modTime := time.Date(2021, 5, 31, 12, 0, 0, 0, time.UTC)
+
+	tables := []struct {
+		name     string
+		handler  http.HandlerFunc
+		expected ImageSize
+	}{
+		{
+			"ranges supported",
+			func(w http.ResponseWriter, r *http.Request) {
+				http.ServeContent(w, r, "ktp-etcher.zip", modTime, bytes.NewReader(zipContent))
+			},
+			ImageSize{DownloadSize: uint64(len(zipContent)), RawSize: uint64(len(rawImage))},
+		},
+		{
+			"ranges not supported",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(zipContent)))
+				w.WriteHeader(http.StatusOK)
+				if r.Method != "HEAD" {
+					_, _ = w.Write(zipContent)
+				}
+			},
+			ImageSize{DownloadSize: uint64(len(zipContent))},
+		},
+	}
+
+	for _, table := range tables {
+		server := httptest.NewServer(table.handler)
+
+		imageSize, err := GetServerImageSize(server.URL+"/ktp-etcher.zip", "naksu-size-test-version")
+		if err != nil || imageSize != table.expected {
+			t.Errorf("GetServerImageSize with %s gives %+v (%v), expected %+v", table.name, imageSize, err, table.expected)
+		}
+
+		server.Close()
+	}
+}
+
+func TestGetLocalImageSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "naksu-size-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipPath := filepath.Join(dir, "ktp-etcher.zip")
+	writeTestZip(t, zipPath, map[string]string{"ytl/ktp.img": "zipped image"})
+
+	rawPath := filepath.Join(dir, "ktp.img")
+	err = ioutil.WriteFile(rawPath, []byte("raw image"), 0600)
+	if err != nil {
+		t.Fatalf("Could not write raw image: %v", err)
+	}
+
+	tables := []struct {
+		path     string
+		expected ImageSize
+	}{
+		{zipPath, ImageSize{RawSize: uint64(len("zipped image"))}},
+		{rawPath, ImageSize{RawSize: uint64(len("raw image"))}},
+	}
+
+	for _, table := range tables {
+		imageSize, err := GetLocalImageSize(table.path)
+		if err != nil || imageSize != table.expected {
+			t.Errorf("GetLocalImageSize('%s') gives %+v (%v), expected %+v", table.path, imageSize, err, table.expected)
+		}
+	}
+}
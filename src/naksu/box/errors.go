@@ -0,0 +1,39 @@
+package box
+
+import (
+	"errors"
+
+	"naksu/box/vboxmanage"
+	"naksu/xlate"
+)
+
+// GetErrorAdvice returns a translated hint for fixing the VirtualBox failure behind
+// err or an empty string if the failure is not known
+func GetErrorAdvice(err error) string {
+	switch {
+	case errors.Is(err, vboxmanage.ErrKernelDriverNotInstalled):
+		return xlate.Get("The VirtualBox kernel driver is not running. Please reinstall VirtualBox and restart the computer.")
+	case errors.Is(err, vboxmanage.ErrSessionLocked):
+		return xlate.Get("The server is in use by another VirtualBox program. Please close the VirtualBox windows of the server and try again.")
+	case errors.Is(err, vboxmanage.ErrMediumInUse):
+		return xlate.Get("The server disk is in use by another VirtualBox program. Please close VirtualBox Manager and try again.")
+	case errors.Is(err, vboxmanage.ErrDuplicateMedium):
+		return xlate.Get("VirtualBox already has a disk with the same name. Please remove the old disk with the Virtual Media Manager of VirtualBox and try again.")
+	case errors.Is(err, vboxmanage.ErrVMNotFound):
+		return xlate.Get("The server was not found in VirtualBox. It may have been removed outside Naksu. Please install the server again.")
+	case errors.Is(err, vboxmanage.ErrAccessDenied):
+		return xlate.Get("VirtualBox denied access. Please close all VirtualBox programs and try again. If the problem persists, restart the computer.")
+	default:
+		return ""
+	}
+}
+
+// AddErrorAdvice appends the hint given by GetErrorAdvice() to the message
+func AddErrorAdvice(message string, err error) string {
+	advice := GetErrorAdvice(err)
+	if advice == "" {
+		return message
+	}
+
+	return message + "\n\n" + advice
+}
@@ -0,0 +1,149 @@
+package box
+
+import (
+	"io"
+	"time"
+
+	"naksu/config"
+	"naksu/log"
+)
+
+// VMSpec describes the virtual machine to be created by Hypervisor.CreateVM()
+type VMSpec struct {
+	Name     string
+	OSType   string
+	CPUs     int
+	MemoryMB uint64
+	VRamMB   int
+	// DiskSizeGB is the size of the disk image created by Hypervisor.ImportDisk()
+	DiskSizeGB uint64
+	// DiskPath is the path of the disk image created by Hypervisor.ImportDisk()
+	DiskPath         string
+	SharedFolderName string
+	SharedFolderPath string
+	// Properties are stored as VM (guest) properties, see Hypervisor.GetProperty()
+	Properties map[string]string
+	// SnapshotName is the name of the snapshot taken after the VM has been created.
+	// No snapshot is taken if the name is empty.
+	SnapshotName string
+}
+
+// Snapshot is a named snapshot of a VM
+type Snapshot struct {
+	Name string
+	// Created is zero if the backend does not know the snapshot time
+	Created time.Time
+}
+
+// NetworkSpec describes how the VM is connected to the exam network
+type NetworkSpec struct {
+	// HostInterface is the system name of the host network device used for bridging
+	HostInterface string
+	// NicType is the emulated network hardware (see constants.AvailableNics)
+	NicType string
+}
+
+// Hypervisor is a virtualisation backend which runs the exam server VM.
+// VirtualBox is the default backend, see config.GetHypervisor().
+type Hypervisor interface {
+	// Name returns a short name of the backend for logging purposes
+	Name() string
+	// IsAvailable returns true if the tools needed by the backend have been installed
+	IsAvailable() bool
+
+	// DiskImagePath returns the path of the disk image for the given VM
+	DiskImagePath(vmName string) string
+	// ImportDisk converts the raw disk image read from image (imageSize bytes) to the
+	// backend disk format and resizes it
+	ImportDisk(image io.Reader, imageSize uint64, diskPath string, diskSizeMB int) error
+	// ImportDiskSpace returns the disk space needed in each directory by ImportDisk()
+	// and CreateVM() for a raw image of imageSize bytes imported to diskPath
+	ImportDiskSpace(diskPath string, imageSize uint64) map[string]uint64
+	// RemoveDisk closes and deletes a disk image which is not attached to a VM (e.g.
+	// one left over by a failed ImportDisk()). A missing disk image is not an error.
+	RemoveDisk(diskPath string) error
+	// ImportVMDK converts the VMDK disk image at vmdkPath (e.g. a backup written by
+	// CloneDisk) to the backend disk format
+	ImportVMDK(vmdkPath string, diskPath string) error
+	// CreateVM creates and registers a new VM
+	CreateVM(spec VMSpec) error
+	// ModifyVM changes the CPU count, memory and video memory of the stopped VM.
+	// The disk size is not changed.
+	ModifyVM(vmName string, resources Resources) error
+	// RemoveVM unregisters the VM and deletes all its files
+	RemoveVM(vmName string) error
+	// UnregisterVM unregisters the stopped VM and deletes its files except the disk
+	// image. A VM which does not exist is not an error.
+	UnregisterVM(vmName string) error
+
+	// StartVM starts the VM with the given network settings
+	StartVM(vmName string, network NetworkSpec) error
+	// StopVM stops the running VM. If force is false the guest is asked to shut down.
+	StopVM(vmName string, force bool) error
+	// DiscardSavedState discards the saved state of the VM so that it boots normally
+	DiscardSavedState(vmName string) error
+
+	// TakeSnapshot takes a snapshot of the stopped VM
+	TakeSnapshot(vmName string, snapshotName string) error
+	// RestoreSnapshot returns the stopped VM to the given snapshot
+	RestoreSnapshot(vmName string, snapshotName string) error
+	// DeleteSnapshot deletes the given snapshot of the stopped VM
+	DeleteSnapshot(vmName string, snapshotName string) error
+	// ListSnapshots returns the snapshots of the VM, oldest first
+	ListSnapshots(vmName string) ([]Snapshot, error)
+	// CloneDisk writes a VMDK copy of the first disk of the VM to clonePath. If split is
+	// true the data is written to 2 GB extent files next to clonePath (e.g. for FAT32).
+	// The percentage of the work done is reported to progressCallbackFn.
+	CloneDisk(vmName string, clonePath string, split bool, progressCallbackFn func(int)) error
+	// CompactDisk releases the unused blocks of the base disk of the stopped VM. The
+	// differencing images of the snapshots are not compacted.
+	CompactDisk(vmName string) error
+
+	// ListVMs returns the names of all VMs known by the backend
+	ListVMs() ([]string, error)
+	// IsInstalled returns true if the VM exists
+	IsInstalled(vmName string) (bool, error)
+	// IsRunning returns true if the VM is currently running
+	IsRunning(vmName string) (bool, error)
+	// GetState returns the state of the VM. A VM which does not exist is VMStateNotInstalled.
+	GetState(vmName string) (VMState, error)
+
+	// GetProperty returns a VM property stored by CreateVM() or an empty string
+	GetProperty(vmName string, property string) string
+	// GetGuestProperty returns the current value of a property set by the running guest
+	// or an empty string if it has not been set
+	GetGuestProperty(vmName string, property string) (string, error)
+	// DiskLocation returns the full path of the first disk of the VM
+	DiskLocation(vmName string) string
+	// DiskSizeOnDisk returns the size of the given disk image on disk in megabytes
+	DiskSizeOnDisk(location string) (uint64, error)
+	// LogDir returns the full path of the directory containing the VM logs
+	LogDir(vmName string) string
+}
+
+var hypervisors = map[string]Hypervisor{
+	"virtualbox": &virtualBoxHypervisor{},
+	"qemu":       &qemuHypervisor{},
+}
+
+// getHypervisor returns the backend selected in the configuration
+func getHypervisor() Hypervisor {
+	hypervisor, ok := hypervisors[config.GetHypervisor()]
+	if !ok {
+		log.Debug("Hypervisor '%s' is not known, falling back to VirtualBox", config.GetHypervisor())
+		return hypervisors["virtualbox"]
+	}
+
+	return hypervisor
+}
+
+// IsHypervisorAvailable returns true if the tools of the selected virtualisation backend
+// have been installed
+func IsHypervisorAvailable() bool {
+	return getHypervisor().IsAvailable()
+}
+
+// HypervisorName returns the name of the selected virtualisation backend
+func HypervisorName() string {
+	return getHypervisor().Name()
+}
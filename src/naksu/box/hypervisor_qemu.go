@@ -0,0 +1,341 @@
+package box
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"naksu/box/qemu"
+	"naksu/log"
+	"naksu/mebroutines"
+)
+
+// qemuHypervisor runs the VM with QEMU/KVM. This backend is supported only on
+// Linux and it expects the selected network device to be a bridge (e.g. br0)
+// allowed in the qemu-bridge-helper configuration.
+type qemuHypervisor struct{}
+
+func (q *qemuHypervisor) Name() string {
+	return "QEMU"
+}
+
+func (q *qemuHypervisor) IsAvailable() bool {
+	if runtime.GOOS != "linux" {
+		log.Debug("QEMU backend is supported only on Linux")
+		return false
+	}
+
+	return qemu.IsInstalled()
+}
+
+func (q *qemuHypervisor) DiskImagePath(vmName string) string {
+	if vmName == legacyBoxName {
+		return filepath.Join(mebroutines.GetKtpDirectory(), "naksu_ktp_disk.qcow2")
+	}
+
+	return filepath.Join(mebroutines.GetKtpDirectory(), vmName+".qcow2")
+}
+
+func (q *qemuHypervisor) ImportDisk(image io.Reader, imageSize uint64, diskPath string, diskSizeMB int) error {
+	// qemu-img cannot read from a pipe so the raw image must be stored temporarily
+	rawImagePath := mebroutines.GetImagePath()
+	err := writeRawImage(image, imageSize, rawImagePath)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		removeErr := os.Remove(rawImagePath)
+		if removeErr != nil {
+			log.Debug(fmt.Sprintf("Could not remove temporary raw image %s: %v", rawImagePath, removeErr))
+		}
+	}()
+
+	_, err = qemu.RunImgCommand([]string{"convert", "-f", "raw", "-O", "qcow2", rawImagePath, diskPath})
+	if err != nil {
+		return err
+	}
+
+	_, err = qemu.RunImgCommand([]string{"resize", "-f", "qcow2", diskPath, fmt.Sprintf("%dM", diskSizeMB)})
+	return err
+}
+
+func (q *qemuHypervisor) ImportDiskSpace(diskPath string, imageSize uint64) map[string]uint64 {
+	// The raw image is stored temporarily next to the qcow2 image, see ImportDisk()
+	space := map[string]uint64{filepath.Dir(diskPath): imageSize}
+	space[filepath.Dir(mebroutines.GetImagePath())] += imageSize
+
+	return space
+}
+
+func (q *qemuHypervisor) RemoveDisk(diskPath string) error {
+	// An interrupted ImportDisk() may have left its temporary raw image behind
+	for _, path := range []string{diskPath, mebroutines.GetImagePath()} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove disk image %s: %v", path, err)
+		}
+	}
+
+	return nil
+}
+
+func (q *qemuHypervisor) ImportVMDK(vmdkPath string, diskPath string) error {
+	_, err := qemu.RunImgCommand([]string{"convert", "-f", "vmdk", "-O", "qcow2", vmdkPath, diskPath})
+	return err
+}
+
+func writeRawImage(image io.Reader, imageSize uint64, rawImagePath string) error {
+	rawImage, err := os.OpenFile(rawImagePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("could not create raw image file %s: %v", rawImagePath, err)
+	}
+	defer rawImage.Close()
+
+	written, err := io.Copy(rawImage, image)
+	if err != nil {
+		return fmt.Errorf("could not write raw image file %s: %v", rawImagePath, err)
+	}
+
+	if uint64(written) != imageSize {
+		return fmt.Errorf("raw image size %d does not match expected size %d", written, imageSize)
+	}
+
+	return nil
+}
+
+func (q *qemuHypervisor) CreateVM(spec VMSpec) error {
+	err := qemu.SaveVMConfig(qemu.VMConfig{
+		Name:             spec.Name,
+		CPUs:             spec.CPUs,
+		MemoryMB:         spec.MemoryMB,
+		VRamMB:           spec.VRamMB,
+		DiskPath:         spec.DiskPath,
+		SharedFolderName: spec.SharedFolderName,
+		SharedFolderPath: spec.SharedFolderPath,
+		Properties:       spec.Properties,
+	})
+	if err != nil {
+		return err
+	}
+
+	if spec.SnapshotName != "" {
+		return q.TakeSnapshot(spec.Name, spec.SnapshotName)
+	}
+
+	return nil
+}
+
+func (q *qemuHypervisor) ModifyVM(vmName string, resources Resources) error {
+	if qemu.IsRunning(vmName) {
+		return errors.New("the vm is running, please stop it first")
+	}
+
+	vmConfig, err := qemu.LoadVMConfig(vmName)
+	if err != nil {
+		return fmt.Errorf("could not read settings of vm %s: %v", vmName, err)
+	}
+
+	vmConfig.CPUs = resources.CPUs
+	vmConfig.MemoryMB = resources.MemoryMB
+	vmConfig.VRamMB = resources.VRamMB
+
+	return qemu.SaveVMConfig(vmConfig)
+}
+
+func (q *qemuHypervisor) RemoveVM(vmName string) error {
+	if qemu.IsRunning(vmName) {
+		err := q.StopVM(vmName, true)
+		if err != nil {
+			log.Debug(fmt.Sprintf("Could not stop vm %s before removing it: %v", vmName, err))
+		}
+	}
+
+	return qemu.RemoveVM(vmName)
+}
+
+func (q *qemuHypervisor) UnregisterVM(vmName string) error {
+	isInstalled, err := q.IsInstalled(vmName)
+	if err != nil || !isInstalled {
+		return err
+	}
+
+	// The snapshots are stored in the disk image which is kept
+	snapshots, err := q.ListSnapshots(vmName)
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		err = q.DeleteSnapshot(vmName, snapshot.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(qemu.GetVMDirectory(vmName))
+}
+
+func (q *qemuHypervisor) StartVM(vmName string, network NetworkSpec) error {
+	return qemu.StartVM(vmName, network.HostInterface, network.NicType)
+}
+
+func (q *qemuHypervisor) StopVM(vmName string, force bool) error {
+	if force {
+		return qemu.SendMonitorCommand(vmName, "quit")
+	}
+
+	return qemu.SendMonitorCommand(vmName, "system_powerdown")
+}
+
+func (q *qemuHypervisor) DiscardSavedState(vmName string) error {
+	return errors.New("qemu vms do not have a saved state")
+}
+
+func (q *qemuHypervisor) getDiskPath(vmName string) (string, error) {
+	vmConfig, err := qemu.LoadVMConfig(vmName)
+	if err != nil {
+		return "", fmt.Errorf("could not read settings of vm %s: %v", vmName, err)
+	}
+
+	return vmConfig.DiskPath, nil
+}
+
+func (q *qemuHypervisor) runSnapshotCommand(vmName string, snapshotFlag string, snapshotName string) error {
+	if qemu.IsRunning(vmName) {
+		return errors.New("the vm is running, please stop it first")
+	}
+
+	diskPath, err := q.getDiskPath(vmName)
+	if err != nil {
+		return err
+	}
+
+	_, err = qemu.RunImgCommand([]string{"snapshot", snapshotFlag, snapshotName, diskPath})
+	return err
+}
+
+func (q *qemuHypervisor) TakeSnapshot(vmName string, snapshotName string) error {
+	return q.runSnapshotCommand(vmName, "-c", snapshotName)
+}
+
+func (q *qemuHypervisor) RestoreSnapshot(vmName string, snapshotName string) error {
+	return q.runSnapshotCommand(vmName, "-a", snapshotName)
+}
+
+func (q *qemuHypervisor) DeleteSnapshot(vmName string, snapshotName string) error {
+	return q.runSnapshotCommand(vmName, "-d", snapshotName)
+}
+
+func (q *qemuHypervisor) ListSnapshots(vmName string) ([]Snapshot, error) {
+	diskPath, err := q.getDiskPath(vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	qemuSnapshots, err := qemu.ListSnapshots(diskPath)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []Snapshot{}
+	for _, snapshot := range qemuSnapshots {
+		snapshots = append(snapshots, Snapshot{Name: snapshot.Name, Created: snapshot.Created})
+	}
+
+	return snapshots, nil
+}
+
+func (q *qemuHypervisor) CloneDisk(vmName string, clonePath string, split bool, progressCallbackFn func(int)) error {
+	diskPath, err := q.getDiskPath(vmName)
+	if err != nil {
+		return err
+	}
+
+	convertCommand := []string{"convert", "-p", "-f", "qcow2", "-O", "vmdk"}
+	if split {
+		convertCommand = append(convertCommand, "-o", "subformat=twoGbMaxExtentSparse")
+	}
+
+	_, err = qemu.RunImgCommandWithProgress(append(convertCommand, diskPath, clonePath), progressCallbackFn)
+	return err
+}
+
+func (q *qemuHypervisor) CompactDisk(vmName string) error {
+	// The snapshots are stored inside the qcow2 image which cannot be compacted in place
+	log.Debug(fmt.Sprintf("Compacting the disk of qemu vm %s is not supported", vmName))
+	return nil
+}
+
+func (q *qemuHypervisor) ListVMs() ([]string, error) {
+	return qemu.ListVMs()
+}
+
+func (q *qemuHypervisor) IsInstalled(vmName string) (bool, error) {
+	_, err := qemu.LoadVMConfig(vmName)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (q *qemuHypervisor) IsRunning(vmName string) (bool, error) {
+	return qemu.IsRunning(vmName), nil
+}
+
+func (q *qemuHypervisor) GetState(vmName string) (VMState, error) {
+	installed, err := q.IsInstalled(vmName)
+	if err != nil {
+		return VMStateUnknown, err
+	}
+
+	if !installed {
+		return VMStateNotInstalled, nil
+	}
+
+	if qemu.IsRunning(vmName) {
+		return VMStateRunning, nil
+	}
+
+	return VMStatePoweredOff, nil
+}
+
+func (q *qemuHypervisor) GetProperty(vmName string, property string) string {
+	vmConfig, err := qemu.LoadVMConfig(vmName)
+	if err != nil {
+		return ""
+	}
+
+	return vmConfig.Properties[property]
+}
+
+func (q *qemuHypervisor) GetGuestProperty(vmName string, property string) (string, error) {
+	return "", errors.New("qemu vms do not have guest properties")
+}
+
+func (q *qemuHypervisor) DiskLocation(vmName string) string {
+	diskPath, err := q.getDiskPath(vmName)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not get disk location: %v", err))
+		return ""
+	}
+
+	return diskPath
+}
+
+func (q *qemuHypervisor) DiskSizeOnDisk(location string) (uint64, error) {
+	size, err := qemu.GetActualDiskSize(location)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get medium size: %v", err)
+	}
+
+	return size / (1024 * 1024), nil
+}
+
+func (q *qemuHypervisor) LogDir(vmName string) string {
+	return qemu.GetLogDirectory(vmName)
+}
@@ -0,0 +1,454 @@
+package box
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	semver "github.com/blang/semver/v4"
+
+	"naksu/box/vboxmanage"
+	"naksu/log"
+	"naksu/mebroutines"
+)
+
+const (
+	// virtualBoxDiskController is the storage controller of the VM disk
+	virtualBoxDiskController = "SATA Controller"
+	// virtualBoxVMFolderSpace is the space needed in the machine folder by the settings,
+	// logs and the differencing disk of the snapshot taken after the install
+	virtualBoxVMFolderSpace = 512 * 1024 * 1024
+	// maxVirtualBoxMediumDepth limits the chain of differencing images followed
+	// when looking for the base medium of a disk
+	maxVirtualBoxMediumDepth = 64
+)
+
+// virtualBoxHypervisor runs the VM with Oracle VirtualBox using VBoxManage
+type virtualBoxHypervisor struct{}
+
+func (v *virtualBoxHypervisor) Name() string {
+	return "VirtualBox"
+}
+
+func (v *virtualBoxHypervisor) IsAvailable() bool {
+	return vboxmanage.IsInstalled()
+}
+
+func (v *virtualBoxHypervisor) DiskImagePath(vmName string) string {
+	// Boxes installed before multiple boxes were supported use the old disk path
+	if vmName == legacyBoxName {
+		return mebroutines.GetVDIImagePath()
+	}
+
+	return filepath.Join(mebroutines.GetKtpDirectory(), vmName+".vdi")
+}
+
+func (v *virtualBoxHypervisor) ImportDisk(image io.Reader, imageSize uint64, diskPath string, diskSizeMB int) error {
+	// The raw image is streamed to VBoxManage so it never has to be written to the disk
+	_, err := vboxmanage.RunCommandWithStdin(vboxmanage.VBoxCommand{"convertfromraw", "stdin", diskPath, fmt.Sprintf("%d", imageSize), "--format", "VDI"}, image)
+	if err != nil {
+		return err
+	}
+
+	_, err = vboxmanage.RunCommand(vboxmanage.VBoxCommand{"modifyhd", diskPath, "--resize", fmt.Sprintf("%d", diskSizeMB)})
+	return err
+}
+
+func (v *virtualBoxHypervisor) ImportDiskSpace(diskPath string, imageSize uint64) map[string]uint64 {
+	// The raw image is streamed to VBoxManage and the VDI contains at most its data
+	space := map[string]uint64{filepath.Dir(diskPath): imageSize}
+	space[mebroutines.GetVirtualBoxVMsDirectory()] += virtualBoxVMFolderSpace
+
+	return space
+}
+
+func (v *virtualBoxHypervisor) RemoveDisk(diskPath string) error {
+	_, err := vboxmanage.RunCommand(vboxmanage.VBoxCommand{"closemedium", "disk", diskPath, "--delete"})
+
+	vboxmanage.ResetVBoxResponseCache()
+
+	if err == nil || !mebroutines.ExistsFile(diskPath) {
+		return nil
+	}
+
+	// VirtualBox cannot open a disk image which was not written completely
+	log.Debug(fmt.Sprintf("Could not close disk %s, removing the file: %v", diskPath, err))
+
+	err = os.Remove(diskPath)
+	if err != nil {
+		return fmt.Errorf("could not remove disk image %s: %v", diskPath, err)
+	}
+
+	return nil
+}
+
+func (v *virtualBoxHypervisor) ImportVMDK(vmdkPath string, diskPath string) error {
+	_, err := vboxmanage.RunCommand(vboxmanage.VBoxCommand{"clonemedium", vmdkPath, diskPath, "--format", "VDI"})
+	if err != nil {
+		return err
+	}
+
+	// Detach the source from VirtualBox disk management so the backup media can be removed
+	_, errCloseMedium := vboxmanage.RunCommand(vboxmanage.VBoxCommand{"closemedium", vmdkPath})
+	if errCloseMedium != nil {
+		log.Debug(fmt.Sprintf("Could not close medium %s: %v", vmdkPath, errCloseMedium))
+	}
+
+	return nil
+}
+
+func (v *virtualBoxHypervisor) CreateVM(spec VMSpec) error {
+	createCommands := []vboxmanage.VBoxCommand{
+		{"createvm", "--name", spec.Name, "--register"},
+		{
+			"modifyvm", spec.Name,
+			"--pae", "on",
+			"--cpus", fmt.Sprintf("%d", spec.CPUs),
+			"--memory", fmt.Sprintf("%d", spec.MemoryMB),
+			"--vram", fmt.Sprintf("%d", spec.VRamMB),
+			"--acpi", "on",
+			"--ioapic", "on",
+			"--ostype", spec.OSType,
+			"--firmware", "efi",
+			"--audio", "none",
+		},
+	}
+
+	for property, value := range spec.Properties {
+		createCommands = append(createCommands, vboxmanage.VBoxCommand{"guestproperty", "set", spec.Name, property, value})
+	}
+
+	createCommands = append(createCommands, []vboxmanage.VBoxCommand{
+		{
+			"sharedfolder", "add", spec.Name,
+			"--name", spec.SharedFolderName,
+			"--hostpath", spec.SharedFolderPath,
+		},
+		{
+			"storagectl", spec.Name,
+			"--add", "sata",
+			"--name", virtualBoxDiskController,
+		},
+		{
+			"storageattach", spec.Name,
+			"--storagectl", virtualBoxDiskController,
+			"--port", "0",
+			"--device", "0",
+			"--type", "hdd",
+			"--medium", spec.DiskPath,
+		},
+		{
+			"setextradata", spec.Name,
+			"GUI/RestrictedCloseActions",
+			"SaveState,PowerOffRestoringSnapshot",
+		},
+	}...)
+
+	v6_1String := "6.1.0"
+	v6_1, err := semver.Make(v6_1String)
+	if err != nil {
+		return fmt.Errorf("hard-coded version string %s could not be converted to sematic version object", v6_1String)
+	}
+
+	vBoxVersion, err := vboxmanage.GetVBoxManageVersion()
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not get VBoxManage version: %v", err))
+		return err
+	}
+
+	if vBoxVersion.LT(v6_1) {
+		createCommands = append(createCommands, vboxmanage.VBoxCommand{"modifyvm", spec.Name, "--clipboard", "bidirectional"})
+	} else {
+		createCommands = append(createCommands, vboxmanage.VBoxCommand{"modifyvm", spec.Name, "--clipboard-mode", "bidirectional"})
+	}
+
+	if spec.SnapshotName != "" {
+		createCommands = append(createCommands, vboxmanage.VBoxCommand{"snapshot", spec.Name, "take", spec.SnapshotName})
+	}
+
+	err = vboxmanage.RunCommands(createCommands)
+	if err != nil {
+		return err
+	}
+
+	vboxmanage.ResetVBoxResponseCache()
+
+	return nil
+}
+
+func (v *virtualBoxHypervisor) ModifyVM(vmName string, resources Resources) error {
+	err := vboxmanage.RunCommands([]vboxmanage.VBoxCommand{
+		{
+			"modifyvm", vmName,
+			"--cpus", fmt.Sprintf("%d", resources.CPUs),
+			"--memory", fmt.Sprintf("%d", resources.MemoryMB),
+			"--vram", fmt.Sprintf("%d", resources.VRamMB),
+		},
+	})
+
+	vboxmanage.ResetVBoxResponseCache()
+
+	return err
+}
+
+func (v *virtualBoxHypervisor) RemoveVM(vmName string) error {
+	err := vboxmanage.RunCommands([]vboxmanage.VBoxCommand{
+		{"unregistervm", vmName, "--delete"},
+	})
+
+	// Other boxes are still installed so the cached state of this box must be forgotten
+	vboxmanage.ResetVBoxResponseCache()
+
+	if errors.Is(err, vboxmanage.ErrVMNotFound) {
+		log.Debug(fmt.Sprintf("VM %s has already been removed", vmName))
+		return nil
+	}
+
+	return err
+}
+
+func (v *virtualBoxHypervisor) UnregisterVM(vmName string) error {
+	_, err := vboxmanage.RunCommand(vboxmanage.VBoxCommand{"unregistervm", vmName})
+
+	vboxmanage.ResetVBoxResponseCache()
+
+	if err != nil && !errors.Is(err, vboxmanage.ErrVMNotFound) {
+		return err
+	}
+
+	// The settings, logs and the differencing disks of the snapshots are in the VM
+	// directory, the disk image is in ~/ktp
+	vmDirectory := filepath.Join(mebroutines.GetVirtualBoxVMsDirectory(), vmName)
+	err = os.RemoveAll(vmDirectory)
+	if err != nil {
+		return fmt.Errorf("could not remove vm directory %s: %v", vmDirectory, err)
+	}
+
+	return nil
+}
+
+func (v *virtualBoxHypervisor) StartVM(vmName string, network NetworkSpec) error {
+	startCommands := []vboxmanage.VBoxCommand{
+		{"modifyvm", vmName, "--nic1", "bridged"},
+		{"modifyvm", vmName, "--bridgeadapter1", network.HostInterface},
+		{"modifyvm", vmName, "--nictype1", network.NicType},
+		{"startvm", vmName, "--type", "gui"},
+	}
+
+	return vboxmanage.RunCommands(startCommands)
+}
+
+func (v *virtualBoxHypervisor) StopVM(vmName string, force bool) error {
+	if force {
+		return vboxmanage.RunCommands([]vboxmanage.VBoxCommand{{"controlvm", vmName, "poweroff"}})
+	}
+
+	return vboxmanage.RunCommands([]vboxmanage.VBoxCommand{{"controlvm", vmName, "acpipowerbutton"}})
+}
+
+func (v *virtualBoxHypervisor) DiscardSavedState(vmName string) error {
+	err := vboxmanage.RunCommands([]vboxmanage.VBoxCommand{{"discardstate", vmName}})
+
+	vboxmanage.ResetVBoxResponseCache()
+
+	return err
+}
+
+func (v *virtualBoxHypervisor) TakeSnapshot(vmName string, snapshotName string) error {
+	return vboxmanage.RunCommands([]vboxmanage.VBoxCommand{
+		{"snapshot", vmName, "take", snapshotName},
+	})
+}
+
+func (v *virtualBoxHypervisor) RestoreSnapshot(vmName string, snapshotName string) error {
+	return vboxmanage.RunCommands([]vboxmanage.VBoxCommand{
+		{"snapshot", vmName, "restore", snapshotName},
+	})
+}
+
+func (v *virtualBoxHypervisor) DeleteSnapshot(vmName string, snapshotName string) error {
+	return vboxmanage.RunCommands([]vboxmanage.VBoxCommand{
+		{"snapshot", vmName, "delete", snapshotName},
+	})
+}
+
+func (v *virtualBoxHypervisor) ListSnapshots(vmName string) ([]Snapshot, error) {
+	vboxSnapshots, err := vboxmanage.ListSnapshots(vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []Snapshot{}
+	for _, snapshot := range vboxSnapshots {
+		snapshots = append(snapshots, Snapshot{Name: snapshot.Name, Created: snapshot.Created})
+	}
+
+	return snapshots, nil
+}
+
+func (v *virtualBoxHypervisor) CloneDisk(vmName string, clonePath string, split bool, progressCallbackFn func(int)) error {
+	disk, err := getVirtualBoxDisk(vmName)
+	if err != nil {
+		return err
+	}
+
+	if disk.ImageUUID == "" {
+		return fmt.Errorf("could not get disk uuid")
+	}
+
+	cloneCommand := vboxmanage.VBoxCommand{"clonemedium", disk.ImageUUID, clonePath, "--format", "VMDK"}
+	if split {
+		cloneCommand = append(cloneCommand, "--variant", "Split2G")
+	}
+
+	// A failed clone is reported by the exit code of VBoxManage, see vboxmanage.CommandError
+	_, err = vboxmanage.RunCommandWithProgress(cloneCommand, progressCallbackFn)
+	if err != nil {
+		return err
+	}
+
+	// Detach media from VirtualBox disk management
+	_, errCloseMedium := vboxmanage.RunCommand(vboxmanage.VBoxCommand{"closemedium", clonePath})
+	return errCloseMedium
+}
+
+func (v *virtualBoxHypervisor) CompactDisk(vmName string) error {
+	disk, err := getVirtualBoxDisk(vmName)
+	if err != nil {
+		return err
+	}
+
+	if disk.ImageUUID == "" {
+		return fmt.Errorf("could not get disk uuid")
+	}
+
+	// When the VM has snapshots its current disk is a differencing image which
+	// is replaced when a snapshot is restored. Compact the base VDI instead.
+	baseUUID, err := getVirtualBoxBaseMediumUUID(disk.ImageUUID)
+	if err != nil {
+		return err
+	}
+
+	_, err = vboxmanage.RunCommand(vboxmanage.VBoxCommand{"modifymedium", "disk", baseUUID, "--compact"})
+	return err
+}
+
+func (v *virtualBoxHypervisor) ListVMs() ([]string, error) {
+	return vboxmanage.ListVMs()
+}
+
+func (v *virtualBoxHypervisor) IsInstalled(vmName string) (bool, error) {
+	return vboxmanage.IsVMInstalled(vmName)
+}
+
+func (v *virtualBoxHypervisor) IsRunning(vmName string) (bool, error) {
+	state, err := v.GetState(vmName)
+	if err != nil {
+		return false, err
+	}
+
+	return state.IsRunning(), nil
+}
+
+func (v *virtualBoxHypervisor) GetState(vmName string) (VMState, error) {
+	vmState, err := vboxmanage.GetVMState(vmName)
+	if err != nil {
+		return VMStateUnknown, err
+	}
+
+	return ParseVMState(vmState), nil
+}
+
+func (v *virtualBoxHypervisor) GetProperty(vmName string, property string) string {
+	return vboxmanage.GetVMProperty(vmName, property)
+}
+
+func (v *virtualBoxHypervisor) GetGuestProperty(vmName string, property string) (string, error) {
+	return vboxmanage.GetGuestProperty(vmName, property)
+}
+
+func (v *virtualBoxHypervisor) DiskLocation(vmName string) string {
+	disk, err := getVirtualBoxDisk(vmName)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not get disk location: %v", err))
+		return ""
+	}
+
+	return disk.Medium
+}
+
+func (v *virtualBoxHypervisor) DiskSizeOnDisk(location string) (uint64, error) {
+	// According to documentation, showmediuminfo should also accept a disk uuid
+	// as a parameter, but that doesn't seem to be the case. To be safe, we'll
+	// use the location of the disk instead.
+
+	mediumInfo, err := vboxmanage.RunCommand([]string{"showmediuminfo", location})
+
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not get medium info to calculate its size: %v", err))
+		return 0, errors.New("failed to get medium size: could not execute vboxmanage")
+	}
+
+	sizeOnDiskRE := regexp.MustCompile(`Size on disk:\s+(\d+)\s+MBytes`)
+	result := sizeOnDiskRE.FindStringSubmatch(mediumInfo)
+	if len(result) > 1 {
+		size := result[1]
+		return strconv.ParseUint(size, 10, 64)
+	}
+	return 0, errors.New("failed to get medium size: no regex matches")
+}
+
+func (v *virtualBoxHypervisor) LogDir(vmName string) string {
+	vmInfo, err := vboxmanage.GetVMInfo(vmName)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not get log directory: %v", err))
+		return ""
+	}
+
+	return vmInfo.LogFolder
+}
+
+// getVirtualBoxBaseMediumUUID follows the parents of the given disk medium
+// (e.g. a snapshot differencing image) and returns the uuid of the base medium
+func getVirtualBoxBaseMediumUUID(mediumUUID string) (string, error) {
+	parentUUIDRE := regexp.MustCompile(`(?m)^Parent UUID:\s+(\S+)\s*$`)
+
+	for i := 0; i < maxVirtualBoxMediumDepth; i++ {
+		mediumInfo, err := vboxmanage.RunCommand(vboxmanage.VBoxCommand{"showmediuminfo", "disk", mediumUUID})
+		if err != nil {
+			return "", fmt.Errorf("could not get info of medium %s: %v", mediumUUID, err)
+		}
+
+		result := parentUUIDRE.FindStringSubmatch(mediumInfo)
+		if result == nil {
+			return "", fmt.Errorf("medium info of %s does not contain parent uuid", mediumUUID)
+		}
+
+		if result[1] == "base" {
+			return mediumUUID, nil
+		}
+
+		mediumUUID = result[1]
+	}
+
+	return "", fmt.Errorf("could not find base medium of %s", mediumUUID)
+}
+
+// getVirtualBoxDisk returns the disk of the VM attached by CreateVM()
+func getVirtualBoxDisk(vmName string) (vboxmanage.StorageAttachment, error) {
+	vmInfo, err := vboxmanage.GetVMInfo(vmName)
+	if err != nil {
+		return vboxmanage.StorageAttachment{}, err
+	}
+
+	disk, ok := vmInfo.GetStorageAttachment(virtualBoxDiskController, 0, 0)
+	if !ok {
+		return vboxmanage.StorageAttachment{}, fmt.Errorf("vm %s does not have a disk attached to %s", vmName, virtualBoxDiskController)
+	}
+
+	return disk, nil
+}
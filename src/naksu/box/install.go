@@ -0,0 +1,315 @@
+package box
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"naksu/config"
+	"naksu/log"
+	"naksu/mebroutines"
+)
+
+// installStep is a step of creating a new box which knows how to undo itself (see
+// CreateNewBox())
+type installStep struct {
+	name string
+	// do runs the step. It is nil if the step cannot be run again when an interrupted
+	// install is resumed, e.g. importing the disk needs the image.
+	do func() error
+	// undo reverts the step. It must succeed also if the step was done partially or
+	// not at all.
+	undo func() error
+	// retry reverts a partially done step before it is run again when an interrupted
+	// install is resumed. If it is nil undo is used.
+	retry func() error
+}
+
+// installJournal records the progress of an install to a file. An install interrupted
+// e.g. by a power loss is resumed or rolled back on the next launch using the journal,
+// see RecoverInterruptedInstall().
+type installJournal struct {
+	path string
+	// Hypervisor is the backend creating the box (see config.GetHypervisor())
+	Hypervisor string    `json:"hypervisor"`
+	Started    time.Time `json:"started"`
+	Spec       VMSpec    `json:"spec"`
+	// Restore is true if the box is restored from a backup (see RestoreBox())
+	Restore bool `json:"restore"`
+	// PreviousActiveBox is restored if the install is rolled back
+	PreviousActiveBox string `json:"previousActiveBox"`
+	// Steps are the steps started so far in the order they were started
+	Steps []installJournalStep `json:"steps"`
+}
+
+type installJournalStep struct {
+	Name string `json:"name"`
+	Done bool   `json:"done"`
+}
+
+// RecoveredInstall is an interrupted install finished or rolled back by
+// RecoverInterruptedInstall()
+type RecoveredInstall struct {
+	Name    string
+	Version string
+	// Resumed is true if the install was finished and false if it was rolled back
+	Resumed bool
+	// Restore is true if the box was restored from a backup instead of installed
+	Restore bool
+}
+
+// newInstallSteps returns the steps of creating the box described by the journal.
+// importDisk writes the disk of the box (see CreateNewBox() and RestoreBox()). It is
+// nil when an interrupted install is recovered.
+func newInstallSteps(hypervisor Hypervisor, journal *installJournal, importDisk func() error) []installStep {
+	spec := journal.Spec
+
+	return []installStep{
+		{
+			name: "import-disk",
+			do:   importDisk,
+			undo: func() error {
+				return hypervisor.RemoveDisk(spec.DiskPath)
+			},
+		},
+		{
+			name: "create-vm",
+			do: func() error {
+				return hypervisor.CreateVM(spec)
+			},
+			undo: func() error {
+				isInstalled, err := hypervisor.IsInstalled(spec.Name)
+				if err != nil || !isInstalled {
+					return err
+				}
+
+				return hypervisor.RemoveVM(spec.Name)
+			},
+			retry: func() error {
+				// RemoveVM() would delete the imported disk
+				return hypervisor.UnregisterVM(spec.Name)
+			},
+		},
+		{
+			name: "set-active",
+			do: func() error {
+				config.SetActiveBox(spec.Name)
+				return nil
+			},
+			undo: func() error {
+				config.SetActiveBox(journal.PreviousActiveBox)
+				return nil
+			},
+		},
+	}
+}
+
+// runInstallSteps runs the steps which have not been done yet and removes the journal.
+// A step which was started but not done is reverted before running it again. If a step
+// fails all started steps are rolled back.
+func runInstallSteps(journal *installJournal, steps []installStep) error {
+	for _, step := range steps {
+		started, done := journal.getStep(step.name)
+		if done {
+			continue
+		}
+
+		var err error
+		if started {
+			log.Debug(fmt.Sprintf("Reverting unfinished install step %s before running it again", step.name))
+			if step.retry != nil {
+				err = step.retry()
+			} else {
+				err = step.undo()
+			}
+		}
+
+		if err == nil {
+			err = journal.setStep(step.name, false)
+		}
+
+		if err == nil {
+			log.Debug(fmt.Sprintf("Running install step %s of %s", step.name, journal.Spec.Name))
+			err = step.do()
+		}
+
+		if err == nil {
+			err = journal.setStep(step.name, true)
+		}
+
+		if err != nil {
+			log.Debug(fmt.Sprintf("Install step %s of %s failed, rolling back the install: %v", step.name, journal.Spec.Name, err))
+
+			rollbackErr := rollBackInstallSteps(journal, steps)
+			if rollbackErr != nil {
+				return fmt.Errorf("%w (could not roll back the install: %v)", err, rollbackErr)
+			}
+
+			return err
+		}
+	}
+
+	journal.remove()
+
+	return nil
+}
+
+// rollBackInstallSteps undoes the started steps in the reverse order and removes the
+// journal. If undoing a step fails the journal is kept so that rolling back can be
+// tried again on the next launch.
+func rollBackInstallSteps(journal *installJournal, steps []installStep) error {
+	for n := len(steps) - 1; n >= 0; n-- {
+		started, _ := journal.getStep(steps[n].name)
+		if !started {
+			continue
+		}
+
+		log.Debug(fmt.Sprintf("Undoing install step %s of %s", steps[n].name, journal.Spec.Name))
+
+		err := steps[n].undo()
+		if err != nil {
+			return fmt.Errorf("could not undo install step %s: %w", steps[n].name, err)
+		}
+	}
+
+	journal.remove()
+
+	return nil
+}
+
+// canResumeInstall returns true if all steps which have not been done can be run again
+func canResumeInstall(journal *installJournal, steps []installStep) bool {
+	for _, step := range steps {
+		_, done := journal.getStep(step.name)
+		if !done && step.do == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RecoverInterruptedInstall finishes an install interrupted e.g. by a power loss if the
+// disk of the new box had been imported. Otherwise the half-created box and its disk
+// are removed. Returns nil if there was no interrupted install.
+func RecoverInterruptedInstall() (*RecoveredInstall, error) {
+	journal, err := loadInstallJournal(mebroutines.GetInstallJournalPath())
+	if err != nil || journal == nil {
+		return nil, err
+	}
+
+	hypervisor, ok := hypervisors[journal.Hypervisor]
+	if !ok {
+		return nil, fmt.Errorf("install journal %s has an unknown hypervisor '%s'", journal.path, journal.Hypervisor)
+	}
+
+	recovered := &RecoveredInstall{
+		Name:    journal.Spec.Name,
+		Version: journal.Spec.Properties["boxVersion"],
+		Restore: journal.Restore,
+	}
+
+	// The version of a restored backup may be unknown
+	if recovered.Version == "" {
+		recovered.Version = recovered.Name
+	}
+
+	steps := newInstallSteps(hypervisor, journal, nil)
+	if canResumeInstall(journal, steps) && mebroutines.ExistsFile(journal.Spec.DiskPath) {
+		log.Action("Resuming the install of %s started at %s", journal.Spec.Name, journal.Started.Format(time.RFC3339))
+		recovered.Resumed = true
+
+		return recovered, runInstallSteps(journal, steps)
+	}
+
+	log.Action("Rolling back the install of %s started at %s", journal.Spec.Name, journal.Started.Format(time.RFC3339))
+
+	return recovered, rollBackInstallSteps(journal, steps)
+}
+
+func newInstallJournal(path string, spec VMSpec) *installJournal {
+	return &installJournal{
+		path:              path,
+		Hypervisor:        config.GetHypervisor(),
+		Started:           time.Now(),
+		Spec:              spec,
+		PreviousActiveBox: config.GetActiveBox(),
+		Steps:             []installJournalStep{},
+	}
+}
+
+// loadInstallJournal reads the journal at path. Returns nil if there is no journal.
+func loadInstallJournal(path string) (*installJournal, error) {
+	content, err := ioutil.ReadFile(path) // #nosec
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read install journal %s: %v", path, err)
+	}
+
+	journal := &installJournal{path: path}
+	err = json.Unmarshal(content, journal)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse install journal %s: %v", path, err)
+	}
+
+	return journal, nil
+}
+
+// getStep returns whether the step has been started and whether it has been done
+func (j *installJournal) getStep(name string) (bool, bool) {
+	for _, step := range j.Steps {
+		if step.Name == name {
+			return true, step.Done
+		}
+	}
+
+	return false, false
+}
+
+// setStep marks the step started or done and writes the journal
+func (j *installJournal) setStep(name string, done bool) error {
+	found := false
+	for n := range j.Steps {
+		if j.Steps[n].Name == name {
+			j.Steps[n].Done = done
+			found = true
+		}
+	}
+
+	if !found {
+		j.Steps = append(j.Steps, installJournalStep{Name: name, Done: done})
+	}
+
+	return j.save()
+}
+
+// save writes the journal to a temporary file which replaces the journal so that a
+// power loss does not leave a partially written journal
+func (j *installJournal) save() error {
+	content, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode install journal: %v", err)
+	}
+
+	err = ioutil.WriteFile(j.path+".tmp", content, 0600)
+	if err == nil {
+		err = os.Rename(j.path+".tmp", j.path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not write install journal %s: %v", j.path, err)
+	}
+
+	return nil
+}
+
+func (j *installJournal) remove() {
+	err := os.Remove(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Debug(fmt.Sprintf("Could not remove install journal %s: %v", j.path, err))
+	}
+}
@@ -0,0 +1,172 @@
+package box
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"naksu/mebroutines"
+)
+
+// newTestInstallSteps returns steps a, b and c which record their calls. The steps
+// given in failing fail.
+func newTestInstallSteps(calls *[]string, failing ...string) []installStep {
+	isFailing := func(call string) bool {
+		for _, failingCall := range failing {
+			if failingCall == call {
+				return true
+			}
+		}
+		return false
+	}
+
+	record := func(call string) func() error {
+		return func() error {
+			*calls = append(*calls, call)
+			if isFailing(call) {
+				return errors.New(call + " failed")
+			}
+			return nil
+		}
+	}
+
+	return []installStep{
+		{name: "a", do: record("do a"), undo: record("undo a")},
+		{name: "b", do: record("do b"), undo: record("undo b"), retry: record("retry b")},
+		{name: "c", do: record("do c"), undo: record("undo c")},
+	}
+}
+
+func newTestInstallJournal(t *testing.T) (*installJournal, func()) {
+	dir, err := ioutil.TempDir("", "naksu-install-journal")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+
+	journal := &installJournal{
+		path: filepath.Join(dir, "naksu_install_journal.json"),
+		Spec: VMSpec{Name: "NaksuAbittiKTP"},
+	}
+
+	return journal, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRunInstallSteps(t *testing.T) {
+	tables := []struct {
+		failing       []string
+		expectedCalls []string
+		isError       bool
+		journalKept   bool
+	}{
+		{nil, []string{"do a", "do b", "do c"}, false, false},
+		{[]string{"do a"}, []string{"do a", "undo a"}, true, false},
+		{[]string{"do b"}, []string{"do a", "do b", "undo b", "undo a"}, true, false},
+		{[]string{"do c", "undo b"}, []string{"do a", "do b", "do c", "undo c", "undo b"}, true, true},
+	}
+
+	for _, table := range tables {
+		journal, cleanup := newTestInstallJournal(t)
+
+		calls := []string{}
+		err := runInstallSteps(journal, newTestInstallSteps(&calls, table.failing...))
+
+		if (err != nil) != table.isError {
+			t.Errorf("runInstallSteps failing %v gives error %v", table.failing, err)
+		}
+
+		if !reflect.DeepEqual(calls, table.expectedCalls) {
+			t.Errorf("runInstallSteps failing %v calls %v, expected %v", table.failing, calls, table.expectedCalls)
+		}
+
+		if mebroutines.ExistsFile(journal.path) != table.journalKept {
+			t.Errorf("runInstallSteps failing %v leaves journal: %v, expected %v", table.failing, !table.journalKept, table.journalKept)
+		}
+
+		cleanup()
+	}
+}
+
+func TestInstallJournalIsWrittenBeforeEachStep(t *testing.T) {
+	journal, cleanup := newTestInstallJournal(t)
+	defer cleanup()
+
+	calls := []string{}
+	steps := newTestInstallSteps(&calls)
+
+	var savedJournal *installJournal
+	steps[1].do = func() error {
+		var err error
+		savedJournal, err = loadInstallJournal(journal.path)
+		return err
+	}
+
+	err := runInstallSteps(journal, steps)
+	if err != nil {
+		t.Fatalf("runInstallSteps failed: %v", err)
+	}
+
+	expectedSteps := []installJournalStep{{"a", true}, {"b", false}}
+	if savedJournal == nil || savedJournal.Spec.Name != "NaksuAbittiKTP" || !reflect.DeepEqual(savedJournal.Steps, expectedSteps) {
+		t.Errorf("Journal during step b is %+v, expected steps %+v", savedJournal, expectedSteps)
+	}
+}
+
+func TestResumeInstallSteps(t *testing.T) {
+	tables := []struct {
+		journalSteps  []installJournalStep
+		canResume     bool
+		expectedCalls []string
+	}{
+		{[]installJournalStep{{"a", true}}, true, []string{"do b", "do c"}},
+		{[]installJournalStep{{"a", true}, {"b", false}}, true, []string{"retry b", "do b", "do c"}},
+		{[]installJournalStep{{"a", true}, {"b", true}, {"c", false}}, true, []string{"undo c", "do c"}},
+		{[]installJournalStep{{"a", false}}, false, []string{"undo a"}},
+	}
+
+	for _, table := range tables {
+		journal, cleanup := newTestInstallJournal(t)
+		journal.Steps = table.journalSteps
+
+		err := journal.save()
+		if err != nil {
+			t.Fatalf("Could not save journal: %v", err)
+		}
+
+		journal, err = loadInstallJournal(journal.path)
+		if err != nil || journal == nil {
+			t.Fatalf("Could not load journal: %v", err)
+		}
+
+		calls := []string{}
+		steps := newTestInstallSteps(&calls)
+
+		// The image is not available when an interrupted install is recovered
+		steps[0].do = nil
+
+		canResume := canResumeInstall(journal, steps)
+		if canResume != table.canResume {
+			t.Errorf("canResumeInstall with %+v gives %v", table.journalSteps, canResume)
+		}
+
+		if canResume {
+			err = runInstallSteps(journal, steps)
+		} else {
+			err = rollBackInstallSteps(journal, steps)
+		}
+
+		if err != nil || !reflect.DeepEqual(calls, table.expectedCalls) {
+			t.Errorf("Recovering install with %+v calls %v (%v), expected %v", table.journalSteps, calls, err, table.expectedCalls)
+		}
+
+		if mebroutines.ExistsFile(journal.path) {
+			t.Errorf("Recovering install with %+v leaves the journal", table.journalSteps)
+		}
+
+		cleanup()
+	}
+}
@@ -0,0 +1,10 @@
+package qemu
+
+import (
+	"syscall"
+)
+
+// processExists returns true if there is a process with the given pid
+func processExists(pid int) bool {
+	return syscall.Kill(pid, syscall.Signal(0)) == nil
+}
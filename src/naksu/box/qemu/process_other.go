@@ -0,0 +1,10 @@
+// +build !linux
+
+package qemu
+
+// The QEMU backend is supported only on Linux. This file creates a placeholder
+// for processExists()
+
+func processExists(pid int) bool {
+	return false
+}
@@ -0,0 +1,349 @@
+package qemu
+
+// Package qemu runs the exam server VM with QEMU/KVM using qemu-img and
+// qemu-system-x86_64. As QEMU does not have a VM registry of its own the VM
+// settings are stored to ~/ktp/qemu/<vm name>/vm.json.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"naksu/log"
+	"naksu/mebroutines"
+)
+
+const (
+	vmConfigFilename = "vm.json"
+	pidFilename      = "qemu.pid"
+	monitorFilename  = "qmp.sock"
+	logFilename      = "qemu.log"
+)
+
+// ovmfPaths lists known locations of the OVMF EFI firmware in Linux distributions
+var ovmfPaths = []string{
+	"/usr/share/OVMF/OVMF_CODE.fd",
+	"/usr/share/ovmf/OVMF.fd",
+	"/usr/share/edk2/ovmf/OVMF_CODE.fd",
+	"/usr/share/qemu/OVMF.fd",
+}
+
+// nicModels maps VirtualBox network hardware names (see constants.AvailableNics)
+// to the corresponding QEMU device models
+var nicModels = map[string]string{
+	"virtio":    "virtio-net-pci",
+	"Am79C970A": "pcnet",
+	"Am79C973":  "pcnet",
+	"82540EM":   "e1000",
+	"82543GC":   "e1000",
+	"82545EM":   "e1000",
+}
+
+// VMConfig holds the settings of a QEMU VM
+type VMConfig struct {
+	Name             string            `json:"name"`
+	CPUs             int               `json:"cpus"`
+	MemoryMB         uint64            `json:"memoryMB"`
+	VRamMB           int               `json:"vramMB"`
+	DiskPath         string            `json:"diskPath"`
+	SharedFolderName string            `json:"sharedFolderName"`
+	SharedFolderPath string            `json:"sharedFolderPath"`
+	Properties       map[string]string `json:"properties"`
+}
+
+func getQemuImgPath() string {
+	var path = "qemu-img"
+	if os.Getenv("QEMUIMGPATH") != "" {
+		path = os.Getenv("QEMUIMGPATH")
+	}
+
+	return path
+}
+
+func getQemuSystemPath() string {
+	var path = "qemu-system-x86_64"
+	if os.Getenv("QEMUSYSTEMPATH") != "" {
+		path = os.Getenv("QEMUSYSTEMPATH")
+	}
+
+	return path
+}
+
+// IsInstalled returns true if both qemu-img and qemu-system-x86_64 can be executed
+func IsInstalled() bool {
+	for _, path := range []string{getQemuImgPath(), getQemuSystemPath()} {
+		output, err := mebroutines.RunAndGetOutput([]string{path, "--version"}, false)
+		if err != nil {
+			log.Debug(fmt.Sprintf("Could not execute %s: %v", path, err))
+			return false
+		}
+		log.Debug(fmt.Sprintf("%s version: %s", path, strings.TrimSpace(output)))
+	}
+
+	return true
+}
+
+// RunImgCommand runs qemu-img with the given arguments
+func RunImgCommand(args []string) (string, error) {
+	return runImgCommand(args, nil)
+}
+
+// RunImgCommandWithProgress executes qemu-img and calls progressCallbackFn with the
+// percentage printed by qemu-img while the command is running. The arguments must
+// contain the option "-p" to make qemu-img print its progress.
+func RunImgCommandWithProgress(args []string, progressCallbackFn func(int)) (string, error) {
+	return runImgCommand(args, mebroutines.NewPercentageWriter(progressCallbackFn))
+}
+
+func runImgCommand(args []string, progressWriter io.Writer) (string, error) {
+	output, err := mebroutines.RunAndGetOutputWithWriter(append([]string{getQemuImgPath()}, args...), nil, progressWriter, true)
+	if err != nil {
+		return output, fmt.Errorf("failed to execute qemu-img %s: %v", strings.Join(args, " "), err)
+	}
+
+	return output, nil
+}
+
+// GetVMDirectory returns the directory holding settings, logs and runtime files of the given VM
+func GetVMDirectory(vmName string) string {
+	return filepath.Join(mebroutines.GetKtpDirectory(), "qemu", vmName)
+}
+
+// SaveVMConfig writes the VM settings, creating the VM directory if needed
+func SaveVMConfig(vmConfig VMConfig) error {
+	vmDirectory := GetVMDirectory(vmConfig.Name)
+	err := os.MkdirAll(vmDirectory, 0700)
+	if err != nil {
+		return fmt.Errorf("could not create vm directory %s: %v", vmDirectory, err)
+	}
+
+	content, err := json.MarshalIndent(vmConfig, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode vm settings: %v", err)
+	}
+
+	return ioutil.WriteFile(filepath.Join(vmDirectory, vmConfigFilename), content, 0600)
+}
+
+// LoadVMConfig reads the VM settings. The returned error satisfies os.IsNotExist()
+// if the VM has not been created.
+func LoadVMConfig(vmName string) (VMConfig, error) {
+	var vmConfig VMConfig
+
+	content, err := ioutil.ReadFile(filepath.Join(GetVMDirectory(vmName), vmConfigFilename))
+	if err != nil {
+		return vmConfig, err
+	}
+
+	err = json.Unmarshal(content, &vmConfig)
+	if err != nil {
+		return vmConfig, fmt.Errorf("could not parse settings of vm %s: %v", vmName, err)
+	}
+
+	return vmConfig, nil
+}
+
+// ListVMs returns the names of all VMs created by Naksu
+func ListVMs() ([]string, error) {
+	vmsDirectory := filepath.Join(mebroutines.GetKtpDirectory(), "qemu")
+	if !mebroutines.ExistsDir(vmsDirectory) {
+		return []string{}, nil
+	}
+
+	files, err := ioutil.ReadDir(vmsDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("could not read vm directory %s: %v", vmsDirectory, err)
+	}
+
+	vmNames := []string{}
+	for _, file := range files {
+		if file.IsDir() && mebroutines.ExistsFile(filepath.Join(vmsDirectory, file.Name(), vmConfigFilename)) {
+			vmNames = append(vmNames, file.Name())
+		}
+	}
+
+	return vmNames, nil
+}
+
+// RemoveVM deletes the VM directory and the disk image
+func RemoveVM(vmName string) error {
+	vmConfig, err := LoadVMConfig(vmName)
+	if err != nil {
+		return err
+	}
+
+	if vmConfig.DiskPath != "" && mebroutines.ExistsFile(vmConfig.DiskPath) {
+		err = os.Remove(vmConfig.DiskPath)
+		if err != nil {
+			return fmt.Errorf("could not remove disk image %s: %v", vmConfig.DiskPath, err)
+		}
+	}
+
+	return os.RemoveAll(GetVMDirectory(vmName))
+}
+
+func getFirmwarePath() (string, error) {
+	for _, ovmfPath := range ovmfPaths {
+		if mebroutines.ExistsFile(ovmfPath) {
+			return ovmfPath, nil
+		}
+	}
+
+	return "", errors.New("could not find ovmf efi firmware, please install ovmf package")
+}
+
+// StartVM starts the VM in the background. hostBridge is the name of the host
+// bridge device (e.g. br0) the VM is connected to.
+func StartVM(vmName string, hostBridge string, nicType string) error {
+	vmConfig, err := LoadVMConfig(vmName)
+	if err != nil {
+		return fmt.Errorf("could not read settings of vm %s: %v", vmName, err)
+	}
+
+	firmwarePath, err := getFirmwarePath()
+	if err != nil {
+		return err
+	}
+
+	nicModel, ok := nicModels[nicType]
+	if !ok {
+		nicModel = nicModels["virtio"]
+	}
+
+	vmDirectory := GetVMDirectory(vmName)
+	pidPath := filepath.Join(vmDirectory, pidFilename)
+	monitorPath := filepath.Join(vmDirectory, monitorFilename)
+
+	// Remove leftovers from the previous run
+	for _, runtimeFile := range []string{pidPath, monitorPath} {
+		if mebroutines.ExistsFile(runtimeFile) {
+			_ = os.Remove(runtimeFile) // #nosec
+		}
+	}
+
+	args := []string{
+		"-name", vmName,
+		"-machine", "q35,accel=kvm",
+		"-cpu", "host",
+		"-smp", strconv.Itoa(vmConfig.CPUs),
+		"-m", strconv.FormatUint(vmConfig.MemoryMB, 10),
+		"-bios", firmwarePath,
+		"-device", "ahci,id=ahci",
+		"-drive", fmt.Sprintf("id=disk0,if=none,format=qcow2,file=%s", vmConfig.DiskPath),
+		"-device", "ide-hd,drive=disk0,bus=ahci.0",
+		"-netdev", fmt.Sprintf("bridge,id=net0,br=%s", hostBridge),
+		"-device", fmt.Sprintf("%s,netdev=net0", nicModel),
+		"-vga", "std",
+		"-qmp", fmt.Sprintf("unix:%s,server,nowait", monitorPath),
+		"-pidfile", pidPath,
+		"-D", filepath.Join(vmDirectory, logFilename),
+	}
+
+	if vmConfig.SharedFolderPath != "" {
+		args = append(args, "-virtfs", fmt.Sprintf("local,path=%s,mount_tag=%s,security_model=mapped-xattr", vmConfig.SharedFolderPath, vmConfig.SharedFolderName))
+	}
+
+	log.Debug(fmt.Sprintf("Starting QEMU: %s %s", getQemuSystemPath(), strings.Join(args, " ")))
+
+	/* #nosec */
+	cmd := exec.Command(getQemuSystemPath(), args...)
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("could not start qemu: %v", err)
+	}
+
+	// Reap the process when it exits so that IsRunning() does not see a zombie process
+	go func() {
+		waitErr := cmd.Wait()
+		log.Debug(fmt.Sprintf("QEMU process of vm %s exited: %v", vmName, waitErr))
+	}()
+
+	return nil
+}
+
+// IsRunning returns true if the QEMU process of the VM is alive
+func IsRunning(vmName string) bool {
+	content, err := ioutil.ReadFile(filepath.Join(GetVMDirectory(vmName), pidFilename))
+	if err != nil {
+		return false
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		log.Debug(fmt.Sprintf("QEMU pid file of vm %s is malformed: %v", vmName, err))
+		return false
+	}
+
+	return processExists(pid)
+}
+
+// GetLogDirectory returns the directory containing the QEMU log of the VM
+func GetLogDirectory(vmName string) string {
+	return GetVMDirectory(vmName)
+}
+
+// GetActualDiskSize returns the size of the disk image on disk in bytes
+func GetActualDiskSize(diskPath string) (uint64, error) {
+	output, err := RunImgCommand([]string{"info", "--output=json", diskPath})
+	if err != nil {
+		return 0, err
+	}
+
+	var info struct {
+		ActualSize uint64 `json:"actual-size"`
+	}
+
+	err = json.Unmarshal([]byte(output), &info)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse qemu-img info output: %v", err)
+	}
+
+	return info.ActualSize, nil
+}
+
+// Snapshot is an internal snapshot of a qcow2 disk image
+type Snapshot struct {
+	Name    string
+	Created time.Time
+}
+
+// ListSnapshots returns the internal snapshots of the disk image
+func ListSnapshots(diskPath string) ([]Snapshot, error) {
+	output, err := RunImgCommand([]string{"info", "--output=json", diskPath})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSnapshots(output)
+}
+
+// parseSnapshots returns the snapshots listed in the output of "qemu-img info --output=json"
+func parseSnapshots(output string) ([]Snapshot, error) {
+	var info struct {
+		Snapshots []struct {
+			Name     string `json:"name"`
+			DateSec  int64  `json:"date-sec"`
+			DateNsec int64  `json:"date-nsec"`
+		} `json:"snapshots"`
+	}
+
+	err := json.Unmarshal([]byte(output), &info)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse qemu-img info output: %v", err)
+	}
+
+	snapshots := []Snapshot{}
+	for _, snapshot := range info.Snapshots {
+		snapshots = append(snapshots, Snapshot{Name: snapshot.Name, Created: time.Unix(snapshot.DateSec, snapshot.DateNsec)})
+	}
+
+	return snapshots, nil
+}
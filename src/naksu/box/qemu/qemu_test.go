@@ -0,0 +1,57 @@
+package qemu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSnapshots(t *testing.T) {
+	output := `{
+    "snapshots": [
+        {
+            "icount": 0,
+            "vm-clock-nsec": 0,
+            "name": "Installed",
+            "date-sec": 1622548800,
+            "date-nsec": 0,
+            "vm-clock-sec": 0,
+            "id": "1",
+            "vm-state-size": 0
+        },
+        {
+            "name": "after exam prep 2021-06-02",
+            "date-sec": 1622622600,
+            "date-nsec": 500,
+            "id": "2",
+            "vm-state-size": 0
+        }
+    ],
+    "virtual-size": 64424509440,
+    "filename": "/home/teacher/ktp/qemu/NaksuAbittiKTP/disk.qcow2",
+    "format": "qcow2",
+    "actual-size": 5368709120
+}`
+
+	snapshots, err := parseSnapshots(output)
+	if err != nil {
+		t.Fatalf("parseSnapshots failed: %v", err)
+	}
+
+	if len(snapshots) != 2 || snapshots[0].Name != "Installed" || snapshots[1].Name != "after exam prep 2021-06-02" {
+		t.Fatalf("parseSnapshots gives unexpected snapshots: %v", snapshots)
+	}
+
+	if !snapshots[1].Created.Equal(time.Unix(1622622600, 500)) {
+		t.Errorf("parseSnapshots gives time %v for the second snapshot", snapshots[1].Created)
+	}
+
+	snapshots, err = parseSnapshots(`{"virtual-size": 64424509440, "format": "qcow2"}`)
+	if err != nil || len(snapshots) != 0 {
+		t.Errorf("parseSnapshots of a disk without snapshots gives %v, %v", snapshots, err)
+	}
+
+	_, err = parseSnapshots("qemu-img: Could not open 'disk.qcow2'")
+	if err == nil {
+		t.Errorf("parseSnapshots accepts malformed output")
+	}
+}
@@ -0,0 +1,100 @@
+package qemu
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"naksu/log"
+)
+
+const qmpTimeout = 10 * time.Second
+
+type qmpCommand struct {
+	Execute string `json:"execute"`
+}
+
+type qmpResponse struct {
+	Return *json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+// SendMonitorCommand sends the given QMP command (e.g. "system_powerdown" or "quit")
+// to the running VM
+func SendMonitorCommand(vmName string, command string) error {
+	monitorPath := filepath.Join(GetVMDirectory(vmName), monitorFilename)
+
+	conn, err := net.DialTimeout("unix", monitorPath, qmpTimeout)
+	if err != nil {
+		return fmt.Errorf("could not connect to qemu monitor %s: %v", monitorPath, err)
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(qmpTimeout))
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	// The server greets with its capabilities
+	_, err = reader.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("could not read qemu monitor greeting: %v", err)
+	}
+
+	for _, execute := range []string{"qmp_capabilities", command} {
+		err = sendQMPCommand(conn, reader, execute)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Debug(fmt.Sprintf("Sent QEMU monitor command '%s' to vm %s", command, vmName))
+
+	return nil
+}
+
+func sendQMPCommand(conn net.Conn, reader *bufio.Reader, execute string) error {
+	request, err := json.Marshal(qmpCommand{Execute: execute})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append(request, '\n'))
+	if err != nil {
+		return fmt.Errorf("could not send qemu monitor command %s: %v", execute, err)
+	}
+
+	// Skip asynchronous events until we get the response to our command
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// The connection is closed when "quit" has been executed
+			if execute == "quit" {
+				return nil
+			}
+			return fmt.Errorf("could not read qemu monitor response to %s: %v", execute, err)
+		}
+
+		var response qmpResponse
+		err = json.Unmarshal(line, &response)
+		if err != nil {
+			return fmt.Errorf("could not parse qemu monitor response: %v", err)
+		}
+
+		if response.Error != nil {
+			return fmt.Errorf("qemu monitor command %s failed: %s: %s", execute, response.Error.Class, response.Error.Desc)
+		}
+
+		if response.Return != nil {
+			return nil
+		}
+	}
+}
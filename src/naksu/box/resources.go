@@ -0,0 +1,191 @@
+package box
+
+import (
+	"errors"
+	"fmt"
+
+	"naksu/config"
+	"naksu/host"
+)
+
+const (
+	minBoxCPUs = 2
+	// minBoxMemory is the memory calculated by calculateBoxMemory() for a host with 8 GB of RAM
+	minBoxMemory = 5304
+	// hostReservedMemory is the memory (in megs) left for the host and its other applications
+	hostReservedMemory = 1024
+	minBoxVRamSize     = 16
+	maxBoxVRamSize     = 256
+	minBoxDiskSizeGB   = boxFinalImageSize / 1024
+	maxBoxDiskSizeGB   = 1024
+)
+
+// Resources are the hardware settings of the VM (see config.GetVMCPUs() etc.)
+type Resources struct {
+	CPUs     int
+	MemoryMB uint64
+	VRamMB   int
+	// DiskSizeGB is used only when a new VM is created. The disk of an existing VM is not resized.
+	DiskSizeGB uint64
+}
+
+// ResourceLimits are the allowed ranges of the VM settings on this host
+type ResourceLimits struct {
+	MinCPUs       int
+	MaxCPUs       int
+	MinMemoryMB   uint64
+	MaxMemoryMB   uint64
+	MinVRamMB     int
+	MaxVRamMB     int
+	MinDiskSizeGB uint64
+	MaxDiskSizeGB uint64
+}
+
+// GetResourceLimits returns the allowed ranges of the VM settings on this host
+func GetResourceLimits() (ResourceLimits, error) {
+	hostCores, err := host.GetCPUCoreCount()
+	if err != nil {
+		return ResourceLimits{}, fmt.Errorf("could not read cpu core count: %v", err)
+	}
+
+	hostMemory, err := host.GetMemory()
+	if err != nil {
+		return ResourceLimits{}, fmt.Errorf("could not read system memory: %v", err)
+	}
+
+	return newResourceLimits(hostCores, hostMemory), nil
+}
+
+// newResourceLimits returns the limits for a host with the given CPU cores and
+// memory (in megs)
+func newResourceLimits(hostCores int, hostMemory uint64) ResourceLimits {
+	limits := ResourceLimits{
+		MinCPUs:       minBoxCPUs,
+		MaxCPUs:       hostCores,
+		MinMemoryMB:   minBoxMemory,
+		MinVRamMB:     minBoxVRamSize,
+		MaxVRamMB:     maxBoxVRamSize,
+		MinDiskSizeGB: minBoxDiskSizeGB,
+		MaxDiskSizeGB: maxBoxDiskSizeGB,
+	}
+
+	// calculateBoxCPUs() gives at least two CPUs even for smaller hosts
+	if limits.MaxCPUs < minBoxCPUs {
+		limits.MaxCPUs = minBoxCPUs
+	}
+
+	if hostMemory > hostReservedMemory {
+		limits.MaxMemoryMB = hostMemory - hostReservedMemory
+	}
+
+	return limits
+}
+
+// Validate returns an error if the resources are not within the limits
+func (limits ResourceLimits) Validate(resources Resources) error {
+	if resources.CPUs < limits.MinCPUs || resources.CPUs > limits.MaxCPUs {
+		return fmt.Errorf("cpu count %d is not between %d and %d", resources.CPUs, limits.MinCPUs, limits.MaxCPUs)
+	}
+
+	if limits.MaxMemoryMB < limits.MinMemoryMB {
+		return fmt.Errorf("the computer does not have enough memory for the server, at least %d MB is needed", limits.MinMemoryMB+hostReservedMemory)
+	}
+
+	if resources.MemoryMB < limits.MinMemoryMB || resources.MemoryMB > limits.MaxMemoryMB {
+		return fmt.Errorf("memory size %d MB is not between %d MB and %d MB", resources.MemoryMB, limits.MinMemoryMB, limits.MaxMemoryMB)
+	}
+
+	if resources.VRamMB < limits.MinVRamMB || resources.VRamMB > limits.MaxVRamMB {
+		return fmt.Errorf("video memory size %d MB is not between %d MB and %d MB", resources.VRamMB, limits.MinVRamMB, limits.MaxVRamMB)
+	}
+
+	if resources.DiskSizeGB < limits.MinDiskSizeGB || resources.DiskSizeGB > limits.MaxDiskSizeGB {
+		return fmt.Errorf("disk size %d GB is not between %d GB and %d GB", resources.DiskSizeGB, limits.MinDiskSizeGB, limits.MaxDiskSizeGB)
+	}
+
+	return nil
+}
+
+// GetResources returns the VM settings from the configuration. CPU count and memory
+// are calculated from the host resources if they have not been set.
+func GetResources() (Resources, error) {
+	resources, err := getValidatedResources(Resources{
+		CPUs:       int(config.GetVMCPUs()),
+		MemoryMB:   config.GetVMMemoryMB(),
+		VRamMB:     int(config.GetVMVRamMB()),
+		DiskSizeGB: config.GetVMDiskSizeGB(),
+	})
+	if err != nil {
+		return Resources{}, fmt.Errorf("invalid vm settings in naksu.ini: %v", err)
+	}
+
+	return resources, nil
+}
+
+// SetResources validates the VM settings and stores them to the configuration. Zero
+// CPU count or memory means that the value is calculated from the host resources.
+func SetResources(resources Resources) error {
+	_, err := getValidatedResources(resources)
+	if err != nil {
+		return err
+	}
+
+	config.SetVMCPUs(uint64(resources.CPUs))
+	config.SetVMMemoryMB(resources.MemoryMB)
+	config.SetVMVRamMB(uint64(resources.VRamMB))
+	config.SetVMDiskSizeGB(resources.DiskSizeGB)
+
+	return nil
+}
+
+// getValidatedResources replaces zero CPU count and memory with the values calculated
+// from the host resources and checks the result against the limits of this host
+func getValidatedResources(resources Resources) (Resources, error) {
+	var err error
+
+	if resources.CPUs == 0 {
+		resources.CPUs, err = calculateBoxCPUs()
+		if err != nil {
+			return Resources{}, err
+		}
+	}
+
+	if resources.MemoryMB == 0 {
+		resources.MemoryMB, err = calculateBoxMemory()
+		if err != nil {
+			return Resources{}, err
+		}
+	}
+
+	limits, err := GetResourceLimits()
+	if err != nil {
+		return Resources{}, err
+	}
+
+	err = limits.Validate(resources)
+	if err != nil {
+		return Resources{}, err
+	}
+
+	return resources, nil
+}
+
+// ApplyResources changes the CPU count, memory and video memory of the stopped active VM
+// to match the configuration
+func ApplyResources() error {
+	isRunning, err := Running()
+	if err != nil {
+		return fmt.Errorf("could not detect whether vm is running: %v", err)
+	}
+
+	if isRunning {
+		return errors.New("the vm is running, please stop it first")
+	}
+
+	resources, err := GetResources()
+	if err != nil {
+		return err
+	}
+
+	return getHypervisor().ModifyVM(getActiveBoxName(), resources)
+}
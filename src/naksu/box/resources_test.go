@@ -0,0 +1,45 @@
+package box
+
+import "testing"
+
+func TestNewResourceLimits(t *testing.T) {
+	limits := newResourceLimits(8, 16384)
+	if limits.MaxCPUs != 8 || limits.MaxMemoryMB != 16384-hostReservedMemory {
+		t.Errorf("newResourceLimits gives unexpected limits: %+v", limits)
+	}
+
+	limits = newResourceLimits(1, 512)
+	if limits.MaxCPUs != minBoxCPUs || limits.MaxMemoryMB != 0 {
+		t.Errorf("newResourceLimits for a small host gives unexpected limits: %+v", limits)
+	}
+}
+
+func TestValidateResources(t *testing.T) {
+	limits := newResourceLimits(8, 16384)
+
+	tables := []struct {
+		resources Resources
+		isError   bool
+	}{
+		{Resources{CPUs: 4, MemoryMB: 8192, VRamMB: 24, DiskSizeGB: 55}, false},
+		{Resources{CPUs: 8, MemoryMB: 15360, VRamMB: 256, DiskSizeGB: 1024}, false},
+		{Resources{CPUs: 1, MemoryMB: 8192, VRamMB: 24, DiskSizeGB: 55}, true},
+		{Resources{CPUs: 9, MemoryMB: 8192, VRamMB: 24, DiskSizeGB: 55}, true},
+		{Resources{CPUs: 4, MemoryMB: 4096, VRamMB: 24, DiskSizeGB: 55}, true},
+		{Resources{CPUs: 4, MemoryMB: 16384, VRamMB: 24, DiskSizeGB: 55}, true},
+		{Resources{CPUs: 4, MemoryMB: 8192, VRamMB: 8, DiskSizeGB: 55}, true},
+		{Resources{CPUs: 4, MemoryMB: 8192, VRamMB: 24, DiskSizeGB: 20}, true},
+	}
+
+	for _, table := range tables {
+		err := limits.Validate(table.resources)
+		if (err != nil) != table.isError {
+			t.Errorf("Validate(%+v) gives error %v", table.resources, err)
+		}
+	}
+
+	err := newResourceLimits(4, 4096).Validate(Resources{CPUs: 2, MemoryMB: 3072, VRamMB: 24, DiskSizeGB: 55})
+	if err == nil {
+		t.Errorf("Validate accepts a host without enough memory")
+	}
+}
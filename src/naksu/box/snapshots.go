@@ -0,0 +1,127 @@
+package box
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// maxSnapshotNameLength limits the length of the snapshot names given by the user
+const maxSnapshotNameLength = 100
+
+// ListSnapshots returns the snapshots of the active VM, oldest first
+func ListSnapshots() ([]Snapshot, error) {
+	snapshots, err := getHypervisor().ListSnapshots(getActiveBoxName())
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.Before(snapshots[j].Created)
+	})
+
+	return snapshots, nil
+}
+
+// IsInstalledSnapshot returns true if the snapshot is the one taken just after the install.
+// It is used by RestoreSnapshot() and it cannot be deleted.
+func IsInstalledSnapshot(snapshotName string) bool {
+	return snapshotName == boxSnapshotName
+}
+
+// TakeSnapshot takes a snapshot of the stopped active VM with the given name
+func TakeSnapshot(snapshotName string) error {
+	err := checkSnapshotName(snapshotName)
+	if err != nil {
+		return err
+	}
+
+	exists, err := snapshotExists(snapshotName)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return fmt.Errorf("snapshot '%s' already exists", snapshotName)
+	}
+
+	return getHypervisor().TakeSnapshot(getActiveBoxName(), snapshotName)
+}
+
+// RestoreSnapshotByName returns the stopped active VM to the given snapshot
+func RestoreSnapshotByName(snapshotName string) error {
+	err := ensureSnapshotExists(snapshotName)
+	if err != nil {
+		return err
+	}
+
+	return getHypervisor().RestoreSnapshot(getActiveBoxName(), snapshotName)
+}
+
+// DeleteSnapshot deletes the given snapshot of the stopped active VM. The snapshot
+// taken just after the install cannot be deleted.
+func DeleteSnapshot(snapshotName string) error {
+	if IsInstalledSnapshot(snapshotName) {
+		return fmt.Errorf("snapshot '%s' is needed for removing exams and it cannot be deleted", snapshotName)
+	}
+
+	err := ensureSnapshotExists(snapshotName)
+	if err != nil {
+		return err
+	}
+
+	return getHypervisor().DeleteSnapshot(getActiveBoxName(), snapshotName)
+}
+
+// checkSnapshotName returns an error if the name cannot be used for a new snapshot
+func checkSnapshotName(snapshotName string) error {
+	if strings.TrimSpace(snapshotName) != snapshotName {
+		return errors.New("snapshot name cannot start or end with a space")
+	}
+
+	if snapshotName == "" {
+		return errors.New("snapshot name cannot be empty")
+	}
+
+	if len(snapshotName) > maxSnapshotNameLength {
+		return fmt.Errorf("snapshot name cannot be longer than %d characters", maxSnapshotNameLength)
+	}
+
+	for _, char := range snapshotName {
+		if unicode.IsControl(char) {
+			return errors.New("snapshot name cannot contain control characters")
+		}
+	}
+
+	return nil
+}
+
+func snapshotExists(snapshotName string) (bool, error) {
+	snapshots, err := ListSnapshots()
+	if err != nil {
+		return false, fmt.Errorf("could not list snapshots: %v", err)
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.Name == snapshotName {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func ensureSnapshotExists(snapshotName string) error {
+	exists, err := snapshotExists(snapshotName)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return fmt.Errorf("snapshot '%s' does not exist", snapshotName)
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package box
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSnapshotName(t *testing.T) {
+	tables := []struct {
+		name    string
+		isError bool
+	}{
+		{"after exam prep 2026-10-16", false},
+		{"Ennen koetta ÅÄÖ", false},
+		{"", true},
+		{" leading space", true},
+		{"trailing space ", true},
+		{"line\nbreak", true},
+		{strings.Repeat("x", maxSnapshotNameLength+1), true},
+	}
+
+	for _, table := range tables {
+		err := checkSnapshotName(table.name)
+		if (err != nil) != table.isError {
+			t.Errorf("checkSnapshotName(%q) gives error %v", table.name, err)
+		}
+	}
+}
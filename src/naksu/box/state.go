@@ -0,0 +1,280 @@
+package box
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"naksu/config"
+	"naksu/log"
+)
+
+const (
+	// vmStatePollInterval is the time between the state checks when waiting for the VM to stop
+	vmStatePollInterval = 2 * time.Second
+	// vmPowerOffTimeout is the time to wait for the VM to stop after a forced power off
+	vmPowerOffTimeout = 30 * time.Second
+)
+
+// VMState is the state of the VM. The states follow the machine states of VirtualBox
+// (see VBoxManage showvminfo --machinereadable). Other backends use a subset of them.
+type VMState int
+
+// The machine states of VirtualBox
+const (
+	VMStateUnknown VMState = iota
+	VMStateNotInstalled
+	VMStatePoweredOff
+	VMStateSaved
+	VMStateTeleported
+	VMStateAborted
+	VMStateAbortedSaved
+	VMStateRunning
+	VMStatePaused
+	VMStateStuck
+	VMStateTeleporting
+	VMStateLiveSnapshotting
+	VMStateStarting
+	VMStateStopping
+	VMStateSaving
+	VMStateRestoring
+	VMStateTeleportingPausedVM
+	VMStateTeleportingIn
+	VMStateDeletingSnapshotOnline
+	VMStateDeletingSnapshotPaused
+	VMStateOnlineSnapshotting
+	VMStateRestoringSnapshot
+	VMStateDeletingSnapshot
+	VMStateSettingUp
+	VMStateSnapshotting
+	VMStateFaultTolerantSyncing
+)
+
+// vmStateNames maps the VMState values of VBoxManage to states
+var vmStateNames = map[string]VMState{
+	"poweroff":                   VMStatePoweredOff,
+	"saved":                      VMStateSaved,
+	"teleported":                 VMStateTeleported,
+	"aborted":                    VMStateAborted,
+	"abortedsaved":               VMStateAbortedSaved,
+	"running":                    VMStateRunning,
+	"paused":                     VMStatePaused,
+	"gurumeditation":             VMStateStuck,
+	"stuck":                      VMStateStuck,
+	"teleporting":                VMStateTeleporting,
+	"livesnapshotting":           VMStateLiveSnapshotting,
+	"starting":                   VMStateStarting,
+	"stopping":                   VMStateStopping,
+	"saving":                     VMStateSaving,
+	"restoring":                  VMStateRestoring,
+	"teleportingpausedvm":        VMStateTeleportingPausedVM,
+	"teleportingin":              VMStateTeleportingIn,
+	"deletingsnapshotlive":       VMStateDeletingSnapshotOnline,
+	"deletingsnapshotlivepaused": VMStateDeletingSnapshotPaused,
+	"onlinesnapshotting":         VMStateOnlineSnapshotting,
+	"restoringsnapshot":          VMStateRestoringSnapshot,
+	"deletingsnapshot":           VMStateDeletingSnapshot,
+	"settingup":                  VMStateSettingUp,
+	"snapshotting":               VMStateSnapshotting,
+	"faulttolerantsyncing":       VMStateFaultTolerantSyncing,
+}
+
+// ParseVMState returns the state matching the VMState value of VBoxManage. An empty
+// value means that the VM is not installed. Unknown values give VMStateUnknown.
+func ParseVMState(name string) VMState {
+	if name == "" {
+		return VMStateNotInstalled
+	}
+
+	state, ok := vmStateNames[name]
+	if !ok {
+		return VMStateUnknown
+	}
+
+	return state
+}
+
+func (state VMState) String() string {
+	switch state {
+	case VMStateUnknown:
+		return "unknown"
+	case VMStateNotInstalled:
+		return "not installed"
+	case VMStateStuck:
+		return "gurumeditation"
+	}
+
+	for name, namedState := range vmStateNames {
+		if namedState == state {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("VMState(%d)", int(state))
+}
+
+// IsRunning returns true if the VM process is active, i.e. the VM is not powered
+// off, saved or aborted. Paused and stuck VMs are running. Unknown states are
+// treated as running so that the VM is not modified while it may be active.
+func (state VMState) IsRunning() bool {
+	switch state {
+	case VMStateNotInstalled, VMStatePoweredOff, VMStateSaved, VMStateTeleported, VMStateAborted, VMStateAbortedSaved:
+		return false
+	default:
+		return true
+	}
+}
+
+// HasSavedState returns true if the VM has a saved state which is resumed when the
+// VM is started. The settings of the VM cannot be changed before it is discarded.
+func (state VMState) HasSavedState() bool {
+	return state == VMStateSaved || state == VMStateAbortedSaved
+}
+
+// NeedsPowerOff returns true if the VM is paused or stuck so that it cannot be shut
+// down gracefully
+func (state VMState) NeedsPowerOff() bool {
+	return state == VMStatePaused || state == VMStateStuck
+}
+
+// lastState is the state seen by StartEnvironmentStatusUpdate(), see GetLastState()
+var lastState = VMStateUnknown
+var lastStateMutex sync.Mutex
+
+// GetLastState returns the state of the active VM seen by the latest update of
+// StartEnvironmentStatusUpdate()
+func GetLastState() VMState {
+	lastStateMutex.Lock()
+	defer lastStateMutex.Unlock()
+
+	return lastState
+}
+
+func setLastState(state VMState) {
+	lastStateMutex.Lock()
+	defer lastStateMutex.Unlock()
+
+	lastState = state
+}
+
+// GetState returns the state of the active VM
+func GetState() (VMState, error) {
+	state, err := getHypervisor().GetState(getActiveBoxName())
+	if err != nil {
+		log.Debug(fmt.Sprintf("box.GetState() could not get VM state: %v", err))
+	}
+
+	return state, err
+}
+
+// IsGuestReady returns true if the guest of the active VM has set the guest property
+// given by config.GetSupervisorReadyProperty()
+func IsGuestReady() (bool, error) {
+	value, err := getHypervisor().GetGuestProperty(getActiveBoxName(), config.GetSupervisorReadyProperty())
+	if err != nil {
+		return false, err
+	}
+
+	return value != "", nil
+}
+
+// ShutdownCurrentBox asks the guest of the active VM to shut down (ACPI power button)
+// and waits until the VM has stopped. If the VM is still running after the timeout
+// it is powered off.
+func ShutdownCurrentBox(timeout time.Duration) error {
+	hypervisor := getHypervisor()
+	name := getActiveBoxName()
+
+	state, err := hypervisor.GetState(name)
+	if err != nil {
+		return err
+	}
+
+	if !state.IsRunning() {
+		return errors.New("the vm is not running")
+	}
+
+	if state.NeedsPowerOff() {
+		log.Debug(fmt.Sprintf("VM %s is %s and it cannot be shut down gracefully, powering it off", name, state))
+		return PowerOffCurrentBox()
+	}
+
+	log.Debug(fmt.Sprintf("Shutting down VM %s", name))
+	err = hypervisor.StopVM(name, false)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not send shutdown request to VM %s: %v", name, err))
+	} else {
+		stopped, err := waitUntilStopped(name, timeout)
+		if err != nil {
+			return err
+		}
+
+		if stopped {
+			return nil
+		}
+
+		log.Debug(fmt.Sprintf("VM %s did not shut down in %v", name, timeout))
+	}
+
+	return PowerOffCurrentBox()
+}
+
+// PowerOffCurrentBox powers off the active VM without shutting down the guest
+func PowerOffCurrentBox() error {
+	log.Debug(fmt.Sprintf("Powering off VM %s", getActiveBoxName()))
+	err := getHypervisor().StopVM(getActiveBoxName(), true)
+	if err != nil {
+		return err
+	}
+
+	stopped, err := waitUntilStopped(getActiveBoxName(), vmPowerOffTimeout)
+	if err != nil {
+		return err
+	}
+
+	if !stopped {
+		return fmt.Errorf("the vm did not power off in %v", vmPowerOffTimeout)
+	}
+
+	return nil
+}
+
+// DiscardSavedState discards the saved state of the active VM so that it boots
+// normally when it is started next time
+func DiscardSavedState() error {
+	state, err := GetState()
+	if err != nil {
+		return err
+	}
+
+	if !state.HasSavedState() {
+		return fmt.Errorf("the vm does not have a saved state (state is %s)", state)
+	}
+
+	return getHypervisor().DiscardSavedState(getActiveBoxName())
+}
+
+// waitUntilStopped polls the state of the VM until it is not running or the timeout
+// has passed. Returns true if the VM stopped.
+func waitUntilStopped(vmName string, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		state, err := getHypervisor().GetState(vmName)
+		if err != nil {
+			return false, err
+		}
+
+		if !state.IsRunning() {
+			log.Debug(fmt.Sprintf("VM %s stopped, state is %s", vmName, state))
+			return true, nil
+		}
+
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+
+		time.Sleep(vmStatePollInterval)
+	}
+}
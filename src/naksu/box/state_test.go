@@ -0,0 +1,60 @@
+package box
+
+import (
+	"testing"
+)
+
+func TestParseVMState(t *testing.T) {
+	tables := []struct {
+		name          string
+		state         VMState
+		isRunning     bool
+		hasSavedState bool
+		needsPowerOff bool
+	}{
+		{"", VMStateNotInstalled, false, false, false},
+		{"poweroff", VMStatePoweredOff, false, false, false},
+		{"running", VMStateRunning, true, false, false},
+		{"paused", VMStatePaused, true, false, true},
+		{"saved", VMStateSaved, false, true, false},
+		{"abortedsaved", VMStateAbortedSaved, false, true, false},
+		{"aborted", VMStateAborted, false, false, false},
+		{"gurumeditation", VMStateStuck, true, false, true},
+		{"stuck", VMStateStuck, true, false, true},
+		{"stopping", VMStateStopping, true, false, false},
+		{"restoringsnapshot", VMStateRestoringSnapshot, true, false, false},
+		{"deletingsnapshotlivepaused", VMStateDeletingSnapshotPaused, true, false, false},
+		{"somethingnew", VMStateUnknown, true, false, false},
+	}
+
+	for _, table := range tables {
+		state := ParseVMState(table.name)
+		if state != table.state {
+			t.Errorf("ParseVMState(%q) gives %v instead of %v", table.name, state, table.state)
+		}
+
+		if state.IsRunning() != table.isRunning {
+			t.Errorf("%v.IsRunning() gives %v", state, state.IsRunning())
+		}
+
+		if state.HasSavedState() != table.hasSavedState {
+			t.Errorf("%v.HasSavedState() gives %v", state, state.HasSavedState())
+		}
+
+		if state.NeedsPowerOff() != table.needsPowerOff {
+			t.Errorf("%v.NeedsPowerOff() gives %v", state, state.NeedsPowerOff())
+		}
+	}
+}
+
+func TestVMStateString(t *testing.T) {
+	for name, state := range vmStateNames {
+		if name == "stuck" {
+			continue
+		}
+
+		if state.String() != name {
+			t.Errorf("%d.String() gives %q instead of %q", int(state), state.String(), name)
+		}
+	}
+}
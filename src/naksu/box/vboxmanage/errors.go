@@ -0,0 +1,100 @@
+package vboxmanage
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+)
+
+// Failures of VBoxManage recognised by classifyOutput(). Use errors.Is() to check
+// whether an error returned by this package is one of these. The complete output of
+// VBoxManage is available from CommandError (see errors.As()).
+var (
+	ErrVMNotFound               = errors.New("virtual machine not found")
+	ErrAccessDenied             = errors.New("access denied by virtualbox")
+	ErrMediumInUse              = errors.New("disk medium is in use")
+	ErrSessionLocked            = errors.New("virtual machine is locked by another session")
+	ErrKernelDriverNotInstalled = errors.New("virtualbox kernel driver is not installed")
+	ErrDuplicateMedium          = errors.New("disk medium is already registered")
+	ErrInvalidCommand           = errors.New("invalid vboxmanage command")
+)
+
+// vBoxManageExitCodeSyntax is the exit code of VBoxManage for an invalid command line
+const vBoxManageExitCodeSyntax = 2
+
+// outputClassifiers map the VBoxManage error messages to errors. The first match is used.
+var outputClassifiers = []struct {
+	err    error
+	regexp *regexp.Regexp
+}{
+	{ErrKernelDriverNotInstalled, regexp.MustCompile(`(?i)kernel driver not installed|VERR_VM_DRIVER_NOT_INSTALLED|VERR_VM_DRIVER_NOT_ACCESSIBLE|VERR_SUPDRV_`)},
+	{ErrDuplicateMedium, duplicateHardDiskRegexp},
+	{ErrDuplicateMedium, regexp.MustCompile(`VERR_ALREADY_EXISTS|with UUID \{[0-9a-fA-F-]+\} already exists`)},
+	{ErrSessionLocked, regexp.MustCompile(`(?i)already locked (for|by) a session|VBOX_E_INVALID_SESSION_STATE`)},
+	{ErrMediumInUse, regexp.MustCompile(`(?i)is locked for (reading|writing)|is still attached to|VBOX_E_OBJECT_IN_USE`)},
+	{ErrVMNotFound, regexp.MustCompile(regexp.QuoteMeta(vBoxManageOutputNoVMInstalled) + `|Could not find a machine`)},
+	{ErrAccessDenied, regexp.MustCompile(`E_ACCESSDENIED`)},
+}
+
+// CommandError is returned when VBoxManage fails. It wraps the error given by
+// classifyOutput() (if any) and carries the complete output of VBoxManage.
+type CommandError struct {
+	Command  string
+	ExitCode int
+	Output   string
+	// Kind is one of the Err* errors of this package or nil if the failure is not known
+	Kind error
+	// Err is the error returned when executing VBoxManage
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	if e.Kind != nil {
+		return fmt.Sprintf("failed to execute %s: %v (%v)", e.Command, e.Kind, e.Err)
+	}
+
+	return fmt.Sprintf("failed to execute %s: %v", e.Command, e.Err)
+}
+
+// Is makes errors.Is(err, ErrVMNotFound) etc. work with CommandError
+func (e *CommandError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// newCommandError returns a CommandError for the failed VBoxManage command
+func newCommandError(command string, output string, err error) *CommandError {
+	exitCode := -1
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) {
+		exitCode = exitError.ExitCode()
+	}
+
+	return &CommandError{
+		Command:  command,
+		ExitCode: exitCode,
+		Output:   output,
+		Kind:     classifyOutput(exitCode, output),
+		Err:      err,
+	}
+}
+
+// classifyOutput returns the Err* error of this package matching the exit code and
+// output of a failed VBoxManage command or nil if the failure is not known
+func classifyOutput(exitCode int, output string) error {
+	for _, classifier := range outputClassifiers {
+		if classifier.regexp.MatchString(output) {
+			return classifier.err
+		}
+	}
+
+	if exitCode == vBoxManageExitCodeSyntax {
+		return ErrInvalidCommand
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package vboxmanage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"naksu/log"
+)
+
+const (
+	// queueWaitLogThreshold is the queue wait time after which the wait is logged
+	queueWaitLogThreshold = time.Second
+	// defaultCommandTimeout is the time after which a VBoxManage process is considered
+	// hung and killed
+	defaultCommandTimeout = 2 * time.Minute
+	// vmCommandTimeout is the timeout of starting and removing VMs
+	vmCommandTimeout = 10 * time.Minute
+)
+
+// commandTimeouts are the timeouts of the VBoxManage subcommands which take longer
+// than defaultCommandTimeout. Zero means no timeout as copying disk images can take
+// hours on slow disks.
+var commandTimeouts = map[string]time.Duration{
+	"convertfromraw": 0,
+	"clonemedium":    0,
+	"clonehd":        0,
+	"modifyhd":       0,
+	"modifymedium":   0,
+	"snapshot":       0,
+	"startvm":        vmCommandTimeout,
+	"unregistervm":   vmCommandTimeout,
+	"discardstate":   vmCommandTimeout,
+}
+
+// QueueStats tells how long commands have waited for their turn to run VBoxManage
+type QueueStats struct {
+	Commands  int
+	TotalWait time.Duration
+	MaxWait   time.Duration
+}
+
+// commandExecutor runs one VBoxManage process at a time. Calling VBoxManage
+// simultaneously tends to cause E_ACCESSDENIED errors from VBoxManage.
+type commandExecutor struct {
+	// slot holds a value while a command is running
+	slot       chan struct{}
+	statsMutex sync.Mutex
+	stats      QueueStats
+}
+
+// executor runs all VBoxManage commands of naksu
+var executor = newCommandExecutor()
+
+func newCommandExecutor() *commandExecutor {
+	return &commandExecutor{slot: make(chan struct{}, 1)}
+}
+
+// execute waits until the previous commands have finished and calls runFn. The context
+// given to runFn is cancelled after timeout (zero means no timeout) or when ctx is cancelled.
+// The wait has no time limit as the previous command may be copying a disk image for
+// hours. A caller which cannot wait that long gives up by cancelling ctx.
+func (e *commandExecutor) execute(ctx context.Context, description string, timeout time.Duration, runFn func(context.Context) (string, error)) (string, error) {
+	queued := time.Now()
+
+	select {
+	case e.slot <- struct{}{}:
+	case <-ctx.Done():
+		wait := time.Since(queued)
+		log.Debug(fmt.Sprintf("Gave up waiting for VBoxManage to run %s after %v: %v", description, wait.Round(time.Millisecond), ctx.Err()))
+		return "", fmt.Errorf("gave up waiting for vboxmanage after %v: %w", wait.Round(time.Millisecond), ctx.Err())
+	}
+
+	defer func() {
+		<-e.slot
+	}()
+
+	wait := time.Since(queued)
+	e.recordWait(wait)
+	if wait > queueWaitLogThreshold {
+		log.Debug(fmt.Sprintf("Waited %v for VBoxManage to run %s", wait.Round(time.Millisecond), description))
+	}
+
+	runCtx := ctx
+	if timeout > 0 {
+		var cancelRun context.CancelFunc
+		runCtx, cancelRun = context.WithTimeout(ctx, timeout)
+		defer cancelRun()
+	}
+
+	return runFn(runCtx)
+}
+
+func (e *commandExecutor) recordWait(wait time.Duration) {
+	e.statsMutex.Lock()
+	defer e.statsMutex.Unlock()
+
+	e.stats.Commands++
+	e.stats.TotalWait += wait
+	if wait > e.stats.MaxWait {
+		e.stats.MaxWait = wait
+	}
+}
+
+func (e *commandExecutor) getStats() QueueStats {
+	e.statsMutex.Lock()
+	defer e.statsMutex.Unlock()
+
+	return e.stats
+}
+
+// GetQueueStats returns the queue wait times of the VBoxManage commands run so far
+func GetQueueStats() QueueStats {
+	return executor.getStats()
+}
+
+// getCommandTimeout returns the time after which the VBoxManage process running the
+// given command is killed. Zero means no timeout.
+func getCommandTimeout(args VBoxCommand) time.Duration {
+	if len(args) == 0 {
+		return defaultCommandTimeout
+	}
+
+	timeout, ok := commandTimeouts[args[0]]
+	if !ok {
+		return defaultCommandTimeout
+	}
+
+	return timeout
+}
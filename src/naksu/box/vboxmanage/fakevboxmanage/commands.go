@@ -0,0 +1,1264 @@
+package fakevboxmanage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The exit codes of VBoxManage
+const (
+	exitCodeSuccess = 0
+	exitCodeFailure = 1
+	exitCodeSyntax  = 2
+)
+
+// readyProperty is set when the guest has booted and cleared when it is powered off
+const readyProperty = "/VirtualBox/GuestInfo/Net/0/V4/IP"
+
+// commands are the supported VBoxManage commands
+var commands = map[string]func(s *session, args []string) error{
+	"list":           listCommand,
+	"showvminfo":     showVMInfoCommand,
+	"createvm":       createVMCommand,
+	"modifyvm":       modifyVMCommand,
+	"guestproperty":  guestPropertyCommand,
+	"sharedfolder":   sharedFolderCommand,
+	"storagectl":     storageCtlCommand,
+	"storageattach":  storageAttachCommand,
+	"setextradata":   setExtraDataCommand,
+	"snapshot":       snapshotCommand,
+	"startvm":        startVMCommand,
+	"controlvm":      controlVMCommand,
+	"discardstate":   discardStateCommand,
+	"unregistervm":   unregisterVMCommand,
+	"convertfromraw": convertFromRawCommand,
+	"modifyhd":       modifyMediumCommand,
+	"modifymedium":   modifyMediumCommand,
+	"clonehd":        cloneMediumCommand,
+	"clonemedium":    cloneMediumCommand,
+	"closemedium":    closeMediumCommand,
+	"showmediuminfo": showMediumInfoCommand,
+	"showhdinfo":     showMediumInfoCommand,
+}
+
+// modifyVMOptions are the options of modifyvm accepted by every version. The clipboard
+// option depends on the version (see Version.ClipboardOption).
+var modifyVMOptions = map[string]bool{
+	"pae":            true,
+	"cpus":           true,
+	"memory":         true,
+	"vram":           true,
+	"acpi":           true,
+	"ioapic":         true,
+	"ostype":         true,
+	"firmware":       true,
+	"audio":          true,
+	"nic1":           true,
+	"bridgeadapter1": true,
+	"nictype1":       true,
+}
+
+// osTypeDescriptions are shown by showvminfo instead of the OS type identifiers
+var osTypeDescriptions = map[string]string{
+	"Debian":    "Debian (32-bit)",
+	"Debian_64": "Debian (64-bit)",
+	"Other":     "Other/Unknown",
+}
+
+// session runs a single VBoxManage command
+type session struct {
+	state   *State
+	version Version
+	stdin   io.Reader
+	stdout  io.Writer
+	// changedVMs are the VMs whose settings file is written after the command
+	changedVMs []*VM
+}
+
+// failure is an error message printed by VBoxManage
+type failure struct {
+	exitCode int
+	message  string
+	// details are the code, the component and the interface of the COM error
+	details string
+	// context is the failed API call
+	context string
+}
+
+func (f *failure) Error() string {
+	return f.message
+}
+
+// String returns the error like VBoxManage prints it
+func (f *failure) String() string {
+	output := fmt.Sprintf("VBoxManage: error: %s\n", f.message)
+	if f.details != "" {
+		output += fmt.Sprintf("VBoxManage: error: Details: code %s, callee nsISupports\n", f.details)
+	}
+	if f.context != "" {
+		output += fmt.Sprintf("VBoxManage: error: Context: %s\n", f.context)
+	}
+
+	return output
+}
+
+func newSyntaxError(message string) *failure {
+	return &failure{exitCode: exitCodeSyntax, message: message}
+}
+
+func newFailure(message string, details string, context string) *failure {
+	return &failure{exitCode: exitCodeFailure, message: message, details: details, context: context}
+}
+
+func (s *session) printf(format string, args ...interface{}) {
+	fmt.Fprintf(s.stdout, format, args...)
+}
+
+// printProgress prints the progress of a long operation like VBoxManage does
+func (s *session) printProgress() {
+	s.printf("0%%...10%%...20%%...30%%...40%%...50%%...60%%...70%%...80%%...90%%...100%%\n")
+}
+
+// changed marks the settings of the VM to be written after the command
+func (s *session) changed(vm *VM) {
+	for _, changedVM := range s.changedVMs {
+		if changedVM == vm {
+			return
+		}
+	}
+
+	s.changedVMs = append(s.changedVMs, vm)
+}
+
+// writeSettings writes the settings files of the changed VMs and VirtualBox.xml
+func (s *session) writeSettings() error {
+	for _, vm := range s.changedVMs {
+		// The VM may have been unregistered
+		if s.state.FindVM(vm.UUID) != vm {
+			continue
+		}
+
+		err := s.state.writeVMSettings(vm)
+		if err != nil {
+			return fmt.Errorf("could not write settings of %s: %v", vm.Name, err)
+		}
+	}
+
+	return s.state.writeGlobalSettings()
+}
+
+// findVM returns the VM or the error printed by VBoxManage when the VM is not registered
+func (s *session) findVM(nameOrUUID string, sourceFile string) (*VM, error) {
+	vm := s.state.FindVM(nameOrUUID)
+	if vm == nil {
+		return nil, newFailure(
+			fmt.Sprintf("Could not find a registered machine named '%s'", nameOrUUID),
+			"VBOX_E_OBJECT_NOT_FOUND (0x80bb0001), component VirtualBoxWrap, interface IVirtualBox",
+			fmt.Sprintf("\"FindMachine(Bstr(a->argv[0]).raw(), machine.asOutParam())\" at line 2780 of file %s", sourceFile),
+		)
+	}
+
+	return vm, nil
+}
+
+// findUnlockedVM returns the VM if it is not running. A running VM is locked by its
+// session so it cannot be changed.
+func (s *session) findUnlockedVM(nameOrUUID string, sourceFile string) (*VM, error) {
+	vm, err := s.findVM(nameOrUUID, sourceFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if vm.isRunning() {
+		return nil, s.newLockedError(vm, "LockMachine(a->session, LockType_Write)", sourceFile)
+	}
+
+	return vm, nil
+}
+
+func (s *session) newLockedError(vm *VM, call string, sourceFile string) error {
+	return newFailure(
+		fmt.Sprintf(s.version.LockedMessage, vm.Name),
+		"VBOX_E_INVALID_OBJECT_STATE (0x80bb0007), component MachineWrap, interface IMachine",
+		fmt.Sprintf("\"%s\" at line 531 of file %s", call, sourceFile),
+	)
+}
+
+// findMedium returns the medium with the given UUID or location. A disk image which
+// is not known yet is opened like VirtualBox does.
+func (s *session) findMedium(locationOrUUID string) (*Medium, error) {
+	medium := s.state.FindMedium(locationOrUUID)
+	if medium == nil {
+		location, _ := filepath.Abs(locationOrUUID)
+		medium = s.state.FindMedium(location)
+
+		if medium == nil {
+			_, capacityMB, err := readDiskData(location)
+			if err != nil {
+				return nil, newFileNotFoundError(locationOrUUID)
+			}
+
+			medium = &Medium{
+				UUID:       newUUID(),
+				Location:   location,
+				Format:     getFormat(location),
+				CapacityMB: capacityMB,
+			}
+			s.state.Media = append(s.state.Media, medium)
+		}
+	}
+
+	if _, err := os.Stat(medium.Location); err != nil {
+		return nil, newFileNotFoundError(medium.Location)
+	}
+
+	return medium, nil
+}
+
+func newFileNotFoundError(location string) error {
+	return newFailure(
+		fmt.Sprintf("Could not find file for the medium '%s' (VERR_FILE_NOT_FOUND)", location),
+		"VBOX_E_FILE_ERROR (0x80bb0004), component MediumWrap, interface IMedium",
+		"\"OpenMedium(Bstr(pszFilenameOrUuid).raw(), enmDevType, enmAccessMode, fForceNewUuidOnOpen, pMedium.asOutParam())\" at line 191 of file VBoxManageDisk.cpp",
+	)
+}
+
+// newMediumLockedError is returned when the medium is used by a running VM
+func newMediumLockedError(medium *Medium) error {
+	return newFailure(
+		fmt.Sprintf("Medium '%s' is locked for writing by another task", medium.Location),
+		"VBOX_E_INVALID_OBJECT_STATE (0x80bb0007), component MediumWrap, interface IMedium",
+		"",
+	)
+}
+
+// getFormat returns the disk image format from the file name extension
+func getFormat(location string) string {
+	switch strings.ToLower(filepath.Ext(location)) {
+	case ".vmdk":
+		return "VMDK"
+	case ".vhd":
+		return "VHD"
+	default:
+		return "VDI"
+	}
+}
+
+// parseOptions returns the positional arguments and the options (without dashes).
+// The given flags do not have a value, the other options have exactly one.
+func parseOptions(args []string, flags ...string) ([]string, map[string]string, error) {
+	positional := []string{}
+	options := map[string]string{}
+
+	for n := 0; n < len(args); n++ {
+		if !strings.HasPrefix(args[n], "--") {
+			positional = append(positional, args[n])
+			continue
+		}
+
+		name := strings.TrimPrefix(args[n], "--")
+		if isFlag(name, flags) {
+			options[name] = ""
+			continue
+		}
+
+		if n+1 >= len(args) {
+			return nil, nil, newSyntaxError(fmt.Sprintf("Missing value for option '%s'", args[n]))
+		}
+
+		options[name] = args[n+1]
+		n++
+	}
+
+	return positional, options, nil
+}
+
+func isFlag(name string, flags []string) bool {
+	for _, flag := range flags {
+		if name == flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// skipMediumType removes the optional medium type ("disk") given before the medium
+func skipMediumType(args []string) []string {
+	if len(args) > 0 && (args[0] == "disk" || args[0] == "dvd" || args[0] == "floppy") {
+		return args[1:]
+	}
+
+	return args
+}
+
+func listCommand(s *session, args []string) error {
+	if len(args) != 1 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	switch args[0] {
+	case "vms", "runningvms":
+		for _, vm := range s.state.VMs {
+			if args[0] == "vms" || vm.isRunning() {
+				s.printf("\"%s\" {%s}\n", vm.Name, vm.UUID)
+			}
+		}
+	case "systemproperties":
+		properties := [][]string{
+			{"API version", strings.Replace(s.version.Name, ".", "_", 1)},
+			{"Minimum guest RAM size", "4 Megabytes"},
+			{"Maximum guest RAM size", "2097152 Megabytes"},
+			{"Maximum guest CPU count", "32"},
+			{"Default machine folder", s.state.getMachineFolder()},
+			{"Default hard disk format", "VDI"},
+		}
+
+		for _, property := range properties {
+			s.printf("%-*s%s\n", s.version.PropertyWidth, property[0]+":", property[1])
+		}
+	case "hdds":
+		for _, medium := range s.state.Media {
+			if !medium.Registered {
+				continue
+			}
+
+			state := "created"
+			if _, err := os.Stat(medium.Location); err != nil {
+				state = "inaccessible"
+			}
+
+			s.printf("UUID:           %s\nParent UUID:    base\nState:          %s\nType:           normal (base)\nLocation:       %s\nStorage format: %s\nCapacity:       %d MBytes\nEncryption:     disabled\n\n",
+				medium.UUID, state, medium.Location, medium.Format, medium.CapacityMB)
+		}
+	default:
+		return newSyntaxError(fmt.Sprintf("Unknown subcommand '%s'", args[0]))
+	}
+
+	return nil
+}
+
+func showVMInfoCommand(s *session, args []string) error {
+	positional, options, err := parseOptions(args, "machinereadable", "details")
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	vm, err := s.findVM(positional[0], "VBoxManageInfo.cpp")
+	if err != nil {
+		return err
+	}
+
+	if _, ok := options["machinereadable"]; !ok {
+		s.printf("Name:            %s\nUUID:            %s\nConfig file:     %s\nState:           %s\n",
+			vm.Name, vm.UUID, s.state.getSettingsPath(vm.Name), vm.State)
+		return nil
+	}
+
+	s.printVMInfo(vm)
+
+	return nil
+}
+
+// printVMInfo prints the VM like "showvminfo --machinereadable"
+func (s *session) printVMInfo(vm *VM) {
+	getSetting := func(name string, defaultValue string) string {
+		value, ok := vm.Settings[name]
+		if !ok {
+			return defaultValue
+		}
+		return value
+	}
+
+	osType := getSetting("ostype", "Other")
+	if description, ok := osTypeDescriptions[osType]; ok {
+		osType = description
+	}
+
+	firmware := "BIOS"
+	if strings.EqualFold(getSetting("firmware", "bios"), "efi") {
+		firmware = "EFI"
+	}
+
+	vmDirectory := s.state.getVMDirectory(vm.Name)
+
+	s.printf("name=\"%s\"\ngroups=\"/\"\nostype=\"%s\"\nUUID=\"%s\"\n", vm.Name, osType, vm.UUID)
+	s.printf("CfgFile=\"%s\"\nSnapFldr=\"%s\"\nLogFldr=\"%s\"\n", s.state.getSettingsPath(vm.Name), filepath.Join(vmDirectory, "Snapshots"), filepath.Join(vmDirectory, "Logs"))
+	s.printf("memory=%s\nvram=%s\ncpus=%s\n", getSetting("memory", "128"), getSetting("vram", "8"), getSetting("cpus", "1"))
+	s.printf("pae=\"%s\"\nacpi=\"%s\"\nioapic=\"%s\"\nfirmware=\"%s\"\n", getSetting("pae", "off"), getSetting("acpi", "on"), getSetting("ioapic", "off"), firmware)
+	s.printf("VMState=\"%s\"\n", vm.State)
+
+	for n, controller := range vm.StorageControllers {
+		s.printf("storagecontrollername%d=\"%s\"\nstoragecontrollertype%d=\"IntelAhci\"\n", n, controller, n)
+	}
+
+	for _, controller := range vm.StorageControllers {
+		if controller != "SATA Controller" {
+			continue
+		}
+
+		medium := s.state.FindMedium(vm.Disk)
+		if medium == nil {
+			s.printf("\"%s-0-0\"=\"none\"\n", controller)
+			continue
+		}
+
+		s.printf("\"%s-0-0\"=\"%s\"\n\"%s-ImageUUID-0-0\"=\"%s\"\n", controller, medium.Location, controller, medium.UUID)
+	}
+
+	s.printf("nic1=\"%s\"\n", getSetting("nic1", "nat"))
+	if adapter, ok := vm.Settings["bridgeadapter1"]; ok {
+		s.printf("bridgeadapter1=\"%s\"\n", adapter)
+	}
+	s.printf("nictype1=\"%s\"\n", getSetting("nictype1", "82540EM"))
+	s.printf("clipboard=\"%s\"\naudio=\"%s\"\n", getSetting(s.version.ClipboardOption, "disabled"), getSetting("audio", "none"))
+
+	folderNames := []string{}
+	for name := range vm.SharedFolders {
+		folderNames = append(folderNames, name)
+	}
+	sort.Strings(folderNames)
+
+	for n, name := range folderNames {
+		s.printf("SharedFolderNameMachineMapping%d=\"%s\"\nSharedFolderPathMachineMapping%d=\"%s\"\n", n+1, name, n+1, vm.SharedFolders[name])
+	}
+
+	// The snapshots form a chain: SnapshotName, SnapshotName-1, SnapshotName-1-1...
+	suffix := ""
+	for n, snapshot := range vm.Snapshots {
+		if n > 0 {
+			suffix += "-1"
+		}
+
+		s.printf("SnapshotName%s=\"%s\"\nSnapshotUUID%s=\"%s\"\n", suffix, snapshot.Name, suffix, snapshot.UUID)
+	}
+
+	currentSnapshot := vm.findSnapshot(vm.CurrentSnapshot)
+	if currentSnapshot >= 0 {
+		node := "SnapshotName" + strings.Repeat("-1", currentSnapshot)
+		s.printf("CurrentSnapshotName=\"%s\"\nCurrentSnapshotUUID=\"%s\"\nCurrentSnapshotNode=\"%s\"\n", vm.CurrentSnapshot, vm.Snapshots[currentSnapshot].UUID, node)
+	}
+}
+
+func createVMCommand(s *session, args []string) error {
+	_, options, err := parseOptions(args, "register")
+	if err != nil {
+		return err
+	}
+
+	name := options["name"]
+	if name == "" {
+		return newSyntaxError("Parameter --name is required")
+	}
+
+	settingsPath := s.state.getSettingsPath(name)
+	if _, err := os.Stat(settingsPath); err == nil || s.state.FindVM(name) != nil {
+		return newFailure(
+			fmt.Sprintf("Machine settings file '%s' already exists", settingsPath),
+			"VBOX_E_FILE_ERROR (0x80bb0004), component MachineWrap, interface IMachine",
+			"\"CreateMachine(bstrSettingsFile.raw(), Bstr(name).raw(), ComSafeArrayAsInParam(groups), Bstr(osTypeId).raw(), createFlags.raw(), machine.asOutParam())\" at line 318 of file VBoxManageMisc.cpp",
+		)
+	}
+
+	osType := options["ostype"]
+	if osType == "" {
+		osType = "Other"
+	}
+
+	vm := &VM{
+		Name:            name,
+		UUID:            newUUID(),
+		State:           StatePoweredOff,
+		Settings:        map[string]string{"ostype": osType},
+		GuestProperties: map[string]string{},
+		ExtraData:       map[string]string{},
+		SharedFolders:   map[string]string{},
+	}
+
+	_, register := options["register"]
+	if !register {
+		s.printf("Virtual machine '%s' is created.\nUUID: %s\nSettings file: '%s'\n", name, vm.UUID, settingsPath)
+		return s.state.writeVMSettings(vm)
+	}
+
+	s.state.VMs = append(s.state.VMs, vm)
+	s.changed(vm)
+
+	s.printf("Virtual machine '%s' is created and registered.\nUUID: %s\nSettings file: '%s'\n", name, vm.UUID, settingsPath)
+
+	return nil
+}
+
+func modifyVMCommand(s *session, args []string) error {
+	positional, options, err := parseOptions(args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	vm, err := s.findUnlockedVM(positional[0], "VBoxManageModifyVM.cpp")
+	if err != nil {
+		return err
+	}
+
+	for name, value := range options {
+		if !modifyVMOptions[name] && name != s.version.ClipboardOption {
+			return newSyntaxError(fmt.Sprintf("Unknown option: --%s", name))
+		}
+
+		if name == "cpus" || name == "memory" || name == "vram" {
+			_, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return newSyntaxError(fmt.Sprintf("Invalid value '%s' for option --%s", value, name))
+			}
+		}
+	}
+
+	for name, value := range options {
+		vm.Settings[name] = value
+	}
+
+	s.changed(vm)
+
+	return nil
+}
+
+func guestPropertyCommand(s *session, args []string) error {
+	if len(args) < 3 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	vm, err := s.findVM(args[1], "VBoxManageGuestProp.cpp")
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "get":
+		value, ok := vm.GuestProperties[args[2]]
+		if ok {
+			s.printf("Value: %s\n", value)
+		} else {
+			s.printf("No value set!\n")
+		}
+	case "set":
+		if len(args) >= 4 {
+			vm.GuestProperties[args[2]] = args[3]
+		} else {
+			delete(vm.GuestProperties, args[2])
+		}
+		s.changed(vm)
+	case "delete", "unset":
+		delete(vm.GuestProperties, args[2])
+		s.changed(vm)
+	default:
+		return newSyntaxError(fmt.Sprintf("Unknown subcommand '%s'", args[0]))
+	}
+
+	return nil
+}
+
+func sharedFolderCommand(s *session, args []string) error {
+	positional, options, err := parseOptions(args, "automount", "transient", "readonly")
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 2 || options["name"] == "" {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	vm, err := s.findVM(positional[1], "VBoxManageMisc.cpp")
+	if err != nil {
+		return err
+	}
+
+	if _, transient := options["transient"]; vm.isRunning() && !transient {
+		return s.newLockedError(vm, "LockMachine(a->session, LockType_Write)", "VBoxManageMisc.cpp")
+	}
+
+	switch positional[0] {
+	case "add":
+		if _, ok := vm.SharedFolders[options["name"]]; ok {
+			return newFailure(
+				fmt.Sprintf("Shared folder named '%s' already exists", options["name"]),
+				"VBOX_E_OBJECT_IN_USE (0x80bb000c), component SessionMachine, interface IMachine",
+				"\"CreateSharedFolder(Bstr(name).raw(), Bstr(hostpath).raw(), fWritable, fAutoMount, Bstr(pszAutoMountPoint).raw())\" at line 1147 of file VBoxManageMisc.cpp",
+			)
+		}
+
+		vm.SharedFolders[options["name"]] = options["hostpath"]
+	case "remove":
+		delete(vm.SharedFolders, options["name"])
+	default:
+		return newSyntaxError(fmt.Sprintf("Unknown subcommand '%s'", positional[0]))
+	}
+
+	s.changed(vm)
+
+	return nil
+}
+
+func storageCtlCommand(s *session, args []string) error {
+	positional, options, err := parseOptions(args, "remove")
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 || options["name"] == "" {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	vm, err := s.findUnlockedVM(positional[0], "VBoxManageStorageController.cpp")
+	if err != nil {
+		return err
+	}
+
+	for _, controller := range vm.StorageControllers {
+		if controller == options["name"] {
+			return newFailure(
+				fmt.Sprintf("Storage controller named '%s' already exists", options["name"]),
+				"VBOX_E_OBJECT_IN_USE (0x80bb000c), component SessionMachine, interface IMachine",
+				"\"AddStorageController(Bstr(pszCtl).raw(), StorageBus_SATA, ctl.asOutParam())\" at line 1003 of file VBoxManageStorageController.cpp",
+			)
+		}
+	}
+
+	vm.StorageControllers = append(vm.StorageControllers, options["name"])
+	s.changed(vm)
+
+	return nil
+}
+
+func storageAttachCommand(s *session, args []string) error {
+	positional, options, err := parseOptions(args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	vm, err := s.findUnlockedVM(positional[0], "VBoxManageStorageController.cpp")
+	if err != nil {
+		return err
+	}
+
+	controllerFound := false
+	for _, controller := range vm.StorageControllers {
+		controllerFound = controllerFound || controller == options["storagectl"]
+	}
+
+	if !controllerFound {
+		return newFailure(fmt.Sprintf("Could not find a controller named '%s'", options["storagectl"]), "", "")
+	}
+
+	if options["storagectl"] != "SATA Controller" || options["port"] != "0" || options["device"] != "0" {
+		return newSyntaxError("The fake supports only a disk attached to port 0 of \"SATA Controller\"")
+	}
+
+	if options["medium"] == "none" || options["medium"] == "emptydrive" {
+		vm.Disk = ""
+		s.changed(vm)
+		return nil
+	}
+
+	medium, err := s.findMedium(options["medium"])
+	if err != nil {
+		return err
+	}
+
+	attachedVM := s.state.findAttachedVM(medium)
+	if attachedVM != nil && attachedVM != vm {
+		return newMediumLockedError(medium)
+	}
+
+	medium.Registered = true
+	vm.Disk = medium.Location
+	s.changed(vm)
+
+	return nil
+}
+
+func setExtraDataCommand(s *session, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	// Global extra data is not stored
+	if args[0] == "global" {
+		return nil
+	}
+
+	vm, err := s.findVM(args[0], "VBoxManageMisc.cpp")
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 3 && args[2] != "" {
+		vm.ExtraData[args[1]] = args[2]
+	} else {
+		delete(vm.ExtraData, args[1])
+	}
+
+	s.changed(vm)
+
+	return nil
+}
+
+func snapshotCommand(s *session, args []string) error {
+	positional, _, err := parseOptions(args, "live", "machinereadable")
+	if err != nil {
+		return err
+	}
+
+	if len(positional) < 2 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	vm, err := s.findVM(positional[0], "VBoxManageSnapshot.cpp")
+	if err != nil {
+		return err
+	}
+
+	if positional[1] == "list" {
+		if len(vm.Snapshots) == 0 {
+			s.printf("This machine does not have any snapshots\n")
+			return nil
+		}
+
+		for n, snapshot := range vm.Snapshots {
+			current := ""
+			if snapshot.Name == vm.CurrentSnapshot {
+				current = " *"
+			}
+
+			s.printf("%sName: %s (UUID: %s)%s\n", strings.Repeat("   ", n+1), snapshot.Name, snapshot.UUID, current)
+		}
+
+		return nil
+	}
+
+	if len(positional) != 3 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	name := positional[2]
+
+	if positional[1] == "take" {
+		snapshot := Snapshot{
+			Name:        name,
+			UUID:        newUUID(),
+			Created:     time.Now().UTC().Truncate(time.Second),
+			DiskChanges: vm.DiskChanges,
+		}
+
+		vm.Snapshots = append(vm.Snapshots, snapshot)
+		vm.CurrentSnapshot = name
+		s.changed(vm)
+
+		s.printProgress()
+		s.printf("Snapshot taken. UUID: %s\n", snapshot.UUID)
+
+		return nil
+	}
+
+	index := vm.findSnapshot(name)
+	if index < 0 {
+		return newFailure(
+			fmt.Sprintf("Could not find a snapshot named '%s'", name),
+			"VBOX_E_OBJECT_NOT_FOUND (0x80bb0001), component SnapshotMachine, interface IMachine",
+			"\"FindSnapshot(Bstr(a->argv[2]).raw(), pSnapshot.asOutParam())\" at line 635 of file VBoxManageSnapshot.cpp",
+		)
+	}
+
+	snapshot := vm.Snapshots[index]
+
+	switch positional[1] {
+	case "restore":
+		if vm.isRunning() {
+			return s.newLockedError(vm, "LockMachine(a->session, LockType_Shared)", "VBoxManageSnapshot.cpp")
+		}
+
+		s.printf("Restoring snapshot '%s' (%s)\n", snapshot.Name, snapshot.UUID)
+		vm.DiskChanges = snapshot.DiskChanges
+		vm.CurrentSnapshot = snapshot.Name
+		if vm.State == StateSaved || vm.State == StateAborted || vm.State == StateAbortedSaved {
+			vm.State = StatePoweredOff
+		}
+	case "delete":
+		s.printf("Deleting snapshot '%s' (%s)\n", snapshot.Name, snapshot.UUID)
+		vm.Snapshots = append(vm.Snapshots[:index], vm.Snapshots[index+1:]...)
+
+		// The parent of the deleted snapshot becomes the current snapshot
+		if vm.CurrentSnapshot == snapshot.Name {
+			vm.CurrentSnapshot = ""
+			if index > 0 {
+				vm.CurrentSnapshot = vm.Snapshots[index-1].Name
+			}
+		}
+	default:
+		return newSyntaxError(fmt.Sprintf("Invalid parameter '%s'", positional[1]))
+	}
+
+	s.changed(vm)
+	s.printProgress()
+
+	return nil
+}
+
+func startVMCommand(s *session, args []string) error {
+	positional, _, err := parseOptions(args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	vm, err := s.findVM(positional[0], "VBoxManageMisc.cpp")
+	if err != nil {
+		return err
+	}
+
+	s.printf("Waiting for VM \"%s\" to power on...\n", vm.Name)
+
+	if vm.isRunning() {
+		return s.newLockedError(vm, "LaunchVMProcess(a->session, sessionType.raw(), ComSafeArrayAsInParam(aBstrEnv), progress.asOutParam())", "VBoxManageMisc.cpp")
+	}
+
+	if vm.Settings["nic1"] == "bridged" && vm.Settings["bridgeadapter1"] == "" {
+		return newFailure(
+			"Nonexistent host networking interface, name '' (VERR_INTERNAL_ERROR)",
+			"NS_ERROR_FAILURE (0x80004005), component ConsoleWrap, interface IConsole",
+			"",
+		)
+	}
+
+	// The guest writes to the disk and reports its address when it has booted
+	vm.State = StateRunning
+	vm.DiskChanges++
+	vm.GuestProperties[readyProperty] = "10.0.2.15"
+	s.changed(vm)
+
+	err = appendVMLog(s.state.getVMDirectory(vm.Name), "VM is starting")
+	if err != nil {
+		return err
+	}
+
+	s.printf("VM \"%s\" has been successfully started.\n", vm.Name)
+
+	return nil
+}
+
+// appendVMLog writes a line to Logs/VBox.log of the VM like the VM process does
+func appendVMLog(vmDirectory string, line string) error {
+	logDirectory := filepath.Join(vmDirectory, "Logs")
+	err := os.MkdirAll(logDirectory, 0755)
+	if err != nil {
+		return err
+	}
+
+	logPath := filepath.Join(logDirectory, "VBox.log")
+	content, err := ioutil.ReadFile(logPath) // #nosec
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	content = append(content, []byte(fmt.Sprintf("%s %s\n", time.Now().UTC().Format("15:04:05.000000"), line))...)
+
+	return ioutil.WriteFile(logPath, content, 0600)
+}
+
+func controlVMCommand(s *session, args []string) error {
+	if len(args) < 2 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	vm, err := s.findVM(args[0], "VBoxManageControlVM.cpp")
+	if err != nil {
+		return err
+	}
+
+	if !vm.isRunning() {
+		return newFailure(fmt.Sprintf("Machine '%s' is not currently running", vm.Name), "", "")
+	}
+
+	switch args[1] {
+	case "poweroff":
+		s.printProgress()
+		vm.State = StatePoweredOff
+	case "acpipowerbutton":
+		// The guest shuts down immediately
+		vm.State = StatePoweredOff
+	case "savestate":
+		s.printProgress()
+		vm.State = StateSaved
+	case "pause":
+		vm.State = StatePaused
+	case "resume":
+		vm.State = StateRunning
+	default:
+		return newSyntaxError(fmt.Sprintf("Invalid parameter '%s'", args[1]))
+	}
+
+	if !vm.isRunning() {
+		delete(vm.GuestProperties, readyProperty)
+	}
+
+	s.changed(vm)
+
+	return nil
+}
+
+func discardStateCommand(s *session, args []string) error {
+	if len(args) != 1 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	vm, err := s.findVM(args[0], "VBoxManageMisc.cpp")
+	if err != nil {
+		return err
+	}
+
+	switch vm.State {
+	case StateSaved:
+		vm.State = StatePoweredOff
+	case StateAbortedSaved:
+		vm.State = StateAborted
+	default:
+		return newFailure(
+			fmt.Sprintf("Cannot discard the saved state as the machine is not in the Saved state (machine state: %s)", vm.State),
+			"VBOX_E_INVALID_VM_STATE (0x80bb0002), component SessionMachine, interface IMachine",
+			"\"DiscardSavedState(true)\" at line 2165 of file VBoxManageMisc.cpp",
+		)
+	}
+
+	s.changed(vm)
+
+	return nil
+}
+
+func unregisterVMCommand(s *session, args []string) error {
+	positional, options, err := parseOptions(args, "delete")
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	vm, err := s.findUnlockedVM(positional[0], "VBoxManageMisc.cpp")
+	if err != nil {
+		return err
+	}
+
+	s.state.removeVM(vm)
+
+	medium := s.state.FindMedium(vm.Disk)
+
+	if _, ok := options["delete"]; !ok {
+		if medium != nil {
+			medium.Registered = false
+		}
+		return nil
+	}
+
+	if medium != nil {
+		err = removeDiskFiles(medium.Location)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not delete disk: %v", err)
+		}
+		s.state.removeMedium(medium)
+	}
+
+	err = os.RemoveAll(s.state.getVMDirectory(vm.Name))
+	if err != nil {
+		return fmt.Errorf("could not delete vm directory: %v", err)
+	}
+
+	s.printProgress()
+
+	return nil
+}
+
+func convertFromRawCommand(s *session, args []string) error {
+	positional, options, err := parseOptions(args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) < 2 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	var data []byte
+
+	if positional[0] == "stdin" {
+		if len(positional) != 3 {
+			return newSyntaxError("Incorrect number of parameters")
+		}
+
+		size, err := strconv.ParseUint(positional[2], 10, 64)
+		if err != nil {
+			return newSyntaxError(fmt.Sprintf("Invalid size '%s'", positional[2]))
+		}
+
+		data = make([]byte, size)
+		_, err = io.ReadFull(s.stdin, data)
+		if err != nil {
+			return newFailure(fmt.Sprintf("Cannot read from input: %v", err), "", "")
+		}
+	} else {
+		data, err = ioutil.ReadFile(positional[0])
+		if err != nil {
+			return newFailure(fmt.Sprintf("Cannot open the raw disk '%s': VERR_FILE_NOT_FOUND", positional[0]), "", "")
+		}
+	}
+
+	location, err := filepath.Abs(positional[1])
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(location); err == nil {
+		return newFailure(fmt.Sprintf("Cannot create the disk image \"%s\": VERR_ALREADY_EXISTS", location), "", "")
+	}
+
+	format := options["format"]
+	if format == "" {
+		format = "VDI"
+	}
+
+	s.printf("Converting from raw image file=\"%s\" to file=\"%s\"...\n", positional[0], location)
+	s.printf("Creating dynamic image with size %d bytes (%dMB)...\n", len(data), getCapacityMB(uint64(len(data))))
+
+	medium := &Medium{
+		UUID:       newUUID(),
+		Location:   location,
+		Format:     format,
+		CapacityMB: getCapacityMB(uint64(len(data))),
+	}
+
+	err = s.writeMedium(medium, data, false)
+	if err != nil {
+		return err
+	}
+
+	// Forget a previous medium at the same location
+	previous := s.state.FindMedium(location)
+	if previous != nil {
+		s.state.removeMedium(previous)
+	}
+	s.state.Media = append(s.state.Media, medium)
+
+	return nil
+}
+
+// writeMedium writes the disk image file of the medium
+func (s *session) writeMedium(medium *Medium, data []byte, split bool) error {
+	var err error
+
+	switch medium.Format {
+	case "VDI":
+		err = writeVDI(medium.Location, data)
+	case "VMDK":
+		err = writeVMDK(medium.Location, data, medium.CapacityMB, medium.UUID, split)
+	default:
+		return newSyntaxError(fmt.Sprintf("The fake does not support disk format '%s'", medium.Format))
+	}
+
+	if err != nil {
+		return newFailure(fmt.Sprintf("Could not create the medium storage unit '%s' (%v)", medium.Location, err), "", "")
+	}
+
+	return nil
+}
+
+func modifyMediumCommand(s *session, args []string) error {
+	positional, options, err := parseOptions(skipMediumType(args), "compact")
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	medium, err := s.findMedium(positional[0])
+	if err != nil {
+		return err
+	}
+
+	attachedVM := s.state.findAttachedVM(medium)
+	if attachedVM != nil && attachedVM.isRunning() {
+		return newMediumLockedError(medium)
+	}
+
+	if resize, ok := options["resize"]; ok {
+		capacityMB, err := strconv.ParseUint(resize, 10, 64)
+		if err != nil {
+			return newSyntaxError(fmt.Sprintf("Invalid size '%s'", resize))
+		}
+
+		if capacityMB < medium.CapacityMB {
+			return newFailure(
+				fmt.Sprintf("Shrinking is not yet supported for medium '%s'", medium.Location),
+				"VBOX_E_NOT_SUPPORTED (0x80bb0009), component MediumWrap, interface IMedium",
+				"",
+			)
+		}
+
+		medium.CapacityMB = capacityMB
+		s.printProgress()
+	}
+
+	if _, ok := options["compact"]; ok {
+		medium.Compactions++
+		s.printProgress()
+	}
+
+	return nil
+}
+
+func cloneMediumCommand(s *session, args []string) error {
+	positional, options, err := parseOptions(skipMediumType(args), "existing")
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 2 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	source, err := s.findMedium(positional[0])
+	if err != nil {
+		return err
+	}
+
+	attachedVM := s.state.findAttachedVM(source)
+	if attachedVM != nil && attachedVM.isRunning() {
+		return newMediumLockedError(source)
+	}
+
+	location, err := filepath.Abs(positional[1])
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(location); err == nil {
+		return newFailure(fmt.Sprintf("Failed to create the clone medium '%s' (VERR_ALREADY_EXISTS)", location), "", "")
+	}
+
+	data, _, err := readDiskData(source.Location)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", source.Location, err)
+	}
+
+	format := options["format"]
+	if format == "" {
+		format = source.Format
+	}
+
+	clone := &Medium{
+		UUID:       newUUID(),
+		Location:   location,
+		Format:     strings.ToUpper(format),
+		CapacityMB: source.CapacityMB,
+		Registered: true,
+	}
+
+	err = s.writeMedium(clone, data, strings.Contains(options["variant"], "Split2G"))
+	if err != nil {
+		return err
+	}
+
+	s.state.Media = append(s.state.Media, clone)
+
+	s.printProgress()
+	s.printf("Clone medium created in format '%s'. UUID: %s\n", clone.Format, clone.UUID)
+
+	return nil
+}
+
+func closeMediumCommand(s *session, args []string) error {
+	positional, options, err := parseOptions(skipMediumType(args), "delete")
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	// A registered medium can be closed even if its file is missing
+	medium := s.state.FindMedium(positional[0])
+	if medium == nil || !medium.Registered {
+		medium, err = s.findMedium(positional[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.state.findAttachedVM(medium) != nil {
+		return newFailure(
+			fmt.Sprintf("Medium '%s' cannot be closed because it is still attached to 1 virtual machines", medium.Location),
+			"VBOX_E_OBJECT_IN_USE (0x80bb000c), component MediumWrap, interface IMedium",
+			"\"Close()\" at line 1818 of file VBoxManageDisk.cpp",
+		)
+	}
+
+	medium.Registered = false
+
+	if _, ok := options["delete"]; ok {
+		err = removeDiskFiles(medium.Location)
+		if err != nil {
+			return fmt.Errorf("could not delete %s: %v", medium.Location, err)
+		}
+
+		s.state.removeMedium(medium)
+		s.printProgress()
+	}
+
+	return nil
+}
+
+func showMediumInfoCommand(s *session, args []string) error {
+	positional := skipMediumType(args)
+	if len(positional) != 1 {
+		return newSyntaxError("Incorrect number of parameters")
+	}
+
+	medium, err := s.findMedium(positional[0])
+	if err != nil {
+		return err
+	}
+
+	s.printf("UUID:           %s\nParent UUID:    base\nState:          created\nType:           normal (base)\n", medium.UUID)
+	s.printf("Location:       %s\nStorage format: %s\nFormat variant: dynamic default\n", medium.Location, medium.Format)
+	s.printf("Capacity:       %d MBytes\nSize on disk:   %d MBytes\nEncryption:     disabled\n", medium.CapacityMB, getFileSizeMB(medium.Location))
+
+	attachedVM := s.state.findAttachedVM(medium)
+	if attachedVM != nil {
+		s.printf("In use by VMs:  %s (UUID: %s)\n", attachedVM.Name, attachedVM.UUID)
+	}
+
+	return nil
+}
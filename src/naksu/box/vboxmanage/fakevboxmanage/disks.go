@@ -0,0 +1,228 @@
+package fakevboxmanage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The disk images written by the fake are small: they contain only the data written
+// to the disk (e.g. the raw image given to convertfromraw) but the headers tell the
+// virtual size of the disk like the real images do.
+const (
+	// vdiHeader starts the fake VDI images
+	vdiHeader = "<<< Oracle VM VirtualBox Disk Image >>>\n"
+	// vmdkSparseMagic is the magic number ("KDMV") at the start of a sparse VMDK extent
+	vmdkSparseMagic = 0x564d444b
+	vmdkSectorSize  = 512
+	// vmdkDescriptorSectors is the size of the descriptor embedded to a sparse VMDK
+	vmdkDescriptorSectors = 20
+	// vmdkSplitExtentSectors is the size of the extents of a split (Split2G) VMDK
+	vmdkSplitExtentSectors = 4192256
+)
+
+// vmdkSparseHeader is the beginning of the header of a sparse VMDK extent
+type vmdkSparseHeader struct {
+	MagicNumber      uint32
+	Version          uint32
+	Flags            uint32
+	Capacity         uint64
+	GrainSize        uint64
+	DescriptorOffset uint64
+	DescriptorSize   uint64
+}
+
+var vmdkExtentRegexp = regexp.MustCompile(`(?m)^RW\s+(\d+)\s+\w+\s+"(.*?)"`)
+
+// writeVDI writes a fake VDI image containing data
+func writeVDI(path string, data []byte) error {
+	return ioutil.WriteFile(path, append([]byte(vdiHeader), data...), 0600)
+}
+
+// writeVMDK writes a VMDK image containing data. A split image is a descriptor file
+// and 2 GB extent files like "VBoxManage clonemedium --variant Split2G" writes.
+func writeVMDK(path string, data []byte, capacityMB uint64, uuid string, split bool) error {
+	sectors := capacityMB * 1024 * 1024 / vmdkSectorSize
+
+	if !split {
+		extents := fmt.Sprintf("RW %d SPARSE \"%s\"\n", sectors, filepath.Base(path))
+		descriptor := getVMDKDescriptor("monolithicSparse", extents, uuid)
+
+		return writeSparseExtent(path, sectors, descriptor, data)
+	}
+
+	extents := ""
+	extentCount := 0
+	for remaining := sectors; remaining > 0; {
+		extentSectors := remaining
+		if extentSectors > vmdkSplitExtentSectors {
+			extentSectors = vmdkSplitExtentSectors
+		}
+		remaining -= extentSectors
+		extentCount++
+
+		extentName := fmt.Sprintf("%s-s%03d.vmdk", strings.TrimSuffix(filepath.Base(path), ".vmdk"), extentCount)
+		extents += fmt.Sprintf("RW %d SPARSE \"%s\"\n", extentSectors, extentName)
+
+		// The data is written to the first extent
+		var extentData []byte
+		if extentCount == 1 {
+			extentData = data
+		}
+
+		err := writeSparseExtent(filepath.Join(filepath.Dir(path), extentName), extentSectors, "", extentData)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(path, []byte(getVMDKDescriptor("twoGbMaxExtentSparse", extents, uuid)), 0600)
+}
+
+func getVMDKDescriptor(createType string, extents string, uuid string) string {
+	return fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=8f5e2c1a
+parentCID=ffffffff
+createType="%s"
+
+# Extent description
+%s
+# The disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.adapterType="ide"
+ddb.uuid.image="%s"
+ddb.uuid.parent="00000000-0000-0000-0000-000000000000"
+ddb.uuid.modification="00000000-0000-0000-0000-000000000000"
+ddb.uuid.parentmodification="00000000-0000-0000-0000-000000000000"
+`, createType, extents, uuid)
+}
+
+// writeSparseExtent writes a sparse VMDK extent with an optional embedded descriptor
+func writeSparseExtent(path string, sectors uint64, descriptor string, data []byte) error {
+	header := vmdkSparseHeader{
+		MagicNumber: vmdkSparseMagic,
+		Version:     1,
+		Capacity:    sectors,
+		GrainSize:   128,
+	}
+
+	if descriptor != "" {
+		header.DescriptorOffset = 1
+		header.DescriptorSize = vmdkDescriptorSectors
+	}
+
+	var content bytes.Buffer
+	err := binary.Write(&content, binary.LittleEndian, header)
+	if err != nil {
+		return err
+	}
+
+	content.Write(make([]byte, vmdkSectorSize-content.Len()))
+	content.WriteString(descriptor)
+	content.Write(make([]byte, getSparseDataOffset(header)-content.Len()))
+	content.Write(data)
+
+	return ioutil.WriteFile(path, content.Bytes(), 0600)
+}
+
+// getSparseDataOffset returns the offset of the data in an extent written by writeSparseExtent()
+func getSparseDataOffset(header vmdkSparseHeader) int {
+	return int((1 + header.DescriptorSize) * vmdkSectorSize)
+}
+
+// readDiskData returns the data written to a disk image by writeVDI() or writeVMDK()
+// and the virtual size of the disk in megabytes
+func readDiskData(path string) ([]byte, uint64, error) {
+	content, err := ioutil.ReadFile(path) // #nosec
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if bytes.HasPrefix(content, []byte(vdiHeader)) {
+		data := content[len(vdiHeader):]
+		return data, getCapacityMB(uint64(len(data))), nil
+	}
+
+	header, isSparse := readSparseHeader(content)
+	if isSparse {
+		data := content[getSparseDataOffset(header):]
+		return data, header.Capacity * vmdkSectorSize / 1024 / 1024, nil
+	}
+
+	// A descriptor file of a split VMDK: the data is in the first extent
+	extents := vmdkExtentRegexp.FindAllStringSubmatch(string(content), -1)
+	if extents == nil {
+		return nil, 0, errors.New("unknown disk image format")
+	}
+
+	var sectors uint64
+	for _, extent := range extents {
+		extentSectors, err := strconv.ParseUint(extent[1], 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		sectors += extentSectors
+	}
+
+	data, _, err := readDiskData(filepath.Join(filepath.Dir(path), extents[0][2]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read extent: %v", err)
+	}
+
+	return data, sectors * vmdkSectorSize / 1024 / 1024, nil
+}
+
+func readSparseHeader(content []byte) (vmdkSparseHeader, bool) {
+	var header vmdkSparseHeader
+
+	err := binary.Read(bytes.NewReader(content), binary.LittleEndian, &header)
+	if err != nil || header.MagicNumber != vmdkSparseMagic || len(content) < getSparseDataOffset(header) {
+		return header, false
+	}
+
+	return header, true
+}
+
+// getCapacityMB returns the size in megabytes rounded up
+func getCapacityMB(size uint64) uint64 {
+	return (size + 1024*1024 - 1) / (1024 * 1024)
+}
+
+// removeDiskFiles removes the disk image and the extent files of a split VMDK
+func removeDiskFiles(path string) error {
+	content, err := ioutil.ReadFile(path) // #nosec
+	if err != nil {
+		return err
+	}
+
+	if _, isSparse := readSparseHeader(content); !isSparse {
+		for _, extent := range vmdkExtentRegexp.FindAllStringSubmatch(string(content), -1) {
+			err := os.Remove(filepath.Join(filepath.Dir(path), extent[2]))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return os.Remove(path)
+}
+
+// getFileSizeMB returns the size of the disk image file in megabytes
+func getFileSizeMB(path string) uint64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+
+	return uint64(info.Size()) / 1024 / 1024
+}
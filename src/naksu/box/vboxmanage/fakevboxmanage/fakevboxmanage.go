@@ -0,0 +1,152 @@
+// Package fakevboxmanage is a test double of VBoxManage. It keeps the VMs, disk media,
+// snapshots and guest properties of a fake VirtualBox installation in a state file and
+// prints the output of the VirtualBox version given to Setup().
+//
+// The test binary acts as the fake VBoxManage. Call Main() at the start of TestMain(),
+// create the fake installation with Setup() and give the path of the test binary to
+// vboxmanage.SetVBoxManagePath():
+//
+//	func TestMain(m *testing.M) {
+//		fakevboxmanage.Main()
+//		os.Exit(m.Run())
+//	}
+package fakevboxmanage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// stateFileEnv tells the path of the state file to the test binary started as VBoxManage
+const stateFileEnv = "NAKSU_FAKE_VBOXMANAGE_STATE"
+
+// Main runs the fake VBoxManage and exits if this process has been started as
+// VBoxManage (see Setup()). Otherwise it returns immediately.
+func Main() {
+	statePath := os.Getenv(stateFileEnv)
+	if statePath == "" {
+		return
+	}
+
+	os.Exit(Run(statePath, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// Setup creates a fake VirtualBox installation of the given version (see Versions)
+// for the user whose home directory is homeDir. The state is written to stateDir.
+// VBoxManage started by this process uses the new installation. Returns the path of
+// the state file for LoadState().
+func Setup(stateDir string, version string, homeDir string) (string, error) {
+	_, err := GetVersion(version)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(stateDir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("could not create state directory: %v", err)
+	}
+
+	statePath := filepath.Join(stateDir, "fakevboxmanage.json")
+	state := &State{
+		Version: version,
+		HomeDir: homeDir,
+	}
+
+	err = state.Save(statePath)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Setenv(stateFileEnv, statePath)
+	if err != nil {
+		return "", fmt.Errorf("could not set %s: %v", stateFileEnv, err)
+	}
+
+	return statePath, nil
+}
+
+// Run executes the VBoxManage command given in args against the state in statePath
+// and returns the exit code of VBoxManage. The state is saved only if the command
+// succeeds.
+func Run(statePath string, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	state, err := LoadState(statePath)
+	if err != nil {
+		fmt.Fprintf(stderr, "fakevboxmanage: %v\n", err)
+		return exitCodeFailure
+	}
+
+	version, err := GetVersion(state.Version)
+	if err != nil {
+		fmt.Fprintf(stderr, "fakevboxmanage: %v\n", err)
+		return exitCodeFailure
+	}
+
+	s := &session{
+		state:   state,
+		version: version,
+		stdin:   stdin,
+		stdout:  stdout,
+	}
+
+	err = s.run(args)
+	if err != nil {
+		fail, ok := err.(*failure)
+		if !ok {
+			fail = &failure{exitCode: exitCodeFailure, message: err.Error()}
+		}
+
+		fmt.Fprint(stderr, fail.String())
+		return fail.exitCode
+	}
+
+	err = s.writeSettings()
+	if err == nil {
+		err = state.Save(statePath)
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "fakevboxmanage: %v\n", err)
+		return exitCodeFailure
+	}
+
+	return exitCodeSuccess
+}
+
+// run finds the handler of the command. Unsupported commands fail like unknown
+// commands so that the tests notice when naksu starts using a new command.
+func (s *session) run(args []string) error {
+	args = skipGlobalOptions(args)
+
+	if len(args) == 0 {
+		return newSyntaxError("No command given")
+	}
+
+	if args[0] == "--version" || args[0] == "-v" || args[0] == "-version" {
+		s.printf("%s\n", s.version.Full)
+		return nil
+	}
+
+	handler, ok := commands[args[0]]
+	if !ok {
+		return newSyntaxError(fmt.Sprintf("Invalid command '%s'", args[0]))
+	}
+
+	for _, failingCommand := range s.state.FailingCommands {
+		if failingCommand == args[0] {
+			return newFailure(fmt.Sprintf("Simulated failure of '%s'", args[0]), "E_FAIL (0x80004005)", "")
+		}
+	}
+
+	return handler(s, args[1:])
+}
+
+// skipGlobalOptions removes the options given before the command (e.g. "--nologo")
+func skipGlobalOptions(args []string) []string {
+	for len(args) > 0 && (args[0] == "--nologo" || args[0] == "-q") {
+		args = args[1:]
+	}
+
+	return args
+}
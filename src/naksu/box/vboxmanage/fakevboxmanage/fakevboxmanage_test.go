@@ -0,0 +1,242 @@
+package fakevboxmanage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeInstallation runs the fake VBoxManage in the test process
+type fakeInstallation struct {
+	t         *testing.T
+	statePath string
+	homeDir   string
+}
+
+func newFakeInstallation(t *testing.T, version string) (*fakeInstallation, func()) {
+	homeDir, err := ioutil.TempDir("", "fakevboxmanage")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+
+	statePath, err := Setup(filepath.Join(homeDir, "state"), version, homeDir)
+	if err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	cleanup := func() {
+		os.Unsetenv(stateFileEnv)
+		os.RemoveAll(homeDir)
+	}
+
+	return &fakeInstallation{t: t, statePath: statePath, homeDir: homeDir}, cleanup
+}
+
+// run executes VBoxManage and returns stdout, stderr and the exit code
+func (f *fakeInstallation) run(stdin []byte, args ...string) (string, string, int) {
+	var stdout, stderr bytes.Buffer
+	exitCode := Run(f.statePath, args, bytes.NewReader(stdin), &stdout, &stderr)
+
+	return stdout.String(), stderr.String(), exitCode
+}
+
+// mustRun executes VBoxManage and fails the test if the command fails
+func (f *fakeInstallation) mustRun(args ...string) string {
+	stdout, stderr, exitCode := f.run(nil, args...)
+	if exitCode != exitCodeSuccess {
+		f.t.Fatalf("VBoxManage %v exited with %d: %s", args, exitCode, stderr)
+	}
+
+	return stdout
+}
+
+func (f *fakeInstallation) loadState() *State {
+	state, err := LoadState(f.statePath)
+	if err != nil {
+		f.t.Fatalf("Could not load state: %v", err)
+	}
+
+	return state
+}
+
+func TestVersion(t *testing.T) {
+	for _, version := range Versions {
+		fake, cleanup := newFakeInstallation(t, version.Name)
+
+		stdout := fake.mustRun("--version")
+		if stdout != version.Full+"\n" {
+			t.Errorf("VBoxManage --version of %s prints %q, expected %q", version.Name, stdout, version.Full)
+		}
+
+		cleanup()
+	}
+
+	_, err := Setup(os.TempDir(), "4.3", os.TempDir())
+	if err == nil {
+		t.Errorf("Setup accepts unknown version 4.3")
+	}
+}
+
+func TestFailures(t *testing.T) {
+	fake, cleanup := newFakeInstallation(t, "6.1")
+	defer cleanup()
+
+	tables := []struct {
+		args     []string
+		exitCode int
+		stderr   string
+	}{
+		{[]string{"foo"}, exitCodeSyntax, "VBoxManage: error: Invalid command 'foo'\n"},
+		{[]string{"showvminfo", "NaksuAbittiKTP", "--machinereadable"}, exitCodeFailure, "VBoxManage: error: Could not find a registered machine named 'NaksuAbittiKTP'\nVBoxManage: error: Details: code VBOX_E_OBJECT_NOT_FOUND"},
+		{[]string{"closemedium", "disk", "/nonexistent.vdi"}, exitCodeFailure, "VBoxManage: error: Could not find file for the medium '/nonexistent.vdi' (VERR_FILE_NOT_FOUND)\n"},
+		{[]string{"list", "foo"}, exitCodeSyntax, "VBoxManage: error: Unknown subcommand 'foo'\n"},
+	}
+
+	for _, table := range tables {
+		stdout, stderr, exitCode := fake.run(nil, table.args...)
+		if exitCode != table.exitCode || !strings.HasPrefix(stderr, table.stderr) || stdout != "" {
+			t.Errorf("VBoxManage %v gives %d, %q and %q, expected %d and %q", table.args, exitCode, stdout, stderr, table.exitCode, table.stderr)
+		}
+	}
+}
+
+func TestFailingCommands(t *testing.T) {
+	fake, cleanup := newFakeInstallation(t, "6.1")
+	defer cleanup()
+
+	state := fake.loadState()
+	state.FailingCommands = []string{"createvm"}
+	if err := state.Save(fake.statePath); err != nil {
+		t.Fatalf("Could not save state: %v", err)
+	}
+
+	_, stderr, exitCode := fake.run(nil, "createvm", "--name", "NaksuAbittiKTP", "--register")
+	if exitCode != exitCodeFailure || !strings.Contains(stderr, "Simulated failure of 'createvm'") {
+		t.Errorf("Failing createvm gives %d and %q", exitCode, stderr)
+	}
+
+	if vms := fake.loadState().VMs; len(vms) != 0 {
+		t.Errorf("Failing createvm registered %+v", vms)
+	}
+
+	fake.mustRun("list", "vms")
+}
+
+func TestClipboardOption(t *testing.T) {
+	tables := []struct {
+		version  string
+		option   string
+		exitCode int
+	}{
+		{"5.2", "--clipboard", exitCodeSuccess},
+		{"5.2", "--clipboard-mode", exitCodeSyntax},
+		{"6.0", "--clipboard", exitCodeSuccess},
+		{"6.1", "--clipboard", exitCodeSyntax},
+		{"6.1", "--clipboard-mode", exitCodeSuccess},
+		{"7.0", "--clipboard-mode", exitCodeSuccess},
+	}
+
+	for _, table := range tables {
+		fake, cleanup := newFakeInstallation(t, table.version)
+
+		fake.mustRun("createvm", "--name", "NaksuAbittiKTP", "--register")
+		_, stderr, exitCode := fake.run(nil, "modifyvm", "NaksuAbittiKTP", table.option, "bidirectional")
+		if exitCode != table.exitCode {
+			t.Errorf("modifyvm %s of %s exited with %d (%q), expected %d", table.option, table.version, exitCode, stderr, table.exitCode)
+		}
+
+		cleanup()
+	}
+}
+
+func TestServerLifecycle(t *testing.T) {
+	fake, cleanup := newFakeInstallation(t, "7.0")
+	defer cleanup()
+
+	image := []byte(strings.Repeat("abitti", 1000))
+	diskPath := filepath.Join(fake.homeDir, "VirtualBox VMs", "NaksuAbittiKTP.vdi")
+	if err := os.MkdirAll(filepath.Dir(diskPath), 0755); err != nil {
+		t.Fatalf("Could not create machine folder: %v", err)
+	}
+
+	_, stderr, exitCode := fake.run(image, "convertfromraw", "stdin", diskPath, "6000", "--format", "VDI")
+	if exitCode != exitCodeSuccess {
+		t.Fatalf("convertfromraw failed: %s", stderr)
+	}
+
+	fake.mustRun("modifyhd", diskPath, "--resize", "56320")
+	fake.mustRun("createvm", "--name", "NaksuAbittiKTP", "--register")
+	fake.mustRun("storagectl", "NaksuAbittiKTP", "--name", "SATA Controller", "--add", "sata")
+	fake.mustRun("storageattach", "NaksuAbittiKTP", "--storagectl", "SATA Controller", "--port", "0", "--device", "0", "--type", "hdd", "--medium", diskPath)
+	fake.mustRun("snapshot", "NaksuAbittiKTP", "take", "Installed")
+	fake.mustRun("modifyvm", "NaksuAbittiKTP", "--nic1", "bridged", "--bridgeadapter1", "eth0")
+	fake.mustRun("startvm", "NaksuAbittiKTP", "--type", "gui")
+
+	if value := fake.mustRun("guestproperty", "get", "NaksuAbittiKTP", readyProperty); value != "Value: 10.0.2.15\n" {
+		t.Errorf("Guest property of a running VM is %q", value)
+	}
+
+	_, stderr, exitCode = fake.run(nil, "modifyvm", "NaksuAbittiKTP", "--memory", "8192")
+	if exitCode != exitCodeFailure || !strings.Contains(stderr, "is already locked by a session") {
+		t.Errorf("modifyvm of a running VM gives %d and %q", exitCode, stderr)
+	}
+
+	_, stderr, exitCode = fake.run(nil, "clonemedium", diskPath, filepath.Join(fake.homeDir, "backup.vmdk"), "--format", "VMDK")
+	if exitCode != exitCodeFailure || !strings.Contains(stderr, "is locked for writing") {
+		t.Errorf("clonemedium of a running VM gives %d and %q", exitCode, stderr)
+	}
+
+	fake.mustRun("controlvm", "NaksuAbittiKTP", "acpipowerbutton")
+
+	vmInfo := fake.mustRun("showvminfo", "NaksuAbittiKTP", "--machinereadable")
+	for _, line := range []string{`VMState="poweroff"`, `"SATA Controller-0-0"="` + diskPath + `"`, `CurrentSnapshotName="Installed"`} {
+		if !strings.Contains(vmInfo, line+"\n") {
+			t.Errorf("showvminfo output does not contain %s:\n%s", line, vmInfo)
+		}
+	}
+
+	if fake.loadState().VMs[0].DiskChanges != 1 {
+		t.Errorf("Starting the VM did not change the disk")
+	}
+
+	fake.mustRun("snapshot", "NaksuAbittiKTP", "restore", "Installed")
+	if fake.loadState().VMs[0].DiskChanges != 0 {
+		t.Errorf("Restoring the snapshot did not reset the disk")
+	}
+
+	backupPath := filepath.Join(fake.homeDir, "backup.vmdk")
+	stdout := fake.mustRun("clonemedium", diskPath, backupPath, "--format", "VMDK", "--variant", "Split2G")
+	if !strings.HasPrefix(stdout, "0%...10%") || !strings.Contains(stdout, "Clone medium created in format 'VMDK'") {
+		t.Errorf("clonemedium prints %q", stdout)
+	}
+
+	data, capacityMB, err := readDiskData(backupPath)
+	if err != nil || !bytes.Equal(data, image) || capacityMB != 56320 {
+		t.Errorf("Clone contains %d bytes of %d MB (%v), expected %d bytes of 56320 MB", len(data), capacityMB, err, len(image))
+	}
+
+	extents, _ := filepath.Glob(filepath.Join(fake.homeDir, "backup-s*.vmdk"))
+	if len(extents) != 28 {
+		t.Errorf("Split clone has %d extents, expected 28", len(extents))
+	}
+
+	fake.mustRun("closemedium", backupPath, "--delete")
+	if extents, _ = filepath.Glob(filepath.Join(fake.homeDir, "backup*")); len(extents) != 0 {
+		t.Errorf("closemedium --delete left %v", extents)
+	}
+
+	fake.mustRun("unregistervm", "NaksuAbittiKTP", "--delete")
+
+	if list := fake.mustRun("list", "vms"); list != "" {
+		t.Errorf("list vms prints %q after unregistervm", list)
+	}
+
+	for _, path := range []string{diskPath, filepath.Join(fake.homeDir, "VirtualBox VMs", "NaksuAbittiKTP")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("unregistervm --delete did not remove %s", path)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package fakevboxmanage
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The values of VMState in "showvminfo --machinereadable" used by the fake
+const (
+	StatePoweredOff   = "poweroff"
+	StateRunning      = "running"
+	StatePaused       = "paused"
+	StateSaved        = "saved"
+	StateAborted      = "aborted"
+	StateAbortedSaved = "abortedsaved"
+)
+
+// State is the fake VirtualBox installation. It is stored as JSON as every
+// VBoxManage command runs in a new process.
+type State struct {
+	// Version is the name of the simulated VirtualBox version (see Versions)
+	Version string `json:"version"`
+	// HomeDir is the home directory of the user. The VMs are created to "VirtualBox VMs"
+	// and the global settings are written to .config/VirtualBox under it.
+	HomeDir string `json:"homeDir"`
+	// VMs are the registered VMs in the order of registration
+	VMs []*VM `json:"vms"`
+	// Media are the disk images created or opened by VirtualBox
+	Media []*Medium `json:"media"`
+	// FailingCommands are the commands (e.g. "snapshot") which fail without changing
+	// the state. The tests set them to simulate failures.
+	FailingCommands []string `json:"failingCommands,omitempty"`
+}
+
+// VM is a registered virtual machine
+type VM struct {
+	Name  string `json:"name"`
+	UUID  string `json:"uuid"`
+	State string `json:"state"`
+	// Settings are the values given to modifyvm, the option names without dashes
+	Settings        map[string]string `json:"settings"`
+	GuestProperties map[string]string `json:"guestProperties"`
+	ExtraData       map[string]string `json:"extraData"`
+	// SharedFolders maps the names of the shared folders to the host paths
+	SharedFolders      map[string]string `json:"sharedFolders"`
+	StorageControllers []string          `json:"storageControllers"`
+	// Disk is the location of the medium attached to the first port of
+	// "SATA Controller" or empty if there is none
+	Disk string `json:"disk"`
+	// Snapshots are the snapshots of the VM, the oldest first. Each snapshot is
+	// a child of the previous one.
+	Snapshots       []Snapshot `json:"snapshots"`
+	CurrentSnapshot string     `json:"currentSnapshot"`
+	// DiskChanges counts the times the guest has been started. Restoring a snapshot
+	// returns it to the value of the snapshot. This tells the tests whether the exams
+	// written by the guest have been removed.
+	DiskChanges int `json:"diskChanges"`
+}
+
+// Snapshot is a snapshot of a VM
+type Snapshot struct {
+	Name        string    `json:"name"`
+	UUID        string    `json:"uuid"`
+	Created     time.Time `json:"created"`
+	DiskChanges int       `json:"diskChanges"`
+}
+
+// Medium is a disk image known by VirtualBox
+type Medium struct {
+	UUID     string `json:"uuid"`
+	Location string `json:"location"`
+	Format   string `json:"format"`
+	// CapacityMB is the virtual size of the disk
+	CapacityMB uint64 `json:"capacityMB"`
+	// Registered is true if the medium is in the media registry (i.e. it has been
+	// attached to a VM or created by clonemedium and not closed)
+	Registered bool `json:"registered"`
+	// Compactions counts the times the medium has been compacted
+	Compactions int `json:"compactions"`
+}
+
+// LoadState reads the state written by Setup() or Run()
+func LoadState(statePath string) (*State, error) {
+	content, err := ioutil.ReadFile(statePath) // #nosec
+	if err != nil {
+		return nil, fmt.Errorf("could not read state: %v", err)
+	}
+
+	state := &State{}
+	err = json.Unmarshal(content, state)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse state: %v", err)
+	}
+
+	return state, nil
+}
+
+// Save writes the state to statePath. The tests may change the state (e.g. to
+// simulate a crash) and save it before calling naksu.
+func (state *State) Save(statePath string) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(statePath, content, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write state: %v", err)
+	}
+
+	return nil
+}
+
+// FindVM returns the VM with the given name or UUID or nil if it is not registered
+func (state *State) FindVM(nameOrUUID string) *VM {
+	for _, vm := range state.VMs {
+		if vm.Name == nameOrUUID || vm.UUID == nameOrUUID {
+			return vm
+		}
+	}
+
+	return nil
+}
+
+// FindMedium returns the medium with the given location or UUID or nil if it is not known
+func (state *State) FindMedium(locationOrUUID string) *Medium {
+	for _, medium := range state.Media {
+		if medium.UUID == locationOrUUID || medium.Location == locationOrUUID {
+			return medium
+		}
+	}
+
+	return nil
+}
+
+func (state *State) removeVM(vm *VM) {
+	vms := []*VM{}
+	for _, otherVM := range state.VMs {
+		if otherVM != vm {
+			vms = append(vms, otherVM)
+		}
+	}
+
+	state.VMs = vms
+}
+
+func (state *State) removeMedium(medium *Medium) {
+	media := []*Medium{}
+	for _, otherMedium := range state.Media {
+		if otherMedium != medium {
+			media = append(media, otherMedium)
+		}
+	}
+
+	state.Media = media
+}
+
+// findAttachedVM returns the VM using the given medium or nil if it is not attached
+func (state *State) findAttachedVM(medium *Medium) *VM {
+	for _, vm := range state.VMs {
+		if vm.Disk == medium.Location {
+			return vm
+		}
+	}
+
+	return nil
+}
+
+// getMachineFolder returns the default machine folder ("VirtualBox VMs")
+func (state *State) getMachineFolder() string {
+	return filepath.Join(state.HomeDir, "VirtualBox VMs")
+}
+
+// getGlobalSettingsPath returns the path of VirtualBox.xml
+func (state *State) getGlobalSettingsPath() string {
+	return filepath.Join(state.HomeDir, ".config", "VirtualBox", "VirtualBox.xml")
+}
+
+// getVMDirectory returns the directory of the VM settings and logs
+func (state *State) getVMDirectory(vmName string) string {
+	return filepath.Join(state.getMachineFolder(), vmName)
+}
+
+// getSettingsPath returns the path of the VM settings file (.vbox)
+func (state *State) getSettingsPath(vmName string) string {
+	return filepath.Join(state.getVMDirectory(vmName), vmName+".vbox")
+}
+
+// findSnapshot returns the index of the snapshot with the given name or UUID or -1
+func (vm *VM) findSnapshot(nameOrUUID string) int {
+	for n, snapshot := range vm.Snapshots {
+		if snapshot.Name == nameOrUUID || snapshot.UUID == nameOrUUID {
+			return n
+		}
+	}
+
+	return -1
+}
+
+// isRunning returns true if the VM process is running
+func (vm *VM) isRunning() bool {
+	return vm.State == StateRunning || vm.State == StatePaused
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	buffer := make([]byte, 16)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		panic(fmt.Sprintf("could not read random bytes: %v", err))
+	}
+
+	buffer[6] = (buffer[6] & 0x0f) | 0x40
+	buffer[8] = (buffer[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buffer[0:4], buffer[4:6], buffer[6:8], buffer[8:10], buffer[10:])
+}
+
+// vboxFile is the VM settings file (.vbox) read by vboxmanage.ListSnapshots()
+type vboxFile struct {
+	XMLName xml.Name    `xml:"VirtualBox"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Version string      `xml:"version,attr"`
+	Machine vboxMachine `xml:"Machine"`
+}
+
+type vboxMachine struct {
+	UUID            string        `xml:"uuid,attr"`
+	Name            string        `xml:"name,attr"`
+	OSType          string        `xml:"OSType,attr"`
+	CurrentSnapshot string        `xml:"currentSnapshot,attr,omitempty"`
+	SnapshotFolder  string        `xml:"snapshotFolder,attr"`
+	Snapshot        *vboxSnapshot `xml:"Snapshot,omitempty"`
+}
+
+type vboxSnapshot struct {
+	UUID      string         `xml:"uuid,attr"`
+	Name      string         `xml:"name,attr"`
+	TimeStamp string         `xml:"timeStamp,attr"`
+	Children  []vboxSnapshot `xml:"Snapshots>Snapshot"`
+}
+
+// globalFile is the global settings file (VirtualBox.xml). The hard disks are
+// written one per line like VirtualBox does (see detectAndFixDuplicateHardDiskProblem()).
+type globalFile struct {
+	XMLName          xml.Name             `xml:"VirtualBox"`
+	Xmlns            string               `xml:"xmlns,attr"`
+	Version          string               `xml:"version,attr"`
+	Machines         []globalMachineEntry `xml:"Global>MachineRegistry>MachineEntry"`
+	HardDisks        []globalHardDisk     `xml:"Global>MediaRegistry>HardDisks>HardDisk"`
+	SystemProperties struct {
+		DefaultMachineFolder string `xml:"defaultMachineFolder,attr"`
+	} `xml:"Global>SystemProperties"`
+}
+
+type globalMachineEntry struct {
+	UUID string `xml:"uuid,attr"`
+	Src  string `xml:"src,attr"`
+}
+
+type globalHardDisk struct {
+	UUID     string `xml:"uuid,attr"`
+	Location string `xml:"location,attr"`
+	Format   string `xml:"format,attr"`
+	Type     string `xml:"type,attr"`
+}
+
+const settingsNamespace = "http://www.virtualbox.org/"
+
+// writeVMSettings writes the settings file of the VM. The previous file is kept as
+// .vbox-prev like VirtualBox does.
+func (state *State) writeVMSettings(vm *VM) error {
+	settings := vboxFile{
+		Xmlns:   settingsNamespace,
+		Version: "1.16-linux",
+		Machine: vboxMachine{
+			UUID:           "{" + vm.UUID + "}",
+			Name:           vm.Name,
+			OSType:         vm.Settings["ostype"],
+			SnapshotFolder: "Snapshots",
+		},
+	}
+
+	// Each snapshot is the only child of the previous one
+	var parent *vboxSnapshot
+	for _, snapshot := range vm.Snapshots {
+		node := vboxSnapshot{
+			UUID:      "{" + snapshot.UUID + "}",
+			Name:      snapshot.Name,
+			TimeStamp: snapshot.Created.UTC().Format(time.RFC3339),
+		}
+
+		if snapshot.Name == vm.CurrentSnapshot {
+			settings.Machine.CurrentSnapshot = node.UUID
+		}
+
+		if parent == nil {
+			settings.Machine.Snapshot = &node
+			parent = settings.Machine.Snapshot
+		} else {
+			parent.Children = []vboxSnapshot{node}
+			parent = &parent.Children[0]
+		}
+	}
+
+	content, err := xml.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	settingsPath := state.getSettingsPath(vm.Name)
+	err = os.MkdirAll(filepath.Dir(settingsPath), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create vm directory: %v", err)
+	}
+
+	if _, err := os.Stat(settingsPath); err == nil {
+		err = os.Rename(settingsPath, settingsPath+"-prev")
+		if err != nil {
+			return fmt.Errorf("could not keep previous settings: %v", err)
+		}
+	}
+
+	return ioutil.WriteFile(settingsPath, append([]byte(xml.Header), content...), 0600)
+}
+
+// writeGlobalSettings writes VirtualBox.xml listing the registered VMs and media
+func (state *State) writeGlobalSettings() error {
+	settings := globalFile{
+		Xmlns:   settingsNamespace,
+		Version: "1.12-linux",
+	}
+	settings.SystemProperties.DefaultMachineFolder = state.getMachineFolder()
+
+	for _, vm := range state.VMs {
+		settings.Machines = append(settings.Machines, globalMachineEntry{
+			UUID: "{" + vm.UUID + "}",
+			Src:  state.getSettingsPath(vm.Name),
+		})
+	}
+
+	for _, medium := range state.Media {
+		if !medium.Registered {
+			continue
+		}
+
+		settings.HardDisks = append(settings.HardDisks, globalHardDisk{
+			UUID:     "{" + medium.UUID + "}",
+			Location: medium.Location,
+			Format:   medium.Format,
+			Type:     "Normal",
+		})
+	}
+
+	content, err := xml.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	settingsPath := state.getGlobalSettingsPath()
+	err = os.MkdirAll(filepath.Dir(settingsPath), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create virtualbox settings directory: %v", err)
+	}
+
+	return ioutil.WriteFile(settingsPath, append([]byte(xml.Header), content...), 0600)
+}
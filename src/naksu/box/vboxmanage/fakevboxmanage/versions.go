@@ -0,0 +1,63 @@
+package fakevboxmanage
+
+import (
+	"fmt"
+)
+
+// Version describes how the output of VBoxManage differs between VirtualBox versions
+type Version struct {
+	// Name is the major and minor version (e.g. "6.1") given to Setup()
+	Name string
+	// Full is printed by "VBoxManage --version"
+	Full string
+	// ClipboardOption is the modifyvm option setting the shared clipboard mode.
+	// VirtualBox 6.1 renamed --clipboard to --clipboard-mode.
+	ClipboardOption string
+	// PropertyWidth is the width of the property names in "list systemproperties"
+	PropertyWidth int
+	// LockedMessage is printed when the VM is locked by another session
+	LockedMessage string
+}
+
+// Versions are the supported VirtualBox versions, the oldest first
+var Versions = []Version{
+	{
+		Name:            "5.2",
+		Full:            "5.2.44r139111",
+		ClipboardOption: "clipboard",
+		PropertyWidth:   32,
+		LockedMessage:   "The machine '%s' is already locked for a session (or being unlocked)",
+	},
+	{
+		Name:            "6.0",
+		Full:            "6.0.24r139119",
+		ClipboardOption: "clipboard",
+		PropertyWidth:   32,
+		LockedMessage:   "The machine '%s' is already locked for a session (or being unlocked)",
+	},
+	{
+		Name:            "6.1",
+		Full:            "6.1.50r161033",
+		ClipboardOption: "clipboard-mode",
+		PropertyWidth:   33,
+		LockedMessage:   "The machine '%s' is already locked for a session (or being unlocked)",
+	},
+	{
+		Name:            "7.0",
+		Full:            "7.0.20r163906",
+		ClipboardOption: "clipboard-mode",
+		PropertyWidth:   35,
+		LockedMessage:   "The machine '%s' is already locked by a session (or being locked or unlocked)",
+	},
+}
+
+// GetVersion returns the version with the given name
+func GetVersion(name string) (Version, error) {
+	for _, version := range Versions {
+		if version.Name == name {
+			return version, nil
+		}
+	}
+
+	return Version{}, fmt.Errorf("unknown virtualbox version '%s'", name)
+}
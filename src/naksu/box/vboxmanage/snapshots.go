@@ -0,0 +1,78 @@
+package vboxmanage
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Snapshot is a snapshot of a VirtualBox VM
+type Snapshot struct {
+	Name    string
+	Created time.Time
+}
+
+// vboxSnapshot is a <Snapshot> element of the VM settings file. The child
+// snapshots are nested inside their parent.
+type vboxSnapshot struct {
+	Name      string         `xml:"name,attr"`
+	TimeStamp string         `xml:"timeStamp,attr"`
+	Children  []vboxSnapshot `xml:"Snapshots>Snapshot"`
+}
+
+type vboxSettings struct {
+	Machine struct {
+		Snapshot *vboxSnapshot `xml:"Snapshot"`
+	} `xml:"Machine"`
+}
+
+// ListSnapshots returns the snapshots of the VM. VBoxManage does not show the
+// snapshot times so they are read from the VM settings file (.vbox).
+func ListSnapshots(vmName string) ([]Snapshot, error) {
+	vmInfo, err := GetVMInfo(vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	if vmInfo.SettingsFile == "" {
+		return nil, errors.New("could not get vm settings file")
+	}
+
+	content, err := ioutil.ReadFile(vmInfo.SettingsFile) // #nosec
+	if err != nil {
+		return nil, fmt.Errorf("could not read vm settings file: %v", err)
+	}
+
+	return parseSnapshots(content)
+}
+
+// parseSnapshots returns the snapshots listed in the VM settings file, parents first
+func parseSnapshots(content []byte) ([]Snapshot, error) {
+	var settings vboxSettings
+
+	err := xml.Unmarshal(content, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse vm settings file: %v", err)
+	}
+
+	snapshots := []Snapshot{}
+	if settings.Machine.Snapshot != nil {
+		snapshots = appendSnapshots(snapshots, *settings.Machine.Snapshot)
+	}
+
+	return snapshots, nil
+}
+
+func appendSnapshots(snapshots []Snapshot, snapshot vboxSnapshot) []Snapshot {
+	// A missing or malformed time stamp gives a zero time
+	created, _ := time.Parse(time.RFC3339, snapshot.TimeStamp)
+
+	snapshots = append(snapshots, Snapshot{Name: snapshot.Name, Created: created})
+	for _, child := range snapshot.Children {
+		snapshots = appendSnapshots(snapshots, child)
+	}
+
+	return snapshots
+}
@@ -7,23 +7,115 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strings"
 
 	"naksu/log"
 )
 
-// CleanUpTrashVMDirectories tries to find and delete leftover VM directories that only contain one .vbox file and nothing else
+const (
+	settingsFileSuffix         = ".vbox"
+	previousSettingsFileSuffix = ".vbox-prev"
+)
+
+// CleanUpTrashVMDirectories tries to find and delete leftover VM directories that only contain .vbox files and nothing else
 func CleanUpTrashVMDirectories() {
-	defaultVMDirectory, err := virtualBoxDefaultVMDirectory()
+	trashVMDirectories, err := FindTrashVMDirectories()
 	if err != nil {
-		log.Debug(fmt.Sprintf("Error searching for trash VM directories (get default vm dir): %v", err))
+		log.Debug(fmt.Sprintf("Error searching for trash VM directories: %v", err))
 		return
 	}
 
-	entriesInDefaultVMDir, err := ioutil.ReadDir(defaultVMDirectory)
+	for _, trashVMDirectory := range trashVMDirectories {
+		log.Debug(fmt.Sprintf("Removing trash VM dir %s", trashVMDirectory))
+		err := os.RemoveAll(trashVMDirectory)
+		if err != nil {
+			log.Debug(fmt.Sprintf("Error removing trash VM dir %s", trashVMDirectory))
+		}
+	}
+}
+
+// FindTrashVMDirectories returns the directories in the default machine folder which
+// only contain settings files (.vbox, .vbox-prev) of VMs which are not registered
+func FindTrashVMDirectories() ([]string, error) {
+	virtualBoxConfig, vmDirectories, err := listVMDirectories()
 	if err != nil {
-		log.Debug(fmt.Sprintf("Error searching for trash VM directories (list default vm dir %s): %v", defaultVMDirectory, err))
-		return
+		return nil, err
+	}
+
+	trashVMDirectories := []string{}
+
+	for vmDirectory, entries := range vmDirectories {
+		if isTrashVMDirectory(virtualBoxConfig, vmDirectory, entries) {
+			trashVMDirectories = append(trashVMDirectories, vmDirectory)
+		}
+	}
+
+	sort.Strings(trashVMDirectories)
+
+	return trashVMDirectories, nil
+}
+
+// FindStalePreviousSettingsFiles returns the previous VM settings files (.vbox-prev) which
+// have been left without the current settings file (.vbox) outside trash VM directories
+func FindStalePreviousSettingsFiles() ([]string, error) {
+	virtualBoxConfig, vmDirectories, err := listVMDirectories()
+	if err != nil {
+		return nil, err
+	}
+
+	staleFiles := []string{}
+
+	for vmDirectory, entries := range vmDirectories {
+		if isTrashVMDirectory(virtualBoxConfig, vmDirectory, entries) {
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), previousSettingsFileSuffix) {
+				continue
+			}
+
+			previousSettingsFile := path.Join(vmDirectory, entry.Name())
+			if _, err := os.Stat(GetCurrentSettingsFile(previousSettingsFile)); os.IsNotExist(err) {
+				staleFiles = append(staleFiles, previousSettingsFile)
+			}
+		}
+	}
+
+	sort.Strings(staleFiles)
+
+	return staleFiles, nil
+}
+
+// GetCurrentSettingsFile returns the settings file (.vbox) of a previous settings file (.vbox-prev)
+func GetCurrentSettingsFile(previousSettingsFile string) string {
+	return strings.TrimSuffix(previousSettingsFile, previousSettingsFileSuffix) + settingsFileSuffix
+}
+
+// listVMDirectories returns the global VirtualBox configuration and the directories of
+// the default machine folder with their entries
+func listVMDirectories() (VirtualBoxConfig, map[string][]os.FileInfo, error) {
+	virtualBoxConfig, err := ReadVirtualBoxConfig()
+	if errors.Is(err, os.ErrNotExist) {
+		// No VMs have been registered yet
+		virtualBoxConfig = VirtualBoxConfig{}
+	} else if err != nil {
+		return VirtualBoxConfig{}, nil, err
+	}
+
+	defaultVMDirectory, err := virtualBoxDefaultVMDirectory()
+	if err != nil {
+		return VirtualBoxConfig{}, nil, fmt.Errorf("get default vm dir: %v", err)
+	}
+
+	vmDirectories := map[string][]os.FileInfo{}
+
+	entriesInDefaultVMDir, err := ioutil.ReadDir(defaultVMDirectory)
+	if os.IsNotExist(err) {
+		return virtualBoxConfig, vmDirectories, nil
+	} else if err != nil {
+		return VirtualBoxConfig{}, nil, fmt.Errorf("list default vm dir %s: %v", defaultVMDirectory, err)
 	}
 
 	for _, entryInDefaultVMDirRoot := range entriesInDefaultVMDir {
@@ -31,20 +123,45 @@ func CleanUpTrashVMDirectories() {
 			continue
 		}
 
-		fullPathToPotentialTrashVMDir := path.Join(defaultVMDirectory, entryInDefaultVMDirRoot.Name())
-		entriesInSubDir, err := ioutil.ReadDir(fullPathToPotentialTrashVMDir)
+		fullPathToVMDir := path.Join(defaultVMDirectory, entryInDefaultVMDirRoot.Name())
+		entriesInSubDir, err := ioutil.ReadDir(fullPathToVMDir)
 		if err != nil {
-			log.Debug(fmt.Sprintf("Error searching for trash VM directories (listing '%s'): %v", fullPathToPotentialTrashVMDir, err))
-			return
-		}
-		if len(entriesInSubDir) == 1 && !entriesInSubDir[0].IsDir() && strings.HasSuffix(entriesInSubDir[0].Name(), ".vbox") {
-			log.Debug(fmt.Sprintf("Removing trash VM dir %s", fullPathToPotentialTrashVMDir))
-			err := os.RemoveAll(fullPathToPotentialTrashVMDir)
-			if err != nil {
-				log.Debug(fmt.Sprintf("Error removing trash VM dir %s", fullPathToPotentialTrashVMDir))
-			}
+			return VirtualBoxConfig{}, nil, fmt.Errorf("listing '%s': %v", fullPathToVMDir, err)
 		}
+
+		vmDirectories[fullPathToVMDir] = entriesInSubDir
+	}
+
+	return virtualBoxConfig, vmDirectories, nil
+}
+
+// isTrashVMDirectory returns true if the directory contains nothing but the settings
+// files of a VM which is not registered
+func isTrashVMDirectory(virtualBoxConfig VirtualBoxConfig, vmDirectory string, entries []os.FileInfo) bool {
+	if len(entries) == 0 {
+		return false
 	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			return false
+		}
+
+		if !strings.HasSuffix(entry.Name(), settingsFileSuffix) && !strings.HasSuffix(entry.Name(), previousSettingsFileSuffix) {
+			return false
+		}
+
+		settingsFile := path.Join(vmDirectory, entry.Name())
+		if strings.HasSuffix(settingsFile, previousSettingsFileSuffix) {
+			settingsFile = GetCurrentSettingsFile(settingsFile)
+		}
+
+		if virtualBoxConfig.IsMachineRegistered(settingsFile) {
+			return false
+		}
+	}
+
+	return true
 }
 
 func virtualBoxDefaultVMDirectory() (string, error) {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"strings"
 	"time"
 
 	"naksu/log"
@@ -21,17 +22,7 @@ func detectAndFixDuplicateHardDiskProblem(vBoxManageOutput string) (wasFixed boo
 		orphanedHardDiskUUID := duplicateHardDiskRegexpMatch[1]
 		log.Debug(fmt.Sprintf("Detected duplicate VirtualBox disk %s, fixing...", orphanedHardDiskUUID))
 
-		fixedVirtualBoxConfigPath, err := writeFixedVirtualBoxConfig(orphanedHardDiskUUID)
-		if err != nil {
-			return false, err
-		}
-
-		virtualBoxConfigBackupPath, err := backupVirtualBoxConfig()
-		if err != nil {
-			return false, err
-		}
-
-		err = replaceVirtualBoxConfigWithFixedOne(fixedVirtualBoxConfigPath, virtualBoxConfigBackupPath)
+		_, err := RemoveHardDisksFromVirtualBoxConfig([]string{orphanedHardDiskUUID})
 		if err != nil {
 			return false, err
 		}
@@ -41,7 +32,30 @@ func detectAndFixDuplicateHardDiskProblem(vBoxManageOutput string) (wasFixed boo
 	return false, nil
 }
 
-func writeFixedVirtualBoxConfig(orphanedHardDiskUUID string) (string, error) {
+// RemoveHardDisksFromVirtualBoxConfig removes the given disk images from the media registry
+// by editing VirtualBox.xml. This is needed when VBoxManage cannot remove them itself
+// (see detectAndFixDuplicateHardDiskProblem()). The original file is kept and its path
+// is returned. Only disks without differencing disks can be removed.
+func RemoveHardDisksFromVirtualBoxConfig(uuids []string) (string, error) {
+	fixedVirtualBoxConfigPath, err := writeFixedVirtualBoxConfig(uuids)
+	if err != nil {
+		return "", err
+	}
+
+	virtualBoxConfigBackupPath, err := backupVirtualBoxConfig()
+	if err != nil {
+		return "", err
+	}
+
+	err = replaceVirtualBoxConfigWithFixedOne(fixedVirtualBoxConfigPath, virtualBoxConfigBackupPath)
+	if err != nil {
+		return "", err
+	}
+
+	return virtualBoxConfigBackupPath, nil
+}
+
+func writeFixedVirtualBoxConfig(orphanedHardDiskUUIDs []string) (string, error) {
 	virtualBoxConfigFile, err := os.Open(getVirtualBoxConfigPath())
 	if err != nil {
 		log.Debug(fmt.Sprintf("Failed to open virtualbox configuration file %s", getVirtualBoxConfigPath()))
@@ -65,11 +79,11 @@ func writeFixedVirtualBoxConfig(orphanedHardDiskUUID string) (string, error) {
 	fixedVirtualBoxConfigWriter := bufio.NewWriter(fixedVirtualBoxConfigFile)
 	for scanner.Scan() {
 		line := scanner.Text()
-		isDuplicateHardDiskLine, err := regexp.MatchString("<HardDisk uuid=\"{"+orphanedHardDiskUUID+"}\"", line)
-
-		if err != nil {
-			log.Debug(fmt.Sprintf("Error trying to regexp, UUID=%s", orphanedHardDiskUUID))
-			return "", err
+		isDuplicateHardDiskLine := false
+		for _, orphanedHardDiskUUID := range orphanedHardDiskUUIDs {
+			if strings.Contains(line, "<HardDisk uuid=\"{"+orphanedHardDiskUUID+"}\"") {
+				isDuplicateHardDiskLine = true
+			}
 		}
 
 		if !isDuplicateHardDiskLine {
@@ -94,7 +108,7 @@ func writeFixedVirtualBoxConfig(orphanedHardDiskUUID string) (string, error) {
 }
 
 func backupVirtualBoxConfig() (string, error) {
-	virtualBoxConfigBackupPath := getVirtualBoxConfigPath() + ".naksubackup"
+	virtualBoxConfigBackupPath := getConfigBackupPath(getVirtualBoxConfigPath())
 	if err := os.Rename(getVirtualBoxConfigPath(), virtualBoxConfigBackupPath); err != nil {
 		log.Debug(fmt.Sprintf("Failed to backup %s to %s", getVirtualBoxConfigPath(), virtualBoxConfigBackupPath))
 		return "", err
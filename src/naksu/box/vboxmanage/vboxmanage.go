@@ -1,11 +1,12 @@
 package vboxmanage
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"regexp"
 	"strings"
-	"time"
 
 	semver "github.com/blang/semver/v4"
 	memory_cache "github.com/paulusrobin/go-memory-cache/memory-cache"
@@ -19,7 +20,6 @@ const vBoxManageOutputNoVMInstalled string = "Could not find a registered machin
 
 // vBoxResponseCache is initialised by init() -> ensureVBoxResponseCacheInitialised()
 var vBoxResponseCache memory_cache.Cache
-var vBoxManageStarted int64
 
 type VBoxCommand = []string
 
@@ -29,29 +29,38 @@ func init() {
 }
 
 func RunCommand(args VBoxCommand) (string, error) {
-	return runCommand(args, true)
+	return runCommand(context.Background(), args, nil, nil, true)
+}
+
+// RunCommandContext executes VBoxManage like RunCommand(). The command is cancelled
+// (and VBoxManage killed) when ctx is cancelled.
+func RunCommandContext(ctx context.Context, args VBoxCommand) (string, error) {
+	return runCommand(ctx, args, nil, nil, true)
 }
 
 func RunCommandWithoutLogging(args VBoxCommand) (string, error) {
-	return runCommand(args, false)
+	return runCommand(context.Background(), args, nil, nil, false)
 }
 
-func runCommand(args VBoxCommand, logOutput bool) (string, error) {
-	// There is an ongoing VBoxManage call (break free after 240 loops)
-	// This locking avoids executing multiple instances of VBoxManage at the same time. Calling
-	// VBoxManage simulaneously tends to cause E_ACCESSDENIED errors from VBoxManage.
-	tryCounter := 0
-	for (vBoxManageStarted != 0) && (tryCounter < 240) {
-		time.Sleep(500 * time.Millisecond)
-		tryCounter++
-		log.Debug(fmt.Sprintf("RunCommand is waiting VBoxManage to exit (race condition lock count %d)", tryCounter))
-	}
+// RunCommandWithStdin executes VBoxManage feeding stdin to its standard input
+// (e.g. "convertfromraw stdin")
+func RunCommandWithStdin(args VBoxCommand, stdin io.Reader) (string, error) {
+	return runCommand(context.Background(), args, stdin, nil, true)
+}
 
-	vBoxManageStarted = time.Now().Unix()
-	vBoxManageOutput, err := runVBoxManage(args, logOutput)
-	vBoxManageStarted = 0
+// RunCommandWithProgress executes VBoxManage and calls progressCallbackFn with the
+// percentage printed by VBoxManage (e.g. "clonemedium") while the command is running
+func RunCommandWithProgress(args VBoxCommand, progressCallbackFn func(int)) (string, error) {
+	return runCommand(context.Background(), args, nil, mebroutines.NewPercentageWriter(progressCallbackFn), true)
+}
 
-	return vBoxManageOutput, err
+// runCommand runs VBoxManage through the executor which makes sure that only one
+// VBoxManage process is running at a time. Hung processes are killed after the
+// timeout given by getCommandTimeout().
+func runCommand(ctx context.Context, args VBoxCommand, stdin io.Reader, output io.Writer, logOutput bool) (string, error) {
+	return executor.execute(ctx, strings.Join(args, " "), getCommandTimeout(args), func(runCtx context.Context) (string, error) {
+		return runVBoxManage(runCtx, args, stdin, output, logOutput)
+	})
 }
 
 func RunCommands(commands []VBoxCommand) error {
@@ -65,37 +74,51 @@ func RunCommands(commands []VBoxCommand) error {
 	return nil
 }
 
-// runVBoxManage runs vboxmanage command with given arguments
-func runVBoxManage(args []string, logOutput bool) (string, error) {
+// runVBoxManage runs vboxmanage command with given arguments. A failure is returned
+// as *CommandError, see classifyOutput().
+func runVBoxManage(ctx context.Context, args []string, stdin io.Reader, output io.Writer, logOutput bool) (string, error) {
 	vboxmanagepathArr := []string{getVBoxManagePath()}
 	runArgs := append(vboxmanagepathArr, args...)
-	vBoxManageOutput, err := mebroutines.RunAndGetOutput(runArgs, logOutput)
-	if err != nil {
-		command := strings.Join(runArgs, " ")
-		logError := func(output string, err error) {
-			log.Debug(fmt.Sprintf("Failed to execute %s (%v), complete output:", command, err))
-			log.Debug(output)
-		}
+	vBoxManageOutput, err := mebroutines.RunAndGetOutputWithContext(ctx, runArgs, stdin, output, logOutput)
+	if err == nil {
+		return vBoxManageOutput, nil
+	}
+
+	command := strings.Join(runArgs, " ")
+	commandErr := newCommandError(command, vBoxManageOutput, err)
+	logError := func(commandErr *CommandError) {
+		log.Debug(fmt.Sprintf("Failed to execute %s (exit code %d, %v), complete output:", command, commandErr.ExitCode, commandErr.Kind))
+		log.Debug(commandErr.Output)
+	}
+
+	logError(commandErr)
 
-		logError(vBoxManageOutput, err)
+	if !errors.Is(commandErr, ErrDuplicateMedium) {
+		return vBoxManageOutput, commandErr
+	}
 
-		fixed, fixErr := detectAndFixDuplicateHardDiskProblem(vBoxManageOutput)
-		if !fixed && fixErr != nil {
+	fixed, fixErr := detectAndFixDuplicateHardDiskProblem(vBoxManageOutput)
+	if !fixed {
+		if fixErr != nil {
 			log.Debug(fmt.Sprintf("Failed to fix duplicate hard disk problem with command %s: (%v)", command, fixErr))
-			return "", fmt.Errorf("failed to execute %s: %v", command, err)
 		}
+		return vBoxManageOutput, commandErr
+	}
 
-		// We need to re-run the command only if problem was fixed
-		if fixed {
-			log.Debug(fmt.Sprintf("Retrying '%s' after fixing problem", command))
-			vBoxManageOutput, err = mebroutines.RunAndGetOutput(runArgs, logOutput)
-			if err != nil {
-				logError(vBoxManageOutput, err)
-			}
-		}
+	// A command reading the standard input cannot be re-run as the input has already been consumed
+	if stdin != nil {
+		return vBoxManageOutput, commandErr
+	}
+
+	log.Debug(fmt.Sprintf("Retrying '%s' after fixing problem", command))
+	vBoxManageOutput, err = mebroutines.RunAndGetOutputWithContext(ctx, runArgs, nil, output, logOutput)
+	if err != nil {
+		commandErr = newCommandError(command, vBoxManageOutput, err)
+		logError(commandErr)
+		return vBoxManageOutput, commandErr
 	}
 
-	return vBoxManageOutput, err
+	return vBoxManageOutput, nil
 }
 
 func ensureVBoxResponseCacheInitialised() {
@@ -115,27 +138,13 @@ func ResetVBoxResponseCache() {
 	ensureVBoxResponseCacheInitialised()
 }
 
-// GetVMInfoByRegexp returns result of the given vmRegexp from the current VBoxManage showvminfo
-// output. This function gets the output either from the cache or calls getVBoxManageOutput()
-func GetVMInfoByRegexp(vmName string, vmRegexp string) string {
-	rawVMInfo := getVMInfo(vmName)
-
-	// Extract server name
-	pattern := regexp.MustCompile(vmRegexp)
-	result := pattern.FindStringSubmatch(rawVMInfo)
-
-	if len(result) > 1 {
-		return result[1]
-	}
-
-	return ""
-}
-
 // Get "showvminfo" output from vBoxResponseCache (if present) or VBoxManage
 func getVMInfo(vmName string) string {
 	var rawVMInfo string
 
-	rawVMInfoInterface, err := vBoxResponseCache.Get("showvminfo")
+	cacheKey := fmt.Sprintf("showvminfo/%s", vmName)
+
+	rawVMInfoInterface, err := vBoxResponseCache.Get(cacheKey)
 	if err != nil {
 		rawVMInfo, err = RunCommandWithoutLogging([]string{"showvminfo", "--machinereadable", vmName})
 		if err != nil {
@@ -143,7 +152,7 @@ func getVMInfo(vmName string) string {
 			rawVMInfo = ""
 		}
 
-		errCache := vBoxResponseCache.Set("showvminfo", rawVMInfo, constants.VBoxManageCacheTimeout)
+		errCache := vBoxResponseCache.Set(cacheKey, rawVMInfo, constants.VBoxManageCacheTimeout)
 		if errCache != nil {
 			log.Debug(fmt.Sprintf("Could not store VM info to cache: %v", errCache))
 		}
@@ -204,8 +213,9 @@ func GetVBoxManageVersion() (semver.Version, error) {
 
 func GetVMProperty(vmName string, property string) string {
 	propertyValue := ""
+	cacheKey := fmt.Sprintf("guestproperty/%s/%s", vmName, property)
 
-	propertyValueInterface, errCache := vBoxResponseCache.Get(property)
+	propertyValueInterface, errCache := vBoxResponseCache.Get(cacheKey)
 	if errCache != nil {
 		output, errVBoxManage := RunCommand([]string{"guestproperty", "get", vmName, property})
 		if errVBoxManage != nil {
@@ -219,7 +229,7 @@ func GetVMProperty(vmName string, property string) string {
 			propertyValue = propMatches[1]
 		}
 
-		errCacheSet := vBoxResponseCache.Set(property, propertyValue, constants.VBoxManageCacheTimeout)
+		errCacheSet := vBoxResponseCache.Set(cacheKey, propertyValue, constants.VBoxManageCacheTimeout)
 		if errCacheSet == nil {
 			log.Debug(fmt.Sprintf("Stored VM guest property '%s' value '%s' to cache", property, propertyValue))
 		} else {
@@ -233,8 +243,21 @@ func GetVMProperty(vmName string, property string) string {
 	return propertyValue
 }
 
-func getVMStateFromOutput(output string) string {
-	re := regexp.MustCompile(`VMState="(.+)"`)
+// GetGuestProperty returns the current value of a guest property or an empty string
+// if the property has not been set. Unlike GetVMProperty() the value is not cached.
+func GetGuestProperty(vmName string, property string) (string, error) {
+	output, err := RunCommandWithoutLogging([]string{"guestproperty", "get", vmName, property})
+	if err != nil {
+		return "", err
+	}
+
+	return parseGuestProperty(output), nil
+}
+
+// parseGuestProperty returns the value from the output of "guestproperty get"
+// ("Value: 10.0.0.5" or "No value set!")
+func parseGuestProperty(output string) string {
+	re := regexp.MustCompile(`(?m)^Value:\s*(.*?)\s*$`)
 	result := re.FindStringSubmatch(output)
 
 	if len(result) > 1 {
@@ -245,12 +268,14 @@ func getVMStateFromOutput(output string) string {
 }
 
 func getVMState(vmName string) (string, error) {
-	vmState, err := vBoxResponseCache.Get("vmstate")
+	cacheKey := fmt.Sprintf("vmstate/%s", vmName)
+
+	vmState, err := vBoxResponseCache.Get(cacheKey)
 	if err != nil {
 		rawVMInfo, err := RunCommandWithoutLogging([]string{"showvminfo", "--machinereadable", vmName})
 
 		// Check whether VM is installed
-		if strings.Contains(rawVMInfo, vBoxManageOutputNoVMInstalled) {
+		if errors.Is(err, ErrVMNotFound) {
 			log.Debug("When trying to get VM state, VM is not installed")
 			return "", nil
 		}
@@ -261,14 +286,14 @@ func getVMState(vmName string) (string, error) {
 			return "", err
 		}
 
-		// Extract state string
-		vmState = getVMStateFromOutput(rawVMInfo)
-		if vmState == "" {
-			log.Debug("Could not find VM state from the VM info")
-			return "", errors.New("could not find vm state from the vm info")
+		vmInfo, err := ParseVMInfo(rawVMInfo)
+		if err != nil {
+			log.Debug(fmt.Sprintf("Could not find VM state from the VM info: %v", err))
+			return "", fmt.Errorf("could not find vm state from the vm info: %v", err)
 		}
+		vmState = vmInfo.State
 
-		errCache := vBoxResponseCache.Set("vmstate", vmState, constants.VBoxRunningCacheTimeout)
+		errCache := vBoxResponseCache.Set(cacheKey, vmState, constants.VBoxRunningCacheTimeout)
 		if errCache != nil {
 			log.Debug(fmt.Sprintf("Could not store VM state to cache: %v", errCache))
 		}
@@ -277,28 +302,25 @@ func getVMState(vmName string) (string, error) {
 	return fmt.Sprintf("%v", vmState), nil
 }
 
-// IsVMRunning returns true if given VM is currently running
-func IsVMRunning(vmName string) (bool, error) {
+// GetVMState returns the VMState value of the given VM (e.g. "running", "poweroff" or
+// "gurumeditation"). An empty string is returned if the VM is not installed.
+func GetVMState(vmName string) (string, error) {
 	vmState, err := getVMState(vmName)
 
-	if vmState != "<nil>" {
+	if vmState != "" {
 		// Log only messages with content to avoid log spam
-		log.Debug(fmt.Sprintf("vboxmanage.IsVMRunning() got following state string: '%s'", vmState))
-	}
-
-	if err != nil {
-		return false, err
+		log.Debug(fmt.Sprintf("vboxmanage.GetVMState() got following state string: '%s'", vmState))
 	}
 
-	return vmState == "running", nil
+	return vmState, err
 }
 
 // IsVMInstalled returns true if given VM has been installed
 func IsVMInstalled(vmName string) (bool, error) {
-	rawVMInfo, err := RunCommandWithoutLogging([]string{"showvminfo", "--machinereadable", vmName})
+	_, err := RunCommandWithoutLogging([]string{"showvminfo", "--machinereadable", vmName})
 
 	if err != nil {
-		if strings.Contains(rawVMInfo, vBoxManageOutputNoVMInstalled) {
+		if errors.Is(err, ErrVMNotFound) {
 			log.Debug("vboxmanage.IsVMInstalled: Box is not installed")
 			return false, nil
 		}
@@ -311,6 +333,29 @@ func IsVMInstalled(vmName string) (bool, error) {
 	return true, nil
 }
 
+// ListVMs returns the names of all registered VMs
+func ListVMs() ([]string, error) {
+	output, err := RunCommandWithoutLogging([]string{"list", "vms"})
+	if err != nil {
+		return nil, fmt.Errorf("could not list vms: %v", err)
+	}
+
+	return parseVMList(output), nil
+}
+
+// parseVMList returns the VM names from the output of "list vms"
+// (e.g. "NaksuAbittiKTP" {a5a2e5a4-...})
+func parseVMList(output string) []string {
+	re := regexp.MustCompile(`(?m)^"(.*)" \{[0-9a-fA-F-]+\}\s*$`)
+
+	vmNames := []string{}
+	for _, match := range re.FindAllStringSubmatch(output, -1) {
+		vmNames = append(vmNames, match[1])
+	}
+
+	return vmNames
+}
+
 // IsIstalled returns true if VBoxManage has been installed
 func IsInstalled() bool {
 	var vboxmanagepath = getVBoxManagePath()
@@ -0,0 +1,244 @@
+package vboxmanage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseVMList(t *testing.T) {
+	tables := []struct {
+		output  string
+		vmNames []string
+	}{
+		{"", []string{}},
+		{"\"NaksuAbittiKTP\" {0c6b4f1a-0c48-4c4b-9a3c-4c1d2f6d4a3e}\n", []string{"NaksuAbittiKTP"}},
+		{
+			"\"NaksuAbittiKTP-SERVER21127X\" {4e1b0b3e-7a5c-4f3e-8a35-a2a7e7b2c2a1}\r\n\"My VM with spaces\" {b7f7c3c2-36a4-4bb7-a4f3-2f8a0f6e4c11}\r\n",
+			[]string{"NaksuAbittiKTP-SERVER21127X", "My VM with spaces"},
+		},
+		{"<inaccessible> {b7f7c3c2-36a4-4bb7-a4f3-2f8a0f6e4c11}\n", []string{}},
+	}
+
+	for _, table := range tables {
+		vmNames := parseVMList(table.output)
+		if !reflect.DeepEqual(vmNames, table.vmNames) {
+			t.Errorf("parseVMList(%q) gives %v, expected %v", table.output, vmNames, table.vmNames)
+		}
+	}
+}
+
+func TestParseGuestProperty(t *testing.T) {
+	tables := []struct {
+		output string
+		value  string
+	}{
+		{"No value set!\n", ""},
+		{"Value: 192.168.1.5\n", "192.168.1.5"},
+		{"Value: Debian GNU/Linux 10 (buster)\r\n", "Debian GNU/Linux 10 (buster)"},
+		{"", ""},
+	}
+
+	for _, table := range tables {
+		value := parseGuestProperty(table.output)
+		if value != table.value {
+			t.Errorf("parseGuestProperty(%q) gives %q, expected %q", table.output, value, table.value)
+		}
+	}
+}
+
+func TestParseSnapshots(t *testing.T) {
+	settings := `<?xml version="1.0"?>
+<VirtualBox xmlns="http://www.virtualbox.org/" version="1.16-linux">
+  <Machine uuid="{0c6b4f1a-0c48-4c4b-9a3c-4c1d2f6d4a3e}" name="NaksuAbittiKTP" currentSnapshot="{6a2f0d3e-5b1c-4e0f-9d7a-1c2b3a4d5e6f}">
+    <Hardware/>
+    <Snapshot uuid="{1d6c8e2a-3b4f-4a5e-8c7d-9e0f1a2b3c4d}" name="Installed" timeStamp="2021-06-01T12:00:00Z">
+      <Hardware/>
+      <Snapshots>
+        <Snapshot uuid="{6a2f0d3e-5b1c-4e0f-9d7a-1c2b3a4d5e6f}" name="after exam prep 2021-06-02" timeStamp="2021-06-02T08:30:00Z">
+          <Description>Exams loaded</Description>
+          <Hardware/>
+        </Snapshot>
+      </Snapshots>
+    </Snapshot>
+  </Machine>
+</VirtualBox>
+`
+
+	snapshots, err := parseSnapshots([]byte(settings))
+	if err != nil {
+		t.Fatalf("parseSnapshots failed: %v", err)
+	}
+
+	expected := []Snapshot{
+		{Name: "Installed", Created: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)},
+		{Name: "after exam prep 2021-06-02", Created: time.Date(2021, 6, 2, 8, 30, 0, 0, time.UTC)},
+	}
+
+	if len(snapshots) != len(expected) {
+		t.Fatalf("parseSnapshots gives %v, expected %v", snapshots, expected)
+	}
+
+	for n := range expected {
+		if snapshots[n].Name != expected[n].Name || !snapshots[n].Created.Equal(expected[n].Created) {
+			t.Errorf("parseSnapshots gives %v, expected %v", snapshots[n], expected[n])
+		}
+	}
+
+	snapshots, err = parseSnapshots([]byte(`<VirtualBox><Machine name="NaksuAbittiKTP"/></VirtualBox>`))
+	if err != nil || len(snapshots) != 0 {
+		t.Errorf("parseSnapshots of a vm without snapshots gives %v, %v", snapshots, err)
+	}
+}
+
+func TestClassifyOutput(t *testing.T) {
+	tables := []struct {
+		exitCode int
+		output   string
+		err      error
+	}{
+		{1, "VBoxManage: error: Could not find a registered machine named 'NaksuAbittiKTP'\nVBoxManage: error: Details: code VBOX_E_OBJECT_NOT_FOUND (0x80bb0001)", ErrVMNotFound},
+		{1, "VBoxManage: error: The machine 'NaksuAbittiKTP' is already locked for a session (or being unlocked)", ErrSessionLocked},
+		{1, "VBoxManage: error: Medium '/home/user/ktp/NaksuAbittiKTP.vdi' is locked for writing by another task", ErrMediumInUse},
+		{1, "VBoxManage: error: Cannot register the hard disk '/home/user/ktp/naksu.vdi' {5c0d2c7e-0b4a-4e4b-9e1a-0b8c6a4f2d11} because a hard disk '/home/user/ktp/naksu.vdi' with UUID {a3f0e1d2-4b5c-4d6e-8f70-9a1b2c3d4e5f} already exists", ErrDuplicateMedium},
+		{1, "VBoxManage: error: The virtual machine 'NaksuAbittiKTP' has terminated unexpectedly during startup with exit code 1 (0x1).\nVBoxManage: error: Details: code NS_ERROR_FAILURE (0x80004005)\nKernel driver not installed (rc=-1908)", ErrKernelDriverNotInstalled},
+		{1, "VBoxManage: error: Details: code E_ACCESSDENIED (0x80070005), component SessionMachine, interface IMachine", ErrAccessDenied},
+		{2, "Syntax error: Invalid parameter '--foo'", ErrInvalidCommand},
+		{1, "VBoxManage: error: Something else went wrong", nil},
+		{-1, "", nil},
+	}
+
+	for _, table := range tables {
+		err := classifyOutput(table.exitCode, table.output)
+		if err != table.err {
+			t.Errorf("classifyOutput(%d, %q) gives %v, expected %v", table.exitCode, table.output, err, table.err)
+		}
+	}
+}
+
+func TestCommandErrorIs(t *testing.T) {
+	execErr := errors.New("exit status 1")
+	commandErr := newCommandError("VBoxManage showvminfo NaksuAbittiKTP", "VBoxManage: error: Could not find a registered machine named 'NaksuAbittiKTP'", execErr)
+	wrappedErr := fmt.Errorf("could not get vm state: %w", commandErr)
+
+	if !errors.Is(wrappedErr, ErrVMNotFound) {
+		t.Errorf("errors.Is(%v, ErrVMNotFound) gives false", wrappedErr)
+	}
+
+	if errors.Is(wrappedErr, ErrAccessDenied) {
+		t.Errorf("errors.Is(%v, ErrAccessDenied) gives true", wrappedErr)
+	}
+
+	if !errors.Is(wrappedErr, execErr) {
+		t.Errorf("errors.Is(%v, execErr) gives false", wrappedErr)
+	}
+
+	var asCommandErr *CommandError
+	if !errors.As(wrappedErr, &asCommandErr) || asCommandErr.Output != commandErr.Output || asCommandErr.ExitCode != -1 {
+		t.Errorf("errors.As(%v) does not give the command error", wrappedErr)
+	}
+}
+
+func TestExecutorRunsOneCommandAtATime(t *testing.T) {
+	e := newCommandExecutor()
+
+	var running int32
+	var overlapped int32
+	var waitGroup sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			_, err := e.execute(context.Background(), "test", time.Second, func(ctx context.Context) (string, error) {
+				if atomic.AddInt32(&running, 1) > 1 {
+					atomic.StoreInt32(&overlapped, 1)
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return "", nil
+			})
+			if err != nil {
+				t.Errorf("execute() gives error %v", err)
+			}
+		}()
+	}
+
+	waitGroup.Wait()
+
+	if overlapped != 0 {
+		t.Errorf("commands were run simultaneously")
+	}
+
+	stats := e.getStats()
+	if stats.Commands != 5 || stats.MaxWait < 10*time.Millisecond {
+		t.Errorf("queue stats %+v do not match 5 commands run one at a time", stats)
+	}
+}
+
+func TestExecutorCancelWhileQueued(t *testing.T) {
+	e := newCommandExecutor()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		_, _ = e.execute(context.Background(), "blocking", 0, func(ctx context.Context) (string, error) {
+			close(started)
+			<-release
+			return "", nil
+		})
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	called := false
+	_, err := e.execute(ctx, "queued", time.Second, func(ctx context.Context) (string, error) {
+		called = true
+		return "", nil
+	})
+
+	close(release)
+
+	if called || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("queued command gives error %v and was called: %v", err, called)
+	}
+}
+
+func TestExecutorTimeout(t *testing.T) {
+	e := newCommandExecutor()
+
+	_, err := e.execute(context.Background(), "hung", 10*time.Millisecond, func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("hung command gives error %v", err)
+	}
+}
+
+func TestGetCommandTimeout(t *testing.T) {
+	tables := []struct {
+		args    VBoxCommand
+		timeout time.Duration
+	}{
+		{VBoxCommand{"showvminfo", "--machinereadable", "NaksuAbittiKTP"}, defaultCommandTimeout},
+		{VBoxCommand{"clonemedium", "disk", "backup.vmdk"}, 0},
+		{VBoxCommand{"startvm", "NaksuAbittiKTP", "--type", "gui"}, vmCommandTimeout},
+		{VBoxCommand{}, defaultCommandTimeout},
+	}
+
+	for _, table := range tables {
+		timeout := getCommandTimeout(table.args)
+		if timeout != table.timeout {
+			t.Errorf("getCommandTimeout(%v) gives %v, expected %v", table.args, timeout, table.timeout)
+		}
+	}
+}
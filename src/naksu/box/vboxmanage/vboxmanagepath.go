@@ -0,0 +1,33 @@
+package vboxmanage
+
+import (
+	"sync"
+)
+
+var (
+	vBoxManagePathMutex    sync.Mutex
+	vBoxManagePathOverride string
+)
+
+// SetVBoxManagePath makes naksu execute the given program instead of VBoxManage of
+// the installed VirtualBox. An empty path restores the default. The tests use this to
+// run a fake VBoxManage (see package fakevboxmanage).
+func SetVBoxManagePath(path string) {
+	vBoxManagePathMutex.Lock()
+	vBoxManagePathOverride = path
+	vBoxManagePathMutex.Unlock()
+
+	// The cached responses (e.g. the version) came from the previous VBoxManage
+	ResetVBoxResponseCache()
+}
+
+func getVBoxManagePath() string {
+	vBoxManagePathMutex.Lock()
+	defer vBoxManagePathMutex.Unlock()
+
+	if vBoxManagePathOverride != "" {
+		return vBoxManagePathOverride
+	}
+
+	return getDefaultVBoxManagePath()
+}
@@ -4,7 +4,8 @@ import (
 	"os"
 )
 
-func getVBoxManagePath() string {
+// getDefaultVBoxManagePath returns the path of VBoxManage of the installed VirtualBox
+func getDefaultVBoxManagePath() string {
 	var path = "VBoxManage"
 	if os.Getenv("VBOXMANAGEPATH") != "" {
 		path = os.Getenv("VBOXMANAGEPATH")
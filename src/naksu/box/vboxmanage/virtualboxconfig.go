@@ -0,0 +1,155 @@
+package vboxmanage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"naksu/mebroutines"
+)
+
+// VirtualBoxConfig is the global VirtualBox configuration file (VirtualBox.xml)
+type VirtualBoxConfig struct {
+	Path string
+	// MachineSettingsFiles are the settings files (.vbox) of the registered VMs
+	MachineSettingsFiles []string
+	// HardDisks are the disk images in the global media registry. The differencing
+	// disks of snapshots are listed after their parents.
+	HardDisks []RegisteredHardDisk
+}
+
+// RegisteredHardDisk is a disk image in the media registry of VirtualBox.xml
+type RegisteredHardDisk struct {
+	UUID string
+	// Location is the full path of the disk image
+	Location string
+	// ParentUUID is empty for base disks
+	ParentUUID string
+	// HasChildren is true if differencing disks have been created on top of the disk
+	HasChildren bool
+}
+
+type virtualBoxConfigHardDisk struct {
+	UUID     string                     `xml:"uuid,attr"`
+	Location string                     `xml:"location,attr"`
+	Children []virtualBoxConfigHardDisk `xml:"HardDisk"`
+}
+
+type virtualBoxConfigFile struct {
+	Machines []struct {
+		Src string `xml:"src,attr"`
+	} `xml:"Global>MachineRegistry>MachineEntry"`
+	HardDisks []virtualBoxConfigHardDisk `xml:"Global>MediaRegistry>HardDisks>HardDisk"`
+}
+
+// ReadVirtualBoxConfig returns the registered VMs and media of VirtualBox.xml. The file
+// is read directly so that this works even if VBoxManage fails because of the registry.
+func ReadVirtualBoxConfig() (VirtualBoxConfig, error) {
+	configPath := getVirtualBoxConfigPath()
+
+	content, err := ioutil.ReadFile(configPath) // #nosec
+	if err != nil {
+		return VirtualBoxConfig{}, fmt.Errorf("could not read virtualbox configuration: %w", err)
+	}
+
+	return parseVirtualBoxConfig(configPath, content)
+}
+
+// parseVirtualBoxConfig parses VirtualBox.xml read from configPath. Relative paths are
+// relative to the directory of the file.
+func parseVirtualBoxConfig(configPath string, content []byte) (VirtualBoxConfig, error) {
+	var file virtualBoxConfigFile
+
+	err := xml.Unmarshal(content, &file)
+	if err != nil {
+		return VirtualBoxConfig{}, fmt.Errorf("could not parse virtualbox configuration: %v", err)
+	}
+
+	config := VirtualBoxConfig{Path: configPath}
+	configDir := filepath.Dir(configPath)
+
+	for _, machine := range file.Machines {
+		config.MachineSettingsFiles = append(config.MachineSettingsFiles, resolveConfigPath(configDir, machine.Src))
+	}
+
+	for _, hardDisk := range file.HardDisks {
+		config.HardDisks = appendRegisteredHardDisks(config.HardDisks, configDir, hardDisk, "")
+	}
+
+	return config, nil
+}
+
+func appendRegisteredHardDisks(hardDisks []RegisteredHardDisk, configDir string, hardDisk virtualBoxConfigHardDisk, parentUUID string) []RegisteredHardDisk {
+	uuid := strings.Trim(hardDisk.UUID, "{}")
+
+	hardDisks = append(hardDisks, RegisteredHardDisk{
+		UUID:        uuid,
+		Location:    resolveConfigPath(configDir, hardDisk.Location),
+		ParentUUID:  parentUUID,
+		HasChildren: len(hardDisk.Children) > 0,
+	})
+
+	for _, child := range hardDisk.Children {
+		hardDisks = appendRegisteredHardDisks(hardDisks, configDir, child, uuid)
+	}
+
+	return hardDisks
+}
+
+func resolveConfigPath(configDir string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(configDir, path)
+}
+
+// IsMachineRegistered returns true if the given VM settings file (.vbox) is registered
+func (config VirtualBoxConfig) IsMachineRegistered(settingsFile string) bool {
+	for _, registeredFile := range config.MachineSettingsFiles {
+		if filepath.Clean(registeredFile) == filepath.Clean(settingsFile) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BackupConfigFile copies the given VirtualBox configuration file before it is
+// changed and returns the path of the copy. Earlier backups are not overwritten.
+func BackupConfigFile(configPath string) (string, error) {
+	backupPath := getConfigBackupPath(configPath)
+
+	err := mebroutines.CopyFile(configPath, backupPath)
+	if err != nil {
+		return "", fmt.Errorf("could not back up %s to %s: %v", configPath, backupPath, err)
+	}
+
+	return backupPath, nil
+}
+
+// getConfigBackupPath returns the first free backup path of the configuration file
+// (e.g. VirtualBox.xml.naksubackup, VirtualBox.xml.naksubackup.1, ...)
+func getConfigBackupPath(configPath string) string {
+	backupPath := configPath + ".naksubackup"
+
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(backupPath); os.IsNotExist(err) {
+			return backupPath
+		}
+
+		backupPath = fmt.Sprintf("%s.naksubackup.%d", configPath, n)
+	}
+}
+
+// CloseMedium removes the disk image with the given UUID from the media registry.
+// The disk image file is not deleted.
+func CloseMedium(uuid string) error {
+	_, err := RunCommand(VBoxCommand{"closemedium", "disk", uuid})
+	ResetVBoxResponseCache()
+
+	return err
+}
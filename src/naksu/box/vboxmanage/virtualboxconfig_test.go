@@ -0,0 +1,93 @@
+package vboxmanage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseVirtualBoxConfig(t *testing.T) {
+	content := `<?xml version="1.0"?>
+<VirtualBox xmlns="http://www.virtualbox.org/" version="1.12-linux">
+  <Global>
+    <ExtraData>
+      <ExtraDataItem name="GUI/LastWindowPosition" value="10,10,640,480"/>
+    </ExtraData>
+    <MachineRegistry>
+      <MachineEntry uuid="{0c6b4f1a-0c48-4c4b-9a3c-4c1d2f6d4a3e}" src="/home/abitti/VirtualBox VMs/NaksuAbittiKTP/NaksuAbittiKTP.vbox"/>
+      <MachineEntry uuid="{b7f7c3c2-36a4-4bb7-a4f3-2f8a0f6e4c11}" src="Machines/Other/Other.vbox"/>
+    </MachineRegistry>
+    <MediaRegistry>
+      <HardDisks>
+        <HardDisk uuid="{4e1b0b3e-7a5c-4f3e-8a35-a2a7e7b2c2a1}" location="/home/abitti/ktp/naksu_ktp_disk.vdi" format="VDI" type="Normal">
+          <HardDisk uuid="{6a2f0d3e-5b1c-4e0f-9d7a-1c2b3a4d5e6f}" location="/home/abitti/VirtualBox VMs/NaksuAbittiKTP/Snapshots/{6a2f0d3e-5b1c-4e0f-9d7a-1c2b3a4d5e6f}.vdi" format="VDI"/>
+        </HardDisk>
+        <HardDisk uuid="{1d6c8e2a-3b4f-4a5e-8c7d-9e0f1a2b3c4d}" location="old.vdi" format="VDI" type="Normal"/>
+      </HardDisks>
+      <DVDImages/>
+    </MediaRegistry>
+    <SystemProperties defaultMachineFolder="/home/abitti/VirtualBox VMs"/>
+  </Global>
+</VirtualBox>
+`
+
+	config, err := parseVirtualBoxConfig("/home/abitti/.config/VirtualBox/VirtualBox.xml", []byte(content))
+	if err != nil {
+		t.Fatalf("parseVirtualBoxConfig failed: %v", err)
+	}
+
+	expected := VirtualBoxConfig{
+		Path: "/home/abitti/.config/VirtualBox/VirtualBox.xml",
+		MachineSettingsFiles: []string{
+			"/home/abitti/VirtualBox VMs/NaksuAbittiKTP/NaksuAbittiKTP.vbox",
+			"/home/abitti/.config/VirtualBox/Machines/Other/Other.vbox",
+		},
+		HardDisks: []RegisteredHardDisk{
+			{UUID: "4e1b0b3e-7a5c-4f3e-8a35-a2a7e7b2c2a1", Location: "/home/abitti/ktp/naksu_ktp_disk.vdi", HasChildren: true},
+			{UUID: "6a2f0d3e-5b1c-4e0f-9d7a-1c2b3a4d5e6f", Location: "/home/abitti/VirtualBox VMs/NaksuAbittiKTP/Snapshots/{6a2f0d3e-5b1c-4e0f-9d7a-1c2b3a4d5e6f}.vdi", ParentUUID: "4e1b0b3e-7a5c-4f3e-8a35-a2a7e7b2c2a1"},
+			{UUID: "1d6c8e2a-3b4f-4a5e-8c7d-9e0f1a2b3c4d", Location: "/home/abitti/.config/VirtualBox/old.vdi"},
+		},
+	}
+
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("parseVirtualBoxConfig gives\n%+v\nexpected\n%+v", config, expected)
+	}
+
+	if !config.IsMachineRegistered("/home/abitti/VirtualBox VMs/NaksuAbittiKTP/../NaksuAbittiKTP/NaksuAbittiKTP.vbox") {
+		t.Errorf("NaksuAbittiKTP.vbox is not registered")
+	}
+
+	if config.IsMachineRegistered("/home/abitti/VirtualBox VMs/Trash/Trash.vbox") {
+		t.Errorf("Trash.vbox is registered")
+	}
+
+	_, err = parseVirtualBoxConfig("VirtualBox.xml", []byte("<VirtualBox><Global>"))
+	if err == nil {
+		t.Errorf("parseVirtualBoxConfig accepts a truncated file")
+	}
+}
+
+func TestGetConfigBackupPath(t *testing.T) {
+	directory, err := ioutil.TempDir("", "naksu-config-backup")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	configPath := filepath.Join(directory, "VirtualBox.xml")
+	expectedPaths := []string{configPath + ".naksubackup", configPath + ".naksubackup.1", configPath + ".naksubackup.2"}
+
+	for _, expectedPath := range expectedPaths {
+		backupPath := getConfigBackupPath(configPath)
+		if backupPath != expectedPath {
+			t.Errorf("getConfigBackupPath gives %s, expected %s", backupPath, expectedPath)
+		}
+
+		err := ioutil.WriteFile(backupPath, []byte("<VirtualBox/>"), 0600)
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", backupPath, err)
+		}
+	}
+}
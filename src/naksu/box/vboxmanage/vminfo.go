@@ -0,0 +1,288 @@
+package vboxmanage
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"naksu/log"
+)
+
+// VMInfo is the output of "showvminfo --machinereadable"
+type VMInfo struct {
+	Name string
+	UUID string
+	// State is the VMState value (e.g. "running", "poweroff" or "gurumeditation")
+	State        string
+	OSType       string
+	Firmware     string
+	CPUs         int
+	MemoryMB     uint64
+	VRamMB       int
+	SettingsFile string
+	LogFolder    string
+	// NICs are the enabled network adapters
+	NICs []NIC
+	// StorageAttachments are the media attached to the storage controllers
+	StorageAttachments []StorageAttachment
+	SharedFolders      []SharedFolder
+	// Snapshots are listed in the order of the snapshot tree, parents first
+	Snapshots       []VMSnapshot
+	CurrentSnapshot string
+}
+
+// NIC is a network adapter of a VM
+type NIC struct {
+	// Index is the number of the adapter (nic1 is 1)
+	Index int
+	// Attachment is the network mode (e.g. "bridged" or "nat")
+	Attachment    string
+	BridgeAdapter string
+	// NICType is the emulated hardware (e.g. "82540EM" or "virtio")
+	NICType    string
+	MACAddress string
+}
+
+// StorageAttachment is a medium attached to a storage controller port
+type StorageAttachment struct {
+	Controller string
+	Port       int
+	Device     int
+	// Medium is the location of the disk image or "emptydrive"
+	Medium    string
+	ImageUUID string
+}
+
+// SharedFolder is a folder shared from the host to the guest
+type SharedFolder struct {
+	Name     string
+	HostPath string
+}
+
+// VMSnapshot is a snapshot listed by showvminfo. See ListSnapshots() for the
+// times when the snapshots were taken.
+type VMSnapshot struct {
+	Name string
+	UUID string
+}
+
+// maxNICs is the number of network adapters of a VirtualBox VM
+const maxNICs = 8
+
+var (
+	vmInfoLineRegexp            = regexp.MustCompile(`^("(?:[^"\\]|\\.)*"|[^=]+)=(.*)$`)
+	storageAttachmentKeyRegexp  = regexp.MustCompile(`^(ImageUUID-)?(\d+)-(\d+)$`)
+	snapshotNameKeyRegexp       = regexp.MustCompile(`^SnapshotName((?:-\d+)*)$`)
+	sharedFolderNameKeyRegexp   = regexp.MustCompile(`^SharedFolderName(Machine|Transient)Mapping(\d+)$`)
+	storageControllerNameRegexp = regexp.MustCompile(`^storagecontrollername\d+$`)
+)
+
+// GetVMInfo returns the VM info of the given VM. The info is cached, see
+// ResetVBoxResponseCache().
+func GetVMInfo(vmName string) (VMInfo, error) {
+	rawVMInfo := getVMInfo(vmName)
+	if rawVMInfo == "" {
+		return VMInfo{}, errors.New("could not get vm info")
+	}
+
+	return ParseVMInfo(rawVMInfo)
+}
+
+// ParseVMInfo parses the output of "showvminfo --machinereadable" printed by the
+// installed VBoxManage. VirtualBox 7 escapes backslashes and quotes in the values,
+// older versions print them as they are (e.g. UNC paths like \\server\share).
+func ParseVMInfo(output string) (VMInfo, error) {
+	return parseVMInfo(output, isVMInfoEscaped())
+}
+
+// isVMInfoEscaped returns true if the installed VBoxManage escapes backslashes
+// and quotes in the machine readable output
+func isVMInfoEscaped() bool {
+	version, err := GetVBoxManageVersion()
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not get VBoxManage version, assuming unescaped vm info: %v", err))
+		return false
+	}
+
+	return version.Major >= 7
+}
+
+// parseVMInfo parses the output of "showvminfo --machinereadable". If escaped is
+// true, the escaping of backslashes and quotes is removed from the keys and values.
+func parseVMInfo(output string, escaped bool) (VMInfo, error) {
+	keys, values := parseMachineReadable(output, escaped)
+
+	if values["VMState"] == "" {
+		return VMInfo{}, errors.New("vm info does not contain VMState")
+	}
+
+	info := VMInfo{
+		Name:            values["name"],
+		UUID:            values["UUID"],
+		State:           values["VMState"],
+		OSType:          values["ostype"],
+		Firmware:        values["firmware"],
+		SettingsFile:    values["CfgFile"],
+		LogFolder:       values["LogFldr"],
+		CurrentSnapshot: values["CurrentSnapshotName"],
+	}
+
+	var err error
+
+	info.CPUs, err = parseVMInfoNumber(values, "cpus")
+	if err != nil {
+		return VMInfo{}, err
+	}
+
+	memoryMB, err := parseVMInfoNumber(values, "memory")
+	if err != nil {
+		return VMInfo{}, err
+	}
+	info.MemoryMB = uint64(memoryMB)
+
+	info.VRamMB, err = parseVMInfoNumber(values, "vram")
+	if err != nil {
+		return VMInfo{}, err
+	}
+
+	for index := 1; index <= maxNICs; index++ {
+		attachment := values[fmt.Sprintf("nic%d", index)]
+		if attachment == "" || attachment == "none" {
+			continue
+		}
+
+		info.NICs = append(info.NICs, NIC{
+			Index:         index,
+			Attachment:    attachment,
+			BridgeAdapter: values[fmt.Sprintf("bridgeadapter%d", index)],
+			NICType:       values[fmt.Sprintf("nictype%d", index)],
+			MACAddress:    values[fmt.Sprintf("macaddress%d", index)],
+		})
+	}
+
+	info.StorageAttachments = parseStorageAttachments(keys, values)
+
+	for _, key := range keys {
+		if match := sharedFolderNameKeyRegexp.FindStringSubmatch(key); match != nil {
+			info.SharedFolders = append(info.SharedFolders, SharedFolder{
+				Name:     values[key],
+				HostPath: values[fmt.Sprintf("SharedFolderPath%sMapping%s", match[1], match[2])],
+			})
+		}
+
+		if match := snapshotNameKeyRegexp.FindStringSubmatch(key); match != nil {
+			info.Snapshots = append(info.Snapshots, VMSnapshot{
+				Name: values[key],
+				UUID: values["SnapshotUUID"+match[1]],
+			})
+		}
+	}
+
+	return info, nil
+}
+
+// parseMachineReadable returns the keys of the machine readable output in the order
+// of the output and the values of the keys. The quotes are removed from the keys
+// (e.g. "SATA Controller-0-0") and the values, see unquoteVMInfoValue().
+func parseMachineReadable(output string, escaped bool) ([]string, map[string]string) {
+	keys := []string{}
+	values := map[string]string{}
+
+	for _, line := range strings.Split(strings.Replace(output, "\r\n", "\n", -1), "\n") {
+		match := vmInfoLineRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		key := unquoteVMInfoValue(match[1], escaped)
+		if _, exists := values[key]; !exists {
+			keys = append(keys, key)
+		}
+		values[key] = unquoteVMInfoValue(match[2], escaped)
+	}
+
+	return keys, values
+}
+
+// unquoteVMInfoValue removes the quotes around a value and, if escaped is true,
+// the escaping of backslashes and quotes inside it
+func unquoteVMInfoValue(value string, escaped bool) string {
+	if len(value) < 2 || !strings.HasPrefix(value, "\"") || !strings.HasSuffix(value, "\"") {
+		return value
+	}
+
+	value = value[1 : len(value)-1]
+	if !escaped {
+		return value
+	}
+
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(value)
+}
+
+// parseVMInfoNumber returns the number value of the key or 0 if it is missing
+func parseVMInfoNumber(values map[string]string, key string) (int, error) {
+	value, ok := values[key]
+	if !ok {
+		return 0, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("vm info %s '%s' is not a number: %v", key, value, err)
+	}
+
+	return number, nil
+}
+
+// parseStorageAttachments returns the attached media of the storage controllers listed
+// in the output. The media are given as "<controller>-<port>-<device>" and their UUIDs
+// as "<controller>-ImageUUID-<port>-<device>".
+func parseStorageAttachments(keys []string, values map[string]string) []StorageAttachment {
+	var attachments []StorageAttachment
+
+	for _, controllerKey := range keys {
+		if !storageControllerNameRegexp.MatchString(controllerKey) {
+			continue
+		}
+
+		controller := values[controllerKey]
+
+		for _, key := range keys {
+			if !strings.HasPrefix(key, controller+"-") {
+				continue
+			}
+
+			match := storageAttachmentKeyRegexp.FindStringSubmatch(strings.TrimPrefix(key, controller+"-"))
+			if match == nil || match[1] != "" || values[key] == "none" {
+				continue
+			}
+
+			port, _ := strconv.Atoi(match[2])
+			device, _ := strconv.Atoi(match[3])
+
+			attachments = append(attachments, StorageAttachment{
+				Controller: controller,
+				Port:       port,
+				Device:     device,
+				Medium:     values[key],
+				ImageUUID:  values[fmt.Sprintf("%s-ImageUUID-%d-%d", controller, port, device)],
+			})
+		}
+	}
+
+	return attachments
+}
+
+// GetStorageAttachment returns the medium attached to the given port and device of
+// the controller or false if nothing is attached
+func (info VMInfo) GetStorageAttachment(controller string, port int, device int) (StorageAttachment, bool) {
+	for _, attachment := range info.StorageAttachments {
+		if attachment.Controller == controller && attachment.Port == port && attachment.Device == device {
+			return attachment, true
+		}
+	}
+
+	return StorageAttachment{}, false
+}
@@ -0,0 +1,483 @@
+package vboxmanage
+
+import (
+	"reflect"
+	"testing"
+)
+
+// vmInfo60 is printed by VirtualBox 6.0 on Linux for a running server
+const vmInfo60 = `name="NaksuAbittiKTP"
+groups="/"
+ostype="Debian (64-bit)"
+UUID="0c6b4f1a-0c48-4c4b-9a3c-4c1d2f6d4a3e"
+CfgFile="/home/opettaja/VirtualBox VMs/NaksuAbittiKTP/NaksuAbittiKTP.vbox"
+SnapFldr="/home/opettaja/VirtualBox VMs/NaksuAbittiKTP/Snapshots"
+LogFldr="/home/opettaja/VirtualBox VMs/NaksuAbittiKTP/Logs"
+hardwareuuid="0c6b4f1a-0c48-4c4b-9a3c-4c1d2f6d4a3e"
+memory=8192
+pagefusion="off"
+vram=24
+cpuexecutioncap=100
+hpet="off"
+chipset="piix3"
+firmware="EFI"
+cpus=4
+pae="on"
+longmode="on"
+triplefaultreset="off"
+apic="on"
+x2apic="on"
+cpuid-portability-level=0
+bootmenu="messageandmenu"
+boot1="floppy"
+boot2="dvd"
+boot3="disk"
+boot4="none"
+acpi="on"
+ioapic="on"
+biosapic="apic"
+biossystemtimeoffset=0
+rtcuseutc="off"
+hwvirtex="on"
+nestedpaging="on"
+largepages="on"
+vtxvpid="on"
+vtxux="on"
+paravirtprovider="default"
+effparavirtprovider="kvm"
+VMState="running"
+VMStateChangeTime="2021-05-20T06:12:41.514000000"
+monitorcount=1
+accelerate3d="off"
+accelerate2dvideo="off"
+teleporterenabled="off"
+teleporterport=0
+teleporteraddress=""
+teleporterpassword=""
+tracing-enabled="off"
+tracing-allow-vm-access="off"
+tracing-config=""
+autostart-enabled="off"
+autostart-delay=0
+defaultfrontend=""
+storagecontrollername0="SATA Controller"
+storagecontrollertype0="IntelAhci"
+storagecontrollerinstance0="0"
+storagecontrollermaxportcount0="30"
+storagecontrollerportcount0="30"
+storagecontrollerbootable0="on"
+"SATA Controller-0-0"="/home/opettaja/ktp/naksu_last_image.vdi"
+"SATA Controller-ImageUUID-0-0"="9e1a3c7b-5d2f-4a8e-b6c4-1f0e2d3c4b5a"
+"SATA Controller-1-0"="none"
+natnet1="nat"
+macaddress1="080027A1B2C3"
+cableconnected1="on"
+nic1="bridged"
+bridgeadapter1="enp3s0"
+nictype1="virtio"
+nicspeed1="0"
+nic2="none"
+nic3="none"
+nic4="none"
+nic5="none"
+nic6="none"
+nic7="none"
+nic8="none"
+hidpointing="ps2mouse"
+hidkeyboard="ps2kbd"
+uart1="off"
+uart2="off"
+uart3="off"
+uart4="off"
+lpt1="off"
+lpt2="off"
+audio="none"
+audio_out="off"
+audio_in="off"
+clipboard="bidirectional"
+draganddrop="disabled"
+SessionName="GUI/Qt"
+VideoMode="1024,768,32"@0,0 1
+vrde="off"
+usb="off"
+ehci="off"
+xhci="off"
+SharedFolderNameMachineMapping1="media"
+SharedFolderPathMachineMapping1="/home/opettaja/ktp-jako"
+videocap="off"
+videocapaudio="off"
+videocapscreens=0
+videocapfile="/home/opettaja/VirtualBox VMs/NaksuAbittiKTP/NaksuAbittiKTP.webm"
+videocapres=1024x768
+videocaprate=512
+videocapfps=25
+videocapopts=
+GuestMemoryBalloon=0
+GuestOSType="Linux26_64"
+GuestAdditionsRunLevel=2
+GuestAdditionsVersion="6.0.24_Debian r139119"
+GuestAdditionsFacility_VirtualBox Base Driver=50,1621491176834
+SnapshotName="Installed"
+SnapshotUUID="1d6c8e2a-3b4f-4a5e-8c7d-9e0f1a2b3c4d"
+CurrentSnapshotName="Installed"
+CurrentSnapshotUUID="1d6c8e2a-3b4f-4a5e-8c7d-9e0f1a2b3c4d"
+CurrentSnapshotNode="SnapshotName"
+`
+
+// vmInfo61 is printed by VirtualBox 6.1 on Linux for a powered off server with a
+// second network adapter and two snapshots
+const vmInfo61 = `name="NaksuAbittiKTP-SERVER21127X v81"
+groups="/"
+ostype="Debian (64-bit)"
+UUID="4e1b0b3e-7a5c-4f3e-8a35-a2a7e7b2c2a1"
+CfgFile="/home/opettaja/VirtualBox VMs/NaksuAbittiKTP-SERVER21127X v81/NaksuAbittiKTP-SERVER21127X v81.vbox"
+SnapFldr="/home/opettaja/VirtualBox VMs/NaksuAbittiKTP-SERVER21127X v81/Snapshots"
+LogFldr="/home/opettaja/VirtualBox VMs/NaksuAbittiKTP-SERVER21127X v81/Logs"
+hardwareuuid="4e1b0b3e-7a5c-4f3e-8a35-a2a7e7b2c2a1"
+memory=5304
+pagefusion="off"
+vram=24
+cpuexecutioncap=100
+hpet="off"
+cpu-profile="host"
+chipset="piix3"
+firmware="EFI"
+cpus=2
+pae="on"
+longmode="on"
+acpi="on"
+ioapic="on"
+hwvirtex="on"
+VMState="poweroff"
+VMStateChangeTime="2021-06-02T08:30:00.000000000"
+graphicscontroller="vboxsvga"
+monitorcount=1
+accelerate3d="off"
+accelerate2dvideo="off"
+storagecontrollername0="SATA Controller"
+storagecontrollertype0="IntelAhci"
+storagecontrollerinstance0="0"
+storagecontrollermaxportcount0="30"
+storagecontrollerportcount0="30"
+storagecontrollerbootable0="on"
+"SATA Controller-0-0"="/home/opettaja/ktp/NaksuAbittiKTP-SERVER21127X v81.vdi"
+"SATA Controller-ImageUUID-0-0"="b7f7c3c2-36a4-4bb7-a4f3-2f8a0f6e4c11"
+"SATA Controller-1-0"="none"
+storagecontrollername1="IDE Controller"
+storagecontrollertype1="PIIX4"
+storagecontrollerinstance1="0"
+storagecontrollermaxportcount1="2"
+storagecontrollerportcount1="2"
+storagecontrollerbootable1="on"
+"IDE Controller-0-0"="none"
+"IDE Controller-0-1"="none"
+"IDE Controller-1-0"="emptydrive"
+"IDE Controller-IsEjected-1-0"="off"
+"IDE Controller-1-1"="none"
+natnet1="nat"
+macaddress1="0800275E8F21"
+cableconnected1="on"
+nic1="bridged"
+bridgeadapter1="wlp2s0"
+nictype1="82540EM"
+nicspeed1="0"
+natnet2="nat"
+macaddress2="0800279D4C10"
+cableconnected2="on"
+nic2="nat"
+nictype2="82540EM"
+nicspeed2="0"
+mtu="0"
+sockSnd="64"
+sockRcv="64"
+tcpWndSnd="64"
+tcpWndRcv="64"
+nic3="none"
+nic4="none"
+nic5="none"
+nic6="none"
+nic7="none"
+nic8="none"
+hidpointing="ps2mouse"
+hidkeyboard="ps2kbd"
+audio="none"
+clipboard="bidirectional"
+draganddrop="disabled"
+vrde="off"
+usb="off"
+ehci="off"
+xhci="off"
+SharedFolderNameMachineMapping1="media"
+SharedFolderPathMachineMapping1="/home/opettaja/ktp-jako"
+videocap="off"
+GuestMemoryBalloon=0
+SnapshotName="Installed"
+SnapshotUUID="1d6c8e2a-3b4f-4a5e-8c7d-9e0f1a2b3c4d"
+SnapshotName-1="after exam prep 2021-06-02"
+SnapshotUUID-1="6a2f0d3e-5b1c-4e0f-9d7a-1c2b3a4d5e6f"
+SnapshotDescription-1="Exams loaded"
+CurrentSnapshotName="after exam prep 2021-06-02"
+CurrentSnapshotUUID="6a2f0d3e-5b1c-4e0f-9d7a-1c2b3a4d5e6f"
+CurrentSnapshotNode="SnapshotName-1"
+`
+
+// vmInfo70 is printed by VirtualBox 7.0 on Windows for a server which has crashed.
+// VirtualBox 7 escapes the backslashes of the paths.
+const vmInfo70 = "name=\"NaksuAbittiKTP-SERVER23010X v5\"\r\n" +
+	"Encryption:     disabled\r\n" +
+	"groups=\"/\"\r\n" +
+	"ostype=\"Debian (64-bit)\"\r\n" +
+	"UUID=\"b7f7c3c2-36a4-4bb7-a4f3-2f8a0f6e4c11\"\r\n" +
+	`CfgFile="C:\\Users\\Opettaja\\VirtualBox VMs\\NaksuAbittiKTP-SERVER23010X v5\\NaksuAbittiKTP-SERVER23010X v5.vbox"` + "\r\n" +
+	`SnapFldr="C:\\Users\\Opettaja\\VirtualBox VMs\\NaksuAbittiKTP-SERVER23010X v5\\Snapshots"` + "\r\n" +
+	`LogFldr="C:\\Users\\Opettaja\\VirtualBox VMs\\NaksuAbittiKTP-SERVER23010X v5\\Logs"` + "\r\n" +
+	"memory=16384\r\n" +
+	"pagefusion=\"off\"\r\n" +
+	"vram=128\r\n" +
+	"cpuexecutioncap=100\r\n" +
+	"hpet=\"off\"\r\n" +
+	"cpu-profile=\"host\"\r\n" +
+	"chipset=\"piix3\"\r\n" +
+	"firmware=\"EFI\"\r\n" +
+	"cpus=8\r\n" +
+	"pae=\"on\"\r\n" +
+	"acpi=\"on\"\r\n" +
+	"ioapic=\"on\"\r\n" +
+	"tpm_type=\"none\"\r\n" +
+	"secureBoot=\"off\"\r\n" +
+	"VMState=\"gurumeditation\"\r\n" +
+	"VMStateChangeTime=\"2023-02-14T09:41:07.118000000\"\r\n" +
+	"graphicscontroller=\"vmsvga\"\r\n" +
+	"monitorcount=1\r\n" +
+	"storagecontrollername0=\"SATA Controller\"\r\n" +
+	"storagecontrollertype0=\"IntelAhci\"\r\n" +
+	"storagecontrollerinstance0=\"0\"\r\n" +
+	"storagecontrollermaxportcount0=\"30\"\r\n" +
+	"storagecontrollerportcount0=\"30\"\r\n" +
+	"storagecontrollerbootable0=\"on\"\r\n" +
+	`"SATA Controller-0-0"="C:\\Users\\Opettaja\\ktp\\NaksuAbittiKTP-SERVER23010X v5.vdi"` + "\r\n" +
+	"\"SATA Controller-ImageUUID-0-0\"=\"2f8a0f6e-4c11-4bb7-a4f3-b7f7c3c236a4\"\r\n" +
+	"natnet1=\"nat\"\r\n" +
+	"macaddress1=\"080027C0FFEE\"\r\n" +
+	"cableconnected1=\"on\"\r\n" +
+	"nic1=\"bridged\"\r\n" +
+	"bridgeadapter1=\"Intel(R) Ethernet Connection (7) I219-V\"\r\n" +
+	"nictype1=\"virtio\"\r\n" +
+	"nicspeed1=\"0\"\r\n" +
+	"nic2=\"none\"\r\n" +
+	"nic3=\"none\"\r\n" +
+	"nic4=\"none\"\r\n" +
+	"nic5=\"none\"\r\n" +
+	"nic6=\"none\"\r\n" +
+	"nic7=\"none\"\r\n" +
+	"nic8=\"none\"\r\n" +
+	"audio=\"none\"\r\n" +
+	"clipboard=\"bidirectional\"\r\n" +
+	"draganddrop=\"disabled\"\r\n" +
+	"vrde=\"off\"\r\n" +
+	"usb=\"off\"\r\n" +
+	"SharedFolderNameMachineMapping1=\"media\"\r\n" +
+	`SharedFolderPathMachineMapping1="C:\\Users\\Opettaja\\ktp-jako"` + "\r\n" +
+	"SharedFolderNameTransientMapping1=\"exam \\\"USB\\\"\"\r\n" +
+	`SharedFolderPathTransientMapping1="E:\\"` + "\r\n" +
+	"recording_enabled=\"off\"\r\n" +
+	"GuestMemoryBalloon=0\r\n" +
+	"SnapshotName=\"Installed\"\r\n" +
+	"SnapshotUUID=\"1d6c8e2a-3b4f-4a5e-8c7d-9e0f1a2b3c4d\"\r\n" +
+	"CurrentSnapshotName=\"Installed\"\r\n" +
+	"CurrentSnapshotUUID=\"1d6c8e2a-3b4f-4a5e-8c7d-9e0f1a2b3c4d\"\r\n" +
+	"CurrentSnapshotNode=\"SnapshotName\"\r\n"
+
+// vmInfo61UNC is printed by VirtualBox 6.1 on Windows for a VM which has its
+// disk and shared folder on a network share. The backslashes are not escaped.
+const vmInfo61UNC = "name=\"NaksuAbittiKTP-SERVER21127X v81\"\r\n" +
+	"UUID=\"4e1b0b3e-7a5c-4f3e-8a35-a2a7e7b2c2a1\"\r\n" +
+	`CfgFile="\\server\share\VirtualBox VMs\NaksuAbittiKTP-SERVER21127X v81\NaksuAbittiKTP-SERVER21127X v81.vbox"` + "\r\n" +
+	`LogFldr="\\server\share\VirtualBox VMs\NaksuAbittiKTP-SERVER21127X v81\Logs"` + "\r\n" +
+	"memory=5304\r\n" +
+	"VMState=\"poweroff\"\r\n" +
+	"storagecontrollername0=\"SATA Controller\"\r\n" +
+	`"SATA Controller-0-0"="\\server\share\ktp\NaksuAbittiKTP-SERVER21127X v81.vdi"` + "\r\n" +
+	"\"SATA Controller-ImageUUID-0-0\"=\"b7f7c3c2-36a4-4bb7-a4f3-2f8a0f6e4c11\"\r\n" +
+	"SharedFolderNameMachineMapping1=\"media\"\r\n" +
+	`SharedFolderPathMachineMapping1="\\server\share\ktp-jako"` + "\r\n" +
+	"SharedFolderNameTransientMapping1=\"usb\"\r\n" +
+	`SharedFolderPathTransientMapping1="E:\"` + "\r\n"
+
+func TestParseVMInfo(t *testing.T) {
+	tables := []struct {
+		version string
+		output  string
+		escaped bool
+		info    VMInfo
+	}{
+		{
+			"6.0",
+			vmInfo60,
+			false,
+			VMInfo{
+				Name:         "NaksuAbittiKTP",
+				UUID:         "0c6b4f1a-0c48-4c4b-9a3c-4c1d2f6d4a3e",
+				State:        "running",
+				OSType:       "Debian (64-bit)",
+				Firmware:     "EFI",
+				CPUs:         4,
+				MemoryMB:     8192,
+				VRamMB:       24,
+				SettingsFile: "/home/opettaja/VirtualBox VMs/NaksuAbittiKTP/NaksuAbittiKTP.vbox",
+				LogFolder:    "/home/opettaja/VirtualBox VMs/NaksuAbittiKTP/Logs",
+				NICs: []NIC{
+					{Index: 1, Attachment: "bridged", BridgeAdapter: "enp3s0", NICType: "virtio", MACAddress: "080027A1B2C3"},
+				},
+				StorageAttachments: []StorageAttachment{
+					{Controller: "SATA Controller", Port: 0, Device: 0, Medium: "/home/opettaja/ktp/naksu_last_image.vdi", ImageUUID: "9e1a3c7b-5d2f-4a8e-b6c4-1f0e2d3c4b5a"},
+				},
+				SharedFolders: []SharedFolder{
+					{Name: "media", HostPath: "/home/opettaja/ktp-jako"},
+				},
+				Snapshots: []VMSnapshot{
+					{Name: "Installed", UUID: "1d6c8e2a-3b4f-4a5e-8c7d-9e0f1a2b3c4d"},
+				},
+				CurrentSnapshot: "Installed",
+			},
+		},
+		{
+			"6.1",
+			vmInfo61,
+			false,
+			VMInfo{
+				Name:         "NaksuAbittiKTP-SERVER21127X v81",
+				UUID:         "4e1b0b3e-7a5c-4f3e-8a35-a2a7e7b2c2a1",
+				State:        "poweroff",
+				OSType:       "Debian (64-bit)",
+				Firmware:     "EFI",
+				CPUs:         2,
+				MemoryMB:     5304,
+				VRamMB:       24,
+				SettingsFile: "/home/opettaja/VirtualBox VMs/NaksuAbittiKTP-SERVER21127X v81/NaksuAbittiKTP-SERVER21127X v81.vbox",
+				LogFolder:    "/home/opettaja/VirtualBox VMs/NaksuAbittiKTP-SERVER21127X v81/Logs",
+				NICs: []NIC{
+					{Index: 1, Attachment: "bridged", BridgeAdapter: "wlp2s0", NICType: "82540EM", MACAddress: "0800275E8F21"},
+					{Index: 2, Attachment: "nat", NICType: "82540EM", MACAddress: "0800279D4C10"},
+				},
+				StorageAttachments: []StorageAttachment{
+					{Controller: "SATA Controller", Port: 0, Device: 0, Medium: "/home/opettaja/ktp/NaksuAbittiKTP-SERVER21127X v81.vdi", ImageUUID: "b7f7c3c2-36a4-4bb7-a4f3-2f8a0f6e4c11"},
+					{Controller: "IDE Controller", Port: 1, Device: 0, Medium: "emptydrive"},
+				},
+				SharedFolders: []SharedFolder{
+					{Name: "media", HostPath: "/home/opettaja/ktp-jako"},
+				},
+				Snapshots: []VMSnapshot{
+					{Name: "Installed", UUID: "1d6c8e2a-3b4f-4a5e-8c7d-9e0f1a2b3c4d"},
+					{Name: "after exam prep 2021-06-02", UUID: "6a2f0d3e-5b1c-4e0f-9d7a-1c2b3a4d5e6f"},
+				},
+				CurrentSnapshot: "after exam prep 2021-06-02",
+			},
+		},
+		{
+			"6.1 (UNC paths)",
+			vmInfo61UNC,
+			false,
+			VMInfo{
+				Name:         "NaksuAbittiKTP-SERVER21127X v81",
+				UUID:         "4e1b0b3e-7a5c-4f3e-8a35-a2a7e7b2c2a1",
+				State:        "poweroff",
+				MemoryMB:     5304,
+				SettingsFile: `\\server\share\VirtualBox VMs\NaksuAbittiKTP-SERVER21127X v81\NaksuAbittiKTP-SERVER21127X v81.vbox`,
+				LogFolder:    `\\server\share\VirtualBox VMs\NaksuAbittiKTP-SERVER21127X v81\Logs`,
+				StorageAttachments: []StorageAttachment{
+					{Controller: "SATA Controller", Port: 0, Device: 0, Medium: `\\server\share\ktp\NaksuAbittiKTP-SERVER21127X v81.vdi`, ImageUUID: "b7f7c3c2-36a4-4bb7-a4f3-2f8a0f6e4c11"},
+				},
+				SharedFolders: []SharedFolder{
+					{Name: "media", HostPath: `\\server\share\ktp-jako`},
+					{Name: "usb", HostPath: `E:\`},
+				},
+			},
+		},
+		{
+			"7.0",
+			vmInfo70,
+			true,
+			VMInfo{
+				Name:         "NaksuAbittiKTP-SERVER23010X v5",
+				UUID:         "b7f7c3c2-36a4-4bb7-a4f3-2f8a0f6e4c11",
+				State:        "gurumeditation",
+				OSType:       "Debian (64-bit)",
+				Firmware:     "EFI",
+				CPUs:         8,
+				MemoryMB:     16384,
+				VRamMB:       128,
+				SettingsFile: `C:\Users\Opettaja\VirtualBox VMs\NaksuAbittiKTP-SERVER23010X v5\NaksuAbittiKTP-SERVER23010X v5.vbox`,
+				LogFolder:    `C:\Users\Opettaja\VirtualBox VMs\NaksuAbittiKTP-SERVER23010X v5\Logs`,
+				NICs: []NIC{
+					{Index: 1, Attachment: "bridged", BridgeAdapter: "Intel(R) Ethernet Connection (7) I219-V", NICType: "virtio", MACAddress: "080027C0FFEE"},
+				},
+				StorageAttachments: []StorageAttachment{
+					{Controller: "SATA Controller", Port: 0, Device: 0, Medium: `C:\Users\Opettaja\ktp\NaksuAbittiKTP-SERVER23010X v5.vdi`, ImageUUID: "2f8a0f6e-4c11-4bb7-a4f3-b7f7c3c236a4"},
+				},
+				SharedFolders: []SharedFolder{
+					{Name: "media", HostPath: `C:\Users\Opettaja\ktp-jako`},
+					{Name: `exam "USB"`, HostPath: `E:\`},
+				},
+				Snapshots: []VMSnapshot{
+					{Name: "Installed", UUID: "1d6c8e2a-3b4f-4a5e-8c7d-9e0f1a2b3c4d"},
+				},
+				CurrentSnapshot: "Installed",
+			},
+		},
+	}
+
+	for _, table := range tables {
+		info, err := parseVMInfo(table.output, table.escaped)
+		if err != nil {
+			t.Errorf("ParseVMInfo fails with output of VirtualBox %s: %v", table.version, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(info, table.info) {
+			t.Errorf("ParseVMInfo with output of VirtualBox %s gives\n%+v\nexpected\n%+v", table.version, info, table.info)
+		}
+	}
+}
+
+func TestParseVMInfoErrors(t *testing.T) {
+	outputs := []string{
+		"",
+		"VBoxManage: error: Could not find a registered machine named 'NaksuAbittiKTP'\n",
+		"name=\"NaksuAbittiKTP\"\nVMState=\"poweroff\"\nmemory=lots\n",
+	}
+
+	for _, output := range outputs {
+		_, err := parseVMInfo(output, false)
+		if err == nil {
+			t.Errorf("ParseVMInfo(%q) does not fail", output)
+		}
+	}
+}
+
+func TestGetStorageAttachment(t *testing.T) {
+	info, err := parseVMInfo(vmInfo61, false)
+	if err != nil {
+		t.Fatalf("ParseVMInfo failed: %v", err)
+	}
+
+	tables := []struct {
+		controller string
+		port       int
+		device     int
+		medium     string
+		found      bool
+	}{
+		{"SATA Controller", 0, 0, "/home/opettaja/ktp/NaksuAbittiKTP-SERVER21127X v81.vdi", true},
+		{"SATA Controller", 1, 0, "", false},
+		{"IDE Controller", 1, 0, "emptydrive", true},
+		{"NVMe Controller", 0, 0, "", false},
+	}
+
+	for _, table := range tables {
+		attachment, found := info.GetStorageAttachment(table.controller, table.port, table.device)
+		if found != table.found || attachment.Medium != table.medium {
+			t.Errorf("GetStorageAttachment(%q, %d, %d) gives %q and %v, expected %q and %v", table.controller, table.port, table.device, attachment.Medium, found, table.medium, table.found)
+		}
+	}
+}
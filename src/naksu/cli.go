@@ -0,0 +1,702 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"naksu/box"
+	"naksu/box/download"
+	"naksu/config"
+	"naksu/constants"
+	"naksu/log"
+	"naksu/logdelivery"
+	"naksu/mebroutines"
+	"naksu/mebroutines/backup"
+	"naksu/mebroutines/destroy"
+	"naksu/mebroutines/doctor"
+	"naksu/mebroutines/install"
+	"naksu/mebroutines/remove"
+	"naksu/mebroutines/restore"
+	"naksu/mebroutines/snapshot"
+	"naksu/mebroutines/start"
+	"naksu/mebroutines/stop"
+	"naksu/mebroutines/storage"
+	"naksu/network"
+
+	humanize "github.com/dustin/go-humanize"
+	flags "github.com/jessevdk/go-flags"
+)
+
+// Exit codes returned by the command-line interface
+const (
+	exitCodeOK      = 0
+	exitCodeFailure = 1
+	exitCodeUsage   = 2
+)
+
+// cliCommand is a subcommand which can be executed without the GUI
+type cliCommand interface {
+	run() error
+}
+
+// localImageOptions are common options for installing a server from a local image
+type localImageOptions struct {
+	FromFile     string `long:"from-file" description:"Install from a local ktp-etcher.zip, raw ktp.img or USB stick device (e.g. /dev/sdb) instead of downloading"`
+	ImageVersion string `long:"image-version" description:"Version of the local image. By default the version is read from the .ver file next to the image or inside it."`
+}
+
+type installAbittiCommand struct {
+	localImageOptions
+}
+
+type installExamCommand struct {
+	localImageOptions
+	PassphraseFile string `long:"passphrase-file" description:"File containing the install passphrase for the exam server. Use - to read the passphrase from standard input."`
+}
+
+type startCommand struct{}
+
+type stopCommand struct {
+	Force bool `long:"force" description:"Power off the server immediately without shutting it down"`
+}
+
+type discardStateCommand struct{}
+
+type backupCommand struct {
+	To string `long:"to" required:"true" description:"Target directory (or .vmdk file path) for the backup"`
+}
+
+type restoreCommand struct {
+	From    string `long:"from" required:"true" description:"Backup (.vmdk file) to restore"`
+	Type    string `long:"type" choice:"abitti" choice:"exam" description:"Type of the backed up server. By default the type is read from the backup manifest."`
+	Version string `long:"version" description:"Version of the backed up server. By default the version is read from the backup manifest."`
+}
+
+type verifyBackupCommand struct {
+	File string `long:"file" required:"true" description:"Backup (.vmdk file) to verify against its manifest"`
+}
+
+type removeExamsCommand struct{}
+
+type removeServerCommand struct{}
+
+type deliverLogsCommand struct{}
+
+type listImagesCommand struct{}
+
+type purgeImagesCommand struct {
+	Version string `long:"version" description:"Remove only the image of this version. By default all cached images are removed."`
+}
+
+type listServersCommand struct{}
+
+type selectServerCommand struct {
+	Name string `long:"name" required:"true" description:"Name of the server to use (see list-servers)"`
+}
+
+type rollbackCommand struct{}
+
+type listSnapshotsCommand struct{}
+
+type takeSnapshotCommand struct {
+	Name string `long:"name" required:"true" description:"Name of the new snapshot"`
+}
+
+type restoreSnapshotCommand struct {
+	Name string `long:"name" required:"true" description:"Name of the snapshot to restore (see list-snapshots)"`
+}
+
+type deleteSnapshotCommand struct {
+	Name string `long:"name" required:"true" description:"Name of the snapshot to delete (see list-snapshots)"`
+}
+
+type doctorCommand struct {
+	Fix     bool  `long:"fix" description:"Fix the problems found. Configuration files are backed up before they are changed."`
+	Finding []int `long:"finding" description:"Fix only the problem with this number in the report (can be given several times)"`
+}
+
+type storageCommand struct {
+	Clean   bool  `long:"clean" description:"Remove the files listed in the cleanups. Only files which naksu can download or create again are removed."`
+	Cleanup []int `long:"cleanup" description:"Do only the cleanup with this number in the report (can be given several times)"`
+}
+
+var cliCommands = map[string]cliCommand{}
+
+// addCLICommands registers all subcommands to the given parser
+func addCLICommands(parser *flags.Parser) {
+	commands := []struct {
+		name             string
+		shortDescription string
+		longDescription  string
+		command          cliCommand
+	}{
+		{"install-abitti", "Install Abitti server", "Download and install the latest Abitti server or install it from a local image", &installAbittiCommand{}},
+		{"install-exam", "Install Matriculation Exam server", "Download and install the Matriculation Exam server using the given install passphrase or install it from a local image", &installExamCommand{}},
+		{"start", "Start the exam server", "Start the currently installed exam server", &startCommand{}},
+		{"stop", "Stop the exam server", "Shut down the running exam server. The server is powered off if it does not shut down in two minutes.", &stopCommand{}},
+		{"discard-state", "Discard saved server state", "Discard the saved state of the exam server so that it boots normally when started", &discardStateCommand{}},
+		{"backup", "Make exam server backup", "Write a backup of the exam server disk to the given location", &backupCommand{}},
+		{"verify-backup", "Verify exam server backup", "Check that the backup matches the checksum in its manifest", &verifyBackupCommand{}},
+		{"restore", "Restore exam server backup", "Create a new exam server from a backup written by the backup command", &restoreCommand{}},
+		{"remove-exams", "Remove exams", "Restore the server to its initial state. Exams, responses and logs in the server will be irreversibly deleted.", &removeExamsCommand{}},
+		{"remove-server", "Remove server", "Remove the server and all downloaded disk images", &removeServerCommand{}},
+		{"deliver-logs", "Send logs to Abitti support", "Collect server logs to a zip archive in ktp-jako and send it to Abitti support", &deliverLogsCommand{}},
+		{"list-images", "List cached server images", "List the downloaded server images kept in the image cache", &listImagesCommand{}},
+		{"purge-images", "Remove cached server images", "Remove downloaded server images from the image cache", &purgeImagesCommand{}},
+		{"list-servers", "List installed servers", "List the installed exam servers. The active server is marked with an asterisk.", &listServersCommand{}},
+		{"select-server", "Select the active server", "Select the installed exam server used by the other commands", &selectServerCommand{}},
+		{"rollback", "Roll back to the previous server", "Make the previously installed server of the same type active", &rollbackCommand{}},
+		{"list-snapshots", "List server snapshots", "List the snapshots of the active server", &listSnapshotsCommand{}},
+		{"take-snapshot", "Take server snapshot", "Take a named snapshot of the stopped active server", &takeSnapshotCommand{}},
+		{"restore-snapshot", "Restore server snapshot", "Return the stopped active server to the given snapshot. Exams, responses and logs saved after the snapshot will be irreversibly deleted.", &restoreSnapshotCommand{}},
+		{"delete-snapshot", "Delete server snapshot", "Delete the given snapshot of the stopped active server", &deleteSnapshotCommand{}},
+		{"doctor", "Diagnose VirtualBox problems", "Find problems in the VirtualBox media registry, leftover disk images and VM files, and the shared folder and snapshot of the servers. With --fix the problems are also fixed.", &doctorCommand{}},
+		{"storage", "Show disk usage", "Show the disk space used by the server images, disks, snapshots and logs and the cleanups which can free space. With --clean the cleanups are also done.", &storageCommand{}},
+	}
+
+	for _, command := range commands {
+		_, err := parser.AddCommand(command.name, command.shortDescription, command.longDescription, command.command)
+		if err != nil {
+			panic(fmt.Sprintf("Could not add command %s: %v", command.name, err))
+		}
+		cliCommands[command.name] = command.command
+	}
+
+	// Naksu starts the GUI if no subcommand was given
+	parser.SubcommandsOptional = true
+}
+
+// runCLICommand executes the given subcommand and returns the process exit code
+func runCLICommand(commandName string) int {
+	command, ok := cliCommands[commandName]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", commandName)
+		return exitCodeUsage
+	}
+
+	log.Action("Executing command-line command '%s'", commandName)
+
+	if !box.IsHypervisorAvailable() {
+		showHypervisorNotAvailableError()
+		return exitCodeFailure
+	}
+
+	// The error has already been shown, the command may still succeed
+	_ = install.RecoverInterruptedInstall()
+
+	err := command.run()
+	if err != nil {
+		log.Error("Command '%s' failed: %v", commandName, err)
+		return exitCodeFailure
+	}
+
+	log.Action("Command '%s' finished successfully", commandName)
+	return exitCodeOK
+}
+
+func (c *installAbittiCommand) run() error {
+	var err error
+	if c.FromFile != "" {
+		err = install.NewServerFromFile(constants.AbittiBoxType, c.FromFile, c.ImageVersion)
+	} else {
+		err = install.NewAbittiServer()
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("A new Abitti server was created, version is: %s\n", box.GetVersion())
+	return nil
+}
+
+func (c *installExamCommand) run() error {
+	var err error
+	if c.FromFile != "" {
+		err = install.NewServerFromFile(constants.MatriculationExamBoxType, c.FromFile, c.ImageVersion)
+	} else {
+		err = c.installFromCloud()
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("A new exam server was created, version is: %s\n", box.GetVersion())
+	return nil
+}
+
+func (c *installExamCommand) installFromCloud() error {
+	if c.PassphraseFile == "" {
+		return errors.New("either --passphrase-file or --from-file must be given")
+	}
+
+	passphrase, err := readPassphrase(c.PassphraseFile)
+	if err != nil {
+		return err
+	}
+
+	return install.NewExamServer(passphrase)
+}
+
+// readPassphrase reads the install passphrase from the given file or from the
+// standard input if the path is "-"
+func readPassphrase(passphraseFile string) (string, error) {
+	var content []byte
+	var err error
+
+	if passphraseFile == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(passphraseFile) // #nosec
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("could not read passphrase: %v", err)
+	}
+
+	passphrase := strings.TrimSpace(string(content))
+	if passphrase == "" {
+		return "", errors.New("passphrase is empty")
+	}
+
+	return passphrase, nil
+}
+
+func (c *startCommand) run() error {
+	if config.GetExtNic() == "" {
+		mebroutines.ShowTranslatedErrorMessage("Please select the network device which is connected to your exam network.")
+		return errors.New("network device has not been selected")
+	}
+
+	if !network.IsExtInterface(config.GetExtNic()) {
+		mebroutines.ShowTranslatedErrorMessage("You have selected network device '%s' which is not available.", config.GetExtNic())
+		return fmt.Errorf("network device %s is not available", config.GetExtNic())
+	}
+
+	if box.TypeIsMatriculationExam() && network.CheckIfNetworkAvailable() {
+		mebroutines.ShowTranslatedWarningMessage("You are starting Matriculation Examination server with an Internet connection.")
+	}
+
+	err := start.Server()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Virtual machine was started")
+	return nil
+}
+
+func (c *stopCommand) run() error {
+	if c.Force {
+		err := stop.PowerOff()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Virtual machine was powered off")
+		return nil
+	}
+
+	err := stop.Server()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Virtual machine was shut down")
+	return nil
+}
+
+func (c *discardStateCommand) run() error {
+	err := stop.DiscardSavedState()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Saved state was discarded")
+	return nil
+}
+
+func (c *backupCommand) run() error {
+	backupPath := c.To
+	if mebroutines.ExistsDir(backupPath) {
+		backupPath = filepath.Join(backupPath, backup.GetBackupFilename(time.Now()))
+	}
+
+	err := backup.MakeBackup(backupPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Backup done: %s\n", backupPath)
+	return nil
+}
+
+func (c *removeExamsCommand) run() error {
+	err := destroy.Server()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Exams were removed successfully.")
+	return nil
+}
+
+func (c *removeServerCommand) run() error {
+	err := remove.Server()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Server was removed successfully.")
+	return nil
+}
+
+func (c *deliverLogsCommand) run() error {
+	copyDoneChannel, copyProgressChannel := logdelivery.RequestLogsFromServer()
+	followCLILogCopyProgress(copyDoneChannel, copyProgressChannel)
+
+	logFilename, zipProgressChannel, zipErrorChannel := logdelivery.CollectLogsToZip()
+	fmt.Printf("Filename for Abitti support: %s\n", logFilename)
+
+	err := followCLILogZippingProgress(zipProgressChannel, zipErrorChannel)
+	if err != nil {
+		return fmt.Errorf("error zipping logs: %v", err)
+	}
+
+	if !network.CheckIfNetworkAvailable() {
+		return errors.New("cannot send logs because there is no internet connection, logs are in a zip archive in the ktp-jako folder")
+	}
+
+	fmt.Println("Sending logs")
+	lastProgress := uint8(0)
+	err = logdelivery.SendLogs(logFilename, func(progress uint8) {
+		if progress != lastProgress {
+			fmt.Printf("Sending logs: %d %%\n", progress)
+			lastProgress = progress
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error sending logs: %v", err)
+	}
+
+	fmt.Println("Logs sent!")
+	return nil
+}
+
+func (c *verifyBackupCommand) run() error {
+	err := backup.Verify(c.File)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Backup %s is intact.\n", c.File)
+	return nil
+}
+
+func (c *restoreCommand) run() error {
+	boxType := ""
+	switch c.Type {
+	case "abitti":
+		boxType = constants.AbittiBoxType
+	case "exam":
+		boxType = constants.MatriculationExamBoxType
+	}
+
+	err := restore.Backup(c.From, boxType, c.Version)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("The backup %s was restored to a new server.\n", c.From)
+	return nil
+}
+
+func (c *listImagesCommand) run() error {
+	images, err := download.ListCachedImages()
+	if err != nil {
+		return err
+	}
+
+	if len(images) == 0 {
+		fmt.Println("The image cache is empty")
+		return nil
+	}
+
+	for _, image := range images {
+		fmt.Printf("%s\t%s\t%s\t%s\n", image.Version, humanize.Bytes(image.Size), image.LastUsed.Format("2006-01-02 15:04"), image.Path)
+	}
+
+	return nil
+}
+
+func (c *purgeImagesCommand) run() error {
+	err := download.PurgeImageCache(c.Version)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Cached server images were removed.")
+	return nil
+}
+
+func (c *listServersCommand) run() error {
+	boxes, err := box.ListBoxes()
+	if err != nil {
+		return err
+	}
+
+	if len(boxes) == 0 {
+		fmt.Println("There are no installed servers")
+		return nil
+	}
+
+	for _, boxInfo := range boxes {
+		active := " "
+		if boxInfo.Active {
+			active = "*"
+		}
+
+		installed := "-"
+		if !boxInfo.Installed.IsZero() {
+			installed = boxInfo.Installed.Format("2006-01-02 15:04")
+		}
+
+		fmt.Printf("%s %s\t%s\t%s\t%s\n", active, boxInfo.Name, boxInfo.Type, boxInfo.Version, installed)
+	}
+
+	return nil
+}
+
+func (c *selectServerCommand) run() error {
+	isRunning, err := box.IsAnyBoxRunning()
+	if err != nil {
+		return err
+	}
+
+	if isRunning {
+		return errors.New("please stop the server before selecting another one")
+	}
+
+	err = box.SetActiveBox(c.Name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Server %s is now active.\n", c.Name)
+	return nil
+}
+
+func (c *rollbackCommand) run() error {
+	previousBox, err := box.RollbackToPreviousBox()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Rolled back to server %s (%s).\n", previousBox.Name, previousBox.Version)
+	return nil
+}
+
+func (c *listSnapshotsCommand) run() error {
+	snapshots, err := box.ListSnapshots()
+	if err != nil {
+		return err
+	}
+
+	if len(snapshots) == 0 {
+		fmt.Println("The server does not have any snapshots")
+		return nil
+	}
+
+	for _, snapshotInfo := range snapshots {
+		created := "-"
+		if !snapshotInfo.Created.IsZero() {
+			created = snapshotInfo.Created.Local().Format("2006-01-02 15:04")
+		}
+
+		fmt.Printf("%s\t%s\n", created, snapshotInfo.Name)
+	}
+
+	return nil
+}
+
+func (c *takeSnapshotCommand) run() error {
+	err := snapshot.Take(c.Name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Snapshot %s was taken.\n", c.Name)
+	return nil
+}
+
+func (c *restoreSnapshotCommand) run() error {
+	err := snapshot.Restore(c.Name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Snapshot %s was restored.\n", c.Name)
+	return nil
+}
+
+func (c *deleteSnapshotCommand) run() error {
+	err := snapshot.Delete(c.Name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Snapshot %s was deleted.\n", c.Name)
+	return nil
+}
+
+func (c *doctorCommand) run() error {
+	findings, err := doctor.Diagnose()
+	if err != nil {
+		return err
+	}
+
+	if len(findings) == 0 {
+		fmt.Println("No problems were found")
+		return nil
+	}
+
+	for n, finding := range findings {
+		fmt.Printf("%d. [%s] %s\n   Fix: %s\n", n+1, finding.Kind, finding.Description, finding.FixDescription)
+	}
+
+	if !c.Fix {
+		return nil
+	}
+
+	failed := 0
+	for n, finding := range findings {
+		if !isSelectedNumber(c.Finding, n+1) {
+			continue
+		}
+
+		err := finding.Fix()
+		if err != nil {
+			fmt.Printf("Fixing problem %d failed: %v\n", n+1, err)
+			failed++
+			continue
+		}
+
+		fmt.Printf("Problem %d was fixed.\n", n+1)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d problems could not be fixed", failed)
+	}
+
+	return nil
+}
+
+// isSelectedNumber returns true if the number was selected on the command line.
+// All numbers are selected if none were given.
+func isSelectedNumber(selected []int, number int) bool {
+	if len(selected) == 0 {
+		return true
+	}
+
+	for _, selectedNumber := range selected {
+		if selectedNumber == number {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *storageCommand) run() error {
+	report, err := storage.GetUsage()
+	if err != nil {
+		return err
+	}
+
+	for _, usage := range report.Usages {
+		fmt.Printf("%s\t%s\t%d files\t%s\n", humanize.Bytes(usage.Size), usage.Description, usage.Files, usage.Directory)
+	}
+
+	fmt.Printf("%s\tTotal\n", humanize.Bytes(report.Total()))
+
+	for _, free := range report.Free {
+		fmt.Printf("%s\tFree on %s\n", humanize.Bytes(free.Free), free.Directory)
+	}
+
+	cleanups, err := storage.ListCleanups()
+	if err != nil {
+		return err
+	}
+
+	if len(cleanups) == 0 {
+		fmt.Println("There is nothing to clean up")
+		return nil
+	}
+
+	fmt.Println()
+	for n, cleanup := range cleanups {
+		fmt.Printf("%d. [%s] %s (frees %s)\n", n+1, cleanup.Category, cleanup.Description, humanize.Bytes(cleanup.Size))
+	}
+
+	if !c.Clean {
+		return nil
+	}
+
+	failed := 0
+	for n, cleanup := range cleanups {
+		if !isSelectedNumber(c.Cleanup, n+1) {
+			continue
+		}
+
+		err := cleanup.Clean()
+		if err != nil {
+			fmt.Printf("Cleanup %d failed: %v\n", n+1, err)
+			failed++
+			continue
+		}
+
+		fmt.Printf("Cleanup %d freed %s.\n", n+1, humanize.Bytes(cleanup.Size))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d cleanups failed", failed)
+	}
+
+	return nil
+}
+
+func followCLILogCopyProgress(copyDoneChannel chan bool, copyProgressChannel chan string) {
+	for {
+		select {
+		case copyDone := <-copyDoneChannel:
+			if copyDone {
+				fmt.Println("Done copying")
+				return
+			}
+		case copyProgress := <-copyProgressChannel:
+			if copyProgress != "0 %" {
+				fmt.Printf("Copying logs: %s\n", copyProgress)
+			}
+		}
+	}
+}
+
+func followCLILogZippingProgress(zipProgressChannel chan uint8, zipErrorChannel chan error) error {
+	for {
+		select {
+		case zipProgress := <-zipProgressChannel:
+			if zipProgress <= 100 {
+				fmt.Printf("Zipping logs: %d %%\n", zipProgress)
+			} else {
+				fmt.Println("Done zipping")
+				return nil
+			}
+		case zipError := <-zipErrorChannel:
+			return zipError
+		}
+	}
+}
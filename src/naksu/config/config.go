@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"naksu/constants"
 	"naksu/log"
@@ -38,6 +39,26 @@ var defaults = []defaultValue{
 	{"selfupdate", "disabled", strconv.FormatBool(false)},
 	{"environment", "nic", constants.AvailableNics[0].ConfigValue},
 	{"environment", "extnic", ""},
+	{"environment", "hypervisor", constants.AvailableHypervisors[0].ConfigValue},
+	{"environment", "activeBox", ""},
+	{"imagecache", "maxImages", strconv.FormatUint(2, 10)},
+	{"imagecache", "maxSizeGB", strconv.FormatUint(0, 10)},
+	{"vm", "cpus", strconv.FormatUint(0, 10)},
+	{"vm", "memoryMB", strconv.FormatUint(0, 10)},
+	{"vm", "vramMB", strconv.FormatUint(24, 10)},
+	{"vm", "diskSizeGB", strconv.FormatUint(55, 10)},
+	{"backup", "schedule", constants.AvailableBackupSchedules[0].ConfigValue},
+	{"backup", "directory", ""},
+	{"backup", "keep", strconv.FormatUint(3, 10)},
+	{"backup", "nightlyHour", strconv.FormatUint(2, 10)},
+	{"backup", "maxAgeHours", strconv.FormatUint(48, 10)},
+	{"backup", "lastRun", ""},
+	{"backup", "lastSuccess", ""},
+	{"backup", "lastError", ""},
+	{"supervisor", "action", constants.AvailableSupervisorActions[0].ConfigValue},
+	{"supervisor", "bootTimeoutSeconds", strconv.FormatUint(300, 10)},
+	{"supervisor", "readyProperty", "/VirtualBox/GuestInfo/Net/0/V4/IP"},
+	{"supervisor", "maxRestarts", strconv.FormatUint(3, 10)},
 }
 
 func fillDefaults() {
@@ -73,10 +94,39 @@ func getBoolean(section string, key string) bool {
 	return value
 }
 
+func getUint(section string, key string) uint64 {
+	value, err := getIniKey(section, key).Uint64()
+	if err != nil {
+		log.Debug(fmt.Sprintf("Parsing key %s / %s as unsigned integer failed", section, key))
+		defaultValue := getDefault(section, key)
+		value, err = strconv.ParseUint(defaultValue, 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("Default unsigned integer parsing for %v / %v (%v) failed to parse to unsigned integer!", section, key, defaultValue))
+		}
+		setValue(section, key, defaultValue)
+	}
+	return value
+}
+
 func getString(section string, key string) string {
 	return getIniKey(section, key).String()
 }
 
+// getTime returns a RFC 3339 timestamp. An empty or malformed value gives a zero time.
+func getTime(section string, key string) time.Time {
+	value := getString(section, key)
+	if value == "" {
+		return time.Time{}
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Parsing key %s / %s as timestamp failed", section, key))
+		return time.Time{}
+	}
+	return timestamp
+}
+
 func setValue(section string, key string, value string) {
 	log.Debug(fmt.Sprintf("Setting new configuration: section %s, key: %s, value: %s", section, key, value))
 	cfg.Section(section).Key(key).SetValue(value)
@@ -169,3 +219,218 @@ func GetExtNic() string {
 func SetExtNic(nic string) {
 	setValue("environment", "extnic", nic)
 }
+
+// GetHypervisor returns the virtualisation backend. Defaults to "virtualbox"
+func GetHypervisor() string {
+	return validateStringChoice("environment", "hypervisor", constants.AvailableHypervisors)
+}
+
+// SetHypervisor sets the virtualisation backend
+func SetHypervisor(hypervisor string) {
+	if constants.GetAvailableSelectionID(hypervisor, constants.AvailableHypervisors, -1) < 0 {
+		setValue("environment", "hypervisor", getDefault("environment", "hypervisor"))
+	} else {
+		setValue("environment", "hypervisor", hypervisor)
+	}
+}
+
+// GetActiveBox returns the name of the VM selected by the user. An empty
+// string means the box installed before multiple boxes were supported.
+func GetActiveBox() string {
+	return getString("environment", "activeBox")
+}
+
+// SetActiveBox sets the name of the VM selected by the user
+func SetActiveBox(boxName string) {
+	setValue("environment", "activeBox", boxName)
+}
+
+// GetImageCacheMaxImages returns the maximum number of server images kept in
+// the image cache. Zero means no limit. The image installed last is always kept.
+// Defaults to 2.
+func GetImageCacheMaxImages() uint64 {
+	return getUint("imagecache", "maxImages")
+}
+
+// SetImageCacheMaxImages sets the maximum number of cached server images
+func SetImageCacheMaxImages(maxImages uint64) {
+	setValue("imagecache", "maxImages", strconv.FormatUint(maxImages, 10))
+}
+
+// GetImageCacheMaxSizeGB returns the maximum total size of the image cache in
+// gigabytes. Zero means no size limit. The image installed last is kept even if it
+// is larger.
+func GetImageCacheMaxSizeGB() uint64 {
+	return getUint("imagecache", "maxSizeGB")
+}
+
+// SetImageCacheMaxSizeGB sets the maximum total size of the image cache
+func SetImageCacheMaxSizeGB(maxSizeGB uint64) {
+	setValue("imagecache", "maxSizeGB", strconv.FormatUint(maxSizeGB, 10))
+}
+
+// GetVMCPUs returns the number of CPUs of the server. Zero means that the
+// number is calculated from the host CPU cores. Defaults to 0.
+func GetVMCPUs() uint64 {
+	return getUint("vm", "cpus")
+}
+
+// SetVMCPUs sets the number of CPUs of the server
+func SetVMCPUs(cpus uint64) {
+	setValue("vm", "cpus", strconv.FormatUint(cpus, 10))
+}
+
+// GetVMMemoryMB returns the memory of the server in megabytes. Zero means that
+// the memory is calculated from the host memory. Defaults to 0.
+func GetVMMemoryMB() uint64 {
+	return getUint("vm", "memoryMB")
+}
+
+// SetVMMemoryMB sets the memory of the server in megabytes
+func SetVMMemoryMB(memoryMB uint64) {
+	setValue("vm", "memoryMB", strconv.FormatUint(memoryMB, 10))
+}
+
+// GetVMVRamMB returns the video memory of the server in megabytes. Defaults to 24.
+func GetVMVRamMB() uint64 {
+	return getUint("vm", "vramMB")
+}
+
+// SetVMVRamMB sets the video memory of the server in megabytes
+func SetVMVRamMB(vramMB uint64) {
+	setValue("vm", "vramMB", strconv.FormatUint(vramMB, 10))
+}
+
+// GetVMDiskSizeGB returns the disk size of new servers in gigabytes. Defaults to 55.
+func GetVMDiskSizeGB() uint64 {
+	return getUint("vm", "diskSizeGB")
+}
+
+// SetVMDiskSizeGB sets the disk size of new servers in gigabytes
+func SetVMDiskSizeGB(diskSizeGB uint64) {
+	setValue("vm", "diskSizeGB", strconv.FormatUint(diskSizeGB, 10))
+}
+
+// GetBackupSchedule returns the schedule of automatic backups. Defaults to "off".
+func GetBackupSchedule() string {
+	return validateStringChoice("backup", "schedule", constants.AvailableBackupSchedules)
+}
+
+// SetBackupSchedule sets the schedule of automatic backups
+func SetBackupSchedule(schedule string) {
+	if constants.GetAvailableSelectionID(schedule, constants.AvailableBackupSchedules, -1) < 0 {
+		setValue("backup", "schedule", getDefault("backup", "schedule"))
+	} else {
+		setValue("backup", "schedule", schedule)
+	}
+}
+
+// GetBackupDirectory returns the directory where the automatic backups are written
+func GetBackupDirectory() string {
+	return getString("backup", "directory")
+}
+
+// SetBackupDirectory sets the directory where the automatic backups are written
+func SetBackupDirectory(directory string) {
+	setValue("backup", "directory", directory)
+}
+
+// GetBackupKeep returns the number of automatic backups kept in the backup
+// directory. Zero keeps all backups. Defaults to 3.
+func GetBackupKeep() uint64 {
+	return getUint("backup", "keep")
+}
+
+// SetBackupKeep sets the number of automatic backups kept in the backup directory
+func SetBackupKeep(keep uint64) {
+	setValue("backup", "keep", strconv.FormatUint(keep, 10))
+}
+
+// GetBackupNightlyHour returns the hour (0-23) when the nightly backup is made. Defaults to 2.
+func GetBackupNightlyHour() uint64 {
+	value := getUint("backup", "nightlyHour")
+	if value > 23 {
+		log.Debug(fmt.Sprintf("Correcting malformed ini-key backup / nightlyHour to default value %v", getDefault("backup", "nightlyHour")))
+		setValue("backup", "nightlyHour", getDefault("backup", "nightlyHour"))
+		return getUint("backup", "nightlyHour")
+	}
+	return value
+}
+
+// SetBackupNightlyHour sets the hour when the nightly backup is made
+func SetBackupNightlyHour(hour uint64) {
+	setValue("backup", "nightlyHour", strconv.FormatUint(hour, 10))
+}
+
+// GetBackupMaxAgeHours returns the age of the latest successful automatic backup
+// after which the user is warned. Defaults to 48.
+func GetBackupMaxAgeHours() uint64 {
+	return getUint("backup", "maxAgeHours")
+}
+
+// SetBackupMaxAgeHours sets the age of the latest successful automatic backup
+// after which the user is warned
+func SetBackupMaxAgeHours(maxAgeHours uint64) {
+	setValue("backup", "maxAgeHours", strconv.FormatUint(maxAgeHours, 10))
+}
+
+// GetBackupLastRun returns the start time of the latest automatic backup or
+// zero time if no automatic backup has been made
+func GetBackupLastRun() time.Time {
+	return getTime("backup", "lastRun")
+}
+
+// GetBackupLastSuccess returns the start time of the latest successful automatic
+// backup or zero time if no automatic backup has succeeded
+func GetBackupLastSuccess() time.Time {
+	return getTime("backup", "lastSuccess")
+}
+
+// GetBackupLastError returns the error of the latest automatic backup or an
+// empty string if it succeeded
+func GetBackupLastError() string {
+	return getString("backup", "lastError")
+}
+
+// SetBackupResult records the result of an automatic backup started at runTime.
+// An empty errorMessage means the backup succeeded.
+func SetBackupResult(runTime time.Time, errorMessage string) {
+	setValue("backup", "lastRun", runTime.Format(time.RFC3339))
+	setValue("backup", "lastError", errorMessage)
+	if errorMessage == "" {
+		setValue("backup", "lastSuccess", runTime.Format(time.RFC3339))
+	}
+}
+
+// GetSupervisorAction returns what the supervisor does when the server crashes
+// or does not boot in time. Defaults to "alert".
+func GetSupervisorAction() string {
+	return validateStringChoice("supervisor", "action", constants.AvailableSupervisorActions)
+}
+
+// SetSupervisorAction sets what the supervisor does when the server crashes
+func SetSupervisorAction(action string) {
+	if constants.GetAvailableSelectionID(action, constants.AvailableSupervisorActions, -1) < 0 {
+		setValue("supervisor", "action", getDefault("supervisor", "action"))
+	} else {
+		setValue("supervisor", "action", action)
+	}
+}
+
+// GetSupervisorBootTimeoutSeconds returns the time the server has for becoming ready
+// after it has been started. Zero disables the boot watchdog. Defaults to 300.
+func GetSupervisorBootTimeoutSeconds() uint64 {
+	return getUint("supervisor", "bootTimeoutSeconds")
+}
+
+// GetSupervisorReadyProperty returns the guest property which is set when the server
+// is ready. Defaults to "/VirtualBox/GuestInfo/Net/0/V4/IP".
+func GetSupervisorReadyProperty() string {
+	return getString("supervisor", "readyProperty")
+}
+
+// GetSupervisorMaxRestarts returns how many times the supervisor restarts the server
+// before it is ready. After that the user is alerted. Defaults to 3.
+func GetSupervisorMaxRestarts() uint64 {
+	return getUint("supervisor", "maxRestarts")
+}
@@ -109,6 +109,68 @@ var AvailableNics = []AvailableSelection{
 	},
 }
 
+// AvailableHypervisors is an array of possible virtualisation backends.
+// The first value is the default.
+var AvailableHypervisors = []AvailableSelection{
+	{
+		ConfigValue: "virtualbox",
+		Legend:      "Oracle VirtualBox",
+	},
+	{
+		ConfigValue: "qemu",
+		Legend:      "QEMU/KVM (Linux)",
+	},
+}
+
+// Schedules of automatic backups, see naksu/mebroutines/backup
+const (
+	BackupScheduleOff      = "off"
+	BackupScheduleShutdown = "shutdown"
+	BackupScheduleNightly  = "nightly"
+)
+
+// AvailableBackupSchedules is an array of possible automatic backup schedules.
+// The first value is the default.
+var AvailableBackupSchedules = []AvailableSelection{
+	{
+		ConfigValue: BackupScheduleOff,
+		Legend:      "Off",
+	},
+	{
+		ConfigValue: BackupScheduleShutdown,
+		Legend:      "After every server shutdown",
+	},
+	{
+		ConfigValue: BackupScheduleNightly,
+		Legend:      "Nightly when the server is stopped",
+	},
+}
+
+// Actions taken by the server supervisor when the server crashes or does not boot,
+// see naksu/mebroutines/supervise
+const (
+	SupervisorActionOff     = "off"
+	SupervisorActionAlert   = "alert"
+	SupervisorActionRestart = "restart"
+)
+
+// AvailableSupervisorActions is an array of possible supervisor actions.
+// The first value is the default.
+var AvailableSupervisorActions = []AvailableSelection{
+	{
+		ConfigValue: SupervisorActionAlert,
+		Legend:      "Alert the user",
+	},
+	{
+		ConfigValue: SupervisorActionRestart,
+		Legend:      "Restart the server",
+	},
+	{
+		ConfigValue: SupervisorActionOff,
+		Legend:      "Only write to the log",
+	},
+}
+
 // DefaultExtNicArray is an array holding the default EXTNIC value
 var DefaultExtNicArray = []AvailableSelection{
 	{
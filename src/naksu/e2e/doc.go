@@ -0,0 +1,5 @@
+// Package e2e contains end-to-end tests of the server flows (install, start, backup,
+// remove exams, remove server) and of the doctor. The tests run naksu against the fake
+// VBoxManage of package fakevboxmanage in a temporary home directory so they do not
+// need VirtualBox.
+package e2e
@@ -0,0 +1,166 @@
+package e2e
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"naksu/box"
+	"naksu/box/vboxmanage"
+	"naksu/mebroutines"
+	"naksu/mebroutines/doctor"
+)
+
+func TestDoctor(t *testing.T) {
+	workDir, restore := useFakeVBoxManage(t)
+	defer restore()
+
+	homeDir, statePath, cleanup := setUpHome(t, "6.1", workDir)
+	defer cleanup()
+
+	vmName := installServer(t, homeDir, statePath)
+	ktpDir := mebroutines.GetKtpDirectory()
+	vmsDir := mebroutines.GetVirtualBoxVMsDirectory()
+	vmInfo := getVMInfo(t, vmName)
+
+	// Break the environment
+
+	runVBoxManage(t,
+		vboxmanage.VBoxCommand{"sharedfolder", "remove", vmName, "--name", box.GetSharedFolderName()},
+		vboxmanage.VBoxCommand{"sharedfolder", "add", vmName, "--name", box.GetSharedFolderName(), "--hostpath", homeDir},
+		vboxmanage.VBoxCommand{"snapshot", vmName, "delete", box.GetInstalledSnapshotName()},
+		vboxmanage.VBoxCommand{"clonemedium", vmInfo.StorageAttachments[0].Medium, filepath.Join(ktpDir, "old.vdi"), "--format", "VDI"},
+		vboxmanage.VBoxCommand{"clonemedium", vmInfo.StorageAttachments[0].Medium, filepath.Join(ktpDir, "gone.vdi"), "--format", "VDI"},
+		vboxmanage.VBoxCommand{"createvm", "--name", "Other", "--register"},
+		vboxmanage.VBoxCommand{"modifyvm", "Other", "--memory", "1024"},
+	)
+
+	for _, path := range []string{filepath.Join(ktpDir, "gone.vdi"), filepath.Join(vmsDir, "Other", "Other.vbox")} {
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("Could not remove %s: %v", path, err)
+		}
+	}
+
+	for _, path := range []string{
+		mebroutines.GetImagePath(),
+		filepath.Join(ktpDir, "unused.vdi"),
+		filepath.Join(vmsDir, "Trash", "Trash.vbox"),
+		filepath.Join(vmsDir, "Gone", "Gone.vbox-prev"),
+		filepath.Join(vmsDir, "Gone", "Logs", "VBox.log"),
+	} {
+		writeFile(t, path)
+	}
+
+	// Diagnose and fix
+
+	tables := []struct {
+		kind doctor.Kind
+		path string
+	}{
+		{doctor.KindOrphanedMedium, filepath.Join(ktpDir, "old.vdi")},
+		{doctor.KindInaccessibleMedium, filepath.Join(ktpDir, "gone.vdi")},
+		{doctor.KindLeftoverFile, mebroutines.GetImagePath()},
+		{doctor.KindLeftoverFile, filepath.Join(ktpDir, "unused.vdi")},
+		{doctor.KindTrashVMDirectory, filepath.Join(vmsDir, "Trash")},
+		{doctor.KindStaleSettingsFile, filepath.Join(vmsDir, "Gone", "Gone.vbox-prev")},
+		{doctor.KindStaleSettingsFile, filepath.Join(vmsDir, "Other", "Other.vbox-prev")},
+		{doctor.KindSharedFolderMismatch, vmName},
+		{doctor.KindMissingSnapshot, vmName},
+	}
+
+	findings := diagnose(t)
+	if len(findings) != len(tables) {
+		t.Fatalf("Doctor found %d problems, expected %d: %+v", len(findings), len(tables), findings)
+	}
+
+	for n, table := range tables {
+		if findings[n].Kind != table.kind || findings[n].Path != table.path {
+			t.Errorf("Problem %d is %s %s, expected %s %s", n+1, findings[n].Kind, findings[n].Path, table.kind, table.path)
+		}
+
+		if err := findings[n].Fix(); err != nil {
+			t.Errorf("Fixing %s %s failed: %v", table.kind, table.path, err)
+		}
+	}
+
+	// The file of the closed orphaned medium is left over
+	findings = diagnose(t)
+	if len(findings) != 1 || findings[0].Kind != doctor.KindLeftoverFile || findings[0].Path != filepath.Join(ktpDir, "old.vdi") {
+		t.Fatalf("Doctor found %+v after fixing, expected the closed disk image", findings)
+	}
+
+	if err := findings[0].Fix(); err != nil {
+		t.Errorf("Removing the closed disk image failed: %v", err)
+	}
+
+	if findings = diagnose(t); len(findings) != 0 {
+		t.Errorf("Doctor found %+v after fixing all problems", findings)
+	}
+
+	// The repaired environment
+
+	vmInfo = getVMInfo(t, vmName)
+	if len(vmInfo.Snapshots) != 1 || vmInfo.Snapshots[0].Name != box.GetInstalledSnapshotName() {
+		t.Errorf("Server has snapshots %+v after fixing", vmInfo.Snapshots)
+	}
+
+	expectedSharedFolders := []vboxmanage.SharedFolder{{Name: box.GetSharedFolderName(), HostPath: mebroutines.GetMebshareDirectory()}}
+	if !reflect.DeepEqual(vmInfo.SharedFolders, expectedSharedFolders) {
+		t.Errorf("Server has shared folders %+v after fixing, expected %+v", vmInfo.SharedFolders, expectedSharedFolders)
+	}
+
+	for _, path := range []string{
+		filepath.Join(vmsDir, "Other", "Other.vbox"),
+		vmInfo.SettingsFile + ".naksubackup",
+		vmInfo.SettingsFile + ".naksubackup.1",
+		filepath.Join(homeDir, ".config", "VirtualBox", "VirtualBox.xml.naksubackup"),
+		filepath.Join(homeDir, ".config", "VirtualBox", "VirtualBox.xml.naksubackup.1"),
+	} {
+		if !mebroutines.ExistsFile(path) {
+			t.Errorf("%s does not exist after fixing", path)
+		}
+	}
+}
+
+func diagnose(t *testing.T) []doctor.Finding {
+	findings, err := doctor.Diagnose()
+	if err != nil {
+		t.Fatalf("Diagnose failed: %v", err)
+	}
+
+	return findings
+}
+
+func getVMInfo(t *testing.T, vmName string) vboxmanage.VMInfo {
+	vboxmanage.ResetVBoxResponseCache()
+
+	vmInfo, err := vboxmanage.GetVMInfo(vmName)
+	if err != nil {
+		t.Fatalf("Could not get info of %s: %v", vmName, err)
+	}
+
+	return vmInfo
+}
+
+func runVBoxManage(t *testing.T, commands ...vboxmanage.VBoxCommand) {
+	err := vboxmanage.RunCommands(commands)
+	if err != nil {
+		t.Fatalf("VBoxManage failed: %v", err)
+	}
+
+	vboxmanage.ResetVBoxResponseCache()
+}
+
+// writeFile writes a small file creating the directory if needed
+func writeFile(t *testing.T, path string) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte("naksu"), 0600)
+	}
+
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", path, err)
+	}
+}
@@ -0,0 +1,219 @@
+package e2e
+
+import (
+	"path/filepath"
+	"testing"
+
+	"naksu/box/vboxmanage"
+	"naksu/box/vboxmanage/fakevboxmanage"
+	"naksu/config"
+	"naksu/constants"
+	"naksu/mebroutines"
+	"naksu/mebroutines/backup"
+	"naksu/mebroutines/install"
+	"naksu/mebroutines/restore"
+)
+
+func TestInstallRollback(t *testing.T) {
+	workDir, restore := useFakeVBoxManage(t)
+	defer restore()
+
+	homeDir, statePath, cleanup := setUpHome(t, "6.1", workDir)
+	defer cleanup()
+
+	imagePath := writeRawImage(t, homeDir)
+
+	// A failure after the VM has been registered removes the VM and its disk
+
+	setFailingCommands(t, statePath, "snapshot")
+
+	err := install.NewServerFromFile(constants.AbittiBoxType, imagePath, serverVersion)
+	if err == nil {
+		t.Fatalf("Install succeeded although taking the snapshot failed")
+	}
+
+	state := loadFakeState(t, statePath)
+	if len(state.VMs) != 0 || len(state.Media) != 0 {
+		t.Errorf("Failed install left VMs %+v and media %+v", state.VMs, state.Media)
+	}
+
+	disks, _ := filepath.Glob(filepath.Join(mebroutines.GetKtpDirectory(), "*.vdi"))
+	if len(disks) != 0 {
+		t.Errorf("Failed install left disk images %v", disks)
+	}
+
+	if mebroutines.ExistsFile(mebroutines.GetInstallJournalPath()) {
+		t.Errorf("Failed install left the install journal")
+	}
+
+	if config.GetActiveBox() != "" {
+		t.Errorf("Failed install changed the active box to %s", config.GetActiveBox())
+	}
+
+	// An install which could not be rolled back (e.g. due to a power loss) is resumed
+	// on the next launch and it replaces the installed server of the same version
+
+	setFailingCommands(t, statePath)
+	vboxmanage.ResetVBoxResponseCache()
+
+	oldServer := installServer(t, homeDir, statePath)
+
+	setFailingCommands(t, statePath, "snapshot", "unregistervm")
+	vboxmanage.ResetVBoxResponseCache()
+
+	err = install.NewServerFromFile(constants.AbittiBoxType, imagePath, serverVersion)
+	if err == nil {
+		t.Fatalf("Install succeeded although taking the snapshot failed")
+	}
+
+	if !mebroutines.ExistsFile(mebroutines.GetInstallJournalPath()) {
+		t.Fatalf("Install which could not be rolled back did not keep the install journal")
+	}
+
+	setFailingCommands(t, statePath)
+	vboxmanage.ResetVBoxResponseCache()
+
+	err = install.RecoverInterruptedInstall()
+	if err != nil {
+		t.Fatalf("Recovering the interrupted install failed: %v", err)
+	}
+
+	state = loadFakeState(t, statePath)
+	if len(state.VMs) != 1 || len(state.VMs[0].Snapshots) != 1 || state.FindMedium(state.VMs[0].Disk) == nil {
+		t.Fatalf("Resumed install did not create a VM with a disk and a snapshot and remove the old server: %+v", state.VMs)
+	}
+
+	if state.VMs[0].Name == oldServer {
+		t.Errorf("Resumed install kept the old server %s instead of the new one", oldServer)
+	}
+
+	if config.GetActiveBox() != state.VMs[0].Name {
+		t.Errorf("Active box is %s after resuming the install, expected %s", config.GetActiveBox(), state.VMs[0].Name)
+	}
+
+	if mebroutines.ExistsFile(mebroutines.GetInstallJournalPath()) {
+		t.Errorf("Resumed install left the install journal")
+	}
+}
+
+// setFailingCommands makes the given VBoxManage commands fail
+func setFailingCommands(t *testing.T, statePath string, commands ...string) {
+	state := loadFakeState(t, statePath)
+	state.FailingCommands = commands
+
+	err := state.Save(statePath)
+	if err != nil {
+		t.Fatalf("Could not save state of fake VirtualBox: %v", err)
+	}
+}
+
+func loadFakeState(t *testing.T, statePath string) *fakevboxmanage.State {
+	state, err := fakevboxmanage.LoadState(statePath)
+	if err != nil {
+		t.Fatalf("Could not load state of fake VirtualBox: %v", err)
+	}
+
+	return state
+}
+
+func TestReinstallKeepsServerUntilNewOneIsReady(t *testing.T) {
+	workDir, restore := useFakeVBoxManage(t)
+	defer restore()
+
+	homeDir, statePath, cleanup := setUpHome(t, "6.1", workDir)
+	defer cleanup()
+
+	originalName := installServer(t, homeDir, statePath)
+	imagePath := writeRawImage(t, homeDir)
+
+	// A failed reinstall of the same version leaves the installed server as it was
+
+	setFailingCommands(t, statePath, "snapshot")
+	vboxmanage.ResetVBoxResponseCache()
+
+	err := install.NewServerFromFile(constants.AbittiBoxType, imagePath, serverVersion)
+	if err == nil {
+		t.Fatalf("Reinstall succeeded although taking the snapshot failed")
+	}
+
+	state := loadFakeState(t, statePath)
+	if len(state.VMs) != 1 || state.VMs[0].Name != originalName || state.FindMedium(state.VMs[0].Disk) == nil {
+		t.Fatalf("Failed reinstall did not keep server %s with its disk: %+v", originalName, state.VMs)
+	}
+
+	if config.GetActiveBox() != originalName {
+		t.Errorf("Active box is %s after a failed reinstall, expected %s", config.GetActiveBox(), originalName)
+	}
+
+	// A successful reinstall replaces the installed server
+
+	setFailingCommands(t, statePath)
+	vboxmanage.ResetVBoxResponseCache()
+
+	err = install.NewServerFromFile(constants.AbittiBoxType, imagePath, serverVersion)
+	if err != nil {
+		t.Fatalf("Reinstall failed: %v", err)
+	}
+
+	state = loadFakeState(t, statePath)
+	if len(state.VMs) != 1 || state.VMs[0].Name == originalName || state.VMs[0].Name != config.GetActiveBox() {
+		t.Errorf("Reinstall did not replace server %s with the active box %s: %+v", originalName, config.GetActiveBox(), state.VMs)
+	}
+}
+
+func TestRestoreRollback(t *testing.T) {
+	workDir, restoreVBoxManage := useFakeVBoxManage(t)
+	defer restoreVBoxManage()
+
+	homeDir, statePath, cleanup := setUpHome(t, "6.1", workDir)
+	defer cleanup()
+
+	originalName := installServer(t, homeDir, statePath)
+
+	backupPath := filepath.Join(homeDir, "backup.vmdk")
+	vboxmanage.ResetVBoxResponseCache()
+	err := backup.MakeBackup(backupPath)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	mediaBefore := len(loadFakeState(t, statePath).Media)
+
+	// A failure after the VM has been registered removes the restored VM and its disk
+
+	setFailingCommands(t, statePath, "setextradata")
+	vboxmanage.ResetVBoxResponseCache()
+
+	err = restore.Backup(backupPath, "", "")
+	if err == nil {
+		t.Fatalf("Restore succeeded although creating the VM failed")
+	}
+
+	state := loadFakeState(t, statePath)
+	if len(state.VMs) != 1 || state.VMs[0].Name != originalName || len(state.Media) != mediaBefore {
+		t.Errorf("Failed restore left VMs %+v and media %+v", state.VMs, state.Media)
+	}
+
+	if mebroutines.ExistsFile(mebroutines.GetInstallJournalPath()) {
+		t.Errorf("Failed restore left the install journal")
+	}
+
+	if config.GetActiveBox() != originalName {
+		t.Errorf("Active box is %s after a failed restore, expected %s", config.GetActiveBox(), originalName)
+	}
+
+	// A successful restore activates the restored VM
+
+	setFailingCommands(t, statePath)
+	vboxmanage.ResetVBoxResponseCache()
+
+	err = restore.Backup(backupPath, "", "")
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	state = loadFakeState(t, statePath)
+	if len(state.VMs) != 2 || config.GetActiveBox() == originalName {
+		t.Errorf("Restore did not create an active VM: active box %s, VMs %+v", config.GetActiveBox(), state.VMs)
+	}
+}
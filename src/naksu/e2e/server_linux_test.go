@@ -0,0 +1,254 @@
+package e2e
+
+import (
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"naksu/box"
+	"naksu/box/vboxmanage"
+	"naksu/box/vboxmanage/fakevboxmanage"
+	"naksu/config"
+	"naksu/constants"
+	"naksu/mebroutines"
+	"naksu/mebroutines/backup"
+	"naksu/mebroutines/destroy"
+	"naksu/mebroutines/install"
+	"naksu/mebroutines/remove"
+	"naksu/mebroutines/start"
+	"naksu/mebroutines/stop"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+const serverVersion = "SERVER7108X v69"
+
+func TestMain(m *testing.M) {
+	// The test binary is started as VBoxManage by naksu
+	fakevboxmanage.Main()
+
+	os.Exit(m.Run())
+}
+
+func TestServerFlows(t *testing.T) {
+	workDir, restore := useFakeVBoxManage(t)
+	defer restore()
+
+	for _, version := range fakevboxmanage.Versions {
+		version := version.Name
+		t.Run("VirtualBox "+version, func(t *testing.T) {
+			testServerFlows(t, version, workDir)
+		})
+	}
+}
+
+// useFakeVBoxManage makes naksu run the test binary as VBoxManage and returns the
+// working directory and a function restoring the original settings
+func useFakeVBoxManage(t *testing.T) (string, func()) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Could not get path of the test binary: %v", err)
+	}
+
+	workDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Could not get working directory: %v", err)
+	}
+
+	originalHome := os.Getenv("HOME")
+	originalDisableCache := homedir.DisableCache
+
+	homedir.DisableCache = true
+	vboxmanage.SetVBoxManagePath(executable)
+
+	return workDir, func() {
+		vboxmanage.SetVBoxManagePath("")
+		homedir.DisableCache = originalDisableCache
+		os.Setenv("HOME", originalHome)
+		os.Chdir(workDir)
+	}
+}
+
+// setUpHome creates a temporary home directory with a fake VirtualBox of the given
+// version and returns the home directory, the path of the fake state and a function
+// removing the directory
+func setUpHome(t *testing.T, version string, workDir string) (string, string, func()) {
+	homeDir, err := ioutil.TempDir("", "naksu-e2e")
+	if err != nil {
+		t.Fatalf("Could not create home directory: %v", err)
+	}
+
+	cleanup := func() {
+		os.Chdir(workDir)
+		os.RemoveAll(homeDir)
+	}
+
+	os.Setenv("HOME", homeDir)
+
+	// Never touch the VMs and files of the user running the tests
+	if mebroutines.GetHomeDirectory() != homeDir {
+		cleanup()
+		t.Fatalf("Home directory is %s, expected %s", mebroutines.GetHomeDirectory(), homeDir)
+	}
+
+	statePath, err := fakevboxmanage.Setup(filepath.Join(homeDir, ".fakevboxmanage"), version, homeDir)
+	if err != nil {
+		cleanup()
+		t.Fatalf("Could not set up fake VirtualBox: %v", err)
+	}
+
+	config.Load()
+	config.SetVMCPUs(2)
+	config.SetVMMemoryMB(5304)
+	config.SetExtNic("eth0")
+	vboxmanage.ResetVBoxResponseCache()
+
+	if _, err := box.GetResources(); err != nil {
+		cleanup()
+		t.Skipf("The host cannot run the server: %v", err)
+	}
+
+	return homeDir, statePath, cleanup
+}
+
+// installServer installs a server from a raw image and returns the name of its VM
+func installServer(t *testing.T, homeDir string, statePath string) string {
+	imagePath := writeRawImage(t, homeDir)
+	err := install.NewServerFromFile(constants.AbittiBoxType, imagePath, serverVersion)
+	if err != nil {
+		t.Fatalf("Install failed: %v", err)
+	}
+
+	state, err := fakevboxmanage.LoadState(statePath)
+	if err != nil {
+		t.Fatalf("Could not load state of fake VirtualBox: %v", err)
+	}
+
+	if len(state.VMs) != 1 || len(state.VMs[0].Snapshots) != 1 || state.VMs[0].Disk == "" {
+		t.Fatalf("Install did not create a VM with a disk and a snapshot: %+v", state.VMs)
+	}
+
+	return state.VMs[0].Name
+}
+
+func testServerFlows(t *testing.T, version string, workDir string) {
+	homeDir, statePath, cleanup := setUpHome(t, version, workDir)
+	defer cleanup()
+
+	loadState := func() *fakevboxmanage.State {
+		state, err := fakevboxmanage.LoadState(statePath)
+		if err != nil {
+			t.Fatalf("Could not load state of fake VirtualBox: %v", err)
+		}
+		return state
+	}
+
+	// Install
+
+	vmName := installServer(t, homeDir, statePath)
+
+	// Start
+
+	vboxmanage.ResetVBoxResponseCache()
+	err := start.Server()
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	vboxmanage.ResetVBoxResponseCache()
+	if start.Server() == nil {
+		t.Errorf("Starting a running server succeeded")
+	}
+
+	_, err = vboxmanage.RunCommand(vboxmanage.VBoxCommand{"modifyvm", vmName, "--memory", "5304"})
+	if !errors.Is(err, vboxmanage.ErrSessionLocked) {
+		t.Errorf("Modifying a running VM gives %v, expected %v", err, vboxmanage.ErrSessionLocked)
+	}
+
+	vboxmanage.ResetVBoxResponseCache()
+	err = stop.PowerOff()
+	if err != nil {
+		t.Fatalf("Power off failed: %v", err)
+	}
+
+	// Backup
+
+	backupPath := filepath.Join(homeDir, "backup.vmdk")
+	vboxmanage.ResetVBoxResponseCache()
+	err = backup.MakeBackup(backupPath)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	err = backup.VerifyBackup(backupPath)
+	if err != nil {
+		t.Errorf("Backup does not match its manifest: %v", err)
+	}
+
+	err = backup.CheckBackupFile(backupPath)
+	if err != nil {
+		t.Errorf("Backup is not a server disk: %v", err)
+	}
+
+	// Remove exams
+
+	if loadState().VMs[0].DiskChanges == 0 {
+		t.Fatalf("Running the server did not change its disk")
+	}
+
+	vboxmanage.ResetVBoxResponseCache()
+	err = destroy.Server()
+	if err != nil {
+		t.Fatalf("Removing exams failed: %v", err)
+	}
+
+	state := loadState()
+	if state.VMs[0].DiskChanges != 0 {
+		t.Errorf("Removing exams did not restore the disk")
+	}
+
+	if disk := state.FindMedium(state.VMs[0].Disk); disk == nil || disk.Compactions != 1 {
+		t.Errorf("Removing exams did not compact the disk: %+v", disk)
+	}
+
+	// Remove server
+
+	vboxmanage.ResetVBoxResponseCache()
+	err = remove.Server()
+	if err != nil {
+		t.Fatalf("Removing server failed: %v", err)
+	}
+
+	if vms := loadState().VMs; len(vms) != 0 {
+		t.Errorf("VMs are still registered after removing the server: %+v", vms)
+	}
+
+	if mebroutines.ExistsDir(mebroutines.GetVirtualBoxVMsDirectory()) {
+		t.Errorf("%s exists after removing the server", mebroutines.GetVirtualBoxVMsDirectory())
+	}
+
+	_, err = vboxmanage.RunCommand(vboxmanage.VBoxCommand{"showvminfo", vmName, "--machinereadable"})
+	if !errors.Is(err, vboxmanage.ErrVMNotFound) {
+		t.Errorf("Getting info of a removed VM gives %v, expected %v", err, vboxmanage.ErrVMNotFound)
+	}
+}
+
+// writeRawImage writes a small raw disk image to be installed
+func writeRawImage(t *testing.T, directory string) string {
+	image := make([]byte, 1024*1024)
+	_, err := rand.Read(image)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+
+	imagePath := filepath.Join(directory, "naksu_ktp_image.dd")
+	err = ioutil.WriteFile(imagePath, image, 0600)
+	if err != nil {
+		t.Fatalf("Could not write image: %v", err)
+	}
+
+	return imagePath
+}
@@ -64,17 +64,37 @@ func MakeBackup(backupPath string) error {
 	}
 
 	progress.TranslateAndSetMessage("Checking for FAT32 filesystem...")
-	err = checkForFATFilesystem(backupPath, diskLocation)
-	if err != nil {
-		mebroutines.ShowTranslatedErrorMessage("The backup file is too large for a FAT32 filesystem. Please reformat the backup disk as exFAT.")
-		return fmt.Errorf("backup file too large for fat32 filesystem: %v", err)
+	split := isSplitBackupNeeded(backupPath, diskLocation)
+	if split {
+		log.Debug("The backup medium has a FAT32 filesystem, writing the backup as 2 GB extents")
 	}
 
 	// Make clone to path_backup
 	progress.TranslateAndSetMessage("Please wait, writing backup...")
-	err = box.WriteDiskClone(backupPath)
+	err = writeDiskCloneWithProgress(backupPath, diskLocation, split)
+	if err != nil {
+		err = fmt.Errorf("failed to make clone: %w", err)
+		mebroutines.ShowErrorMessage(box.AddErrorAdvice(xlate.Get(generalErrorString, err), err))
+		return err
+	}
+
+	progress.TranslateAndSetMessage("Writing backup manifest...")
+	err = writeManifest(backupPath)
+	if err != nil {
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(generalErrorString, fmt.Errorf("failed to write manifest: %v", err))
+	}
+
+	return nil
+}
+
+// Verify checks that the backup matches its manifest and shows the result to the user
+func Verify(backupPath string) error {
+	progress.TranslateAndSetMessage("Verifying backup...")
+
+	err := VerifyBackup(backupPath)
 	if err != nil {
-		return mebroutines.ShowTranslatedErrorMessageAndPassError(generalErrorString, fmt.Errorf("failed to make clone: %v", err))
+		mebroutines.ShowTranslatedErrorMessage("The backup %s is damaged or incomplete. Please make a new backup: %v", backupPath, err)
+		return err
 	}
 
 	return nil
@@ -102,35 +122,30 @@ func ensureBoxInstalledAndNotRunning() error {
 	return nil
 }
 
-func checkForFATFilesystem(backupPath string, vmDiskLocation string) error {
+// isSplitBackupNeeded returns true if the backup does not fit to a single file on
+// the backup medium (FAT32 file size is limited to 4 GB)
+func isSplitBackupNeeded(backupPath string, vmDiskLocation string) bool {
 	// Check VM disk size
 	mediumSizeMB, err := box.MediumSizeOnDisk(vmDiskLocation)
 
-	// If we can't get medium size, we'll just ignore the error and continue.
+	// If we can't get medium size, we'll just ignore the error and check the filesystem.
 	if err != nil {
 		log.Debug(fmt.Sprintf("Error getting VirtualBox medium size: %s", err))
-		return nil
-	}
-
-	// FAT32 is enough to store this backup, so we don't need to check the filesystem.
-	if mediumSizeMB < 4*1024 {
-		return nil
+	} else if mediumSizeMB < 4*1024 {
+		// FAT32 is enough to store this backup, so we don't need to check the filesystem.
+		return false
 	}
 
 	// If there is an error checking whether the backup medium has a FAT32
-	// filesystem, we'll just allow the user to continue. The user will
-	// see an error eventually, if the backup disk actually is FAT32.
+	// filesystem, we'll just write a single file. The user will see an error
+	// eventually, if the backup disk actually is FAT32.
 	isFAT32, err := isFAT32(backupPath)
 	if err != nil {
 		log.Debug(fmt.Sprintf("Error checking if the backup medium has a FAT filesystem: %s", err))
-		return nil
-	}
-
-	if isFAT32 {
-		return errors.New("backup too large for FAT32")
+		return false
 	}
 
-	return nil
+	return isFAT32
 }
 
 // GetBackupFilename returns generated filename
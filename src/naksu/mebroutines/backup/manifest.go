@@ -0,0 +1,270 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"naksu/box"
+	"naksu/log"
+	"naksu/mebroutines"
+	"naksu/ui/progress"
+	"naksu/xlate"
+)
+
+// manifestSuffix is appended to the backup path to get the path of its manifest
+const manifestSuffix = ".json"
+
+// Suppress checksum progress messages if there has been less than 2 seconds from a message
+const checksumProgressTimeout = 2 * time.Second
+
+// naksuVersion is stored to the manifest, see SetNaksuVersion()
+var naksuVersion = ""
+
+// Manifest describes the contents of a backup. It is written next to the backup file.
+// Size and SHA256 describe the backup file. A split backup (see box.WriteDiskClone())
+// has also extent files which are listed in Extents.
+type Manifest struct {
+	BoxType      string         `json:"boxType"`
+	BoxVersion   string         `json:"boxVersion"`
+	NaksuVersion string         `json:"naksuVersion"`
+	HostName     string         `json:"hostName"`
+	DiskUUID     string         `json:"diskUUID"`
+	Created      time.Time      `json:"created"`
+	Size         uint64         `json:"size"`
+	SHA256       string         `json:"sha256"`
+	Extents      []ManifestFile `json:"extents,omitempty"`
+}
+
+// ManifestFile describes an extent file of a split backup. Name is relative to the
+// directory of the backup.
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   uint64 `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// checksumCounter implements io.Writer interface to report checksum progress
+type checksumCounter struct {
+	Total           uint64
+	FileSize        uint64
+	ProgressString  string
+	lastMessageTime time.Time
+}
+
+func (c *checksumCounter) Write(p []byte) (int, error) {
+	n := len(p)
+	c.Total += uint64(n)
+
+	if c.FileSize > 0 && time.Now().After(c.lastMessageTime.Add(checksumProgressTimeout)) {
+		progress.SetMessage(fmt.Sprintf(c.ProgressString, (100*c.Total)/c.FileSize))
+		c.lastMessageTime = time.Now()
+	}
+
+	return n, nil
+}
+
+// SetNaksuVersion sets the naksu version stored to the backup manifests
+func SetNaksuVersion(version string) {
+	naksuVersion = version
+}
+
+// GetManifestPath returns the path of the manifest of the given backup
+func GetManifestPath(backupPath string) string {
+	return backupPath + manifestSuffix
+}
+
+// ReadManifest reads the manifest of the given backup
+func ReadManifest(backupPath string) (Manifest, error) {
+	var manifest Manifest
+
+	content, err := ioutil.ReadFile(GetManifestPath(backupPath)) // #nosec
+	if err != nil {
+		return manifest, err
+	}
+
+	err = json.Unmarshal(content, &manifest)
+	if err != nil {
+		return manifest, fmt.Errorf("could not parse backup manifest: %v", err)
+	}
+
+	return manifest, nil
+}
+
+// writeManifest calculates the checksum of the backup and writes its manifest
+func writeManifest(backupPath string) error {
+	hostName, err := os.Hostname()
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not get host name for backup manifest: %v", err))
+	}
+
+	diskUUID := ""
+	vmdkInfo, err := ReadVMDKInfo(backupPath)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not read disk uuid for backup manifest: %v", err))
+	} else {
+		diskUUID = vmdkInfo.UUID
+	}
+
+	paths, err := getBackupDataFiles(backupPath)
+	if err != nil {
+		return err
+	}
+
+	files, err := getBackupChecksums(paths, xlate.GetRaw("Calculating backup checksum: %d %%"))
+	if err != nil {
+		return err
+	}
+
+	manifest := Manifest{
+		BoxType:      box.GetType(),
+		BoxVersion:   box.GetVersion(),
+		NaksuVersion: naksuVersion,
+		HostName:     hostName,
+		DiskUUID:     diskUUID,
+		Created:      time.Now(),
+		Size:         files[0].Size,
+		SHA256:       files[0].SHA256,
+		Extents:      files[1:],
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(GetManifestPath(backupPath), content, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write backup manifest: %v", err)
+	}
+
+	return nil
+}
+
+// getBackupDataFiles returns the path of the backup and the paths of its extent files.
+// The extent files of a split VMDK are listed in the backup file. Returns an error if
+// an extent file is outside the directory of the backup.
+func getBackupDataFiles(backupPath string) ([]string, error) {
+	paths := []string{backupPath}
+
+	info, err := ReadVMDKInfo(backupPath)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not read extents of backup %s: %v", backupPath, err))
+		return paths, nil
+	}
+
+	for _, extent := range info.Extents {
+		if info.CreateType == "monolithicSparse" || extent.File == "" || extent.File == filepath.Base(backupPath) {
+			continue
+		}
+
+		extentPath, err := getExtentPath(backupPath, extent)
+		if err != nil {
+			return nil, err
+		}
+
+		paths = append(paths, extentPath)
+	}
+
+	return paths, nil
+}
+
+// getBackupChecksums returns the sizes and the hex encoded SHA-256 digests of the given
+// files. The progress of all files is shown using the translated progressString which gets
+// the percentage as a parameter.
+func getBackupChecksums(paths []string, progressString string) ([]ManifestFile, error) {
+	counter := &checksumCounter{
+		ProgressString: progressString,
+	}
+
+	for _, path := range paths {
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not get size of %s: %v", path, err)
+		}
+		counter.FileSize += uint64(fileInfo.Size())
+	}
+
+	files := []ManifestFile{}
+
+	for _, path := range paths {
+		size, checksum, err := getFileChecksum(path, counter)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, ManifestFile{Name: filepath.Base(path), Size: size, SHA256: checksum})
+	}
+
+	return files, nil
+}
+
+// getFileChecksum returns the size and the hex encoded SHA-256 digest of the file
+func getFileChecksum(path string, counter *checksumCounter) (uint64, string, error) {
+	file, err := os.Open(path) // #nosec
+	if err != nil {
+		return 0, "", fmt.Errorf("could not open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, io.TeeReader(file, counter))
+	if err != nil {
+		return 0, "", fmt.Errorf("could not read %s: %v", path, err)
+	}
+
+	return uint64(size), fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// VerifyBackup rehashes the backup and its extent files and compares them with the manifest
+func VerifyBackup(backupPath string) error {
+	if !mebroutines.ExistsFile(backupPath) {
+		return fmt.Errorf("backup file %s does not exist", backupPath)
+	}
+
+	manifest, err := ReadManifest(backupPath)
+	if err != nil {
+		return fmt.Errorf("could not read backup manifest %s: %v", GetManifestPath(backupPath), err)
+	}
+
+	expectedFiles := append([]ManifestFile{{Name: filepath.Base(backupPath), Size: manifest.Size, SHA256: manifest.SHA256}}, manifest.Extents...)
+
+	paths, err := getBackupDataFiles(backupPath)
+	if err != nil {
+		return err
+	}
+
+	if len(paths) != len(expectedFiles) {
+		return fmt.Errorf("backup has %d files but the manifest lists %d files", len(paths), len(expectedFiles))
+	}
+
+	files, err := getBackupChecksums(paths, xlate.GetRaw("Verifying backup: %d %%"))
+	if err != nil {
+		return err
+	}
+
+	for n, file := range files {
+		expected := expectedFiles[n]
+
+		if file.Name != expected.Name {
+			return fmt.Errorf("backup file %s does not match the manifest (%s)", file.Name, expected.Name)
+		}
+
+		if file.Size != expected.Size {
+			return fmt.Errorf("size of %s %d bytes does not match the manifest (%d bytes)", file.Name, file.Size, expected.Size)
+		}
+
+		if file.SHA256 != expected.SHA256 {
+			return fmt.Errorf("checksum of %s %s does not match the manifest (%s)", file.Name, file.SHA256, expected.SHA256)
+		}
+	}
+
+	log.Debug(fmt.Sprintf("Backup %s matches its manifest (%s)", backupPath, manifest.SHA256))
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testWrongChecksum does not match the test backup
+var testWrongChecksum = strings.Repeat("0", 64)
+
+func writeTestBackup(t *testing.T, dir string, manifest *Manifest) string {
+	backupPath := filepath.Join(dir, "2021-06-01_12-00-00.vmdk")
+	err := ioutil.WriteFile(backupPath, []byte("naksu test backup"), 0600)
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", backupPath, err)
+	}
+
+	if manifest != nil {
+		content, err := json.Marshal(manifest)
+		if err != nil {
+			t.Fatalf("Could not encode manifest: %v", err)
+		}
+
+		err = ioutil.WriteFile(GetManifestPath(backupPath), content, 0600)
+		if err != nil {
+			t.Fatalf("Could not write manifest: %v", err)
+		}
+	}
+
+	return backupPath
+}
+
+func TestGetBackupChecksums(t *testing.T) {
+	dir, cleanup := getTempDir(t)
+	defer cleanup()
+
+	backupPath := writeTestBackup(t, dir, nil)
+
+	files, err := getBackupChecksums([]string{backupPath}, "%d")
+	if err != nil {
+		t.Fatalf("getBackupChecksums failed: %v", err)
+	}
+
+	if len(files) != 1 || files[0].Name != "2021-06-01_12-00-00.vmdk" || files[0].Size != 17 {
+		t.Fatalf("getBackupChecksums gives unexpected files: %+v", files)
+	}
+
+	if len(files[0].SHA256) != 64 {
+		t.Errorf("getBackupChecksums gives checksum '%s' which is not a hex encoded SHA-256 digest", files[0].SHA256)
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	dir, cleanup := getTempDir(t)
+	defer cleanup()
+
+	backupPath := writeTestBackup(t, dir, nil)
+	files, err := getBackupChecksums([]string{backupPath}, "%d")
+	if err != nil {
+		t.Fatalf("getBackupChecksums failed: %v", err)
+	}
+	size, checksum := files[0].Size, files[0].SHA256
+
+	tables := []struct {
+		manifest *Manifest
+		isError  bool
+	}{
+		{&Manifest{BoxType: "digabi/ktp-qa", Size: size, SHA256: checksum}, false},
+		{&Manifest{Size: size + 1, SHA256: checksum}, true},
+		{&Manifest{Size: size, SHA256: testWrongChecksum}, true},
+		{nil, true},
+	}
+
+	for _, table := range tables {
+		tableDir, tableCleanup := getTempDir(t)
+
+		backupPath := writeTestBackup(t, tableDir, table.manifest)
+		err := VerifyBackup(backupPath)
+		if (err != nil) != table.isError {
+			t.Errorf("VerifyBackup with manifest %+v gives error %v", table.manifest, err)
+		}
+
+		tableCleanup()
+	}
+}
+
+func TestVerifySplitBackup(t *testing.T) {
+	dir, cleanup := getTempDir(t)
+	defer cleanup()
+
+	backupPath := filepath.Join(dir, "backup.vmdk")
+	descriptor := "# Disk DescriptorFile\ncreateType=\"twoGbMaxExtentSparse\"\nRW 4192256 SPARSE \"backup-s001.vmdk\"\nRW 4192256 SPARSE \"backup-s002.vmdk\"\n"
+	writeTestFiles(t, map[string]string{
+		backupPath:                             descriptor,
+		filepath.Join(dir, "backup-s001.vmdk"): "first extent",
+		filepath.Join(dir, "backup-s002.vmdk"): "second extent",
+	})
+
+	paths, err := getBackupDataFiles(backupPath)
+	if err != nil {
+		t.Fatalf("getBackupDataFiles failed: %v", err)
+	}
+
+	files, err := getBackupChecksums(paths, "%d")
+	if err != nil {
+		t.Fatalf("getBackupChecksums failed: %v", err)
+	}
+
+	if len(files) != 3 || files[2].Name != "backup-s002.vmdk" {
+		t.Fatalf("getBackupChecksums gives unexpected files: %+v", files)
+	}
+
+	manifest := Manifest{Size: files[0].Size, SHA256: files[0].SHA256, Extents: files[1:]}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("Could not encode manifest: %v", err)
+	}
+	writeTestFiles(t, map[string]string{GetManifestPath(backupPath): string(content)})
+
+	err = VerifyBackup(backupPath)
+	if err != nil {
+		t.Errorf("VerifyBackup fails for an intact split backup: %v", err)
+	}
+
+	writeTestFiles(t, map[string]string{filepath.Join(dir, "backup-s002.vmdk"): "damaged extent"})
+
+	err = VerifyBackup(backupPath)
+	if err == nil {
+		t.Errorf("VerifyBackup accepts a damaged extent")
+	}
+}
+
+func writeTestFiles(t *testing.T, files map[string]string) {
+	for path, content := range files {
+		err := ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", path, err)
+		}
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir, cleanup := getTempDir(t)
+	defer cleanup()
+
+	backupPath := writeTestBackup(t, dir, &Manifest{BoxType: "digabi/ktp-qa", BoxVersion: "SERVER21127X", DiskUUID: "8d2d5f52-0fb4-4f5e-a4a9-3b1c1a6f3e01"})
+
+	manifest, err := ReadManifest(backupPath)
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+
+	if manifest.BoxType != "digabi/ktp-qa" || manifest.BoxVersion != "SERVER21127X" || manifest.DiskUUID != "8d2d5f52-0fb4-4f5e-a4a9-3b1c1a6f3e01" {
+		t.Errorf("ReadManifest gives unexpected manifest: %+v", manifest)
+	}
+}
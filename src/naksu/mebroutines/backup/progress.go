@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"fmt"
+	"time"
+
+	"naksu/box"
+	"naksu/log"
+	"naksu/ui/progress"
+	"naksu/xlate"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// writeDiskCloneWithProgress writes the disk clone showing the percentage, the throughput
+// and the estimated time remaining in a progress dialog. See box.WriteDiskClone() for split.
+func writeDiskCloneWithProgress(backupPath string, diskLocation string, split bool) error {
+	// The clone is about as large as the disk image. If we don't know the size
+	// we can still show the percentage and the time remaining.
+	var diskSize uint64
+	diskSizeMB, err := box.MediumSizeOnDisk(diskLocation)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not get disk size for backup progress: %v", err))
+	} else {
+		diskSize = diskSizeMB * 1024 * 1024
+	}
+
+	progressDialog := progress.TranslateAndShowProgressDialog(xlate.Get("Please wait, writing backup..."))
+	defer progress.CloseProgressDialog(progressDialog)
+
+	started := time.Now()
+
+	return box.WriteDiskClone(backupPath, split, func(percentage int) {
+		message := getCloneProgressMessage(percentage, time.Since(started), diskSize)
+		progress.UpdateProgressDialog(progressDialog, percentage, &message)
+	})
+}
+
+// getCloneProgressMessage returns a progress message with the throughput and the estimated
+// time remaining when percentage of diskSize bytes has been written in elapsed time.
+// The throughput is left out if the size is not known (0).
+func getCloneProgressMessage(percentage int, elapsed time.Duration, diskSize uint64) string {
+	if percentage <= 0 || percentage >= 100 || elapsed <= 0 {
+		return xlate.Get("Writing backup")
+	}
+
+	remaining := time.Duration(float64(elapsed) * float64(100-percentage) / float64(percentage))
+
+	if diskSize == 0 {
+		return xlate.Get("Writing backup, %s remaining", formatRemainingTime(remaining))
+	}
+
+	bytesPerSecond := uint64(float64(diskSize) * float64(percentage) / 100 / elapsed.Seconds())
+
+	return xlate.Get("Writing backup: %s/s, %s remaining", humanize.Bytes(bytesPerSecond), formatRemainingTime(remaining))
+}
+
+// formatRemainingTime returns the given duration rounded to minutes or seconds
+func formatRemainingTime(remaining time.Duration) string {
+	if remaining >= time.Minute {
+		return xlate.Get("%d min", int((remaining+30*time.Second)/time.Minute))
+	}
+
+	return xlate.Get("%d s", int(remaining/time.Second))
+}
@@ -0,0 +1,28 @@
+package backup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetCloneProgressMessage(t *testing.T) {
+	tables := []struct {
+		percentage int
+		elapsed    time.Duration
+		diskSize   uint64
+		message    string
+	}{
+		{0, 0, 10 * 1000 * 1000 * 1000, "Writing backup"},
+		{100, 10 * time.Minute, 10 * 1000 * 1000 * 1000, "Writing backup"},
+		{25, 100 * time.Second, 10 * 1000 * 1000 * 1000, "Writing backup: 25 MB/s, 5 min remaining"},
+		{50, 20 * time.Second, 0, "Writing backup, 20 s remaining"},
+		{90, 9 * time.Minute, 0, "Writing backup, 1 min remaining"},
+	}
+
+	for _, table := range tables {
+		message := getCloneProgressMessage(table.percentage, table.elapsed, table.diskSize)
+		if message != table.message {
+			t.Errorf("getCloneProgressMessage(%d, %v, %d) gives '%s' instead of '%s'", table.percentage, table.elapsed, table.diskSize, message, table.message)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"naksu/config"
+	"naksu/constants"
+	"naksu/log"
+	"naksu/mebroutines"
+)
+
+// nightlyBackupWindow is the time after the nightly backup hour during which a
+// missed nightly backup is still made. This way starting naksu in the middle of
+// a working day does not start a backup.
+const nightlyBackupWindow = 6 * time.Hour
+
+// scheduledBackupRegexp matches the file names given by GetBackupFilename()
+var scheduledBackupRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2}\.vmdk$`)
+
+// Scheduler decides when automatic backups are made according to the schedule
+// set in naksu.ini. It follows the server state to notice server shutdowns.
+type Scheduler struct {
+	mutex      sync.Mutex
+	wasRunning bool
+	inProgress bool
+}
+
+// Update records the current server state and returns true if an automatic
+// backup should be made now. If it returns true the caller must call Run().
+func (scheduler *Scheduler) Update(boxInstalled bool, boxRunning bool, now time.Time) bool {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	shutDown := scheduler.wasRunning && !boxRunning
+	scheduler.wasRunning = boxRunning
+
+	if scheduler.inProgress || !boxInstalled || boxRunning {
+		return false
+	}
+
+	if !isBackupDue(config.GetBackupSchedule(), int(config.GetBackupNightlyHour()), config.GetBackupLastRun(), shutDown, now) {
+		return false
+	}
+
+	scheduler.inProgress = true
+	return true
+}
+
+// Run makes the automatic backup, see RunScheduledBackup()
+func (scheduler *Scheduler) Run() error {
+	defer func() {
+		scheduler.mutex.Lock()
+		scheduler.inProgress = false
+		scheduler.mutex.Unlock()
+	}()
+
+	return RunScheduledBackup()
+}
+
+// isBackupDue returns true if an automatic backup should be made on the given
+// schedule. shutDown tells whether the server has just been shut down.
+func isBackupDue(schedule string, nightlyHour int, lastRun time.Time, shutDown bool, now time.Time) bool {
+	switch schedule {
+	case constants.BackupScheduleShutdown:
+		return shutDown
+	case constants.BackupScheduleNightly:
+		scheduled := time.Date(now.Year(), now.Month(), now.Day(), nightlyHour, 0, 0, 0, now.Location())
+		if now.Before(scheduled) {
+			scheduled = scheduled.AddDate(0, 0, -1)
+		}
+		return now.Sub(scheduled) < nightlyBackupWindow && lastRun.Before(scheduled)
+	default:
+		return false
+	}
+}
+
+// RunScheduledBackup makes a backup to the directory set in naksu.ini, records
+// the result and removes the oldest automatic backups exceeding the count to keep
+func RunScheduledBackup() error {
+	runTime := time.Now()
+
+	backupPath, err := makeScheduledBackup(runTime)
+	if err != nil {
+		config.SetBackupResult(runTime, err.Error())
+		return err
+	}
+
+	config.SetBackupResult(runTime, "")
+	log.Debug(fmt.Sprintf("Automatic backup written to %s", backupPath))
+
+	removeOldBackups(filepath.Dir(backupPath), config.GetBackupKeep())
+
+	return nil
+}
+
+func makeScheduledBackup(runTime time.Time) (string, error) {
+	directory := config.GetBackupDirectory()
+	if directory == "" {
+		mebroutines.ShowTranslatedErrorMessage("Automatic backups are turned on but the backup directory has not been set in naksu.ini")
+		return "", errors.New("backup directory has not been set")
+	}
+
+	if !mebroutines.ExistsDir(directory) {
+		err := mebroutines.CreateDir(directory)
+		if err != nil {
+			mebroutines.ShowTranslatedErrorMessage("Could not create backup directory %s", directory)
+			return "", fmt.Errorf("could not create backup directory %s: %v", directory, err)
+		}
+	}
+
+	backupPath := filepath.Join(directory, GetBackupFilename(runTime))
+	log.Debug(fmt.Sprintf("Starting automatic backup to %s", backupPath))
+
+	// Failures are reported to the user by MakeBackup()
+	err := MakeBackup(backupPath)
+	if err != nil {
+		return "", err
+	}
+
+	return backupPath, nil
+}
+
+// IsLatestBackupTooOld returns true if automatic backups are turned on and the
+// latest successful automatic backup is older than allowed in naksu.ini
+func IsLatestBackupTooOld(now time.Time) bool {
+	maxAgeHours := config.GetBackupMaxAgeHours()
+	if config.GetBackupSchedule() == constants.BackupScheduleOff || maxAgeHours == 0 {
+		return false
+	}
+
+	lastSuccess := config.GetBackupLastSuccess()
+
+	return lastSuccess.IsZero() || now.Sub(lastSuccess) > time.Duration(maxAgeHours)*time.Hour
+}
+
+// getOldBackups returns the paths of the automatic backups in the directory except
+// the newest keep backups. Zero keep returns no backups. Only the files named by
+// GetBackupFilename() are considered so that other files are never removed.
+func getOldBackups(directory string, keep uint64) ([]string, error) {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, file := range files {
+		if !file.IsDir() && scheduledBackupRegexp.MatchString(file.Name()) {
+			names = append(names, file.Name())
+		}
+	}
+
+	// The file names are timestamps, newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	if keep == 0 || uint64(len(names)) <= keep {
+		return nil, nil
+	}
+
+	paths := []string{}
+	for _, name := range names[keep:] {
+		paths = append(paths, filepath.Join(directory, name))
+	}
+
+	return paths, nil
+}
+
+// removeOldBackups removes the automatic backups in the directory except the newest keep backups
+func removeOldBackups(directory string, keep uint64) {
+	oldBackups, err := getOldBackups(directory, keep)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Could not list old backups in %s: %v", directory, err))
+		return
+	}
+
+	for _, backupPath := range oldBackups {
+		log.Debug(fmt.Sprintf("Removing old automatic backup %s", backupPath))
+		removeBackup(backupPath)
+	}
+}
+
+// removeBackup removes the backup, its extent files and its manifest
+func removeBackup(backupPath string) {
+	dataPaths, err := getBackupDataFiles(backupPath)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Not removing the extent files of backup %s: %v", backupPath, err))
+		dataPaths = []string{backupPath}
+	}
+
+	paths := append(dataPaths, GetManifestPath(backupPath))
+
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Debug(fmt.Sprintf("Could not remove %s: %v", path, err))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package backup
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"naksu/constants"
+	"naksu/mebroutines"
+)
+
+func TestIsBackupDue(t *testing.T) {
+	now := time.Date(2021, 6, 2, 3, 0, 0, 0, time.Local)
+	lastNight := time.Date(2021, 6, 2, 2, 30, 0, 0, time.Local)
+	yesterday := time.Date(2021, 6, 1, 14, 0, 0, 0, time.Local)
+
+	tables := []struct {
+		schedule    string
+		nightlyHour int
+		lastRun     time.Time
+		shutDown    bool
+		now         time.Time
+		isDue       bool
+	}{
+		{constants.BackupScheduleOff, 2, time.Time{}, true, now, false},
+		{constants.BackupScheduleShutdown, 2, time.Time{}, true, now, true},
+		{constants.BackupScheduleShutdown, 2, time.Time{}, false, now, false},
+		{constants.BackupScheduleNightly, 2, time.Time{}, false, now, true},
+		{constants.BackupScheduleNightly, 2, yesterday, false, now, true},
+		{constants.BackupScheduleNightly, 2, lastNight, false, now, false},
+		{constants.BackupScheduleNightly, 4, yesterday, false, now, false},
+		{constants.BackupScheduleNightly, 2, yesterday, false, now.Add(8 * time.Hour), false},
+		{constants.BackupScheduleNightly, 23, yesterday, false, now, true},
+	}
+
+	for _, table := range tables {
+		isDue := isBackupDue(table.schedule, table.nightlyHour, table.lastRun, table.shutDown, table.now)
+		if isDue != table.isDue {
+			t.Errorf("isBackupDue(%s, %d, %v, %v, %v) gives %v instead of %v", table.schedule, table.nightlyHour, table.lastRun, table.shutDown, table.now, isDue, table.isDue)
+		}
+	}
+}
+
+func TestRemoveOldBackups(t *testing.T) {
+	dir, cleanup := getTempDir(t)
+	defer cleanup()
+
+	splitDescriptor := "# Disk DescriptorFile\ncreateType=\"twoGbMaxExtentSparse\"\nRW 4192256 SPARSE \"2021-05-30_02-00-00-s001.vmdk\"\n"
+	writeTestFiles(t, map[string]string{
+		filepath.Join(dir, "2021-05-30_02-00-00.vmdk"):      splitDescriptor,
+		filepath.Join(dir, "2021-05-30_02-00-00-s001.vmdk"): "extent",
+		filepath.Join(dir, "2021-05-30_02-00-00.vmdk.json"): "{}",
+		filepath.Join(dir, "2021-05-31_02-00-00.vmdk"):      "backup",
+		filepath.Join(dir, "2021-05-31_02-00-00.vmdk.json"): "{}",
+		filepath.Join(dir, "2021-06-01_02-00-00.vmdk"):      "backup",
+		filepath.Join(dir, "2021-06-02_02-00-00.vmdk"):      "backup",
+		filepath.Join(dir, "my-own-backup.vmdk"):            "backup",
+	})
+
+	removeOldBackups(dir, 2)
+
+	tables := []struct {
+		name   string
+		exists bool
+	}{
+		{"2021-05-30_02-00-00.vmdk", false},
+		{"2021-05-30_02-00-00-s001.vmdk", false},
+		{"2021-05-30_02-00-00.vmdk.json", false},
+		{"2021-05-31_02-00-00.vmdk", false},
+		{"2021-05-31_02-00-00.vmdk.json", false},
+		{"2021-06-01_02-00-00.vmdk", true},
+		{"2021-06-02_02-00-00.vmdk", true},
+		{"my-own-backup.vmdk", true},
+	}
+
+	for _, table := range tables {
+		exists := mebroutines.ExistsFile(filepath.Join(dir, table.name))
+		if exists != table.exists {
+			t.Errorf("After removing old backups file %s exists: %v, expected %v", table.name, exists, table.exists)
+		}
+	}
+}
+
+func TestGetOldBackupsKeepsAllWithZero(t *testing.T) {
+	dir, cleanup := getTempDir(t)
+	defer cleanup()
+
+	writeTestFiles(t, map[string]string{
+		filepath.Join(dir, "2021-05-31_02-00-00.vmdk"): "backup",
+		filepath.Join(dir, "2021-06-01_02-00-00.vmdk"): "backup",
+	})
+
+	oldBackups, err := getOldBackups(dir, 0)
+	if err != nil {
+		t.Fatalf("getOldBackups failed: %v", err)
+	}
+
+	if len(oldBackups) != 0 {
+		t.Errorf("getOldBackups with zero keep gives backups to remove: %v", oldBackups)
+	}
+}
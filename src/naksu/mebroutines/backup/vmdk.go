@@ -0,0 +1,296 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"naksu/box"
+	"naksu/mebroutines"
+)
+
+const (
+	// vmdkSparseMagic is the magic number ("KDMV") at the start of a sparse VMDK extent
+	vmdkSparseMagic = 0x564d444b
+	// vmdkDescriptorHeader starts a VMDK descriptor file (e.g. a split VMDK)
+	vmdkDescriptorHeader = "# Disk DescriptorFile"
+	// vmdkMaxDescriptorSize limits the size of the descriptor we are willing to read
+	vmdkMaxDescriptorSize = 64 * 1024
+	vmdkSectorSize        = 512
+	// vmdkNullUUID is the parent UUID of a disk which is not a differencing disk
+	vmdkNullUUID = "00000000-0000-0000-0000-000000000000"
+	// vmdkNullCID is the parent content ID of a disk which is not a differencing disk
+	vmdkNullCID = "ffffffff"
+)
+
+// backupCreateTypes are the VMDK types written by box.WriteDiskClone()
+var backupCreateTypes = []string{"monolithicSparse", "twoGbMaxExtentSparse"}
+
+// vmdkSparseHeader is the beginning of the header of a sparse VMDK extent
+type vmdkSparseHeader struct {
+	MagicNumber      uint32
+	Version          uint32
+	Flags            uint32
+	Capacity         uint64
+	GrainSize        uint64
+	DescriptorOffset uint64
+	DescriptorSize   uint64
+}
+
+// VMDKExtent is an extent line of a VMDK descriptor
+type VMDKExtent struct {
+	Access  string
+	Sectors uint64
+	Type    string
+	File    string
+}
+
+// VMDKInfo describes a VMDK disk image
+type VMDKInfo struct {
+	CreateType string
+	// UUID is the image UUID (ddb.uuid.image) or empty if the descriptor does not have one
+	UUID string
+	// ParentUUID is the UUID of the parent of a differencing disk (ddb.uuid.parent). It
+	// is vmdkNullUUID or empty for other disks.
+	ParentUUID string
+	// ParentCID is the content ID of the parent of a differencing disk (parentCID). It
+	// is vmdkNullCID or empty for other disks.
+	ParentCID string
+	Extents   []VMDKExtent
+}
+
+// Capacity returns the virtual size of the disk in bytes
+func (info VMDKInfo) Capacity() uint64 {
+	var sectors uint64
+	for _, extent := range info.Extents {
+		sectors += extent.Sectors
+	}
+
+	return sectors * vmdkSectorSize
+}
+
+var vmdkCreateTypeRegexp = regexp.MustCompile(`^createType\s*=\s*"(.*)"$`)
+var vmdkUUIDRegexp = regexp.MustCompile(`^ddb\.uuid\.image\s*=\s*"(.*)"$`)
+var vmdkParentUUIDRegexp = regexp.MustCompile(`^ddb\.uuid\.parent\s*=\s*"(.*)"$`)
+var vmdkParentCIDRegexp = regexp.MustCompile(`^parentCID\s*=\s*(\w+)$`)
+var vmdkExtentRegexp = regexp.MustCompile(`^(RW|RDONLY|NOACCESS)\s+(\d+)\s+(\w+)(?:\s+"(.*?)")?`)
+
+// ReadVMDKInfo reads the descriptor of the given VMDK file. Both monolithic
+// sparse files and descriptor files (split VMDKs) are supported.
+func ReadVMDKInfo(path string) (VMDKInfo, error) {
+	file, err := os.Open(path) // #nosec
+	if err != nil {
+		return VMDKInfo{}, err
+	}
+	defer file.Close()
+
+	var header vmdkSparseHeader
+	err = binary.Read(file, binary.LittleEndian, &header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return VMDKInfo{}, fmt.Errorf("could not read vmdk header: %v", err)
+	}
+
+	if header.MagicNumber == vmdkSparseMagic {
+		if header.DescriptorOffset == 0 || header.DescriptorSize == 0 || header.DescriptorSize*vmdkSectorSize > vmdkMaxDescriptorSize {
+			return VMDKInfo{}, errors.New("sparse vmdk does not have an embedded descriptor")
+		}
+
+		descriptor := make([]byte, header.DescriptorSize*vmdkSectorSize)
+		_, err = file.ReadAt(descriptor, int64(header.DescriptorOffset*vmdkSectorSize))
+		if err != nil {
+			return VMDKInfo{}, fmt.Errorf("could not read vmdk descriptor: %v", err)
+		}
+
+		return parseVMDKDescriptor(string(bytes.TrimRight(descriptor, "\x00")))
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return VMDKInfo{}, err
+	}
+
+	descriptor := make([]byte, vmdkMaxDescriptorSize)
+	n, err := io.ReadFull(file, descriptor)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return VMDKInfo{}, fmt.Errorf("could not read vmdk descriptor: %v", err)
+	}
+
+	if !bytes.HasPrefix(descriptor[:n], []byte(vmdkDescriptorHeader)) {
+		return VMDKInfo{}, errors.New("file is not a vmdk disk image")
+	}
+
+	return parseVMDKDescriptor(string(descriptor[:n]))
+}
+
+// parseVMDKDescriptor returns the create type and the extents of a VMDK descriptor
+func parseVMDKDescriptor(descriptor string) (VMDKInfo, error) {
+	info := VMDKInfo{}
+
+	scanner := bufio.NewScanner(strings.NewReader(descriptor))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		matches := vmdkCreateTypeRegexp.FindStringSubmatch(line)
+		if matches != nil {
+			info.CreateType = matches[1]
+			continue
+		}
+
+		matches = vmdkUUIDRegexp.FindStringSubmatch(line)
+		if matches != nil {
+			info.UUID = matches[1]
+			continue
+		}
+
+		matches = vmdkParentUUIDRegexp.FindStringSubmatch(line)
+		if matches != nil {
+			info.ParentUUID = matches[1]
+			continue
+		}
+
+		matches = vmdkParentCIDRegexp.FindStringSubmatch(line)
+		if matches != nil {
+			info.ParentCID = strings.ToLower(matches[1])
+			continue
+		}
+
+		matches = vmdkExtentRegexp.FindStringSubmatch(line)
+		if matches != nil {
+			sectors, err := strconv.ParseUint(matches[2], 10, 64)
+			if err != nil {
+				return VMDKInfo{}, fmt.Errorf("malformed vmdk extent '%s': %v", line, err)
+			}
+
+			info.Extents = append(info.Extents, VMDKExtent{
+				Access:  matches[1],
+				Sectors: sectors,
+				Type:    matches[3],
+				File:    matches[4],
+			})
+		}
+	}
+
+	if info.CreateType == "" {
+		return VMDKInfo{}, errors.New("vmdk descriptor does not have a create type")
+	}
+
+	if len(info.Extents) == 0 {
+		return VMDKInfo{}, errors.New("vmdk descriptor does not have any extents")
+	}
+
+	return info, nil
+}
+
+// CheckBackupFile returns an error if the given file is not a disk clone written by
+// MakeBackup(). The VMDK must be a complete clone of a server disk. If the backup has
+// a manifest the manifest must describe the backup file. The contents of a VirtualBox
+// clone are not checked, see VerifyBackup(). A clone written by qemu-img has no image
+// UUID to compare with the manifest so it must have a manifest which its contents match.
+func CheckBackupFile(backupPath string) error {
+	info, err := ReadVMDKInfo(backupPath)
+	if err != nil {
+		return err
+	}
+
+	if !isBackupCreateType(info.CreateType) {
+		return fmt.Errorf("disk type %s is not a naksu backup type", info.CreateType)
+	}
+
+	if info.ParentUUID != "" && info.ParentUUID != vmdkNullUUID {
+		return fmt.Errorf("disk is a differencing disk of %s", info.ParentUUID)
+	}
+
+	if info.ParentCID != "" && info.ParentCID != vmdkNullCID {
+		return fmt.Errorf("disk is a differencing disk of content id %s", info.ParentCID)
+	}
+
+	// The disk of the backed up server may be larger than the minimum (see box.GetResources())
+	if info.Capacity() < box.GetDiskSize() {
+		return fmt.Errorf("disk size %d bytes is smaller than the server disk size %d bytes", info.Capacity(), box.GetDiskSize())
+	}
+
+	// Descriptor files refer to the extent files in the same directory
+	for _, extent := range info.Extents {
+		if info.CreateType == "monolithicSparse" || extent.File == "" {
+			continue
+		}
+
+		extentPath, err := getExtentPath(backupPath, extent)
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Stat(extentPath)
+		if err != nil {
+			return fmt.Errorf("backup file %s is missing: %v", extentPath, err)
+		}
+	}
+
+	if info.UUID == "" && !mebroutines.ExistsFile(GetManifestPath(backupPath)) {
+		return errors.New("disk does not have an image uuid or a manifest")
+	}
+
+	err = checkBackupManifest(backupPath, info)
+	if err != nil || info.UUID != "" {
+		return err
+	}
+
+	return VerifyBackup(backupPath)
+}
+
+// getExtentPath returns the path of an extent file of the VMDK descriptor at vmdkPath.
+// The extent files are in the directory of the descriptor so a name pointing to
+// another directory is rejected.
+func getExtentPath(vmdkPath string, extent VMDKExtent) (string, error) {
+	if filepath.Base(extent.File) != extent.File || extent.File == "." || extent.File == ".." {
+		return "", fmt.Errorf("vmdk extent file '%s' is not in the directory of the disk", extent.File)
+	}
+
+	return filepath.Join(filepath.Dir(vmdkPath), extent.File), nil
+}
+
+func isBackupCreateType(createType string) bool {
+	for _, backupCreateType := range backupCreateTypes {
+		if createType == backupCreateType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkBackupManifest returns an error if the backup has a manifest which does not
+// describe the backup file. Backups without a manifest are accepted.
+func checkBackupManifest(backupPath string, info VMDKInfo) error {
+	if !mebroutines.ExistsFile(GetManifestPath(backupPath)) {
+		return nil
+	}
+
+	manifest, err := ReadManifest(backupPath)
+	if err != nil {
+		return err
+	}
+
+	if manifest.DiskUUID != "" && manifest.DiskUUID != info.UUID {
+		return fmt.Errorf("disk uuid %s does not match the manifest (%s)", info.UUID, manifest.DiskUUID)
+	}
+
+	fileInfo, err := os.Stat(backupPath)
+	if err != nil {
+		return err
+	}
+
+	if uint64(fileInfo.Size()) != manifest.Size {
+		return fmt.Errorf("size %d bytes does not match the manifest (%d bytes)", fileInfo.Size(), manifest.Size)
+	}
+
+	return nil
+}
@@ -0,0 +1,300 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"naksu/box"
+)
+
+var testDiskSectors = box.GetDiskSize() / vmdkSectorSize
+
+// testQemuImgDescriptor is the descriptor embedded by "qemu-img convert -O vmdk" (see
+// box.CloneDisk() of the qemu backend) with the parent CID and the extent file name
+// as parameters. It has no ddb.uuid.image.
+const testQemuImgDescriptor = `# Disk DescriptorFile
+version=1
+CID=6f1c2a9e
+parentCID=%s
+createType="monolithicSparse"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "114428"
+ddb.geometry.heads = "16"
+ddb.geometry.sectors = "63"
+ddb.adapterType = "ide"
+ddb.toolsVersion = "2147483647"
+`
+
+func getTempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "naksu-vmdk-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+
+	return dir, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// writeSparseVMDK writes a sparse VMDK header with the given embedded descriptor
+func writeSparseVMDK(t *testing.T, path string, descriptor string) {
+	header := vmdkSparseHeader{
+		MagicNumber:      vmdkSparseMagic,
+		Version:          1,
+		Capacity:         testDiskSectors,
+		GrainSize:        128,
+		DescriptorOffset: 1,
+		DescriptorSize:   20,
+	}
+
+	var content bytes.Buffer
+	err := binary.Write(&content, binary.LittleEndian, header)
+	if err != nil {
+		t.Fatalf("Could not encode vmdk header: %v", err)
+	}
+
+	content.Write(make([]byte, vmdkSectorSize-content.Len()))
+	content.WriteString(descriptor)
+	content.Write(make([]byte, 21*vmdkSectorSize-content.Len()))
+
+	err = ioutil.WriteFile(path, content.Bytes(), 0600)
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", path, err)
+	}
+}
+
+func TestReadVMDKInfoSparse(t *testing.T) {
+	dir, cleanup := getTempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "backup.vmdk")
+	writeSparseVMDK(t, path, fmt.Sprintf("# Disk DescriptorFile\nversion=1\ncreateType=\"monolithicSparse\"\n\n# Extent description\nRW %d SPARSE \"backup.vmdk\"\n\n# The Disk Data Base\nddb.uuid.image=\"8d2d5f52-0fb4-4f5e-a4a9-3b1c1a6f3e01\"\n", testDiskSectors))
+
+	info, err := ReadVMDKInfo(path)
+	if err != nil {
+		t.Fatalf("ReadVMDKInfo failed: %v", err)
+	}
+
+	if info.CreateType != "monolithicSparse" || info.UUID != "8d2d5f52-0fb4-4f5e-a4a9-3b1c1a6f3e01" || len(info.Extents) != 1 || info.Capacity() != box.GetDiskSize() {
+		t.Errorf("ReadVMDKInfo gives unexpected info: %+v", info)
+	}
+
+	err = CheckBackupFile(path)
+	if err != nil {
+		t.Errorf("CheckBackupFile failed for a valid backup: %v", err)
+	}
+}
+
+func TestReadVMDKInfoDescriptorFile(t *testing.T) {
+	dir, cleanup := getTempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "backup.vmdk")
+	descriptor := fmt.Sprintf("# Disk DescriptorFile\nversion=1\ncreateType=\"twoGbMaxExtentSparse\"\n\nRW %d SPARSE \"backup-s001.vmdk\"\nRW %d SPARSE \"backup-s002.vmdk\"\n", testDiskSectors-4194304, 4194304)
+
+	err := ioutil.WriteFile(path, []byte(descriptor), 0600)
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", path, err)
+	}
+
+	info, err := ReadVMDKInfo(path)
+	if err != nil {
+		t.Fatalf("ReadVMDKInfo failed: %v", err)
+	}
+
+	if info.CreateType != "twoGbMaxExtentSparse" || len(info.Extents) != 2 || info.Extents[1].File != "backup-s002.vmdk" {
+		t.Errorf("ReadVMDKInfo gives unexpected info: %+v", info)
+	}
+
+	err = CheckBackupFile(path)
+	if err == nil {
+		t.Errorf("CheckBackupFile should fail when the extent files are missing")
+	}
+}
+
+func TestCheckBackupFileRejectsOtherFiles(t *testing.T) {
+	dir, cleanup := getTempDir(t)
+	defer cleanup()
+
+	tables := []struct {
+		name    string
+		content string
+	}{
+		{"empty.vmdk", ""},
+		{"text.vmdk", "this is not a disk image"},
+		{"small.vmdk", "# Disk DescriptorFile\ncreateType=\"monolithicFlat\"\nRW 2048 FLAT \"small-flat.vmdk\" 0\n"},
+		{"noextents.vmdk", "# Disk DescriptorFile\ncreateType=\"monolithicFlat\"\n"},
+	}
+
+	for _, table := range tables {
+		path := filepath.Join(dir, table.name)
+		err := ioutil.WriteFile(path, []byte(table.content), 0600)
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", path, err)
+		}
+
+		err = CheckBackupFile(path)
+		if err == nil {
+			t.Errorf("CheckBackupFile accepts %s", table.name)
+		}
+	}
+}
+
+func TestCheckBackupFileRejectsOtherDisks(t *testing.T) {
+	dir, cleanup := getTempDir(t)
+	defer cleanup()
+
+	tables := []struct {
+		name       string
+		descriptor string
+	}{
+		{"flat.vmdk", fmt.Sprintf("# Disk DescriptorFile\ncreateType=\"monolithicSparse\"\nRW %d SPARSE \"flat.vmdk\"\n", testDiskSectors)},
+		{"differencing.vmdk", fmt.Sprintf("# Disk DescriptorFile\ncreateType=\"monolithicSparse\"\nRW %d SPARSE \"differencing.vmdk\"\nddb.uuid.image=\"8d2d5f52-0fb4-4f5e-a4a9-3b1c1a6f3e01\"\nddb.uuid.parent=\"1c6f5e2a-1b2c-4d5e-8f90-0a1b2c3d4e5f\"\n", testDiskSectors)},
+		{"qemu-differencing.vmdk", fmt.Sprintf(testQemuImgDescriptor, "6f1c2a9e", testDiskSectors, "qemu-differencing.vmdk")},
+		{"stream.vmdk", fmt.Sprintf("# Disk DescriptorFile\ncreateType=\"streamOptimized\"\nRW %d SPARSE \"stream.vmdk\"\nddb.uuid.image=\"8d2d5f52-0fb4-4f5e-a4a9-3b1c1a6f3e01\"\n", testDiskSectors)},
+	}
+
+	for _, table := range tables {
+		path := filepath.Join(dir, table.name)
+		writeSparseVMDK(t, path, table.descriptor)
+
+		err := CheckBackupFile(path)
+		if err == nil {
+			t.Errorf("CheckBackupFile accepts %s", table.name)
+		}
+	}
+}
+
+func TestCheckBackupFileWithManifest(t *testing.T) {
+	dir, cleanup := getTempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "backup.vmdk")
+	writeSparseVMDK(t, path, fmt.Sprintf("# Disk DescriptorFile\ncreateType=\"monolithicSparse\"\nRW %d SPARSE \"backup.vmdk\"\nddb.uuid.image=\"8d2d5f52-0fb4-4f5e-a4a9-3b1c1a6f3e01\"\nddb.uuid.parent=\"00000000-0000-0000-0000-000000000000\"\n", testDiskSectors))
+
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Could not stat %s: %v", path, err)
+	}
+
+	tables := []struct {
+		manifest string
+		isError  bool
+	}{
+		{fmt.Sprintf(`{"diskUUID": "8d2d5f52-0fb4-4f5e-a4a9-3b1c1a6f3e01", "size": %d}`, fileInfo.Size()), false},
+		{fmt.Sprintf(`{"diskUUID": "1c6f5e2a-1b2c-4d5e-8f90-0a1b2c3d4e5f", "size": %d}`, fileInfo.Size()), true},
+		{`{"diskUUID": "8d2d5f52-0fb4-4f5e-a4a9-3b1c1a6f3e01", "size": 1}`, true},
+		{`not json`, true},
+	}
+
+	for _, table := range tables {
+		err = ioutil.WriteFile(GetManifestPath(path), []byte(table.manifest), 0600)
+		if err != nil {
+			t.Fatalf("Could not write manifest: %v", err)
+		}
+
+		err = CheckBackupFile(path)
+		if (err != nil) != table.isError {
+			t.Errorf("CheckBackupFile with manifest %s gives error %v", table.manifest, err)
+		}
+	}
+}
+
+func TestCheckBackupFileRejectsExtentsOutsideBackupDirectory(t *testing.T) {
+	dir, cleanup := getTempDir(t)
+	defer cleanup()
+
+	backupDir := filepath.Join(dir, "backups")
+	err := os.Mkdir(backupDir, 0700)
+	if err != nil {
+		t.Fatalf("Could not create %s: %v", backupDir, err)
+	}
+
+	outsidePath := filepath.Join(dir, "outside.vmdk")
+	err = ioutil.WriteFile(outsidePath, []byte("not a part of the backup"), 0600)
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", outsidePath, err)
+	}
+
+	for _, extentFile := range []string{"../outside.vmdk", outsidePath, ".."} {
+		path := filepath.Join(backupDir, "backup.vmdk")
+		descriptor := fmt.Sprintf("# Disk DescriptorFile\ncreateType=\"twoGbMaxExtentSparse\"\nRW %d SPARSE \"%s\"\nddb.uuid.image=\"8d2d5f52-0fb4-4f5e-a4a9-3b1c1a6f3e01\"\n", testDiskSectors, extentFile)
+
+		err = ioutil.WriteFile(path, []byte(descriptor), 0600)
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", path, err)
+		}
+
+		err = CheckBackupFile(path)
+		if err == nil {
+			t.Errorf("CheckBackupFile accepts extent file %s", extentFile)
+		}
+
+		_, err = getBackupDataFiles(path)
+		if err == nil {
+			t.Errorf("getBackupDataFiles accepts extent file %s", extentFile)
+		}
+	}
+}
+
+func TestCheckBackupFileWrittenByQemuImg(t *testing.T) {
+	dir, cleanup := getTempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "backup.vmdk")
+	writeSparseVMDK(t, path, fmt.Sprintf(testQemuImgDescriptor, "ffffffff", testDiskSectors, "backup.vmdk"))
+
+	info, err := ReadVMDKInfo(path)
+	if err != nil || info.UUID != "" || info.ParentCID != vmdkNullCID || info.CreateType != "monolithicSparse" {
+		t.Fatalf("ReadVMDKInfo gives %+v (%v)", info, err)
+	}
+
+	err = CheckBackupFile(path)
+	if err == nil {
+		t.Errorf("CheckBackupFile accepts a qemu-img backup without a manifest")
+	}
+
+	files, err := getBackupChecksums([]string{path}, "%d")
+	if err != nil {
+		t.Fatalf("getBackupChecksums failed: %v", err)
+	}
+
+	tables := []struct {
+		manifest Manifest
+		isError  bool
+	}{
+		{Manifest{Size: files[0].Size, SHA256: files[0].SHA256}, false},
+		{Manifest{Size: files[0].Size, SHA256: testWrongChecksum}, true},
+		{Manifest{DiskUUID: "8d2d5f52-0fb4-4f5e-a4a9-3b1c1a6f3e01", Size: files[0].Size, SHA256: files[0].SHA256}, true},
+	}
+
+	for _, table := range tables {
+		content, err := json.Marshal(table.manifest)
+		if err != nil {
+			t.Fatalf("Could not encode manifest: %v", err)
+		}
+
+		err = ioutil.WriteFile(GetManifestPath(path), content, 0600)
+		if err != nil {
+			t.Fatalf("Could not write manifest: %v", err)
+		}
+
+		err = CheckBackupFile(path)
+		if (err != nil) != table.isError {
+			t.Errorf("CheckBackupFile of a qemu-img backup with manifest %+v gives error %v", table.manifest, err)
+		}
+	}
+}
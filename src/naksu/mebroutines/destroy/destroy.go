@@ -43,6 +43,14 @@ func Server() error {
 		return mebroutines.ShowTranslatedErrorMessageAndPassError(generalErrorString, fmt.Errorf("could not restore snapshot: %v", err))
 	}
 
+	// The exams have been removed but the disk image does not shrink by itself
+	progress.TranslateAndSetMessage("Compacting the server disk. This takes a while.")
+
+	err = box.CompactCurrentDisk()
+	if err != nil {
+		log.Warning("Could not compact the server disk after removing exams: %v", err)
+	}
+
 	progress.SetMessage("")
 
 	return nil
@@ -0,0 +1,343 @@
+package doctor
+
+import (
+	"os"
+	"path/filepath"
+
+	"naksu/box"
+	"naksu/box/vboxmanage"
+	"naksu/mebroutines"
+	"naksu/xlate"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// checkMediaRegistry finds duplicate, inaccessible and orphaned disk images in the
+// global media registry (VirtualBox.xml)
+func checkMediaRegistry(env *environment) ([]Finding, error) {
+	findings := []Finding{}
+	handled := map[string]bool{}
+
+	inUse := getHardDisksInUse(env)
+
+	hardDisksByLocation := map[string][]vboxmanage.RegisteredHardDisk{}
+	locations := []string{}
+	for _, hardDisk := range env.virtualBoxConfig.HardDisks {
+		location := filepath.Clean(hardDisk.Location)
+		if len(hardDisksByLocation[location]) == 0 {
+			locations = append(locations, location)
+		}
+		hardDisksByLocation[location] = append(hardDisksByLocation[location], hardDisk)
+	}
+
+	for _, location := range locations {
+		duplicateUUIDs := getDuplicateUUIDs(hardDisksByLocation[location], inUse)
+		if len(duplicateUUIDs) == 0 {
+			continue
+		}
+
+		for _, uuid := range duplicateUUIDs {
+			handled[uuid] = true
+		}
+
+		findings = append(findings, Finding{
+			Kind:           KindDuplicateMedium,
+			Path:           location,
+			Description:    xlate.Get("Disk image %s has been registered to VirtualBox %d times", location, len(hardDisksByLocation[location])),
+			FixDescription: xlate.Get("Remove the extra registrations from the VirtualBox configuration (the original file is backed up)"),
+			fix: func() error {
+				_, err := vboxmanage.RemoveHardDisksFromVirtualBoxConfig(duplicateUUIDs)
+				return err
+			},
+		})
+	}
+
+	for _, hardDisk := range env.virtualBoxConfig.HardDisks {
+		if handled[hardDisk.UUID] || inUse[hardDisk.UUID] || hardDisk.HasChildren {
+			continue
+		}
+
+		uuid := hardDisk.UUID
+		closeMedium := func() error {
+			_, err := vboxmanage.BackupConfigFile(env.virtualBoxConfig.Path)
+			if err != nil {
+				return err
+			}
+
+			return vboxmanage.CloseMedium(uuid)
+		}
+
+		switch {
+		case !mebroutines.ExistsFile(hardDisk.Location):
+			findings = append(findings, Finding{
+				Kind:           KindInaccessibleMedium,
+				Path:           hardDisk.Location,
+				Description:    xlate.Get("Disk image %s is registered to VirtualBox but the file is missing", hardDisk.Location),
+				FixDescription: xlate.Get("Remove the disk image from the VirtualBox media registry"),
+				fix:            closeMedium,
+			})
+		case isInKtpDirectory(hardDisk.Location):
+			findings = append(findings, Finding{
+				Kind:           KindOrphanedMedium,
+				Path:           hardDisk.Location,
+				Description:    xlate.Get("Disk image %s is registered to VirtualBox but it is not used by any virtual machine", hardDisk.Location),
+				FixDescription: xlate.Get("Remove the disk image from the VirtualBox media registry (the file is kept)"),
+				fix:            closeMedium,
+			})
+		}
+	}
+
+	return findings, nil
+}
+
+// getHardDisksInUse returns the UUIDs of the registered disk images which are attached
+// to a VM and the parents of the attached differencing disks
+func getHardDisksInUse(env *environment) map[string]bool {
+	parents := map[string]string{}
+	for _, hardDisk := range env.virtualBoxConfig.HardDisks {
+		parents[hardDisk.UUID] = hardDisk.ParentUUID
+	}
+
+	inUse := map[string]bool{}
+	for _, hardDisk := range env.virtualBoxConfig.HardDisks {
+		if !env.attachedUUIDs[hardDisk.UUID] && !env.attachedLocations[filepath.Clean(hardDisk.Location)] {
+			continue
+		}
+
+		for uuid := hardDisk.UUID; uuid != "" && !inUse[uuid]; uuid = parents[uuid] {
+			inUse[uuid] = true
+		}
+	}
+
+	return inUse
+}
+
+// getDuplicateUUIDs returns the UUIDs of the registrations of the same disk image which
+// should be removed. The registration in use (or the first one) is kept. Registrations
+// with differencing disks cannot be removed.
+func getDuplicateUUIDs(hardDisks []vboxmanage.RegisteredHardDisk, inUse map[string]bool) []string {
+	if len(hardDisks) < 2 {
+		return nil
+	}
+
+	kept := hardDisks[0].UUID
+	for _, hardDisk := range hardDisks {
+		if inUse[hardDisk.UUID] {
+			kept = hardDisk.UUID
+			break
+		}
+	}
+
+	duplicateUUIDs := []string{}
+	for _, hardDisk := range hardDisks {
+		if hardDisk.UUID != kept && !inUse[hardDisk.UUID] && !hardDisk.HasChildren {
+			duplicateUUIDs = append(duplicateUUIDs, hardDisk.UUID)
+		}
+	}
+
+	return duplicateUUIDs
+}
+
+// checkLeftoverFiles finds raw images and unused disk images in ~/ktp
+func checkLeftoverFiles(env *environment) ([]Finding, error) {
+	candidates := []string{
+		mebroutines.GetImagePath(),
+		mebroutines.GetZipImagePath(),
+		filepath.Join(mebroutines.GetKtpDirectory(), "ktp.img"),
+	}
+
+	diskImages, err := filepath.Glob(filepath.Join(mebroutines.GetKtpDirectory(), "*.vdi"))
+	if err != nil {
+		return nil, err
+	}
+
+	registeredLocations := map[string]bool{}
+	for _, hardDisk := range env.virtualBoxConfig.HardDisks {
+		registeredLocations[filepath.Clean(hardDisk.Location)] = true
+	}
+
+	for _, diskImage := range diskImages {
+		if !registeredLocations[filepath.Clean(diskImage)] && !env.attachedLocations[filepath.Clean(diskImage)] {
+			candidates = append(candidates, diskImage)
+		}
+	}
+
+	findings := []Finding{}
+
+	for _, path := range candidates {
+		fileInfo, err := os.Stat(path)
+		if err != nil || !fileInfo.Mode().IsRegular() {
+			continue
+		}
+
+		path := path
+		findings = append(findings, Finding{
+			Kind:           KindLeftoverFile,
+			Path:           path,
+			Description:    xlate.Get("File %s (%s) is not used by any virtual machine", path, humanize.Bytes(uint64(fileInfo.Size()))),
+			FixDescription: xlate.Get("Delete the file"),
+			fix: func() error {
+				return os.Remove(path)
+			},
+		})
+	}
+
+	return findings, nil
+}
+
+// checkVMDirectories finds trash VM directories and stale .vbox-prev files in the
+// default machine folder
+func checkVMDirectories(env *environment) ([]Finding, error) {
+	findings := []Finding{}
+
+	trashVMDirectories, err := vboxmanage.FindTrashVMDirectories()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, trashVMDirectory := range trashVMDirectories {
+		trashVMDirectory := trashVMDirectory
+		findings = append(findings, Finding{
+			Kind:           KindTrashVMDirectory,
+			Path:           trashVMDirectory,
+			Description:    xlate.Get("Directory %s contains only the settings of a removed virtual machine", trashVMDirectory),
+			FixDescription: xlate.Get("Delete the directory"),
+			fix: func() error {
+				return os.RemoveAll(trashVMDirectory)
+			},
+		})
+	}
+
+	staleFiles, err := vboxmanage.FindStalePreviousSettingsFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, staleFile := range staleFiles {
+		staleFile := staleFile
+		settingsFile := vboxmanage.GetCurrentSettingsFile(staleFile)
+
+		if env.virtualBoxConfig.IsMachineRegistered(settingsFile) {
+			findings = append(findings, Finding{
+				Kind:           KindStaleSettingsFile,
+				Path:           staleFile,
+				Description:    xlate.Get("Settings file %s of a registered virtual machine is missing but the previous settings %s exist", filepath.Base(settingsFile), staleFile),
+				FixDescription: xlate.Get("Restore the settings from the previous settings file"),
+				fix: func() error {
+					return mebroutines.CopyFile(staleFile, settingsFile)
+				},
+			})
+			continue
+		}
+
+		findings = append(findings, Finding{
+			Kind:           KindStaleSettingsFile,
+			Path:           staleFile,
+			Description:    xlate.Get("File %s contains the previous settings of a virtual machine which has been removed", staleFile),
+			FixDescription: xlate.Get("Delete the file"),
+			fix: func() error {
+				return os.Remove(staleFile)
+			},
+		})
+	}
+
+	return findings, nil
+}
+
+// checkServers finds naksu VMs whose shared folder is not ktp-jako or which do
+// not have the snapshot used for removing exams
+func checkServers(env *environment) ([]Finding, error) {
+	findings := []Finding{}
+
+	for _, server := range env.servers {
+		vmInfo, ok := env.vms[server]
+		if !ok {
+			continue
+		}
+
+		if finding, ok := checkSharedFolder(vmInfo); ok {
+			findings = append(findings, finding)
+		}
+
+		if finding, ok := checkInstalledSnapshot(vmInfo); ok {
+			findings = append(findings, finding)
+		}
+	}
+
+	return findings, nil
+}
+
+func checkSharedFolder(vmInfo vboxmanage.VMInfo) (Finding, bool) {
+	sharedFolderName := box.GetSharedFolderName()
+	expectedPath := mebroutines.GetMebshareDirectory()
+
+	currentPath := ""
+	for _, sharedFolder := range vmInfo.SharedFolders {
+		if sharedFolder.Name == sharedFolderName {
+			currentPath = sharedFolder.HostPath
+		}
+	}
+
+	if currentPath != "" && filepath.Clean(currentPath) == filepath.Clean(expectedPath) {
+		return Finding{}, false
+	}
+
+	description := xlate.Get("Server %s does not share the folder %s", vmInfo.Name, expectedPath)
+	if currentPath != "" {
+		description = xlate.Get("Server %s shares the folder %s instead of %s", vmInfo.Name, currentPath, expectedPath)
+	}
+
+	return Finding{
+		Kind:           KindSharedFolderMismatch,
+		Path:           vmInfo.Name,
+		Description:    description,
+		FixDescription: xlate.Get("Share %s with the server (the server settings are backed up)", expectedPath),
+		fix: func() error {
+			_, err := vboxmanage.BackupConfigFile(vmInfo.SettingsFile)
+			if err != nil {
+				return err
+			}
+
+			if !mebroutines.ExistsDir(expectedPath) {
+				err = mebroutines.CreateDir(expectedPath)
+				if err != nil {
+					return err
+				}
+			}
+
+			commands := []vboxmanage.VBoxCommand{}
+			if currentPath != "" {
+				commands = append(commands, vboxmanage.VBoxCommand{"sharedfolder", "remove", vmInfo.Name, "--name", sharedFolderName})
+			}
+			commands = append(commands, vboxmanage.VBoxCommand{"sharedfolder", "add", vmInfo.Name, "--name", sharedFolderName, "--hostpath", expectedPath})
+
+			return vboxmanage.RunCommands(commands)
+		},
+	}, true
+}
+
+func checkInstalledSnapshot(vmInfo vboxmanage.VMInfo) (Finding, bool) {
+	snapshotName := box.GetInstalledSnapshotName()
+
+	for _, snapshot := range vmInfo.Snapshots {
+		if snapshot.Name == snapshotName {
+			return Finding{}, false
+		}
+	}
+
+	return Finding{
+		Kind:           KindMissingSnapshot,
+		Path:           vmInfo.Name,
+		Description:    xlate.Get("Server %s does not have the snapshot '%s' which is needed for removing exams", vmInfo.Name, snapshotName),
+		FixDescription: xlate.Get("Take the snapshot of the current state of the server. Removing exams will return the server to this state (the server settings are backed up)."),
+		fix: func() error {
+			_, err := vboxmanage.BackupConfigFile(vmInfo.SettingsFile)
+			if err != nil {
+				return err
+			}
+
+			_, err = vboxmanage.RunCommand(vboxmanage.VBoxCommand{"snapshot", vmInfo.Name, "take", snapshotName})
+			return err
+		},
+	}, true
+}
@@ -0,0 +1,52 @@
+package doctor
+
+import (
+	"reflect"
+	"testing"
+
+	"naksu/box/vboxmanage"
+)
+
+func TestGetHardDisksInUse(t *testing.T) {
+	env := &environment{
+		virtualBoxConfig: vboxmanage.VirtualBoxConfig{
+			HardDisks: []vboxmanage.RegisteredHardDisk{
+				{UUID: "base", Location: "/ktp/base.vdi", HasChildren: true},
+				{UUID: "diff1", Location: "/vms/Snapshots/diff1.vdi", ParentUUID: "base", HasChildren: true},
+				{UUID: "diff2", Location: "/vms/Snapshots/diff2.vdi", ParentUUID: "diff1"},
+				{UUID: "attached-by-location", Location: "/ktp/other.vdi"},
+				{UUID: "orphan", Location: "/ktp/orphan.vdi"},
+			},
+		},
+		attachedUUIDs:     map[string]bool{"diff2": true},
+		attachedLocations: map[string]bool{"/ktp/other.vdi": true},
+	}
+
+	inUse := getHardDisksInUse(env)
+	expected := map[string]bool{"base": true, "diff1": true, "diff2": true, "attached-by-location": true}
+
+	if !reflect.DeepEqual(inUse, expected) {
+		t.Errorf("getHardDisksInUse gives %v, expected %v", inUse, expected)
+	}
+}
+
+func TestGetDuplicateUUIDs(t *testing.T) {
+	tables := []struct {
+		hardDisks      []vboxmanage.RegisteredHardDisk
+		inUse          map[string]bool
+		duplicateUUIDs []string
+	}{
+		{[]vboxmanage.RegisteredHardDisk{{UUID: "a"}}, map[string]bool{}, nil},
+		{[]vboxmanage.RegisteredHardDisk{{UUID: "a"}, {UUID: "b"}, {UUID: "c"}}, map[string]bool{}, []string{"b", "c"}},
+		{[]vboxmanage.RegisteredHardDisk{{UUID: "a"}, {UUID: "b"}}, map[string]bool{"b": true}, []string{"a"}},
+		{[]vboxmanage.RegisteredHardDisk{{UUID: "a"}, {UUID: "b", HasChildren: true}}, map[string]bool{}, []string{}},
+		{[]vboxmanage.RegisteredHardDisk{{UUID: "a"}, {UUID: "b"}}, map[string]bool{"a": true, "b": true}, []string{}},
+	}
+
+	for _, table := range tables {
+		duplicateUUIDs := getDuplicateUUIDs(table.hardDisks, table.inUse)
+		if !reflect.DeepEqual(duplicateUUIDs, table.duplicateUUIDs) {
+			t.Errorf("getDuplicateUUIDs(%+v, %v) gives %v, expected %v", table.hardDisks, table.inUse, duplicateUUIDs, table.duplicateUUIDs)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package doctor diagnoses and repairs the VirtualBox environment of the exam
+// servers: the media registry, leftover disk images and VM settings files, and
+// the shared folder and snapshot of each server.
+package doctor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"naksu/box"
+	"naksu/box/vboxmanage"
+	"naksu/config"
+	"naksu/log"
+	"naksu/mebroutines"
+)
+
+// Kind is the type of a problem found by Diagnose()
+type Kind string
+
+// Problems recognised by Diagnose()
+const (
+	// KindInaccessibleMedium is a disk image in the media registry whose file is missing
+	KindInaccessibleMedium Kind = "inaccessible-medium"
+	// KindOrphanedMedium is a disk image in ~/ktp which is registered but not used by any VM
+	KindOrphanedMedium Kind = "orphaned-medium"
+	// KindDuplicateMedium is a disk image registered several times with different UUIDs
+	KindDuplicateMedium Kind = "duplicate-medium"
+	// KindLeftoverFile is a raw image or a disk image in ~/ktp which is not used
+	KindLeftoverFile Kind = "leftover-file"
+	// KindStaleSettingsFile is a .vbox-prev file whose .vbox file is missing
+	KindStaleSettingsFile Kind = "stale-settings-file"
+	// KindTrashVMDirectory is a VM directory containing only settings files of a removed VM
+	KindTrashVMDirectory Kind = "trash-vm-directory"
+	// KindSharedFolderMismatch is a server whose shared folder is not ktp-jako
+	KindSharedFolderMismatch Kind = "shared-folder-mismatch"
+	// KindMissingSnapshot is a server without the snapshot used for removing exams
+	KindMissingSnapshot Kind = "missing-snapshot"
+)
+
+// Finding is a problem found by Diagnose()
+type Finding struct {
+	Kind Kind
+	// Path is the file, directory or VM the finding is about
+	Path string
+	// Description is a translated description of the problem
+	Description string
+	// FixDescription is a translated description of what Fix() does
+	FixDescription string
+	fix            func() error
+}
+
+// Fix repairs the problem. Configuration files are backed up before they are changed.
+func (f Finding) Fix() error {
+	log.Action("Fixing %s: %s", f.Kind, f.Path)
+
+	err := f.fix()
+	vboxmanage.ResetVBoxResponseCache()
+
+	if errors.Is(err, vboxmanage.ErrSessionLocked) {
+		return fmt.Errorf("the server is running, please stop it first: %w", err)
+	}
+
+	return err
+}
+
+// environment is the state of VirtualBox shared by the checks
+type environment struct {
+	virtualBoxConfig vboxmanage.VirtualBoxConfig
+	// vms are the registered VMs by name
+	vms map[string]vboxmanage.VMInfo
+	// servers are the names of the registered naksu VMs
+	servers []string
+	// attachedUUIDs and attachedLocations are the disk images attached to the VMs
+	attachedUUIDs     map[string]bool
+	attachedLocations map[string]bool
+}
+
+// check returns the problems of one part of the environment
+type check func(env *environment) ([]Finding, error)
+
+var checks = []check{
+	checkMediaRegistry,
+	checkLeftoverFiles,
+	checkVMDirectories,
+	checkServers,
+}
+
+// Diagnose checks the VirtualBox environment and returns the problems found, if any
+func Diagnose() ([]Finding, error) {
+	if config.GetHypervisor() == "qemu" {
+		return nil, errors.New("only the virtualbox environment can be diagnosed")
+	}
+
+	vboxmanage.ResetVBoxResponseCache()
+
+	env, err := readEnvironment()
+	if err != nil {
+		return nil, err
+	}
+
+	findings := []Finding{}
+
+	for _, check := range checks {
+		checkFindings, err := check(env)
+		if err != nil {
+			return nil, err
+		}
+
+		findings = append(findings, checkFindings...)
+	}
+
+	for _, finding := range findings {
+		log.Debug("Doctor found %s: %s", finding.Kind, finding.Path)
+	}
+
+	return findings, nil
+}
+
+// readEnvironment reads the media registry and the settings of the registered VMs
+func readEnvironment() (*environment, error) {
+	virtualBoxConfig, err := vboxmanage.ReadVirtualBoxConfig()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	env := &environment{
+		virtualBoxConfig:  virtualBoxConfig,
+		vms:               map[string]vboxmanage.VMInfo{},
+		servers:           []string{},
+		attachedUUIDs:     map[string]bool{},
+		attachedLocations: map[string]bool{},
+	}
+
+	vmNames, err := vboxmanage.ListVMs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, vmName := range vmNames {
+		vmInfo, err := vboxmanage.GetVMInfo(vmName)
+		if err != nil {
+			return nil, fmt.Errorf("could not get info of vm %s: %v", vmName, err)
+		}
+
+		env.vms[vmName] = vmInfo
+
+		for _, attachment := range vmInfo.StorageAttachments {
+			env.attachedUUIDs[attachment.ImageUUID] = true
+			env.attachedLocations[filepath.Clean(attachment.Medium)] = true
+		}
+	}
+
+	boxes, err := box.ListBoxes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, boxInfo := range boxes {
+		env.servers = append(env.servers, boxInfo.Name)
+	}
+
+	return env, nil
+}
+
+// isInKtpDirectory returns true if the file is inside ~/ktp
+func isInKtpDirectory(path string) bool {
+	relativePath, err := filepath.Rel(mebroutines.GetKtpDirectory(), path)
+
+	return err == nil && !strings.HasPrefix(relativePath, "..")
+}
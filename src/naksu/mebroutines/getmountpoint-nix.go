@@ -0,0 +1,42 @@
+// +build linux darwin
+
+package mebroutines
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+)
+
+// getMountPoint walks up from the existing path until the parent is on another device
+func getMountPoint(path string) (string, error) {
+	device, err := getDevice(path)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path, nil
+		}
+
+		parentDevice, err := getDevice(parent)
+		if err != nil || parentDevice != device {
+			return path, nil
+		}
+
+		path = parent
+	}
+}
+
+func getDevice(path string) (uint64, error) {
+	var stat syscall.Stat_t
+
+	err := syscall.Stat(path, &stat)
+	if err != nil {
+		return 0, fmt.Errorf("could not stat %s: %v", path, err)
+	}
+
+	return uint64(stat.Dev), nil // nolint: unconvert
+}
@@ -0,0 +1,18 @@
+// +build windows
+
+package mebroutines
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// getMountPoint returns the drive (e.g. C:\) of the existing path
+func getMountPoint(path string) (string, error) {
+	volume := filepath.VolumeName(path)
+	if volume == "" {
+		return "", fmt.Errorf("could not detect drive of path %s", path)
+	}
+
+	return volume + `\`, nil
+}
@@ -0,0 +1,41 @@
+package mebroutines
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// GetMountPoint returns the root directory of the file system containing the path
+// (e.g. /home or C:\). Paths on the same file system have the same mount point.
+// The path does not have to exist yet.
+func GetMountPoint(path string) (string, error) {
+	existingPath, err := getExistingAncestor(path)
+	if err != nil {
+		return "", err
+	}
+
+	return getMountPoint(existingPath)
+}
+
+// getExistingAncestor returns the absolute path or its closest existing parent directory
+func getExistingAncestor(path string) (string, error) {
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("could not get absolute path of %s: %v", path, err)
+	}
+
+	for {
+		_, err := os.Stat(absolutePath)
+		if err == nil {
+			return absolutePath, nil
+		}
+
+		parent := filepath.Dir(absolutePath)
+		if parent == absolutePath {
+			return "", fmt.Errorf("no parent directory of %s exists", path)
+		}
+
+		absolutePath = parent
+	}
+}
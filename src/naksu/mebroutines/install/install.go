@@ -5,18 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
 	"regexp"
 
 	"naksu/box"
 	"naksu/box/download"
 	"naksu/constants"
-	"naksu/host"
 	"naksu/log"
 	"naksu/mebroutines"
 	"naksu/ui/progress"
-
-	humanize "github.com/dustin/go-humanize"
+	"naksu/xlate"
 )
 
 // newServer downloads and creates new Abitti or Exam server using the given image URL
@@ -32,6 +29,32 @@ func newServer(boxType string, imageURL string, versionURL string) error {
 		return fmt.Errorf("error from server: %v", err)
 	}
 
+	imageSize, err := download.GetServerImageSize(imageURL, version)
+	if err != nil {
+		// The disk space needed by the download is checked again after downloading
+		log.Warning("Could not get size of the server image, checking disk space after downloading: %v", err)
+	}
+
+	err = installServer(boxType, version, imageSize, func(updateProgressFunc func(string, int)) (io.ReadCloser, uint64, error) {
+		updateProgressFunc("Getting Image from the Cloud", 100*(1/3))
+		err := download.GetServerImage(imageURL, version, updateProgressFunc)
+		if err != nil {
+			return nil, 0, fmt.Errorf("downloading image failed: %w", err)
+		}
+
+		updateProgressFunc("Creating New VM", 100*(2/3))
+		return download.OpenServerImage(imageURL, version, updateProgressFunc)
+	})
+
+	download.CollectImageCacheGarbage()
+
+	return err
+}
+
+// installServer creates a new server from the raw disk image returned by getImage.
+// The disk space is checked before getting the image using imageSize and again with
+// the actual size of the image before creating the server.
+func installServer(boxType string, version string, imageSize download.ImageSize, getImage func(func(string, int)) (io.ReadCloser, uint64, error)) error {
 	// Clean message
 	progress.SetMessage("")
 
@@ -44,40 +67,47 @@ func newServer(boxType string, imageURL string, versionURL string) error {
 	}
 
 	// Check prerequisites
-	if ensureServerIsNotRunningAndDoesNotExist() != nil || ensureDiskIsReady(&progressDialog) != nil {
+	if ensureServerIsNotRunning() != nil || ensureDiskIsReady(&progressDialog) != nil {
 		progress.CloseProgressDialog(progressDialog)
 		return errors.New("server exists or disk is not ready")
 	}
 
-	updateProgressFunc("Getting Image from the Cloud", 100*(1/3))
-	err = download.GetServerImage(imageURL, updateProgressFunc)
+	err := ensureFreeDisk(getInstallDiskSpace(version, imageSize))
 	if err != nil {
 		progress.CloseProgressDialog(progressDialog)
-		mebroutines.ShowTranslatedErrorMessage("Failed to get new VM image: %v", err)
-		return fmt.Errorf("downloading image failed: %v", err)
+		return err
 	}
 
-	updateProgressFunc("Creating New VM", 100*(2/3))
-	err = box.CreateNewBox(boxType, version)
-
+	image, rawImageSize, err := getImage(updateProgressFunc)
 	if err != nil {
-		mebroutines.ShowTranslatedErrorMessage("Failed to create new VM: %v", err)
+		progress.CloseProgressDialog(progressDialog)
+		mebroutines.ShowTranslatedErrorMessage("Failed to get new VM image: %v", err)
+		return err
+	}
 
-		removeErr := os.Remove(mebroutines.GetImagePath())
-		if removeErr != nil {
-			log.Debug("Failed to remove image file %s: %v", mebroutines.GetImagePath(), removeErr)
-		}
+	err = ensureFreeDisk(box.GetNewBoxDiskSpace(version, rawImageSize))
+	if err != nil {
+		_ = image.Close()
 		progress.CloseProgressDialog(progressDialog)
-		return fmt.Errorf("failed to create new vm: %v", err)
+		return err
 	}
 
-	updateProgressFunc("Removing temporary raw image file", 100)
-	err = os.Remove(mebroutines.GetImagePath())
+	err = box.CreateNewBox(boxType, version, image, rawImageSize)
+
+	closeErr := image.Close()
+	if closeErr != nil {
+		log.Debug(fmt.Sprintf("Failed to close server image: %v", closeErr))
+	}
 
 	if err != nil {
 		progress.CloseProgressDialog(progressDialog)
-		mebroutines.ShowTranslatedWarningMessage("Failed to remove raw image file %s: %v", mebroutines.GetImagePath(), err)
+		mebroutines.ShowErrorMessage(box.AddErrorAdvice(xlate.Get("Failed to create new VM: %v", err), err))
+		return fmt.Errorf("failed to create new vm: %w", err)
 	}
+
+	removeOldServers()
+
+	updateProgressFunc(xlate.Get("Uncompressing finished"), 100)
 	progress.CloseProgressDialog(progressDialog)
 	return nil
 }
@@ -96,8 +126,80 @@ func NewExamServer(passphrase string) error {
 	return newServer(constants.MatriculationExamBoxType, imageURL, versionURL)
 }
 
-func ensureServerIsNotRunningAndDoesNotExist() error {
-	isRunning, errRunning := box.Running()
+// NewServerFromFile installs a new server of the given type from a local etcher zip,
+// raw disk image or USB stick written with Etcher. If version is empty it is read
+// from the image (see download.GetLocalImageVersion()).
+func NewServerFromFile(boxType string, imagePath string, version string) error {
+	if boxType != constants.AbittiBoxType && boxType != constants.MatriculationExamBoxType {
+		return fmt.Errorf("unknown server type '%s'", boxType)
+	}
+
+	// The version is a part of the VM name and the disk image path
+	givenVersion := version
+	version = download.SanitizeBoxVersionString(version)
+	if givenVersion != "" && version == "" {
+		return fmt.Errorf("version '%s' does not contain any allowed characters", givenVersion)
+	}
+
+	if version == "" {
+		var err error
+		version, err = download.GetLocalImageVersion(imagePath)
+		if err != nil {
+			mebroutines.ShowTranslatedErrorMessage("Could not find the version of the server image. Please place the .ver file next to the image or give the version.")
+			return fmt.Errorf("could not get version of %s: %v", imagePath, err)
+		}
+	}
+
+	log.Debug(fmt.Sprintf("Installing %s server version %s from %s", boxType, version, imagePath))
+
+	imageSize, err := download.GetLocalImageSize(imagePath)
+	if err != nil {
+		log.Warning("Could not get size of %s, checking disk space after opening it: %v", imagePath, err)
+	}
+
+	return installServer(boxType, version, imageSize, func(updateProgressFunc func(string, int)) (io.ReadCloser, uint64, error) {
+		updateProgressFunc("Creating New VM", 100*(2/3))
+		image, imageSize, err := download.OpenLocalImage(imagePath, updateProgressFunc)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if imageSize > box.GetDiskSize() {
+			_ = image.Close()
+			return nil, 0, fmt.Errorf("image size %d bytes exceeds the server disk size %d bytes", imageSize, box.GetDiskSize())
+		}
+
+		return image, imageSize, nil
+	})
+}
+
+// RecoverInterruptedInstall finishes or rolls back an install interrupted e.g. by a
+// power loss (see box.RecoverInterruptedInstall()) and tells the user what was done
+func RecoverInterruptedInstall() error {
+	recovered, err := box.RecoverInterruptedInstall()
+	if err != nil {
+		mebroutines.ShowTranslatedErrorMessage("Could not clean up the interrupted installation of the server: %v", err)
+		return err
+	}
+
+	switch {
+	case recovered == nil:
+	case recovered.Resumed:
+		// Only an install replaces the old servers, a restored backup is kept next to them
+		if !recovered.Restore {
+			removeOldServers()
+		}
+
+		mebroutines.ShowTranslatedInfoMessage("The installation of server %s interrupted earlier has been finished.", recovered.Version)
+	default:
+		mebroutines.ShowTranslatedInfoMessage("The installation of server %s interrupted earlier has been cleaned up. Please install the server again.", recovered.Version)
+	}
+
+	return nil
+}
+
+func ensureServerIsNotRunning() error {
+	isRunning, errRunning := box.IsAnyBoxRunning()
 	if errRunning != nil {
 		mebroutines.ShowTranslatedErrorMessage("Could not install server as we could not detect whether existing VM is running: %v", errRunning)
 		return errRunning
@@ -108,20 +210,16 @@ func ensureServerIsNotRunningAndDoesNotExist() error {
 		return errors.New("please stop the current server before installing a new one")
 	}
 
-	isInstalled, errInstalled := box.Installed()
-	if errInstalled != nil {
-		mebroutines.ShowTranslatedErrorMessage("Could not install server as we could not detect whether existing VM is installed: %v", errInstalled)
-		return errInstalled
-	}
+	return nil
+}
 
-	if isInstalled {
-		errRemove := box.RemoveCurrentBox()
-		if errRemove != nil {
-			mebroutines.ShowTranslatedWarningMessage("Could not remove current VM before installing new one: %v", errRemove)
-		}
+// removeOldServers removes the servers replaced by the newly installed active server
+// leaving the previous version for a rollback
+func removeOldServers() {
+	errRemove := box.RemoveOldBoxes()
+	if errRemove != nil {
+		mebroutines.ShowTranslatedWarningMessage("Could not remove old VM after installing new one: %v", errRemove)
 	}
-
-	return nil
 }
 
 func ensureDiskIsReady(dialog *progress.Dialog) error {
@@ -132,13 +230,6 @@ func ensureDiskIsReady(dialog *progress.Dialog) error {
 		return err
 	}
 
-	err = ensureFreeDisk()
-	if err != nil {
-		log.Debug(fmt.Sprintf("Failed to ensure we have enough free disk: %v", err))
-		mebroutines.ShowTranslatedErrorMessage("Could not calculate free disk size: %v", err)
-		return err
-	}
-
 	return nil
 }
 
@@ -174,20 +265,19 @@ func ensureNaksuDirectoriesExist(dialog *progress.Dialog) error {
 	return nil
 }
 
-func ensureFreeDisk() error {
-	err := host.CheckFreeDisk(constants.LowDiskLimit, []string{mebroutines.GetKtpDirectory(), mebroutines.GetVirtualBoxHiddenDirectory(), mebroutines.GetVirtualBoxVMsDirectory()})
+// ensureFreeDisk checks that the file systems have the disk space needed in the
+// directories (see checkDiskSpace()) and tells the user if they do not
+func ensureFreeDisk(needs map[string]uint64) error {
+	err := checkDiskSpace(needs)
 
-	if err != nil {
-		if err, ok := err.(*host.LowDiskSizeError); ok {
-			// We just inform the user instead of returning an error
-			mebroutines.ShowTranslatedWarningMessage("Your free disk size is getting low (%s)", humanize.Bytes(err.LowSize))
-		} else {
-			mebroutines.ShowTranslatedErrorMessage("Failed to calculate free disk space: %v", err)
-			return err
-		}
+	var spaceErr *InsufficientDiskSpaceError
+	if errors.As(err, &spaceErr) {
+		log.Debug(fmt.Sprintf("Not enough disk space for installing the server: %v", err))
+		mebroutines.ShowTranslatedErrorMessage("There is not enough disk space for the server: it needs %s on %s and there is %s free. Free up disk space e.g. with \"Disk Usage...\" and try again.", formatGigabytes(spaceErr.Needed), spaceErr.MountPoint, formatGigabytes(spaceErr.Free))
+		return fmt.Errorf("not enough disk space: %w", err)
 	}
 
-	return nil
+	return err
 }
 
 func createKtpDir() (string, error) {
@@ -0,0 +1,105 @@
+package install
+
+import (
+	"fmt"
+	"sort"
+
+	"naksu/box"
+	"naksu/box/download"
+	"naksu/log"
+	"naksu/mebroutines"
+)
+
+// InsufficientDiskSpaceError is returned when a file system does not have enough
+// free space for installing the server
+type InsufficientDiskSpaceError struct {
+	MountPoint string
+	Needed     uint64
+	Free       uint64
+}
+
+func (e *InsufficientDiskSpaceError) Error() string {
+	return fmt.Sprintf("needs %s on %s, %s free", formatGigabytes(e.Needed), e.MountPoint, formatGigabytes(e.Free))
+}
+
+// diskSpaceNeed is the disk space needed on one file system
+type diskSpaceNeed struct {
+	MountPoint string
+	Needed     uint64
+}
+
+// getInstallDiskSpace returns the disk space needed in each directory for downloading
+// the image and creating the server. If the raw image size is not known only the
+// download is accounted for.
+func getInstallDiskSpace(version string, imageSize download.ImageSize) map[string]uint64 {
+	needs := map[string]uint64{}
+	if imageSize.DownloadSize > 0 {
+		needs[download.GetImageCacheDirectory()] = imageSize.DownloadSize
+	}
+
+	if imageSize.RawSize > 0 {
+		for directory, size := range box.GetNewBoxDiskSpace(version, imageSize.RawSize) {
+			needs[directory] += size
+		}
+	}
+
+	return needs
+}
+
+// checkDiskSpace returns an InsufficientDiskSpaceError if a file system does not have
+// the free space needed in its directories. Directories on the same file system (e.g.
+// ~/ktp and the VirtualBox machine folder) share the free space. If the free space
+// cannot be found out the file system is not checked.
+func checkDiskSpace(needs map[string]uint64) error {
+	return findInsufficientDiskSpace(needs, mebroutines.GetMountPoint, mebroutines.GetDiskFree)
+}
+
+func findInsufficientDiskSpace(needs map[string]uint64, getMountPoint func(string) (string, error), getDiskFree func(string) (uint64, error)) error {
+	for _, need := range sumByFileSystem(needs, getMountPoint) {
+		free, err := getDiskFree(need.MountPoint)
+		if err != nil {
+			log.Debug(fmt.Sprintf("Could not get free disk space of %s, not checking it: %v", need.MountPoint, err))
+			continue
+		}
+
+		log.Debug(fmt.Sprintf("Install needs %d bytes on %s, %d bytes free", need.Needed, need.MountPoint, free))
+
+		if free < need.Needed {
+			return &InsufficientDiskSpaceError{MountPoint: need.MountPoint, Needed: need.Needed, Free: free}
+		}
+	}
+
+	return nil
+}
+
+// sumByFileSystem sums the disk space needed in the directories by their file
+// systems. The needs are sorted by the mount point. If the mount point of a directory
+// cannot be found out the directory is its own file system.
+func sumByFileSystem(needs map[string]uint64, getMountPoint func(string) (string, error)) []diskSpaceNeed {
+	sums := map[string]uint64{}
+	for directory, needed := range needs {
+		mountPoint, err := getMountPoint(directory)
+		if err != nil {
+			log.Debug(fmt.Sprintf("Could not get mount point of %s: %v", directory, err))
+			mountPoint = directory
+		}
+
+		sums[mountPoint] += needed
+	}
+
+	fileSystemNeeds := []diskSpaceNeed{}
+	for mountPoint, needed := range sums {
+		fileSystemNeeds = append(fileSystemNeeds, diskSpaceNeed{MountPoint: mountPoint, Needed: needed})
+	}
+
+	sort.Slice(fileSystemNeeds, func(i, j int) bool {
+		return fileSystemNeeds[i].MountPoint < fileSystemNeeds[j].MountPoint
+	})
+
+	return fileSystemNeeds
+}
+
+// formatGigabytes formats bytes as decimal gigabytes with one decimal (e.g. "38.2 GB")
+func formatGigabytes(bytes uint64) string {
+	return fmt.Sprintf("%.1f GB", float64(bytes)/1e9)
+}
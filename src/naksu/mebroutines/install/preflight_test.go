@@ -0,0 +1,114 @@
+package install
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testMountPoints are the mount points of the test directories. The mount point of
+// the directories under /mnt/unknown cannot be found out.
+var testMountPoints = map[string]string{
+	"/home/user/ktp":                 "/home",
+	"/home/user/ktp/image-cache":     "/home",
+	"/home/user/VirtualBox VMs":      "/home",
+	"/data/VirtualBox VMs":           "/data",
+	"/data/VirtualBox VMs/Snapshots": "/data",
+	"/media/usb/ktp/naksu_disk.vdi":  "/media/usb",
+	"/media/usb/VirtualBox VMs":      "/media/usb",
+}
+
+func getTestMountPoint(directory string) (string, error) {
+	mountPoint := testMountPoints[filepath.ToSlash(directory)]
+	if mountPoint == "" {
+		return "", errors.New("unknown mount point")
+	}
+
+	return mountPoint, nil
+}
+
+func TestSumByFileSystem(t *testing.T) {
+	tables := []struct {
+		needs    map[string]uint64
+		expected []diskSpaceNeed
+	}{
+		{
+			map[string]uint64{},
+			[]diskSpaceNeed{},
+		},
+		{
+			map[string]uint64{"/home/user/ktp": 30, "/home/user/VirtualBox VMs": 1, "/home/user/ktp/image-cache": 10},
+			[]diskSpaceNeed{{"/home", 41}},
+		},
+		{
+			map[string]uint64{"/home/user/ktp": 30, "/data/VirtualBox VMs": 1, "/data/VirtualBox VMs/Snapshots": 2},
+			[]diskSpaceNeed{{"/data", 3}, {"/home", 30}},
+		},
+		{
+			map[string]uint64{"/home/user/ktp": 30, "/mnt/unknown/VirtualBox VMs": 1, "/mnt/unknown/ktp/image-cache": 10},
+			[]diskSpaceNeed{{"/home", 30}, {"/mnt/unknown/VirtualBox VMs", 1}, {"/mnt/unknown/ktp/image-cache", 10}},
+		},
+	}
+
+	for _, table := range tables {
+		needs := sumByFileSystem(table.needs, getTestMountPoint)
+		if !reflect.DeepEqual(needs, table.expected) {
+			t.Errorf("sumByFileSystem(%v) gives %v, expected %v", table.needs, needs, table.expected)
+		}
+	}
+}
+
+func TestFindInsufficientDiskSpace(t *testing.T) {
+	free := map[string]uint64{
+		"/home":      21000000000,
+		"/data":      100000000000,
+		"/media/usb": 0,
+	}
+
+	getTestDiskFree := func(mountPoint string) (uint64, error) {
+		if mountPoint == "/media/usb" {
+			return 0, errors.New("no free space information")
+		}
+
+		return free[mountPoint], nil
+	}
+
+	tables := []struct {
+		needs    map[string]uint64
+		expected string
+	}{
+		{
+			map[string]uint64{"/home/user/ktp": 20000000000, "/data/VirtualBox VMs": 90000000000},
+			"",
+		},
+		{
+			map[string]uint64{"/home/user/ktp": 20000000000, "/home/user/VirtualBox VMs": 1000000000},
+			"",
+		},
+		{
+			map[string]uint64{"/home/user/ktp": 30000000000, "/home/user/ktp/image-cache": 8200000000, "/data/VirtualBox VMs": 1000000000},
+			"needs 38.2 GB on /home, 21.0 GB free",
+		},
+		{
+			map[string]uint64{"/home/user/ktp": 1000000000, "/data/VirtualBox VMs": 100000000001},
+			"needs 100.0 GB on /data, 100.0 GB free",
+		},
+		{
+			map[string]uint64{"/media/usb/ktp/naksu_disk.vdi": 30000000000, "/media/usb/VirtualBox VMs": 1000000000},
+			"",
+		},
+	}
+
+	for _, table := range tables {
+		err := findInsufficientDiskSpace(table.needs, getTestMountPoint, getTestDiskFree)
+
+		switch {
+		case table.expected == "" && err != nil:
+			t.Errorf("findInsufficientDiskSpace(%v) gives error %v, expected none", table.needs, err)
+		case table.expected != "" && (err == nil || !strings.Contains(err.Error(), table.expected)):
+			t.Errorf("findInsufficientDiskSpace(%v) gives error %v, expected '%s'", table.needs, err, table.expected)
+		}
+	}
+}
@@ -214,6 +214,11 @@ func GetImagePath() string {
 	return filepath.Join(GetKtpDirectory(), "naksu_last_image.dd")
 }
 
+// GetInstallJournalPath returns the path of the journal of the install in progress
+func GetInstallJournalPath() string {
+	return filepath.Join(GetKtpDirectory(), "naksu_install_journal.json")
+}
+
 // chdir changes current working directory to the given directory
 func chdir(chdirTo string) bool {
 	log.Debug(fmt.Sprintf("chdir %s", chdirTo))
@@ -0,0 +1,51 @@
+package mebroutines
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// percentageWriterTail is the number of bytes kept between writes to catch a
+// percentage split to several writes
+const percentageWriterTail = 32
+
+// percentageRegexp matches "10%" (VBoxManage) and "(10.00/100%)" (qemu-img -p)
+var percentageRegexp = regexp.MustCompile(`(\d+)(?:\.\d+)?(?:/100)?%`)
+
+// percentageWriter implements io.Writer interface (see NewPercentageWriter)
+type percentageWriter struct {
+	buffer             []byte
+	lastPercentage     int
+	progressCallbackFn func(int)
+}
+
+// NewPercentageWriter returns a writer which parses the progress percentages printed by
+// commands like VBoxManage ("0%...10%...20%") and calls progressCallbackFn with the
+// latest percentage of each write when the percentage changes
+func NewPercentageWriter(progressCallbackFn func(int)) io.Writer {
+	return &percentageWriter{lastPercentage: -1, progressCallbackFn: progressCallbackFn}
+}
+
+func (w *percentageWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+
+	matches := percentageRegexp.FindAllSubmatchIndex(w.buffer, -1)
+	if len(matches) > 0 {
+		lastMatch := matches[len(matches)-1]
+
+		percentage, err := strconv.Atoi(string(w.buffer[lastMatch[2]:lastMatch[3]]))
+		if err == nil && percentage <= 100 && percentage != w.lastPercentage {
+			w.lastPercentage = percentage
+			w.progressCallbackFn(percentage)
+		}
+
+		w.buffer = w.buffer[lastMatch[1]:]
+	}
+
+	if len(w.buffer) > percentageWriterTail {
+		w.buffer = w.buffer[len(w.buffer)-percentageWriterTail:]
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,37 @@
+package mebroutines_test
+
+import (
+	"naksu/mebroutines"
+	"reflect"
+	"testing"
+)
+
+func TestPercentageWriter(t *testing.T) {
+	tables := []struct {
+		writes      []string
+		percentages []int
+	}{
+		{[]string{"0%...", "10%...", "20%...", "30%...40%...50%...60%...70%...80%...90%...100%\n"}, []int{0, 10, 20, 100}},
+		{[]string{"0%...1", "0%...", "2", "0%...", "100%\nClone medium created in format 'VMDK'. UUID: 1234\n"}, []int{0, 10, 20, 100}},
+		{[]string{"    (0.00/100%)\r", "    (12.50/100%)\r", "    (12.51/100%)\r", "    (100.00/100%)\r\n"}, []int{0, 12, 100}},
+		{[]string{"VBoxManage: error: Could not find file for the medium\n"}, []int{}},
+	}
+
+	for _, table := range tables {
+		percentages := []int{}
+		writer := mebroutines.NewPercentageWriter(func(percentage int) {
+			percentages = append(percentages, percentage)
+		})
+
+		for _, data := range table.writes {
+			n, err := writer.Write([]byte(data))
+			if n != len(data) || err != nil {
+				t.Errorf("PercentageWriter.Write returns %d, %v for '%s'", n, err, data)
+			}
+		}
+
+		if !reflect.DeepEqual(percentages, table.percentages) {
+			t.Errorf("PercentageWriter reports %v instead of %v for %q", percentages, table.percentages, table.writes)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"naksu/box"
+	"naksu/box/download"
 	"naksu/log"
 	"naksu/mebroutines"
 	"naksu/ui/progress"
@@ -15,7 +16,7 @@ var generalErrorString = xlate.GetRaw("Error while removing server: %v")
 
 // Server removes all directories related to VirtualBox
 func Server() error {
-	isRunning, err := box.Running()
+	isRunning, err := box.IsAnyBoxRunning()
 
 	switch {
 	case err != nil:
@@ -24,10 +25,10 @@ func Server() error {
 		mebroutines.ShowWarningMessage("There is a server appears to be running but we remove it as you requested.")
 	}
 
-	// Remove current box to syncronise running VirtualBox GUI
-	err = box.RemoveCurrentBox()
+	// Remove boxes to syncronise running VirtualBox GUI
+	err = box.RemoveAllBoxes()
 	if err != nil {
-		log.Debug("Got error when removed current box before removing server: %v", err)
+		log.Debug("Got error when removed boxes before removing server: %v", err)
 	}
 
 	// Chdir to home directory to avoid problems with Windows where deleting
@@ -47,5 +48,12 @@ func Server() error {
 		return err
 	}
 
+	progress.TranslateAndSetMessage("Deleting downloaded server images")
+	err = download.PurgeImageCache("")
+	if err != nil {
+		mebroutines.ShowWarningMessage(fmt.Sprintf("Failed to remove directory %s: %v", download.GetImageCacheDirectory(), err))
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,101 @@
+package restore
+
+import (
+	"errors"
+	"fmt"
+
+	"naksu/box"
+	"naksu/constants"
+	"naksu/host"
+	"naksu/log"
+	"naksu/mebroutines"
+	"naksu/mebroutines/backup"
+	"naksu/ui/progress"
+	"naksu/xlate"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+var generalErrorString = xlate.GetRaw("Restoring the backup failed: %v")
+
+// Backup creates a new server of the given type from a backup written by backup.MakeBackup().
+// The version is shown to the user and it may be empty if it is not known. Empty type and
+// version are read from the backup manifest if there is one.
+func Backup(backupPath string, boxType string, boxVersion string) error {
+	manifest, err := backup.ReadManifest(backupPath)
+	if err == nil {
+		if boxType == "" {
+			boxType = manifest.BoxType
+		}
+		if boxVersion == "" {
+			boxVersion = manifest.BoxVersion
+		}
+	} else {
+		log.Debug(fmt.Sprintf("Could not read manifest of backup %s: %v", backupPath, err))
+	}
+
+	if boxType != constants.AbittiBoxType && boxType != constants.MatriculationExamBoxType {
+		return fmt.Errorf("unknown server type '%s', please give the type of the backed up server", boxType)
+	}
+
+	isRunning, err := box.IsAnyBoxRunning()
+	if err != nil {
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(generalErrorString, fmt.Errorf("could not detect whether existing VM is running: %v", err))
+	}
+
+	if isRunning {
+		mebroutines.ShowTranslatedErrorMessage("Please stop the current server before restoring a backup")
+		return errors.New("please stop the current server before restoring a backup")
+	}
+
+	progress.TranslateAndSetMessage("Checking backup file...")
+	if !mebroutines.ExistsFile(backupPath) {
+		mebroutines.ShowTranslatedErrorMessage("File %s does not exist", backupPath)
+		return fmt.Errorf("backup file %s does not exist", backupPath)
+	}
+
+	err = backup.CheckBackupFile(backupPath)
+	if err != nil {
+		mebroutines.ShowTranslatedErrorMessage("The file %s is not a server backup made by naksu: %v", backupPath, err)
+		return fmt.Errorf("not a naksu backup: %v", err)
+	}
+
+	err = ensureDirectoriesExist()
+	if err != nil {
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(generalErrorString, err)
+	}
+
+	err = host.CheckFreeDisk(constants.LowDiskLimit, []string{mebroutines.GetKtpDirectory(), mebroutines.GetVirtualBoxVMsDirectory()})
+	if err != nil {
+		if err, ok := err.(*host.LowDiskSizeError); ok {
+			mebroutines.ShowTranslatedWarningMessage("Your free disk size is getting low (%s)", humanize.Bytes(err.LowSize))
+		} else {
+			log.Debug(fmt.Sprintf("Failed to calculate free disk size: %v", err))
+		}
+	}
+
+	progress.TranslateAndSetMessage("Please wait, restoring backup...")
+	name, err := box.RestoreBox(backupPath, boxType, boxVersion)
+	if err != nil {
+		mebroutines.ShowErrorMessage(box.AddErrorAdvice(xlate.Get(generalErrorString, err), err))
+		return err
+	}
+
+	log.Debug(fmt.Sprintf("Restored backup %s to server %s", backupPath, name))
+
+	return nil
+}
+
+// ensureDirectoriesExist creates ~/ktp for the disk image and ~/ktp-jako for the shared folder
+func ensureDirectoriesExist() error {
+	for _, path := range []string{mebroutines.GetKtpDirectory(), mebroutines.GetMebshareDirectory()} {
+		if !mebroutines.ExistsDir(path) {
+			err := mebroutines.CreateDir(path)
+			if err != nil {
+				return fmt.Errorf("could not create directory %s: %v", path, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package mebroutines
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"naksu/log"
+)
+
+// killWaitTimeout is the time to wait for the output of a killed process to close.
+// Processes started by the killed process may keep the output open.
+const killWaitTimeout = 5 * time.Second
+
+// runWithCombinedOutput works like cmd.CombinedOutput() but it also writes the
+// combined output to output (if not nil) while the command is running. If ctx is
+// cancelled before the command exits the process is killed.
+func runWithCombinedOutput(ctx context.Context, cmd *exec.Cmd, output io.Writer) ([]byte, error) {
+	var combinedOutput bytes.Buffer
+	var writer io.Writer = &combinedOutput
+	if output != nil {
+		writer = io.MultiWriter(&combinedOutput, output)
+	}
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		return combinedOutput.Bytes(), err
+	case <-ctx.Done():
+		log.Debug("Killing process %d (%s): %v", cmd.Process.Pid, cmd.Path, ctx.Err())
+		killErr := killProcess(cmd)
+		if killErr != nil {
+			log.Debug("Could not kill process %d: %v", cmd.Process.Pid, killErr)
+		}
+		select {
+		case <-done:
+			return combinedOutput.Bytes(), fmt.Errorf("process was killed: %w", ctx.Err())
+		case <-time.After(killWaitTimeout):
+			// The output is still being written so it cannot be returned
+			return nil, fmt.Errorf("process was killed but its output was not closed: %w", ctx.Err())
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package mebroutines
 
 import (
+	"context"
+	"io"
 	"os/exec"
 	"strings"
 
@@ -9,14 +11,34 @@ import (
 
 // RunAndGetOutput runs command with arguments and returns output as a string
 func RunAndGetOutput(commandArgs []string, logAction bool) (string, error) {
+	return RunAndGetOutputWithStdin(commandArgs, nil, logAction)
+}
+
+// RunAndGetOutputWithStdin runs command with arguments feeding stdin to its
+// standard input and returns output as a string
+func RunAndGetOutputWithStdin(commandArgs []string, stdin io.Reader, logAction bool) (string, error) {
+	return RunAndGetOutputWithWriter(commandArgs, stdin, nil, logAction)
+}
+
+// RunAndGetOutputWithWriter runs command with arguments feeding stdin to its standard
+// input and returns output as a string. The output is also written to output while
+// the command is running (e.g. to follow its progress). Both stdin and output may be nil.
+func RunAndGetOutputWithWriter(commandArgs []string, stdin io.Reader, output io.Writer, logAction bool) (string, error) {
+	return RunAndGetOutputWithContext(context.Background(), commandArgs, stdin, output, logAction)
+}
+
+// RunAndGetOutputWithContext works like RunAndGetOutputWithWriter() but the command
+// is killed if ctx is cancelled (e.g. its deadline passes) before the command exits
+func RunAndGetOutputWithContext(ctx context.Context, commandArgs []string, stdin io.Reader, output io.Writer, logAction bool) (string, error) {
 	if logAction {
 		log.Debug("RunAndGetOutput: %s", strings.Join(commandArgs, " "))
 	}
 
 	/* #nosec */
 	cmd := exec.Command(commandArgs[0], commandArgs[1:]...)
+	cmd.Stdin = stdin
 
-	out, err := cmd.CombinedOutput()
+	out, err := runWithCombinedOutput(ctx, cmd, output)
 
 	if err != nil {
 		log.Debug("command failed: %s (%v)", strings.Join(commandArgs, " "), err)
@@ -33,3 +55,8 @@ func RunAndGetOutput(commandArgs []string, logAction bool) (string, error) {
 
 	return string(out), err
 }
+
+// killProcess kills the command
+func killProcess(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,28 @@
+package mebroutines
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunAndGetOutputWithContext(t *testing.T) {
+	output, err := RunAndGetOutputWithContext(context.Background(), []string{"echo", "hello"}, nil, nil, false)
+	if err != nil || output != "hello\n" {
+		t.Errorf("echo gives output %q and error %v", output, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	_, err = RunAndGetOutputWithContext(ctx, []string{"sleep", "10"}, nil, nil, false)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("killed sleep gives error %v", err)
+	}
+
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("sleep was not killed")
+	}
+}
@@ -1,9 +1,12 @@
 package mebroutines
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -22,6 +25,25 @@ func quoteWindowsCommandArgs(args []string) []string {
 
 // RunAndGetOutput runs command with arguments and returns output as a string
 func RunAndGetOutput(origCommandArgs []string, logAction bool) (string, error) {
+	return RunAndGetOutputWithStdin(origCommandArgs, nil, logAction)
+}
+
+// RunAndGetOutputWithStdin runs command with arguments feeding stdin to its
+// standard input and returns output as a string
+func RunAndGetOutputWithStdin(origCommandArgs []string, stdin io.Reader, logAction bool) (string, error) {
+	return RunAndGetOutputWithWriter(origCommandArgs, stdin, nil, logAction)
+}
+
+// RunAndGetOutputWithWriter runs command with arguments feeding stdin to its standard
+// input and returns output as a string. The output is also written to output while
+// the command is running (e.g. to follow its progress). Both stdin and output may be nil.
+func RunAndGetOutputWithWriter(origCommandArgs []string, stdin io.Reader, output io.Writer, logAction bool) (string, error) {
+	return RunAndGetOutputWithContext(context.Background(), origCommandArgs, stdin, output, logAction)
+}
+
+// RunAndGetOutputWithContext works like RunAndGetOutputWithWriter() but the command
+// is killed if ctx is cancelled (e.g. its deadline passes) before the command exits
+func RunAndGetOutputWithContext(ctx context.Context, origCommandArgs []string, stdin io.Reader, output io.Writer, logAction bool) (string, error) {
 	windowsComSpec := os.Getenv("ComSpec")
 	if windowsComSpec == "" {
 		windowsComSpec = "C:\\Windows\\system32\\cmd.exe"
@@ -38,8 +60,9 @@ func RunAndGetOutput(origCommandArgs []string, logAction bool) (string, error) {
 	cmd := exec.Command(windowsComSpec)
 	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
 	cmd.SysProcAttr.CmdLine = strings.Join(escapedCommandArgs, " ")
+	cmd.Stdin = stdin
 
-	out, err := cmd.CombinedOutput()
+	out, err := runWithCombinedOutput(ctx, cmd, output)
 
 	if err != nil {
 		log.Debug("command failed: %s (%v)", strings.Join(escapedCommandArgs, " "), err)
@@ -56,3 +79,18 @@ func RunAndGetOutput(origCommandArgs []string, logAction bool) (string, error) {
 
 	return string(out), err
 }
+
+// killProcess kills the command and its child processes. The command is run by
+// cmd.exe so killing only cmd.exe would leave the actual program running.
+func killProcess(cmd *exec.Cmd) error {
+	// #nosec
+	taskkill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
+	taskkill.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	err := taskkill.Run()
+	if err != nil {
+		log.Debug("taskkill failed, killing only process %d: %v", cmd.Process.Pid, err)
+		return cmd.Process.Kill()
+	}
+
+	return nil
+}
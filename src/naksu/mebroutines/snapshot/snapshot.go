@@ -0,0 +1,103 @@
+package snapshot
+
+import (
+	"errors"
+
+	"naksu/box"
+	"naksu/log"
+	"naksu/mebroutines"
+	"naksu/ui/progress"
+	"naksu/xlate"
+)
+
+var (
+	takeErrorString    = xlate.GetRaw("Failed to take snapshot: %v")
+	restoreErrorString = xlate.GetRaw("Failed to restore snapshot: %v")
+	deleteErrorString  = xlate.GetRaw("Failed to delete snapshot: %v")
+)
+
+// Take takes a named snapshot of the stopped server
+func Take(snapshotName string) error {
+	err := ensureBoxInstalledAndNotRunning()
+	if err != nil {
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(takeErrorString, err)
+	}
+
+	progress.TranslateAndSetMessage("Taking snapshot %s...", snapshotName)
+
+	err = box.TakeSnapshot(snapshotName)
+	if err != nil {
+		log.Debug("Could not take snapshot %s: %v", snapshotName, err)
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(takeErrorString, err)
+	}
+
+	progress.SetMessage("")
+
+	return nil
+}
+
+// Restore returns the stopped server to the given snapshot. Exams, responses and logs
+// saved after the snapshot will be lost.
+func Restore(snapshotName string) error {
+	err := ensureBoxInstalledAndNotRunning()
+	if err != nil {
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(restoreErrorString, err)
+	}
+
+	progress.TranslateAndSetMessage("Restoring snapshot %s. This takes a while.", snapshotName)
+
+	err = box.RestoreSnapshotByName(snapshotName)
+	if err != nil {
+		log.Debug("Could not restore snapshot %s: %v", snapshotName, err)
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(restoreErrorString, err)
+	}
+
+	progress.SetMessage("")
+
+	return nil
+}
+
+// Delete deletes the given snapshot of the stopped server
+func Delete(snapshotName string) error {
+	err := ensureBoxInstalledAndNotRunning()
+	if err != nil {
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(deleteErrorString, err)
+	}
+
+	progress.TranslateAndSetMessage("Deleting snapshot %s. This takes a while.", snapshotName)
+
+	err = box.DeleteSnapshot(snapshotName)
+	if err != nil {
+		log.Debug("Could not delete snapshot %s: %v", snapshotName, err)
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(deleteErrorString, err)
+	}
+
+	progress.SetMessage("")
+
+	return nil
+}
+
+// ensureBoxInstalledAndNotRunning makes the same checks as destroy.Server()
+func ensureBoxInstalledAndNotRunning() error {
+	isInstalled, err := box.Installed()
+	if err != nil {
+		log.Debug("Could not detect whether existing VM is installed: %v", err)
+		return errors.New("could not detect whether there is an existing vm installed")
+	}
+
+	if !isInstalled {
+		return errors.New("there is no vm installed")
+	}
+
+	isRunning, err := box.Running()
+	if err != nil {
+		log.Debug("Could not detect whether existing VM is running: %v", err)
+		return errors.New("could not detect whether there is existing vm running")
+	}
+
+	if isRunning {
+		return errors.New("the vm is running, please stop it first")
+	}
+
+	return nil
+}
@@ -27,20 +27,31 @@ func Server() error {
 		return errors.New("no server has been installed")
 	}
 
-	isRunning, err := box.Running()
+	state, err := box.GetState()
 	if err != nil {
-		mebroutines.ShowErrorMessage(fmt.Sprintf("Could not start server as we could not detect whether existing VM is running: %v", err))
-		return fmt.Errorf("could not detect whether the server is running: %v", err)
+		mebroutines.ShowErrorMessage(fmt.Sprintf("Could not start server as we could not detect the state of the existing VM: %v", err))
+		return fmt.Errorf("could not detect the state of the server: %v", err)
 	}
 
-	if isRunning {
+	switch {
+	case state == box.VMStateRunning:
 		mebroutines.ShowErrorMessage("The server is already running.")
 		return errors.New("the server is already running")
+	case state.NeedsPowerOff():
+		mebroutines.ShowTranslatedErrorMessage("The server is not responding. Use \"Power Off Server\" and start the server again.")
+		return fmt.Errorf("the server is %s", state)
+	case state.HasSavedState():
+		mebroutines.ShowTranslatedErrorMessage("The server has a saved state. Use \"Discard Saved State\" and start the server again.")
+		return fmt.Errorf("the server is %s", state)
+	case state.IsRunning():
+		mebroutines.ShowTranslatedErrorMessage("The server is busy (%s). Please try again in a moment.", state)
+		return fmt.Errorf("the server is %s", state)
 	}
 
 	err = box.StartCurrentBox()
 	if err != nil {
-		return mebroutines.ShowTranslatedErrorMessageAndPassError(generalErrorString, err)
+		mebroutines.ShowErrorMessage(box.AddErrorAdvice(xlate.Get(generalErrorString, err), err))
+		return err
 	}
 
 	return nil
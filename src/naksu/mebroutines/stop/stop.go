@@ -0,0 +1,106 @@
+package stop
+
+import (
+	"errors"
+	"time"
+
+	"naksu/box"
+	"naksu/log"
+	"naksu/mebroutines"
+	"naksu/ui/progress"
+	"naksu/xlate"
+)
+
+// shutdownTimeout is the time given to the server to shut down before it is powered off
+const shutdownTimeout = 2 * time.Minute
+
+var (
+	shutdownErrorString     = xlate.GetRaw("Failed to shut down server: %v")
+	powerOffErrorString     = xlate.GetRaw("Failed to power off server: %v")
+	discardStateErrorString = xlate.GetRaw("Failed to discard saved state: %v")
+)
+
+// Server shuts down the running server. If the server does not stop in a couple of
+// minutes it is powered off.
+func Server() error {
+	state, err := getInstalledState()
+	if err != nil {
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(shutdownErrorString, err)
+	}
+
+	if !state.IsRunning() {
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(shutdownErrorString, errors.New("the vm is not running"))
+	}
+
+	progress.TranslateAndSetMessage("Shutting down server...")
+
+	err = box.ShutdownCurrentBox(shutdownTimeout)
+	if err != nil {
+		log.Debug("Could not shut down server: %v", err)
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(shutdownErrorString, err)
+	}
+
+	progress.SetMessage("")
+
+	return nil
+}
+
+// PowerOff turns off the server immediately. This is used to recover paused and stuck
+// servers which cannot be shut down.
+func PowerOff() error {
+	state, err := getInstalledState()
+	if err != nil {
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(powerOffErrorString, err)
+	}
+
+	if !state.IsRunning() {
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(powerOffErrorString, errors.New("the vm is not running"))
+	}
+
+	progress.TranslateAndSetMessage("Powering off server...")
+
+	err = box.PowerOffCurrentBox()
+	if err != nil {
+		log.Debug("Could not power off server: %v", err)
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(powerOffErrorString, err)
+	}
+
+	progress.SetMessage("")
+
+	return nil
+}
+
+// DiscardSavedState discards the saved state of the server so that it boots normally
+// when it is started next time
+func DiscardSavedState() error {
+	_, err := getInstalledState()
+	if err != nil {
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(discardStateErrorString, err)
+	}
+
+	progress.TranslateAndSetMessage("Discarding saved state...")
+
+	err = box.DiscardSavedState()
+	if err != nil {
+		log.Debug("Could not discard saved state: %v", err)
+		return mebroutines.ShowTranslatedErrorMessageAndPassError(discardStateErrorString, err)
+	}
+
+	progress.SetMessage("")
+
+	return nil
+}
+
+func getInstalledState() (box.VMState, error) {
+	state, err := box.GetState()
+	if err != nil {
+		log.Debug("Could not detect the state of the VM: %v", err)
+		return state, errors.New("could not detect the state of the vm")
+	}
+
+	if state == box.VMStateNotInstalled {
+		return state, errors.New("there is no vm installed")
+	}
+
+	return state, nil
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"naksu/box/download"
+	"naksu/log"
+	"naksu/mebroutines"
+	"naksu/xlate"
+)
+
+// Cleanup removes files which naksu does not need. Only files which naksu can
+// download or create again are removed.
+type Cleanup struct {
+	Category Category
+	// Description is a translated description of what Clean() does
+	Description string
+	// Size is the disk space freed by Clean()
+	Size  uint64
+	Files []string
+	clean func() error
+}
+
+// Clean removes the files of the cleanup
+func (c Cleanup) Clean() error {
+	log.Action("Cleaning up %s: %d files, %d bytes", c.Category, len(c.Files), c.Size)
+
+	return c.clean()
+}
+
+// ListCleanups returns the cleanups which free disk space. Cleanups which would not
+// free any space are not returned.
+func ListCleanups() ([]Cleanup, error) {
+	cleanups := []Cleanup{}
+
+	imageCacheFiles, err := findImageCacheFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	cleanups = appendCleanup(cleanups, Cleanup{
+		Category:    CategoryImageCache,
+		Description: xlate.Get("Delete the downloaded server images. They are downloaded again when needed."),
+		Files:       imageCacheFiles,
+		clean: func() error {
+			return download.PurgeImageCache("")
+		},
+	})
+
+	cleanups = appendCleanup(cleanups, Cleanup{
+		Category:    CategoryRawImage,
+		Description: xlate.Get("Delete the uncompressed server images left over from earlier installs"),
+		Files:       findRawImages(),
+	})
+
+	rotatedLogs, err := findRotatedLogs()
+	if err != nil {
+		return nil, err
+	}
+
+	cleanups = appendCleanup(cleanups, Cleanup{
+		Category:    CategoryLog,
+		Description: xlate.Get("Delete the old naksu logs. The current log is kept."),
+		Files:       rotatedLogs,
+	})
+
+	logZips, err := findLogZips()
+	if err != nil {
+		return nil, err
+	}
+
+	cleanups = appendCleanup(cleanups, Cleanup{
+		Category:    CategoryLogZip,
+		Description: xlate.Get("Delete the log zips in ~/ktp-jako"),
+		Files:       logZips,
+	})
+
+	return cleanups, nil
+}
+
+// appendCleanup appends the cleanup if it has any files. Cleanups without a clean
+// function remove their files.
+func appendCleanup(cleanups []Cleanup, cleanup Cleanup) []Cleanup {
+	if len(cleanup.Files) == 0 {
+		return cleanups
+	}
+
+	for _, file := range cleanup.Files {
+		cleanup.Size += getFileSize(file)
+	}
+
+	if cleanup.clean == nil {
+		files := cleanup.Files
+		cleanup.clean = func() error {
+			return removeFiles(files)
+		}
+	}
+
+	return append(cleanups, cleanup)
+}
+
+// findImageCacheFiles returns the cached images and unfinished downloads removed by download.PurgeImageCache()
+func findImageCacheFiles() ([]string, error) {
+	files := []string{}
+	if mebroutines.ExistsFile(mebroutines.GetZipImagePath()) {
+		files = append(files, mebroutines.GetZipImagePath())
+	}
+
+	err := walkFiles(download.GetImageCacheDirectory(), func(relativePath string, size uint64) {
+		files = append(files, filepath.Join(download.GetImageCacheDirectory(), relativePath))
+	})
+
+	return files, err
+}
+
+func removeFiles(files []string) error {
+	for _, file := range files {
+		err := os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove %s: %v", file, err)
+		}
+	}
+
+	return nil
+}
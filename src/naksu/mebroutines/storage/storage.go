@@ -0,0 +1,310 @@
+// Package storage reports the disk space used by naksu and the exam servers and
+// cleans up the files which are not needed.
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"naksu/log"
+	"naksu/mebroutines"
+	"naksu/xlate"
+)
+
+// Category is a group of files using disk space
+type Category string
+
+// Categories reported by GetUsage(), in the order they are reported
+const (
+	// CategoryImageCache is the downloaded server images (zip) in ~/ktp
+	CategoryImageCache Category = "image-cache"
+	// CategoryRawImage is the uncompressed server images in ~/ktp
+	CategoryRawImage Category = "raw-image"
+	// CategoryDiskImage is the server disk images (VDI) in ~/ktp
+	CategoryDiskImage Category = "disk-image"
+	// CategoryLog is the naksu logs in ~/ktp
+	CategoryLog Category = "log"
+	// CategoryOther is the rest of the files in ~/ktp
+	CategoryOther Category = "other"
+	// CategoryVMFolder is the VM settings and logs in the VirtualBox machine folder
+	CategoryVMFolder Category = "vm-folder"
+	// CategorySnapshotDisk is the differencing disks of the snapshots in the machine folder
+	CategorySnapshotDisk Category = "snapshot-disk"
+	// CategoryLogZip is the log zips written to ~/ktp-jako by "Deliver logs"
+	CategoryLogZip Category = "log-zip"
+)
+
+var categories = []Category{
+	CategoryImageCache,
+	CategoryRawImage,
+	CategoryDiskImage,
+	CategoryLog,
+	CategoryOther,
+	CategoryVMFolder,
+	CategorySnapshotDisk,
+	CategoryLogZip,
+}
+
+var (
+	rawImageNames    = []string{"naksu_last_image.dd", "ktp.img"}
+	diskImageRegexp  = regexp.MustCompile(`(?i)\.(vdi|qcow2|vmdk)$`)
+	logRegexp        = regexp.MustCompile(`^naksu_lastlog.*\.txt$`)
+	rotatedLogRegexp = regexp.MustCompile(`^naksu_lastlog-.+\.txt$`)
+	logZipRegexp     = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2}\.zip$`)
+)
+
+// Usage is the disk space used by the files of one category
+type Usage struct {
+	Category Category
+	// Description is a translated description of the category
+	Description string
+	// Directory is where the files of the category are
+	Directory string
+	Size      uint64
+	Files     int
+}
+
+// FreeSpace is the free disk space available for a naksu directory
+type FreeSpace struct {
+	Directory string
+	Free      uint64
+}
+
+// Report is the disk space used and available for naksu
+type Report struct {
+	Usages []Usage
+	// Free is the free space of ~/ktp and the machine folder. Directories on the
+	// same file system have the same free space.
+	Free []FreeSpace
+}
+
+// Total returns the disk space used by all categories
+func (r Report) Total() uint64 {
+	var total uint64
+	for _, usage := range r.Usages {
+		total += usage.Size
+	}
+
+	return total
+}
+
+// GetUsage returns the disk space used by naksu and the servers
+func GetUsage() (Report, error) {
+	usages := map[Category]*Usage{}
+	for _, category := range categories {
+		usages[category] = &Usage{Category: category, Description: getCategoryDescription(category)}
+	}
+
+	usages[CategoryImageCache].Directory = mebroutines.GetKtpDirectory()
+	usages[CategoryRawImage].Directory = mebroutines.GetKtpDirectory()
+	usages[CategoryDiskImage].Directory = mebroutines.GetKtpDirectory()
+	usages[CategoryLog].Directory = mebroutines.GetKtpDirectory()
+	usages[CategoryOther].Directory = mebroutines.GetKtpDirectory()
+	usages[CategoryVMFolder].Directory = mebroutines.GetVirtualBoxVMsDirectory()
+	usages[CategorySnapshotDisk].Directory = mebroutines.GetVirtualBoxVMsDirectory()
+	usages[CategoryLogZip].Directory = mebroutines.GetMebshareDirectory()
+
+	err := walkFiles(mebroutines.GetKtpDirectory(), func(relativePath string, size uint64) {
+		usages[getKtpCategory(relativePath)].add(size)
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	err = walkFiles(mebroutines.GetVirtualBoxVMsDirectory(), func(relativePath string, size uint64) {
+		usages[getVMFolderCategory(relativePath)].add(size)
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	logZips, err := findLogZips()
+	if err != nil {
+		return Report{}, err
+	}
+
+	for _, logZip := range logZips {
+		usages[CategoryLogZip].add(getFileSize(logZip))
+	}
+
+	report := Report{}
+	for _, category := range categories {
+		report.Usages = append(report.Usages, *usages[category])
+	}
+
+	for _, directory := range []string{mebroutines.GetKtpDirectory(), mebroutines.GetVirtualBoxVMsDirectory()} {
+		if !mebroutines.ExistsDir(directory) {
+			continue
+		}
+
+		free, err := mebroutines.GetDiskFree(directory)
+		if err != nil {
+			log.Debug(fmt.Sprintf("Could not get free disk space of %s: %v", directory, err))
+			continue
+		}
+
+		report.Free = append(report.Free, FreeSpace{Directory: directory, Free: free})
+	}
+
+	return report, nil
+}
+
+func (u *Usage) add(size uint64) {
+	u.Size += size
+	u.Files++
+}
+
+// getKtpCategory returns the category of a file in ~/ktp
+func getKtpCategory(relativePath string) Category {
+	relativePath = filepath.ToSlash(relativePath)
+	name := filepath.Base(relativePath)
+
+	switch {
+	case strings.HasPrefix(relativePath, "image-cache/") || name == filepath.Base(mebroutines.GetZipImagePath()):
+		return CategoryImageCache
+	case strings.Contains(relativePath, "/"):
+		// e.g. the settings and logs of qemu VMs
+		return CategoryOther
+	case isRawImageName(name):
+		return CategoryRawImage
+	case diskImageRegexp.MatchString(name):
+		return CategoryDiskImage
+	case logRegexp.MatchString(name):
+		return CategoryLog
+	}
+
+	return CategoryOther
+}
+
+// getVMFolderCategory returns the category of a file in the machine folder
+func getVMFolderCategory(relativePath string) Category {
+	parts := strings.Split(filepath.ToSlash(relativePath), "/")
+
+	// VirtualBox VMs/<vm>/Snapshots/<uuid>.vdi
+	if len(parts) == 3 && parts[1] == "Snapshots" && diskImageRegexp.MatchString(parts[2]) {
+		return CategorySnapshotDisk
+	}
+
+	return CategoryVMFolder
+}
+
+func isRawImageName(name string) bool {
+	for _, rawImageName := range rawImageNames {
+		if name == rawImageName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// walkFiles calls fn for each regular file under the directory. A missing directory
+// is empty.
+func walkFiles(directory string, fn func(relativePath string, size uint64)) error {
+	if !mebroutines.ExistsDir(directory) {
+		return nil
+	}
+
+	return filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files may be removed while walking, e.g. by a running VM
+			log.Debug(fmt.Sprintf("Could not read %s while calculating disk usage: %v", path, err))
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+
+		fn(relativePath, uint64(info.Size()))
+
+		return nil
+	})
+}
+
+// findLogZips returns the log zips written by logdelivery.CollectLogsToZip()
+func findLogZips() ([]string, error) {
+	return findFiles(mebroutines.GetMebshareDirectory(), logZipRegexp)
+}
+
+// findRotatedLogs returns the old naksu logs. The current log is not included.
+func findRotatedLogs() ([]string, error) {
+	return findFiles(mebroutines.GetKtpDirectory(), rotatedLogRegexp)
+}
+
+// findRawImages returns the uncompressed server images in ~/ktp
+func findRawImages() []string {
+	rawImages := []string{}
+	for _, rawImageName := range rawImageNames {
+		path := filepath.Join(mebroutines.GetKtpDirectory(), rawImageName)
+		if mebroutines.ExistsFile(path) {
+			rawImages = append(rawImages, path)
+		}
+	}
+
+	return rawImages
+}
+
+// findFiles returns the regular files in the directory (not in its subdirectories)
+// whose names match the pattern
+func findFiles(directory string, pattern *regexp.Regexp) ([]string, error) {
+	files := []string{}
+
+	if !mebroutines.ExistsDir(directory) {
+		return files, nil
+	}
+
+	fileInfos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory %s: %v", directory, err)
+	}
+
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Mode().IsRegular() && pattern.MatchString(fileInfo.Name()) {
+			files = append(files, filepath.Join(directory, fileInfo.Name()))
+		}
+	}
+
+	return files, nil
+}
+
+func getFileSize(path string) uint64 {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+
+	return uint64(fileInfo.Size())
+}
+
+func getCategoryDescription(category Category) string {
+	switch category {
+	case CategoryImageCache:
+		return xlate.Get("Downloaded server images")
+	case CategoryRawImage:
+		return xlate.Get("Uncompressed server images")
+	case CategoryDiskImage:
+		return xlate.Get("Server disks")
+	case CategoryLog:
+		return xlate.Get("Naksu logs")
+	case CategoryOther:
+		return xlate.Get("Other files in ~/ktp")
+	case CategoryVMFolder:
+		return xlate.Get("Server settings and logs")
+	case CategorySnapshotDisk:
+		return xlate.Get("Server snapshots")
+	case CategoryLogZip:
+		return xlate.Get("Log zips in ~/ktp-jako")
+	}
+
+	return string(category)
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"naksu/mebroutines"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+func TestGetKtpCategory(t *testing.T) {
+	tables := []struct {
+		relativePath string
+		category     Category
+	}{
+		{"image-cache/ktp-etcher-SERVER7108X_v69.zip", CategoryImageCache},
+		{"image-cache/ktp-etcher-SERVER7108X_v69.zip.part", CategoryImageCache},
+		{"naksu_last_image.zip", CategoryImageCache},
+		{"naksu_last_image.dd", CategoryRawImage},
+		{"ktp.img", CategoryRawImage},
+		{"NaksuAbittiKTP-SERVER7108X_v69.vdi", CategoryDiskImage},
+		{"naksu_ktp_disk.vdi", CategoryDiskImage},
+		{"naksu_ktp_disk.qcow2", CategoryDiskImage},
+		{"naksu_lastlog.txt", CategoryLog},
+		{"naksu_lastlog-2020-11-02T10-00-00.000.txt", CategoryLog},
+		{"qemu/NaksuAbittiKTP/vm.json", CategoryOther},
+		{"qemu/NaksuAbittiKTP/old.vdi", CategoryOther},
+		{"notes.txt", CategoryOther},
+	}
+
+	for _, table := range tables {
+		category := getKtpCategory(filepath.FromSlash(table.relativePath))
+		if category != table.category {
+			t.Errorf("getKtpCategory(%s) gives %s, expected %s", table.relativePath, category, table.category)
+		}
+	}
+}
+
+func TestGetVMFolderCategory(t *testing.T) {
+	tables := []struct {
+		relativePath string
+		category     Category
+	}{
+		{"NaksuAbittiKTP/NaksuAbittiKTP.vbox", CategoryVMFolder},
+		{"NaksuAbittiKTP/Logs/VBox.log", CategoryVMFolder},
+		{"NaksuAbittiKTP/Snapshots/{0b2c1d7e-2f3a-4c1b-9d1e-6a7b8c9d0e1f}.vdi", CategorySnapshotDisk},
+		{"NaksuAbittiKTP/Snapshots/2020-11-02T10-00-00-000000000Z.sav", CategoryVMFolder},
+		{"Snapshots/disk.vdi", CategoryVMFolder},
+	}
+
+	for _, table := range tables {
+		category := getVMFolderCategory(filepath.FromSlash(table.relativePath))
+		if category != table.category {
+			t.Errorf("getVMFolderCategory(%s) gives %s, expected %s", table.relativePath, category, table.category)
+		}
+	}
+}
+
+func TestUsageAndCleanups(t *testing.T) {
+	homeDir, err := ioutil.TempDir("", "naksu-storage")
+	if err != nil {
+		t.Fatalf("Could not create home directory: %v", err)
+	}
+	defer os.RemoveAll(homeDir)
+
+	originalHome := os.Getenv("HOME")
+	originalDisableCache := homedir.DisableCache
+	defer func() {
+		os.Setenv("HOME", originalHome)
+		homedir.DisableCache = originalDisableCache
+	}()
+
+	os.Setenv("HOME", homeDir)
+	homedir.DisableCache = true
+
+	if mebroutines.GetHomeDirectory() != homeDir {
+		t.Fatalf("Home directory is %s, expected %s", mebroutines.GetHomeDirectory(), homeDir)
+	}
+
+	files := map[string]int{
+		"ktp/image-cache/ktp-etcher-v1.zip":                       100,
+		"ktp/image-cache/ktp-etcher-v1.zip.part":                  10,
+		"ktp/naksu_last_image.dd":                                 200,
+		"ktp/server.vdi":                                          300,
+		"ktp/naksu_lastlog.txt":                                   20,
+		"ktp/naksu_lastlog-2020-11-02T10-00-00.000.txt":           30,
+		"VirtualBox VMs/server/server.vbox":                       40,
+		"VirtualBox VMs/server/Snapshots/{uuid}.vdi":              50,
+		"ktp-jako/2020-11-02_10-00-00.zip":                        60,
+		"ktp-jako/exam.zip":                                       70,
+		"ktp-jako/ktp_logs/2020-11-02_10-00-00.zip":               80,
+		"VirtualBox VMs/server/Snapshots/not-a-snapshot-disk.sav": 5,
+	}
+
+	for relativePath, size := range files {
+		path := filepath.Join(homeDir, filepath.FromSlash(relativePath))
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, make([]byte, size), 0600)
+		}
+
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", path, err)
+		}
+	}
+
+	report, err := GetUsage()
+	if err != nil {
+		t.Fatalf("GetUsage failed: %v", err)
+	}
+
+	expectedSizes := map[Category]uint64{
+		CategoryImageCache:   110,
+		CategoryRawImage:     200,
+		CategoryDiskImage:    300,
+		CategoryLog:          50,
+		CategoryOther:        0,
+		CategoryVMFolder:     45,
+		CategorySnapshotDisk: 50,
+		CategoryLogZip:       60,
+	}
+
+	if len(report.Usages) != len(expectedSizes) {
+		t.Fatalf("GetUsage gives %d categories, expected %d", len(report.Usages), len(expectedSizes))
+	}
+
+	for _, usage := range report.Usages {
+		if usage.Size != expectedSizes[usage.Category] {
+			t.Errorf("Category %s uses %d bytes, expected %d", usage.Category, usage.Size, expectedSizes[usage.Category])
+		}
+	}
+
+	if report.Total() != 815 {
+		t.Errorf("Total usage is %d bytes, expected 815", report.Total())
+	}
+
+	cleanups, err := ListCleanups()
+	if err != nil {
+		t.Fatalf("ListCleanups failed: %v", err)
+	}
+
+	expectedCleanups := []struct {
+		category Category
+		size     uint64
+	}{
+		{CategoryImageCache, 110},
+		{CategoryRawImage, 200},
+		{CategoryLog, 30},
+		{CategoryLogZip, 60},
+	}
+
+	if len(cleanups) != len(expectedCleanups) {
+		t.Fatalf("ListCleanups gives %+v, expected %+v", cleanups, expectedCleanups)
+	}
+
+	for n, expected := range expectedCleanups {
+		if cleanups[n].Category != expected.category || cleanups[n].Size != expected.size {
+			t.Errorf("Cleanup %d is %s (%d bytes), expected %s (%d bytes)", n+1, cleanups[n].Category, cleanups[n].Size, expected.category, expected.size)
+		}
+
+		if err := cleanups[n].Clean(); err != nil {
+			t.Errorf("Cleanup %s failed: %v", cleanups[n].Category, err)
+		}
+	}
+
+	for relativePath := range files {
+		path := filepath.Join(homeDir, filepath.FromSlash(relativePath))
+		removed := relativePath == "ktp/image-cache/ktp-etcher-v1.zip" ||
+			relativePath == "ktp/image-cache/ktp-etcher-v1.zip.part" ||
+			relativePath == "ktp/naksu_last_image.dd" ||
+			relativePath == "ktp/naksu_lastlog-2020-11-02T10-00-00.000.txt" ||
+			relativePath == "ktp-jako/2020-11-02_10-00-00.zip"
+
+		if mebroutines.ExistsFile(path) == removed {
+			t.Errorf("%s exists: %v, expected %v", relativePath, removed, !removed)
+		}
+	}
+
+	if cleanups, err = ListCleanups(); err != nil || len(cleanups) != 0 {
+		t.Errorf("ListCleanups gives %+v, %v after cleaning up", cleanups, err)
+	}
+}
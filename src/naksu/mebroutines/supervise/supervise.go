@@ -0,0 +1,293 @@
+package supervise
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"naksu/box"
+	"naksu/config"
+	"naksu/constants"
+	"naksu/log"
+	"naksu/mebroutines"
+	"naksu/mebroutines/start"
+)
+
+// guestReadyCheckInterval limits how often the guest ready property is read as
+// Update() is called more often than the server state is updated
+const guestReadyCheckInterval = 5 * time.Second
+
+// restartCountResetUptime is the time after which a running server is considered to
+// work even if the boot watchdog has not seen it become ready (e.g. the watchdog is
+// disabled) so that the restarts are counted from zero again
+const restartCountResetUptime = 10 * time.Minute
+
+// EventType tells what the supervisor noticed about the server
+type EventType int
+
+// The events reported by Supervisor.Update()
+const (
+	// EventStarted means that the server was started (or was running when naksu started)
+	EventStarted EventType = iota
+	// EventStopped means that the server was stopped by naksu or saved by the user
+	EventStopped
+	// EventCrashed means that the VM was aborted while it was running
+	EventCrashed
+	// EventUnexpectedStop means that the server was powered off without naksu, e.g.
+	// from the server itself or by another naksu process. It is usually intentional
+	// so it is only logged.
+	EventUnexpectedStop
+	// EventGuestReady means that the guest set the ready property after it was started
+	EventGuestReady
+	// EventBootTimeout means that the guest did not become ready in time
+	EventBootTimeout
+	// EventWatchdogUnavailable means that the ready property cannot be read
+	EventWatchdogUnavailable
+)
+
+// Event is a change in the server state noticed by the supervisor
+type Event struct {
+	Type  EventType
+	State box.VMState
+	// Elapsed is the time since the server was started
+	Elapsed time.Duration
+}
+
+// NeedsAction returns true if the event means that the server is not working and
+// the user should be alerted or the server restarted
+func (event Event) NeedsAction() bool {
+	return event.Type == EventCrashed || event.Type == EventBootTimeout
+}
+
+// Supervisor follows the server state to notice crashes and servers which do not
+// boot in time (the boot watchdog). The state is read from
+// box.GetLastState() which is updated by box.StartEnvironmentStatusUpdate().
+type Supervisor struct {
+	mutex          sync.Mutex
+	lastState      box.VMState
+	startedAt      time.Time
+	lastReadyCheck time.Time
+	watchdogDone   bool
+	stopExpected   bool
+	restarts       uint64
+}
+
+// Update records the current server state and returns the events since the previous
+// update. If any of them needs an action the caller should call Handle().
+func (supervisor *Supervisor) Update(state box.VMState, now time.Time) []Event {
+	bootTimeout := time.Duration(config.GetSupervisorBootTimeoutSeconds()) * time.Second
+	return supervisor.update(state, now, bootTimeout, box.IsGuestReady)
+}
+
+// update is Update() with the boot timeout and the guest ready check given by the caller.
+// Zero bootTimeout disables the boot watchdog.
+func (supervisor *Supervisor) update(state box.VMState, now time.Time, bootTimeout time.Duration, isGuestReady func() (bool, error)) []Event {
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+
+	// The state could not be read, wait for the next update
+	if state == box.VMStateUnknown {
+		return nil
+	}
+
+	events := []Event{}
+	wasRunning := supervisor.lastState != box.VMStateUnknown && supervisor.lastState.IsRunning()
+	supervisor.lastState = state
+
+	switch {
+	case !wasRunning && state.IsRunning():
+		supervisor.startedAt = now
+		supervisor.watchdogDone = bootTimeout == 0
+		supervisor.stopExpected = false
+		events = append(events, Event{Type: EventStarted, State: state})
+	case wasRunning && !state.IsRunning():
+		events = append(events, Event{Type: getStopEventType(state, supervisor.stopExpected), State: state, Elapsed: now.Sub(supervisor.startedAt)})
+		supervisor.stopExpected = false
+	}
+
+	if state == box.VMStateRunning && supervisor.restarts > 0 && now.Sub(supervisor.startedAt) >= restartCountResetUptime {
+		log.Debug(fmt.Sprintf("Server has been running for %v, resetting the automatic restart count %d", now.Sub(supervisor.startedAt).Round(time.Second), supervisor.restarts))
+		supervisor.restarts = 0
+	}
+
+	// Stuck and paused servers are not checked as they cannot become ready
+	if supervisor.watchdogDone || (state != box.VMStateRunning && !state.NeedsPowerOff()) {
+		return events
+	}
+
+	elapsed := now.Sub(supervisor.startedAt)
+
+	ready := false
+	if state == box.VMStateRunning && now.Sub(supervisor.lastReadyCheck) >= guestReadyCheckInterval {
+		supervisor.lastReadyCheck = now
+
+		var err error
+		ready, err = isGuestReady()
+		if err != nil {
+			log.Debug(fmt.Sprintf("Could not check whether the guest is ready: %v", err))
+			supervisor.watchdogDone = true
+			return append(events, Event{Type: EventWatchdogUnavailable, State: state, Elapsed: elapsed})
+		}
+	}
+
+	if ready {
+		supervisor.watchdogDone = true
+		supervisor.restarts = 0
+		return append(events, Event{Type: EventGuestReady, State: state, Elapsed: elapsed})
+	}
+
+	if elapsed > bootTimeout {
+		supervisor.watchdogDone = true
+		return append(events, Event{Type: EventBootTimeout, State: state, Elapsed: elapsed})
+	}
+
+	return events
+}
+
+// getStopEventType tells whether the server stopped as expected. Only an aborted VM
+// is a crash: a poweroff which naksu did not start may have been made on purpose.
+func getStopEventType(state box.VMState, stopExpected bool) EventType {
+	switch {
+	case stopExpected:
+		return EventStopped
+	case state == box.VMStateAborted || state == box.VMStateAbortedSaved:
+		return EventCrashed
+	case state == box.VMStatePoweredOff:
+		return EventUnexpectedStop
+	default:
+		return EventStopped
+	}
+}
+
+// SetStopExpected tells the supervisor that naksu is stopping the server so that the
+// stop is not reported as unexpected. Call it with false if stopping the server failed.
+func (supervisor *Supervisor) SetStopExpected(expected bool) {
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+
+	supervisor.stopExpected = expected
+}
+
+// Handle writes the events to the log and alerts the user according to
+// config.GetSupervisorAction(). It returns the event which should be handled by
+// restarting the server with Restart() or nil if no restart is needed.
+func (supervisor *Supervisor) Handle(events []Event) *Event {
+	var restartEvent *Event
+
+	for i := range events {
+		event := events[i]
+		logEvent(event)
+
+		if !event.NeedsAction() {
+			continue
+		}
+
+		switch config.GetSupervisorAction() {
+		case constants.SupervisorActionRestart:
+			if supervisor.allowRestart() {
+				restartEvent = &event
+			} else {
+				log.Warning("Server has been restarted %d times without becoming ready, not restarting it again", config.GetSupervisorMaxRestarts())
+				mebroutines.ShowTranslatedErrorMessage("The server has been restarted %d times without success. Please check the server.", config.GetSupervisorMaxRestarts())
+			}
+		case constants.SupervisorActionAlert:
+			alert(event)
+		}
+	}
+
+	return restartEvent
+}
+
+// allowRestart counts the restarts made before the server becomes ready (or has been
+// running for restartCountResetUptime) and returns false if the maximum has been reached
+func (supervisor *Supervisor) allowRestart() bool {
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+
+	if supervisor.restarts >= config.GetSupervisorMaxRestarts() {
+		return false
+	}
+
+	supervisor.restarts++
+	return true
+}
+
+// Restart starts the server again after the given event. A server which did not
+// boot in time is powered off first.
+func (supervisor *Supervisor) Restart(event Event) error {
+	log.Warning("Restarting server automatically after %s", getEventDescription(event))
+
+	if event.Type == EventBootTimeout {
+		supervisor.SetStopExpected(true)
+
+		err := box.PowerOffCurrentBox()
+		if err != nil {
+			supervisor.SetStopExpected(false)
+			log.Error("Could not power off server for automatic restart: %v", err)
+			mebroutines.ShowTranslatedErrorMessage("Failed to restart server automatically: %v", err)
+			return err
+		}
+	}
+
+	if event.State.HasSavedState() {
+		err := box.DiscardSavedState()
+		if err != nil {
+			log.Error("Could not discard saved state for automatic restart: %v", err)
+			mebroutines.ShowTranslatedErrorMessage("Failed to restart server automatically: %v", err)
+			return err
+		}
+	}
+
+	err := start.Server()
+	if err != nil {
+		// start.Server() has shown the error to the user
+		return errors.New("could not restart server")
+	}
+
+	log.Info("Server was restarted automatically")
+	return nil
+}
+
+func logEvent(event Event) {
+	message := fmt.Sprintf("Supervisor: %s (state %s, %v since start)", getEventDescription(event), event.State, event.Elapsed.Round(time.Second))
+
+	switch {
+	case event.NeedsAction():
+		log.Error(message)
+	case event.Type == EventWatchdogUnavailable || event.Type == EventUnexpectedStop:
+		log.Warning(message)
+	default:
+		log.Info(message)
+	}
+}
+
+func getEventDescription(event Event) string {
+	switch event.Type {
+	case EventStarted:
+		return "server started"
+	case EventStopped:
+		return "server stopped"
+	case EventCrashed:
+		return "server crashed"
+	case EventUnexpectedStop:
+		return "server stopped unexpectedly"
+	case EventGuestReady:
+		return "server is ready"
+	case EventBootTimeout:
+		return "server did not become ready in time"
+	case EventWatchdogUnavailable:
+		return "boot watchdog is not available"
+	default:
+		return fmt.Sprintf("unknown event %d", event.Type)
+	}
+}
+
+func alert(event Event) {
+	switch event.Type {
+	case EventCrashed:
+		mebroutines.ShowTranslatedErrorMessage("The server has crashed. Please start it again and check that the exam continues normally.")
+	case EventBootTimeout:
+		mebroutines.ShowTranslatedErrorMessage("The server has not started in %d minutes. Please check the server window.", int(event.Elapsed.Minutes()))
+	}
+}
@@ -0,0 +1,169 @@
+package supervise
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"naksu/box"
+)
+
+type supervisorStep struct {
+	state  box.VMState
+	ready  bool
+	events []EventType
+}
+
+func runSupervisorSteps(t *testing.T, name string, supervisor *Supervisor, steps []supervisorStep, readyErr error) {
+	now := time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC)
+
+	for i, step := range steps {
+		ready := step.ready
+		events := supervisor.update(step.state, now, 5*time.Minute, func() (bool, error) {
+			return ready, readyErr
+		})
+
+		eventTypes := []EventType{}
+		for _, event := range events {
+			eventTypes = append(eventTypes, event.Type)
+		}
+
+		if !reflect.DeepEqual(eventTypes, step.events) {
+			t.Errorf("%s: step %d (%s) gives events %v, expected %v", name, i, step.state, eventTypes, step.events)
+		}
+
+		now = now.Add(2 * time.Minute)
+	}
+}
+
+func TestSupervisorUpdate(t *testing.T) {
+	tables := []struct {
+		name  string
+		steps []supervisorStep
+	}{
+		{
+			"normal boot and crash",
+			[]supervisorStep{
+				{box.VMStatePoweredOff, false, []EventType{}},
+				{box.VMStateRunning, false, []EventType{EventStarted}},
+				{box.VMStateRunning, true, []EventType{EventGuestReady}},
+				{box.VMStateRunning, true, []EventType{}},
+				{box.VMStateAborted, false, []EventType{EventCrashed}},
+			},
+		},
+		{
+			"boot timeout",
+			[]supervisorStep{
+				{box.VMStatePoweredOff, false, []EventType{}},
+				{box.VMStateRunning, false, []EventType{EventStarted}},
+				{box.VMStateRunning, false, []EventType{}},
+				{box.VMStateRunning, false, []EventType{}},
+				{box.VMStateRunning, false, []EventType{EventBootTimeout}},
+				{box.VMStateRunning, true, []EventType{}},
+			},
+		},
+		{
+			"stuck during boot",
+			[]supervisorStep{
+				{box.VMStatePoweredOff, false, []EventType{}},
+				{box.VMStateRunning, false, []EventType{EventStarted}},
+				{box.VMStateStuck, true, []EventType{}},
+				{box.VMStateStuck, true, []EventType{}},
+				{box.VMStateStuck, true, []EventType{EventBootTimeout}},
+			},
+		},
+		{
+			"unexpected poweroff and unknown state",
+			[]supervisorStep{
+				{box.VMStateRunning, true, []EventType{EventStarted, EventGuestReady}},
+				{box.VMStateUnknown, false, []EventType{}},
+				{box.VMStatePoweredOff, false, []EventType{EventUnexpectedStop}},
+				{box.VMStatePoweredOff, false, []EventType{}},
+			},
+		},
+		{
+			"saved by user",
+			[]supervisorStep{
+				{box.VMStateRunning, true, []EventType{EventStarted, EventGuestReady}},
+				{box.VMStateSaved, false, []EventType{EventStopped}},
+			},
+		},
+	}
+
+	for _, table := range tables {
+		runSupervisorSteps(t, table.name, &Supervisor{}, table.steps, nil)
+	}
+}
+
+func TestSupervisorExpectedStop(t *testing.T) {
+	supervisor := &Supervisor{}
+
+	runSupervisorSteps(t, "expected stop", supervisor, []supervisorStep{
+		{box.VMStateRunning, true, []EventType{EventStarted, EventGuestReady}},
+	}, nil)
+
+	supervisor.SetStopExpected(true)
+
+	runSupervisorSteps(t, "expected stop", supervisor, []supervisorStep{
+		{box.VMStatePoweredOff, false, []EventType{EventStopped}},
+		{box.VMStateRunning, true, []EventType{EventStarted, EventGuestReady}},
+		{box.VMStatePoweredOff, false, []EventType{EventUnexpectedStop}},
+	}, nil)
+}
+
+func TestSupervisorWatchdogUnavailable(t *testing.T) {
+	runSupervisorSteps(t, "watchdog unavailable", &Supervisor{}, []supervisorStep{
+		{box.VMStatePoweredOff, false, []EventType{}},
+		{box.VMStateRunning, false, []EventType{EventStarted, EventWatchdogUnavailable}},
+		{box.VMStateRunning, false, []EventType{}},
+		{box.VMStateRunning, false, []EventType{}},
+		{box.VMStateRunning, false, []EventType{}},
+	}, errors.New("qemu vms do not have guest properties"))
+}
+
+func TestSupervisorHandleDoesNotRestartPoweredOffServer(t *testing.T) {
+	events := []Event{
+		{Type: EventUnexpectedStop, State: box.VMStatePoweredOff},
+		{Type: EventStopped, State: box.VMStateSaved},
+	}
+
+	for _, event := range events {
+		if event.NeedsAction() {
+			t.Errorf("Event %s (state %s) needs an action", getEventDescription(event), event.State)
+		}
+	}
+
+	for _, state := range []box.VMState{box.VMStateAborted, box.VMStateAbortedSaved} {
+		event := Event{Type: getStopEventType(state, false), State: state}
+		if event.Type != EventCrashed || !event.NeedsAction() {
+			t.Errorf("Stopping to state %s gives %s, expected a crash", state, getEventDescription(event))
+		}
+	}
+}
+
+func TestSupervisorResetsRestartsAfterUptimeWithoutWatchdog(t *testing.T) {
+	supervisor := &Supervisor{restarts: 3}
+	now := time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC)
+	notReadable := func() (bool, error) {
+		return false, errors.New("guest property cannot be read")
+	}
+
+	for _, bootTimeout := range []time.Duration{0, 5 * time.Minute} {
+		supervisor.update(box.VMStatePoweredOff, now, bootTimeout, notReadable)
+		supervisor.update(box.VMStateRunning, now, bootTimeout, notReadable)
+
+		supervisor.update(box.VMStateRunning, now.Add(restartCountResetUptime-time.Second), bootTimeout, notReadable)
+		if supervisor.restarts != 3 {
+			t.Errorf("Restart count was reset to %d before the server had run %v (boot timeout %v)", supervisor.restarts, restartCountResetUptime, bootTimeout)
+		}
+
+		supervisor.update(box.VMStateRunning, now.Add(restartCountResetUptime), bootTimeout, notReadable)
+		if supervisor.restarts != 0 {
+			t.Errorf("Restart count is %d after the server had run %v (boot timeout %v)", supervisor.restarts, restartCountResetUptime, bootTimeout)
+		}
+
+		supervisor.restarts = 3
+		now = now.Add(time.Hour)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"naksu/host"
 	"naksu/log"
 	"naksu/mebroutines"
+	"naksu/mebroutines/backup"
 	"naksu/xlate"
 
 	flags "github.com/jessevdk/go-flags"
@@ -68,12 +69,14 @@ func main() {
 	xlate.SetLanguage(config.GetLanguage())
 
 	var parser = flags.NewParser(&options, flags.Default)
+	addCLICommands(parser)
 	_, parseErr := parser.Parse()
 
 	if flags.WroteHelp(parseErr) {
-		os.Exit(0)
+		os.Exit(exitCodeOK)
 	} else if parseErr != nil {
-		panic(parseErr)
+		// The parser has already printed the error message
+		os.Exit(exitCodeUsage)
 	}
 
 	handleOptionalArgument("debug", parser, func(opt *flags.Option) {
@@ -101,10 +104,16 @@ func main() {
 
 	log.Action("This is Naksu %s. Hello world!", version)
 
+	backup.SetNaksuVersion(version)
+
 	logDirectoryPaths()
 
 	logHardwareDetails()
 
+	if parser.Active != nil {
+		os.Exit(runCLICommand(parser.Active.Name))
+	}
+
 	var err = RunUI()
 
 	if err != nil {
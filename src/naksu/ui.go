@@ -3,11 +3,13 @@ package main
 import (
 	"fmt"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"naksu/box"
 	"naksu/box/download"
-	"naksu/box/vboxmanage"
 	"naksu/config"
 	"naksu/constants"
 	"naksu/host"
@@ -16,9 +18,15 @@ import (
 	"naksu/mebroutines"
 	"naksu/mebroutines/backup"
 	"naksu/mebroutines/destroy"
+	"naksu/mebroutines/doctor"
 	"naksu/mebroutines/install"
 	"naksu/mebroutines/remove"
+	"naksu/mebroutines/restore"
+	"naksu/mebroutines/snapshot"
 	"naksu/mebroutines/start"
+	"naksu/mebroutines/stop"
+	"naksu/mebroutines/storage"
+	"naksu/mebroutines/supervise"
 	"naksu/network"
 	"naksu/ui/networkstatus"
 	"naksu/ui/progress"
@@ -26,6 +34,7 @@ import (
 
 	"github.com/andlabs/ui"
 	"github.com/atotto/clipboard"
+	humanize "github.com/dustin/go-humanize"
 )
 
 type mainUIStatusType = string
@@ -37,14 +46,32 @@ var window *ui.Window
 
 var environmentStatus constants.EnvironmentStatus
 
+var backupScheduler backup.Scheduler
+
+var serverSupervisor supervise.Supervisor
+
+// backgroundChecksRunning is 1 while startBackgroundChecks() is running the checks
+var backgroundChecksRunning int32
+
 var buttonSelfUpdateOn *ui.Button
 var buttonStartServer *ui.Button
+var buttonShutdownServer *ui.Button
+var buttonRecoverServer *ui.Button
 var buttonInstallAbittiServer *ui.Button
 var buttonInstallExamServer *ui.Button
+var buttonInstallFromFile *ui.Button
+var buttonSelectServer *ui.Button
+var buttonRollbackServer *ui.Button
+var buttonSnapshots *ui.Button
+var buttonServerResources *ui.Button
 var buttonDestroyServer *ui.Button
 var buttonRemoveServer *ui.Button
 var buttonMakeBackup *ui.Button
+var buttonRestoreBackup *ui.Button
+var buttonVerifyBackup *ui.Button
 var buttonDeliverLogs *ui.Button
+var buttonDoctor *ui.Button
+var buttonStorage *ui.Button
 var buttonMebShare *ui.Button
 
 var comboboxLang *ui.Combobox
@@ -53,10 +80,13 @@ var comboboxNic *ui.Combobox
 
 var labelBox *ui.Label
 var labelBoxAvailable *ui.Label
+var labelBackupWarning *ui.Label
+var labelServerState *ui.Label
 var labelStatus *ui.Label
 var labelExtNic *ui.Label
 var labelAdvancedNic *ui.Label
 var labelAdvancedUpdate *ui.Label
+var labelAdvancedServers *ui.Label
 var labelAdvancedAnnihilate *ui.Label
 
 var checkboxAdvanced *ui.Checkbox
@@ -65,6 +95,7 @@ var boxVersions *ui.Box
 var boxBasicUpper *ui.Box
 var boxBasic *ui.Box
 var boxAdvancedUpdate *ui.Box
+var boxAdvancedServers *ui.Box
 var boxAdvancedAnnihilate *ui.Box
 var boxAdvanced *ui.Box
 var boxStatusBar *ui.Box
@@ -104,6 +135,39 @@ var examInstallPassphraseEntry *ui.Entry
 var examInstallButtonInstall *ui.Button
 var examInstallButtonCancel *ui.Button
 
+// File Install Window
+var fileInstallWindow *ui.Window
+
+var fileInstallBox *ui.Box
+var fileInstallPathBox *ui.Box
+var fileInstallPathLabel *ui.Label
+var fileInstallPathEntry *ui.Entry
+var fileInstallButtonBrowse *ui.Button
+var fileInstallTypeLabel *ui.Label
+var fileInstallTypeCombobox *ui.Combobox
+var fileInstallVersionLabel *ui.Label
+var fileInstallVersionEntry *ui.Entry
+var fileInstallButtonInstall *ui.Button
+var fileInstallButtonCancel *ui.Button
+
+// fileInstallBoxTypes are the box types in fileInstallTypeCombobox and restoreTypeCombobox
+var fileInstallBoxTypes = []string{constants.AbittiBoxType, constants.MatriculationExamBoxType}
+
+// Restore Backup Window
+var restoreWindow *ui.Window
+
+var restoreBox *ui.Box
+var restorePathBox *ui.Box
+var restorePathLabel *ui.Label
+var restorePathEntry *ui.Entry
+var restoreButtonBrowse *ui.Button
+var restoreTypeLabel *ui.Label
+var restoreTypeCombobox *ui.Combobox
+var restoreVersionLabel *ui.Label
+var restoreVersionEntry *ui.Entry
+var restoreButtonRestore *ui.Button
+var restoreButtonCancel *ui.Button
+
 // Destroy Confirmation Window
 var destroyWindow *ui.Window
 
@@ -130,12 +194,23 @@ func createMainWindowElements() {
 	// Define main window
 	buttonSelfUpdateOn = ui.NewButton("Turn Naksu self updates back on")
 	buttonStartServer = ui.NewButton("Start Exam Server")
+	buttonShutdownServer = ui.NewButton("Shut Down Server")
+	buttonRecoverServer = ui.NewButton("")
 	buttonInstallAbittiServer = ui.NewButton("Abitti Exam")
 	buttonInstallExamServer = ui.NewButton("Matriculation Exam")
+	buttonInstallFromFile = ui.NewButton("Install from file...")
+	buttonSelectServer = ui.NewButton("Select Server...")
+	buttonRollbackServer = ui.NewButton("Roll Back to Previous Version")
+	buttonSnapshots = ui.NewButton("Snapshots...")
+	buttonServerResources = ui.NewButton("Server Resources...")
 	buttonDestroyServer = ui.NewButton("Remove Exams")
 	buttonRemoveServer = ui.NewButton("Remove Server")
 	buttonMakeBackup = ui.NewButton("Make Exam Server Backup")
+	buttonRestoreBackup = ui.NewButton("Restore Exam Server Backup...")
+	buttonVerifyBackup = ui.NewButton("Verify Exam Server Backup...")
 	buttonDeliverLogs = ui.NewButton("Send logs to Abitti support")
+	buttonDoctor = ui.NewButton("Diagnose VirtualBox...")
+	buttonStorage = ui.NewButton("Disk Usage...")
 	buttonMebShare = ui.NewButton("Open virtual USB stick (ktp-jako)")
 
 	// Define language setting combobox
@@ -161,10 +236,13 @@ func createMainWindowElements() {
 
 	labelBox = ui.NewLabel("")
 	labelBoxAvailable = ui.NewLabel("")
+	labelBackupWarning = ui.NewLabel("")
+	labelServerState = ui.NewLabel("")
 	labelStatus = ui.NewLabel("")
 	labelExtNic = ui.NewLabel("")
 	labelAdvancedNic = ui.NewLabel("")
 	labelAdvancedUpdate = ui.NewLabel("")
+	labelAdvancedServers = ui.NewLabel("")
 	labelAdvancedAnnihilate = ui.NewLabel("")
 
 	checkboxAdvanced = ui.NewCheckbox("")
@@ -176,6 +254,7 @@ func createMainWindowElements() {
 	boxVersions.SetPadded(true)
 	boxVersions.Append(labelBox, true)
 	boxVersions.Append(labelBoxAvailable, true)
+	boxVersions.Append(labelBackupWarning, true)
 
 	// Box version and language selection dropdown
 	boxBasicUpper = ui.NewHorizontalBox()
@@ -189,6 +268,9 @@ func createMainWindowElements() {
 	boxBasic.Append(labelStatus, true)
 	boxBasic.Append(buttonSelfUpdateOn, false)
 	boxBasic.Append(buttonStartServer, false)
+	boxBasic.Append(buttonShutdownServer, false)
+	boxBasic.Append(labelServerState, false)
+	boxBasic.Append(buttonRecoverServer, false)
 	boxBasic.Append(buttonMebShare, false)
 	boxBasic.Append(labelExtNic, false)
 	boxBasic.Append(comboboxExtNic, false)
@@ -198,6 +280,13 @@ func createMainWindowElements() {
 	boxAdvancedUpdate.SetPadded(true)
 	boxAdvancedUpdate.Append(buttonInstallAbittiServer, true)
 	boxAdvancedUpdate.Append(buttonInstallExamServer, true)
+	boxAdvancedUpdate.Append(buttonInstallFromFile, true)
+
+	boxAdvancedServers = ui.NewHorizontalBox()
+	boxAdvancedServers.SetPadded(true)
+	boxAdvancedServers.Append(buttonSelectServer, true)
+	boxAdvancedServers.Append(buttonRollbackServer, true)
+	boxAdvancedServers.Append(buttonSnapshots, true)
 
 	boxAdvancedAnnihilate = ui.NewHorizontalBox()
 	boxAdvancedAnnihilate.SetPadded(true)
@@ -209,12 +298,19 @@ func createMainWindowElements() {
 	boxAdvanced.Append(ui.NewHorizontalSeparator(), false)
 	boxAdvanced.Append(labelAdvancedNic, false)
 	boxAdvanced.Append(comboboxNic, false)
+	boxAdvanced.Append(buttonServerResources, false)
 	boxAdvanced.Append(ui.NewHorizontalSeparator(), false)
 	boxAdvanced.Append(buttonMakeBackup, true)
+	boxAdvanced.Append(buttonRestoreBackup, true)
+	boxAdvanced.Append(buttonVerifyBackup, true)
 	boxAdvanced.Append(buttonDeliverLogs, true)
+	boxAdvanced.Append(buttonDoctor, true)
+	boxAdvanced.Append(buttonStorage, true)
 	boxAdvanced.Append(ui.NewHorizontalSeparator(), false)
 	boxAdvanced.Append(labelAdvancedUpdate, false)
 	boxAdvanced.Append(boxAdvancedUpdate, true)
+	boxAdvanced.Append(labelAdvancedServers, false)
+	boxAdvanced.Append(boxAdvancedServers, true)
 	boxAdvanced.Append(labelAdvancedAnnihilate, false)
 	boxAdvanced.Append(boxAdvancedAnnihilate, true)
 
@@ -320,6 +416,80 @@ func createExamInstallElements() {
 	examInstallWindow.SetChild(examInstallBox)
 }
 
+func createFileInstallElements() {
+	// Define install from file dialog window
+	fileInstallPathLabel = ui.NewLabel(xlate.Get("Server image (ktp-etcher.zip, ktp.img or USB stick device):"))
+	fileInstallPathEntry = ui.NewEntry()
+	fileInstallButtonBrowse = ui.NewButton(xlate.Get("Browse..."))
+	fileInstallTypeLabel = ui.NewLabel(xlate.Get("Server type:"))
+	fileInstallTypeCombobox = ui.NewCombobox()
+	fileInstallTypeCombobox.Append(xlate.Get("Abitti server"))
+	fileInstallTypeCombobox.Append(xlate.Get("Matric Exam server"))
+	fileInstallTypeCombobox.SetSelected(0)
+	fileInstallVersionLabel = ui.NewLabel(xlate.Get("Version (leave empty to read it from the .ver file):"))
+	fileInstallVersionEntry = ui.NewEntry()
+	fileInstallButtonCancel = ui.NewButton(xlate.Get("Cancel"))
+	fileInstallButtonInstall = ui.NewButton(xlate.Get("Install"))
+
+	fileInstallPathBox = ui.NewHorizontalBox()
+	fileInstallPathBox.SetPadded(true)
+	fileInstallPathBox.Append(fileInstallPathEntry, true)
+	fileInstallPathBox.Append(fileInstallButtonBrowse, false)
+
+	fileInstallBox = ui.NewVerticalBox()
+	fileInstallBox.SetPadded(true)
+
+	fileInstallBox.Append(fileInstallPathLabel, false)
+	fileInstallBox.Append(fileInstallPathBox, false)
+	fileInstallBox.Append(fileInstallTypeLabel, false)
+	fileInstallBox.Append(fileInstallTypeCombobox, false)
+	fileInstallBox.Append(fileInstallVersionLabel, false)
+	fileInstallBox.Append(fileInstallVersionEntry, false)
+	fileInstallBox.Append(fileInstallButtonInstall, false)
+	fileInstallBox.Append(fileInstallButtonCancel, false)
+
+	fileInstallWindow = ui.NewWindow("", 400, 1, false)
+	fileInstallWindow.SetMargined(true)
+	fileInstallWindow.SetChild(fileInstallBox)
+}
+
+func createRestoreElements() {
+	// Define restore backup dialog window
+	restorePathLabel = ui.NewLabel(xlate.Get("Backup file (.vmdk):"))
+	restorePathEntry = ui.NewEntry()
+	restoreButtonBrowse = ui.NewButton(xlate.Get("Browse..."))
+	restoreTypeLabel = ui.NewLabel(xlate.Get("Server type:"))
+	restoreTypeCombobox = ui.NewCombobox()
+	restoreTypeCombobox.Append(xlate.Get("Abitti server"))
+	restoreTypeCombobox.Append(xlate.Get("Matric Exam server"))
+	restoreTypeCombobox.SetSelected(0)
+	restoreVersionLabel = ui.NewLabel(xlate.Get("Version (optional):"))
+	restoreVersionEntry = ui.NewEntry()
+	restoreButtonCancel = ui.NewButton(xlate.Get("Cancel"))
+	restoreButtonRestore = ui.NewButton(xlate.Get("Restore"))
+
+	restorePathBox = ui.NewHorizontalBox()
+	restorePathBox.SetPadded(true)
+	restorePathBox.Append(restorePathEntry, true)
+	restorePathBox.Append(restoreButtonBrowse, false)
+
+	restoreBox = ui.NewVerticalBox()
+	restoreBox.SetPadded(true)
+
+	restoreBox.Append(restorePathLabel, false)
+	restoreBox.Append(restorePathBox, false)
+	restoreBox.Append(restoreTypeLabel, false)
+	restoreBox.Append(restoreTypeCombobox, false)
+	restoreBox.Append(restoreVersionLabel, false)
+	restoreBox.Append(restoreVersionEntry, false)
+	restoreBox.Append(restoreButtonRestore, false)
+	restoreBox.Append(restoreButtonCancel, false)
+
+	restoreWindow = ui.NewWindow("", 400, 1, false)
+	restoreWindow.SetMargined(true)
+	restoreWindow.SetChild(restoreBox)
+}
+
 func createDestroyElements() {
 	// Define Destroy Confirmation window/dialog
 	for i := 0; i <= 4; i++ {
@@ -391,6 +561,7 @@ func setupMainLoop(mainUIStatus chan string) {
 			select {
 			case <-updateUITicker.C:
 				mainUIStatusHandler(currentMainUIStatus)
+				startBackgroundChecks(mainUIStatus, currentMainUIStatus)
 			case newStatus := <-mainUIStatus:
 				currentMainUIStatus = newStatus
 				mainUIStatusHandler(currentMainUIStatus)
@@ -411,6 +582,7 @@ func mainUIStatusHandler(currentMainUIStatus mainUIStatusType) { //nolint:gocycl
 	boxInstalled := environmentStatus.BoxInstalled
 	boxRunning := environmentStatus.BoxRunning
 	netAvailable := environmentStatus.NetAvailable
+	boxState := box.GetLastState()
 
 	// Create rule for "enabled" for each button
 	buttonRules := []struct {
@@ -418,12 +590,23 @@ func mainUIStatusHandler(currentMainUIStatus mainUIStatusType) { //nolint:gocycl
 		enable  bool
 	}{
 		{buttonSelfUpdateOn, config.IsSelfUpdateDisabled()},
-		{buttonStartServer, mainUIEnabled && boxInstalled && !boxRunning},
+		{buttonStartServer, mainUIEnabled && boxInstalled && !boxRunning && !boxState.HasSavedState()},
+		{buttonShutdownServer, mainUIEnabled && boxRunning},
+		{buttonRecoverServer, mainUIEnabled},
 		{buttonMebShare, true},
 		{buttonMakeBackup, mainUIEnabled && boxInstalled && !boxRunning},
+		{buttonRestoreBackup, mainUIEnabled && !boxRunning},
+		{buttonVerifyBackup, mainUIEnabled},
 		{buttonDeliverLogs, mainUIEnabled && true},
+		{buttonDoctor, mainUIEnabled && !boxRunning},
+		{buttonStorage, mainUIEnabled},
 		{buttonInstallAbittiServer, mainUIEnabled && !boxRunning && netAvailable},
 		{buttonInstallExamServer, mainUIEnabled && !boxRunning && netAvailable},
+		{buttonInstallFromFile, mainUIEnabled && !boxRunning},
+		{buttonSelectServer, mainUIEnabled && !boxRunning},
+		{buttonRollbackServer, mainUIEnabled && boxInstalled && !boxRunning},
+		{buttonSnapshots, mainUIEnabled && boxInstalled && !boxRunning},
+		{buttonServerResources, mainUIEnabled && !boxRunning},
 		{buttonDestroyServer, mainUIEnabled && boxInstalled && !boxRunning},
 		{buttonRemoveServer, true},
 	}
@@ -438,6 +621,8 @@ func mainUIStatusHandler(currentMainUIStatus mainUIStatusType) { //nolint:gocycl
 	}
 
 	ui.QueueMain(func() {
+		updateServerStateElements(boxState)
+
 		for _, buttonRule := range buttonRules {
 			if buttonRule.enable {
 				buttonRule.element.Enable()
@@ -456,6 +641,132 @@ func mainUIStatusHandler(currentMainUIStatus mainUIStatusType) { //nolint:gocycl
 	})
 }
 
+// updateServerStateElements tells the user if the server is in a state which prevents
+// starting or shutting it down and shows a button for recovering from the state.
+// Make sure you call this inside ui.QueueMain() only
+func updateServerStateElements(state box.VMState) {
+	switch {
+	case state.NeedsPowerOff():
+		labelServerState.SetText(xlate.Get("The server is not responding (%s). You can power it off and start it again.", state))
+		buttonRecoverServer.SetText(xlate.Get("Power Off Server"))
+	case state.HasSavedState():
+		labelServerState.SetText(xlate.Get("The server has a saved state. Discard the saved state before starting the server."))
+		buttonRecoverServer.SetText(xlate.Get("Discard Saved State"))
+	default:
+		labelServerState.Hide()
+		buttonRecoverServer.Hide()
+		return
+	}
+
+	labelServerState.Show()
+	buttonRecoverServer.Show()
+}
+
+// startBackgroundChecks runs the server supervisor and the backup scheduler in their
+// own goroutine as the supervisor calls VBoxManage which may wait for other VBoxManage
+// commands and block the main loop. A check is not started while the previous one runs.
+func startBackgroundChecks(mainUIStatus chan string, currentMainUIStatus mainUIStatusType) {
+	if !atomic.CompareAndSwapInt32(&backgroundChecksRunning, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&backgroundChecksRunning, 0)
+
+		if !checkServerSupervisor(mainUIStatus, currentMainUIStatus) {
+			checkScheduledBackup(mainUIStatus, currentMainUIStatus)
+		}
+	}()
+}
+
+// checkServerSupervisor follows the server state, reports crashes
+// and boot timeouts and restarts the server if so configured in naksu.ini. Returns
+// true if an automatic restart was started.
+func checkServerSupervisor(mainUIStatus chan string, currentMainUIStatus mainUIStatusType) bool {
+	events := serverSupervisor.Update(box.GetLastState(), time.Now())
+	if len(events) == 0 {
+		return false
+	}
+
+	restartEvent := serverSupervisor.Handle(events)
+	if restartEvent == nil {
+		return false
+	}
+
+	if currentMainUIStatus != mainUIStatusEnabled {
+		log.Warning("Not restarting server automatically as another operation is in progress")
+		mebroutines.ShowTranslatedErrorMessage("The server has stopped but it was not restarted automatically as another operation is in progress.")
+		return false
+	}
+
+	go func() {
+		disableUI(mainUIStatus)
+		progress.TranslateAndSetMessage("Restarting server automatically...")
+
+		err := serverSupervisor.Restart(*restartEvent)
+		if err != nil {
+			// Failure has been reported to the user by serverSupervisor.Restart()
+			log.Debug("Automatic restart failed: %v", err)
+			progress.SetMessage("")
+		} else {
+			progress.TranslateAndSetMessage("The server was restarted automatically")
+		}
+
+		enableUI(mainUIStatus)
+	}()
+
+	return true
+}
+
+// checkScheduledBackup starts an automatic backup if one is due according to
+// the schedule set in naksu.ini. Backups are not started while the UI is disabled.
+func checkScheduledBackup(mainUIStatus chan string, currentMainUIStatus mainUIStatusType) {
+	updateBackupWarningLabel()
+
+	if currentMainUIStatus != mainUIStatusEnabled {
+		return
+	}
+
+	if !backupScheduler.Update(environmentStatus.BoxInstalled, environmentStatus.BoxRunning, time.Now()) {
+		return
+	}
+
+	go func() {
+		disableUI(mainUIStatus)
+		log.Debug("Starting automatic backup")
+
+		err := backupScheduler.Run()
+		if err != nil {
+			// Failure has been reported to the user by backup.RunScheduledBackup()
+			log.Debug("Automatic backup failed: %v", err)
+			progress.SetMessage("")
+		} else {
+			progress.TranslateAndSetMessage("Automatic backup done")
+		}
+
+		updateBackupWarningLabel()
+		enableUI(mainUIStatus)
+	}()
+}
+
+// updateBackupWarningLabel warns the user if the latest successful automatic
+// backup is too old
+func updateBackupWarningLabel() {
+	warning := ""
+	if backup.IsLatestBackupTooOld(time.Now()) {
+		lastSuccess := config.GetBackupLastSuccess()
+		if lastSuccess.IsZero() {
+			warning = xlate.Get("Warning: No automatic backup has succeeded yet")
+		} else {
+			warning = xlate.Get("Warning: The latest automatic backup is from %s", lastSuccess.Format("2006-01-02 15:04"))
+		}
+	}
+
+	ui.QueueMain(func() {
+		labelBackupWarning.SetText(warning)
+	})
+}
+
 // checkAbittiUpdate checks
 // 1) if currently installed box is Abitti or if no box is installed
 // 2) and there is a new version available
@@ -543,11 +854,22 @@ func translateUILabels() {
 		updateStartButtonLabel()
 		updateGetServerButtonLabel()
 		buttonSelfUpdateOn.SetText(xlate.Get("Turn Naksu self updates back on"))
+		buttonShutdownServer.SetText(xlate.Get("Shut Down Server"))
+		updateServerStateElements(box.GetLastState())
 		buttonInstallExamServer.SetText(xlate.Get("Matriculation Exam"))
+		buttonInstallFromFile.SetText(xlate.Get("Install from file..."))
+		buttonSelectServer.SetText(xlate.Get("Select Server..."))
+		buttonRollbackServer.SetText(xlate.Get("Roll Back to Previous Version"))
+		buttonSnapshots.SetText(xlate.Get("Snapshots..."))
+		buttonServerResources.SetText(xlate.Get("Server Resources..."))
 		buttonDestroyServer.SetText(xlate.Get("Remove Exams"))
 		buttonRemoveServer.SetText(xlate.Get("Remove Server"))
 		buttonMakeBackup.SetText(xlate.Get("Make Exam Server Backup"))
+		buttonRestoreBackup.SetText(xlate.Get("Restore Exam Server Backup..."))
+		buttonVerifyBackup.SetText(xlate.Get("Verify Exam Server Backup..."))
 		buttonDeliverLogs.SetText(xlate.Get("Send logs to Abitti support"))
+		buttonDoctor.SetText(xlate.Get("Diagnose VirtualBox..."))
+		buttonStorage.SetText(xlate.Get("Disk Usage..."))
 		buttonMebShare.SetText(xlate.Get("Open virtual USB stick (ktp-jako)"))
 		labelExtNic.SetText(xlate.Get("Network device:"))
 
@@ -555,6 +877,7 @@ func translateUILabels() {
 
 		// Show available box version if we have a Abitti box
 		updateBoxAvailabilityLabel()
+		updateBackupWarningLabel()
 
 		// Suggest VM install if none installed
 		if progress.GetLastMessage() == "" && box.GetVersion() == "" {
@@ -564,6 +887,7 @@ func translateUILabels() {
 		checkboxAdvanced.SetText(xlate.Get("Show management features"))
 		labelAdvancedNic.SetText(xlate.Get("Server networking hardware:"))
 		labelAdvancedUpdate.SetText(xlate.Get("Install/update server for:"))
+		labelAdvancedServers.SetText(xlate.Get("Installed servers:"))
 		labelAdvancedAnnihilate.SetText(xlate.Get("DANGER! Annihilate your server:"))
 
 		backupWindow.SetTitle(xlate.Get("naksu: SaveTo"))
@@ -581,6 +905,22 @@ func translateUILabels() {
 		examInstallButtonInstall.SetText(xlate.Get("Install"))
 		examInstallButtonCancel.SetText(xlate.Get("Cancel"))
 
+		fileInstallWindow.SetTitle(xlate.Get("naksu: Install Server from File"))
+		fileInstallPathLabel.SetText(xlate.Get("Server image (ktp-etcher.zip, ktp.img or USB stick device):"))
+		fileInstallButtonBrowse.SetText(xlate.Get("Browse..."))
+		fileInstallTypeLabel.SetText(xlate.Get("Server type:"))
+		fileInstallVersionLabel.SetText(xlate.Get("Version (leave empty to read it from the .ver file):"))
+		fileInstallButtonInstall.SetText(xlate.Get("Install"))
+		fileInstallButtonCancel.SetText(xlate.Get("Cancel"))
+
+		restoreWindow.SetTitle(xlate.Get("naksu: Restore Exam Server Backup"))
+		restorePathLabel.SetText(xlate.Get("Backup file (.vmdk):"))
+		restoreButtonBrowse.SetText(xlate.Get("Browse..."))
+		restoreTypeLabel.SetText(xlate.Get("Server type:"))
+		restoreVersionLabel.SetText(xlate.Get("Version (optional):"))
+		restoreButtonRestore.SetText(xlate.Get("Restore"))
+		restoreButtonCancel.SetText(xlate.Get("Cancel"))
+
 		destroyWindow.SetTitle(xlate.Get("naksu: Remove Exams"))
 		destroyInfoLabel[0].SetText(xlate.Get("Remove Exams restores server to its initial status."))
 		destroyInfoLabel[1].SetText(xlate.Get("Exams, responses and logs in the server will be irreversibly deleted."))
@@ -719,6 +1059,86 @@ func startServerButtonClicked(mainUIStatus chan string) {
 	}()
 }
 
+func bindOnShutdownServer(mainUIStatus chan string) {
+	buttonShutdownServer.OnClicked(func(*ui.Button) {
+		log.Action("Shutting down server")
+		disableUI(mainUIStatus)
+
+		go func() {
+			serverSupervisor.SetStopExpected(true)
+
+			err := stop.Server()
+			if err != nil {
+				serverSupervisor.SetStopExpected(false)
+				// Failure has been reported to the user by stop.Server()
+				log.Debug("Failed to shut down server: %v", err)
+				progress.SetMessage("")
+			} else {
+				progress.TranslateAndSetMessage("The server has been shut down")
+			}
+
+			enableUI(mainUIStatus)
+		}()
+	})
+}
+
+// bindOnRecoverServer powers off a paused or stuck server or discards the saved state
+// of a server depending on the state shown by updateServerStateElements()
+func bindOnRecoverServer(mainUIStatus chan string) {
+	buttonRecoverServer.OnClicked(func(*ui.Button) {
+		state := box.GetLastState()
+
+		var title, message, doneMessage string
+		var action func() error
+
+		switch {
+		case state.NeedsPowerOff():
+			title = xlate.Get("Power Off Server")
+			message = xlate.Get("The server will be turned off without shutting it down. Changes which have not been saved by the server may be lost.")
+			doneMessage = "The server has been powered off"
+			action = func() error {
+				serverSupervisor.SetStopExpected(true)
+
+				err := stop.PowerOff()
+				if err != nil {
+					serverSupervisor.SetStopExpected(false)
+				}
+
+				return err
+			}
+		case state.HasSavedState():
+			title = xlate.Get("Discard Saved State")
+			message = xlate.Get("The server will boot normally next time it is started. Changes which have not been saved by the server may be lost.")
+			doneMessage = "The saved state has been discarded"
+			action = stop.DiscardSavedState
+		default:
+			return
+		}
+
+		log.Action("Opening server recovery dialog for state %s", state)
+		disableUI(mainUIStatus)
+
+		showConfirmWindow(title, message, title, func() {
+			log.Action("Recovering server from state %s", state)
+
+			go func() {
+				err := action()
+				if err != nil {
+					// Failure has been reported to the user by the action
+					log.Debug("Server recovery failed: %v", err)
+					progress.SetMessage("")
+				} else {
+					progress.TranslateAndSetMessage(doneMessage)
+				}
+
+				enableUI(mainUIStatus)
+			}()
+		}, func() {
+			enableUI(mainUIStatus)
+		})
+	})
+}
+
 func bindOnInstallAbittiServer(mainUIStatus chan string) {
 	buttonInstallAbittiServer.OnClicked(func(*ui.Button) {
 		go func() {
@@ -791,6 +1211,772 @@ func bindOnInstallExamServer(mainUIStatus chan string) {
 	})
 }
 
+func bindOnInstallFromFile(mainUIStatus chan string) {
+	buttonInstallFromFile.OnClicked(func(*ui.Button) {
+		log.Action("Opening InstallFromFile dialog")
+		disableUI(mainUIStatus)
+		fileInstallWindow.Show()
+	})
+
+	fileInstallButtonBrowse.OnClicked(func(*ui.Button) {
+		imagePath := ui.OpenFile(fileInstallWindow)
+		if imagePath != "" {
+			fileInstallPathEntry.SetText(imagePath)
+		}
+	})
+
+	closeFileInstallWindow := func() {
+		fileInstallWindow.Hide()
+		fileInstallPathEntry.SetText("")
+		fileInstallVersionEntry.SetText("")
+	}
+
+	fileInstallButtonInstall.OnClicked(func(*ui.Button) {
+		imagePath := fileInstallPathEntry.Text()
+		imageVersion := fileInstallVersionEntry.Text()
+		boxType := fileInstallBoxTypes[fileInstallTypeCombobox.Selected()]
+
+		if imagePath == "" {
+			mebroutines.ShowTranslatedErrorMessage("Please select the server image file")
+			return
+		}
+
+		closeFileInstallWindow()
+
+		go func() {
+			log.Action("Installing %s server from file %s", boxType, imagePath)
+
+			err := install.NewServerFromFile(boxType, imagePath, imageVersion)
+			if err != nil {
+				log.Debug("Failed to install a server from file: %v", err)
+				progress.SetMessage("")
+			} else {
+				progress.TranslateAndSetMessage("A new server was created from the file")
+			}
+
+			translateUILabels()
+			enableUI(mainUIStatus)
+
+			log.Debug("Finished installing server from file, version is: %s", box.GetVersion())
+		}()
+	})
+
+	fileInstallButtonCancel.OnClicked(func(*ui.Button) {
+		log.Action("Cancelling InstallFromFile dialog")
+		closeFileInstallWindow()
+		enableUI(mainUIStatus)
+	})
+
+	fileInstallWindow.OnClosing(func(*ui.Window) bool {
+		log.Action("Closing InstallFromFile dialog")
+		closeFileInstallWindow()
+		enableUI(mainUIStatus)
+		return false
+	})
+}
+
+// getBoxLegend returns an user-readable description of an installed box
+func getBoxLegend(boxInfo box.Info) string {
+	legend := fmt.Sprintf("%s %s", box.GetTypeLegendOf(boxInfo.Type), boxInfo.Version)
+	if !boxInfo.Installed.IsZero() {
+		legend = fmt.Sprintf("%s (%s)", legend, boxInfo.Installed.Format("2006-01-02 15:04"))
+	}
+
+	if boxInfo.Active {
+		legend = fmt.Sprintf("%s - %s", legend, xlate.Get("active"))
+	}
+
+	return legend
+}
+
+// showSelectServerWindow opens a dialog for selecting the active server. The dialog
+// is created every time as the combobox items cannot be changed after creation.
+func showSelectServerWindow(mainUIStatus chan string, boxes []box.Info) {
+	selectWindow := ui.NewWindow(xlate.Get("naksu: Select Server"), 400, 1, false)
+	selectLabel := ui.NewLabel(xlate.Get("Select the server to use:"))
+	selectCombobox := ui.NewCombobox()
+	selectButtonSelect := ui.NewButton(xlate.Get("Select"))
+	selectButtonCancel := ui.NewButton(xlate.Get("Cancel"))
+
+	for n, boxInfo := range boxes {
+		selectCombobox.Append(getBoxLegend(boxInfo))
+		if boxInfo.Active {
+			selectCombobox.SetSelected(n)
+		}
+	}
+
+	selectBox := ui.NewVerticalBox()
+	selectBox.SetPadded(true)
+	selectBox.Append(selectLabel, false)
+	selectBox.Append(selectCombobox, false)
+	selectBox.Append(selectButtonSelect, false)
+	selectBox.Append(selectButtonCancel, false)
+
+	selectWindow.SetMargined(true)
+	selectWindow.SetChild(selectBox)
+
+	closeSelectWindow := func() {
+		selectWindow.Destroy()
+		translateUILabels()
+		enableUI(mainUIStatus)
+	}
+
+	selectButtonSelect.OnClicked(func(*ui.Button) {
+		if selectCombobox.Selected() >= 0 {
+			selectedBox := boxes[selectCombobox.Selected()]
+			log.Action("Selecting server %s", selectedBox.Name)
+
+			err := box.SetActiveBox(selectedBox.Name)
+			if err != nil {
+				mebroutines.ShowTranslatedErrorMessage("Could not select server: %v", err)
+			}
+		}
+
+		closeSelectWindow()
+	})
+
+	selectButtonCancel.OnClicked(func(*ui.Button) {
+		log.Action("Cancelling SelectServer dialog")
+		closeSelectWindow()
+	})
+
+	selectWindow.OnClosing(func(*ui.Window) bool {
+		log.Action("Closing SelectServer dialog")
+		closeSelectWindow()
+		return false
+	})
+
+	selectWindow.Show()
+}
+
+func bindOnSelectServer(mainUIStatus chan string) {
+	buttonSelectServer.OnClicked(func(*ui.Button) {
+		log.Action("Opening SelectServer dialog")
+		disableUI(mainUIStatus)
+
+		go func() {
+			boxes, err := box.ListBoxes()
+			if err != nil {
+				mebroutines.ShowTranslatedErrorMessage("Could not get the list of installed servers: %v", err)
+				enableUI(mainUIStatus)
+				return
+			}
+
+			if len(boxes) == 0 {
+				mebroutines.ShowTranslatedErrorMessage("There are no installed servers")
+				enableUI(mainUIStatus)
+				return
+			}
+
+			ui.QueueMain(func() {
+				showSelectServerWindow(mainUIStatus, boxes)
+			})
+		}()
+	})
+
+	buttonRollbackServer.OnClicked(func(*ui.Button) {
+		go func() {
+			log.Action("Rolling back to the previous server version")
+			disableUI(mainUIStatus)
+
+			previousBox, err := box.RollbackToPreviousBox()
+			if err != nil {
+				mebroutines.ShowTranslatedErrorMessage("Could not roll back to the previous version: %v", err)
+			} else {
+				progress.TranslateAndSetMessage("Rolled back to version %s", previousBox.Version)
+			}
+
+			translateUILabels()
+			enableUI(mainUIStatus)
+		}()
+	})
+}
+
+// getSnapshotLegend returns an user-readable description of a snapshot
+func getSnapshotLegend(snapshotInfo box.Snapshot) string {
+	legend := snapshotInfo.Name
+	if !snapshotInfo.Created.IsZero() {
+		legend = fmt.Sprintf("%s (%s)", legend, snapshotInfo.Created.Local().Format("2006-01-02 15:04"))
+	}
+
+	return legend
+}
+
+// showConfirmWindow asks the user to confirm an action. Either onConfirm or onCancel is called.
+func showConfirmWindow(title string, message string, confirmText string, onConfirm func(), onCancel func()) {
+	confirmWindow := ui.NewWindow(title, 400, 1, false)
+	confirmLabel := ui.NewLabel(message)
+	confirmButtonConfirm := ui.NewButton(confirmText)
+	confirmButtonCancel := ui.NewButton(xlate.Get("Cancel"))
+
+	confirmBox := ui.NewVerticalBox()
+	confirmBox.SetPadded(true)
+	confirmBox.Append(confirmLabel, false)
+	confirmBox.Append(confirmButtonConfirm, false)
+	confirmBox.Append(confirmButtonCancel, false)
+
+	confirmWindow.SetMargined(true)
+	confirmWindow.SetChild(confirmBox)
+
+	confirmButtonConfirm.OnClicked(func(*ui.Button) {
+		confirmWindow.Destroy()
+		onConfirm()
+	})
+
+	confirmButtonCancel.OnClicked(func(*ui.Button) {
+		confirmWindow.Destroy()
+		onCancel()
+	})
+
+	confirmWindow.OnClosing(func(*ui.Window) bool {
+		onCancel()
+		return true
+	})
+
+	confirmWindow.Show()
+}
+
+// runSnapshotAction runs a snapshot action in a goroutine and enables the UI after it
+func runSnapshotAction(mainUIStatus chan string, action func(string) error, snapshotName string, doneMessage string) {
+	go func() {
+		err := action(snapshotName)
+		if err != nil {
+			// Failure has been reported to the user by the action
+			log.Debug("Snapshot action failed: %v", err)
+			progress.SetMessage("")
+		} else {
+			progress.TranslateAndSetMessage(doneMessage, snapshotName)
+		}
+
+		translateUILabels()
+		enableUI(mainUIStatus)
+	}()
+}
+
+// showSnapshotsWindow opens a dialog for taking, restoring and deleting snapshots of
+// the active server. The dialog is created every time as the combobox items cannot
+// be changed after creation.
+func showSnapshotsWindow(mainUIStatus chan string, snapshots []box.Snapshot) {
+	snapshotsWindow := ui.NewWindow(xlate.Get("naksu: Snapshots"), 400, 1, false)
+	snapshotsLabel := ui.NewLabel(xlate.Get("Snapshots of the server:"))
+	snapshotsCombobox := ui.NewCombobox()
+	snapshotsButtonRestore := ui.NewButton(xlate.Get("Restore Snapshot"))
+	snapshotsButtonDelete := ui.NewButton(xlate.Get("Delete Snapshot"))
+	snapshotsNameLabel := ui.NewLabel(xlate.Get("Name of the new snapshot:"))
+	snapshotsNameEntry := ui.NewEntry()
+	snapshotsButtonTake := ui.NewButton(xlate.Get("Take Snapshot"))
+	snapshotsButtonClose := ui.NewButton(xlate.Get("Close"))
+
+	for _, snapshotInfo := range snapshots {
+		snapshotsCombobox.Append(getSnapshotLegend(snapshotInfo))
+	}
+	if len(snapshots) > 0 {
+		snapshotsCombobox.SetSelected(len(snapshots) - 1)
+	}
+
+	snapshotsBox := ui.NewVerticalBox()
+	snapshotsBox.SetPadded(true)
+	snapshotsBox.Append(snapshotsLabel, false)
+	snapshotsBox.Append(snapshotsCombobox, false)
+	snapshotsBox.Append(snapshotsButtonRestore, false)
+	snapshotsBox.Append(snapshotsButtonDelete, false)
+	snapshotsBox.Append(ui.NewHorizontalSeparator(), false)
+	snapshotsBox.Append(snapshotsNameLabel, false)
+	snapshotsBox.Append(snapshotsNameEntry, false)
+	snapshotsBox.Append(snapshotsButtonTake, false)
+	snapshotsBox.Append(ui.NewHorizontalSeparator(), false)
+	snapshotsBox.Append(snapshotsButtonClose, false)
+
+	snapshotsWindow.SetMargined(true)
+	snapshotsWindow.SetChild(snapshotsBox)
+
+	cancelAction := func() {
+		enableUI(mainUIStatus)
+	}
+
+	getSelectedSnapshot := func() (box.Snapshot, bool) {
+		if snapshotsCombobox.Selected() < 0 {
+			mebroutines.ShowTranslatedErrorMessage("Please select a snapshot")
+			return box.Snapshot{}, false
+		}
+
+		return snapshots[snapshotsCombobox.Selected()], true
+	}
+
+	snapshotsButtonRestore.OnClicked(func(*ui.Button) {
+		selectedSnapshot, ok := getSelectedSnapshot()
+		if !ok {
+			return
+		}
+
+		snapshotsWindow.Destroy()
+		showConfirmWindow(
+			xlate.Get("naksu: Restore Snapshot"),
+			xlate.Get("Exams, responses and logs saved after the snapshot %s will be irreversibly deleted. Do you wish to restore the snapshot?", getSnapshotLegend(selectedSnapshot)),
+			xlate.Get("Yes, Restore"),
+			func() {
+				log.Action("Restoring snapshot %s", selectedSnapshot.Name)
+				runSnapshotAction(mainUIStatus, snapshot.Restore, selectedSnapshot.Name, xlate.GetRaw("Snapshot %s was restored"))
+			},
+			cancelAction,
+		)
+	})
+
+	snapshotsButtonDelete.OnClicked(func(*ui.Button) {
+		selectedSnapshot, ok := getSelectedSnapshot()
+		if !ok {
+			return
+		}
+
+		if box.IsInstalledSnapshot(selectedSnapshot.Name) {
+			mebroutines.ShowTranslatedErrorMessage("The snapshot %s is needed for removing exams and it cannot be deleted", selectedSnapshot.Name)
+			return
+		}
+
+		snapshotsWindow.Destroy()
+		showConfirmWindow(
+			xlate.Get("naksu: Delete Snapshot"),
+			xlate.Get("Do you wish to delete the snapshot %s?", getSnapshotLegend(selectedSnapshot)),
+			xlate.Get("Yes, Delete"),
+			func() {
+				log.Action("Deleting snapshot %s", selectedSnapshot.Name)
+				runSnapshotAction(mainUIStatus, snapshot.Delete, selectedSnapshot.Name, xlate.GetRaw("Snapshot %s was deleted"))
+			},
+			cancelAction,
+		)
+	})
+
+	snapshotsButtonTake.OnClicked(func(*ui.Button) {
+		snapshotName := strings.TrimSpace(snapshotsNameEntry.Text())
+		if snapshotName == "" {
+			mebroutines.ShowTranslatedErrorMessage("Please enter a name for the snapshot")
+			return
+		}
+
+		snapshotsWindow.Destroy()
+		log.Action("Taking snapshot %s", snapshotName)
+		runSnapshotAction(mainUIStatus, snapshot.Take, snapshotName, xlate.GetRaw("Snapshot %s was taken"))
+	})
+
+	snapshotsButtonClose.OnClicked(func(*ui.Button) {
+		log.Action("Closing Snapshots dialog")
+		snapshotsWindow.Destroy()
+		enableUI(mainUIStatus)
+	})
+
+	snapshotsWindow.OnClosing(func(*ui.Window) bool {
+		log.Action("Closing Snapshots dialog")
+		enableUI(mainUIStatus)
+		return true
+	})
+
+	snapshotsWindow.Show()
+}
+
+func bindOnSnapshots(mainUIStatus chan string) {
+	buttonSnapshots.OnClicked(func(*ui.Button) {
+		log.Action("Opening Snapshots dialog")
+		disableUI(mainUIStatus)
+
+		go func() {
+			snapshots, err := box.ListSnapshots()
+			if err != nil {
+				mebroutines.ShowTranslatedErrorMessage("Could not get the list of snapshots: %v", err)
+				enableUI(mainUIStatus)
+				return
+			}
+
+			ui.QueueMain(func() {
+				showSnapshotsWindow(mainUIStatus, snapshots)
+			})
+		}()
+	})
+}
+
+// fixDoctorFindings applies the fixes of the selected findings in a goroutine and
+// reports the results
+func fixDoctorFindings(mainUIStatus chan string, findings []doctor.Finding) {
+	go func() {
+		failures := []string{}
+
+		for n, finding := range findings {
+			progress.TranslateAndSetMessage("Fixing problem %d of %d...", n+1, len(findings))
+
+			err := finding.Fix()
+			if err != nil {
+				log.Debug("Could not fix %s: %v", finding.Path, err)
+				failures = append(failures, fmt.Sprintf("%s: %v", finding.Description, err))
+			}
+		}
+
+		progress.SetMessage("")
+
+		if len(failures) > 0 {
+			mebroutines.ShowTranslatedErrorMessage("Some problems could not be fixed:\n\n%s", strings.Join(failures, "\n"))
+		} else {
+			mebroutines.ShowTranslatedInfoMessage("The selected problems were fixed")
+		}
+
+		translateUILabels()
+		enableUI(mainUIStatus)
+	}()
+}
+
+// showDoctorWindow lists the problems found in the VirtualBox environment. The user
+// selects the problems to be fixed.
+func showDoctorWindow(mainUIStatus chan string, findings []doctor.Finding) {
+	doctorWindow := ui.NewWindow(xlate.Get("naksu: Diagnose VirtualBox"), 600, 1, false)
+	doctorLabel := ui.NewLabel(xlate.Get("Select the problems to fix:"))
+	doctorButtonFix := ui.NewButton(xlate.Get("Fix Selected"))
+	doctorButtonClose := ui.NewButton(xlate.Get("Close"))
+
+	doctorBox := ui.NewVerticalBox()
+	doctorBox.SetPadded(true)
+	doctorBox.Append(doctorLabel, false)
+
+	doctorCheckboxes := []*ui.Checkbox{}
+	for _, finding := range findings {
+		doctorCheckbox := ui.NewCheckbox(finding.Description)
+		doctorCheckboxes = append(doctorCheckboxes, doctorCheckbox)
+
+		doctorBox.Append(doctorCheckbox, false)
+		doctorBox.Append(ui.NewLabel(xlate.Get("Fix: %s", finding.FixDescription)), false)
+	}
+
+	doctorBox.Append(ui.NewHorizontalSeparator(), false)
+	doctorBox.Append(doctorButtonFix, false)
+	doctorBox.Append(doctorButtonClose, false)
+
+	doctorWindow.SetMargined(true)
+	doctorWindow.SetChild(doctorBox)
+
+	doctorButtonFix.OnClicked(func(*ui.Button) {
+		selectedFindings := []doctor.Finding{}
+		for n, doctorCheckbox := range doctorCheckboxes {
+			if doctorCheckbox.Checked() {
+				selectedFindings = append(selectedFindings, findings[n])
+			}
+		}
+
+		if len(selectedFindings) == 0 {
+			mebroutines.ShowTranslatedErrorMessage("Please select the problems to fix")
+			return
+		}
+
+		log.Action("Fixing %d problems found by doctor", len(selectedFindings))
+		doctorWindow.Destroy()
+		fixDoctorFindings(mainUIStatus, selectedFindings)
+	})
+
+	doctorButtonClose.OnClicked(func(*ui.Button) {
+		log.Action("Closing Diagnose VirtualBox dialog")
+		doctorWindow.Destroy()
+		enableUI(mainUIStatus)
+	})
+
+	doctorWindow.OnClosing(func(*ui.Window) bool {
+		log.Action("Closing Diagnose VirtualBox dialog")
+		enableUI(mainUIStatus)
+		return true
+	})
+
+	doctorWindow.Show()
+}
+
+func bindOnDoctor(mainUIStatus chan string) {
+	buttonDoctor.OnClicked(func(*ui.Button) {
+		log.Action("Opening Diagnose VirtualBox dialog")
+		disableUI(mainUIStatus)
+
+		go func() {
+			progress.TranslateAndSetMessage("Diagnosing VirtualBox...")
+			findings, err := doctor.Diagnose()
+			progress.SetMessage("")
+
+			if err != nil {
+				mebroutines.ShowTranslatedErrorMessage("Could not diagnose VirtualBox: %v", err)
+				enableUI(mainUIStatus)
+				return
+			}
+
+			if len(findings) == 0 {
+				mebroutines.ShowTranslatedInfoMessage("No problems were found")
+				enableUI(mainUIStatus)
+				return
+			}
+
+			ui.QueueMain(func() {
+				showDoctorWindow(mainUIStatus, findings)
+			})
+		}()
+	})
+}
+
+// cleanUpStorage does the selected cleanups in a goroutine and reports the freed space
+func cleanUpStorage(mainUIStatus chan string, cleanups []storage.Cleanup) {
+	go func() {
+		failures := []string{}
+		var freed uint64
+
+		for n, cleanup := range cleanups {
+			progress.TranslateAndSetMessage("Cleaning up %d of %d...", n+1, len(cleanups))
+
+			err := cleanup.Clean()
+			if err != nil {
+				log.Debug("Could not clean up %s: %v", cleanup.Category, err)
+				failures = append(failures, fmt.Sprintf("%s: %v", cleanup.Description, err))
+				continue
+			}
+
+			freed += cleanup.Size
+		}
+
+		progress.SetMessage("")
+
+		if len(failures) > 0 {
+			mebroutines.ShowTranslatedErrorMessage("Some files could not be removed:\n\n%s", strings.Join(failures, "\n"))
+		} else {
+			mebroutines.ShowTranslatedInfoMessage("%s of disk space was freed", humanize.Bytes(freed))
+		}
+
+		enableUI(mainUIStatus)
+	}()
+}
+
+// showStorageWindow shows the disk space used by naksu and the servers. The user
+// selects the cleanups to be done.
+func showStorageWindow(mainUIStatus chan string, report storage.Report, cleanups []storage.Cleanup) {
+	storageWindow := ui.NewWindow(xlate.Get("naksu: Disk Usage"), 600, 1, false)
+	storageButtonClean := ui.NewButton(xlate.Get("Clean Up Selected"))
+	storageButtonClose := ui.NewButton(xlate.Get("Close"))
+
+	storageBox := ui.NewVerticalBox()
+	storageBox.SetPadded(true)
+
+	for _, usage := range report.Usages {
+		storageBox.Append(ui.NewLabel(xlate.Get("%s: %s (%d files)", usage.Description, humanize.Bytes(usage.Size), usage.Files)), false)
+	}
+	storageBox.Append(ui.NewLabel(xlate.Get("Total: %s", humanize.Bytes(report.Total()))), false)
+	for _, free := range report.Free {
+		storageBox.Append(ui.NewLabel(xlate.Get("Free on %s: %s", free.Directory, humanize.Bytes(free.Free))), false)
+	}
+	storageBox.Append(ui.NewHorizontalSeparator(), false)
+
+	storageCheckboxes := []*ui.Checkbox{}
+	if len(cleanups) == 0 {
+		storageBox.Append(ui.NewLabel(xlate.Get("There is nothing to clean up")), false)
+	} else {
+		storageBox.Append(ui.NewLabel(xlate.Get("Select the files to remove:")), false)
+	}
+
+	for _, cleanup := range cleanups {
+		storageCheckbox := ui.NewCheckbox(xlate.Get("%s (frees %s)", cleanup.Description, humanize.Bytes(cleanup.Size)))
+		storageCheckboxes = append(storageCheckboxes, storageCheckbox)
+		storageBox.Append(storageCheckbox, false)
+	}
+
+	storageBox.Append(ui.NewHorizontalSeparator(), false)
+	if len(cleanups) > 0 {
+		storageBox.Append(storageButtonClean, false)
+	}
+	storageBox.Append(storageButtonClose, false)
+
+	storageWindow.SetMargined(true)
+	storageWindow.SetChild(storageBox)
+
+	storageButtonClean.OnClicked(func(*ui.Button) {
+		selectedCleanups := []storage.Cleanup{}
+		for n, storageCheckbox := range storageCheckboxes {
+			if storageCheckbox.Checked() {
+				selectedCleanups = append(selectedCleanups, cleanups[n])
+			}
+		}
+
+		if len(selectedCleanups) == 0 {
+			mebroutines.ShowTranslatedErrorMessage("Please select the files to remove")
+			return
+		}
+
+		log.Action("Doing %d disk space cleanups", len(selectedCleanups))
+		storageWindow.Destroy()
+		cleanUpStorage(mainUIStatus, selectedCleanups)
+	})
+
+	storageButtonClose.OnClicked(func(*ui.Button) {
+		log.Action("Closing Disk Usage dialog")
+		storageWindow.Destroy()
+		enableUI(mainUIStatus)
+	})
+
+	storageWindow.OnClosing(func(*ui.Window) bool {
+		log.Action("Closing Disk Usage dialog")
+		enableUI(mainUIStatus)
+		return true
+	})
+
+	storageWindow.Show()
+}
+
+func bindOnStorage(mainUIStatus chan string) {
+	buttonStorage.OnClicked(func(*ui.Button) {
+		log.Action("Opening Disk Usage dialog")
+		disableUI(mainUIStatus)
+
+		go func() {
+			progress.TranslateAndSetMessage("Calculating disk usage...")
+			report, err := storage.GetUsage()
+			var cleanups []storage.Cleanup
+			if err == nil {
+				cleanups, err = storage.ListCleanups()
+			}
+			progress.SetMessage("")
+
+			if err != nil {
+				mebroutines.ShowTranslatedErrorMessage("Could not calculate disk usage: %v", err)
+				enableUI(mainUIStatus)
+				return
+			}
+
+			ui.QueueMain(func() {
+				showStorageWindow(mainUIStatus, report, cleanups)
+			})
+		}()
+	})
+}
+
+// formatResourceValue returns the value for a resource entry. Zero is shown as an
+// empty entry which means an automatic value.
+func formatResourceValue(value uint64) string {
+	if value == 0 {
+		return ""
+	}
+
+	return strconv.FormatUint(value, 10)
+}
+
+// parseResourceValue returns the value of a resource entry. An empty entry gives zero.
+func parseResourceValue(text string) (uint64, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, nil
+	}
+
+	return strconv.ParseUint(text, 10, 64)
+}
+
+// showServerResourcesWindow opens a dialog for changing the CPU count, memory, video
+// memory and disk size of the server. The changes are applied to the installed server.
+func showServerResourcesWindow(mainUIStatus chan string, limits box.ResourceLimits) {
+	resourcesWindow := ui.NewWindow(xlate.Get("naksu: Server Resources"), 400, 1, false)
+	resourcesCPUsLabel := ui.NewLabel(xlate.Get("CPUs (%d-%d, leave empty for automatic):", limits.MinCPUs, limits.MaxCPUs))
+	resourcesCPUsEntry := ui.NewEntry()
+	resourcesMemoryLabel := ui.NewLabel(xlate.Get("Memory in MB (%d-%d, leave empty for automatic):", limits.MinMemoryMB, limits.MaxMemoryMB))
+	resourcesMemoryEntry := ui.NewEntry()
+	resourcesVRamLabel := ui.NewLabel(xlate.Get("Video memory in MB (%d-%d):", limits.MinVRamMB, limits.MaxVRamMB))
+	resourcesVRamEntry := ui.NewEntry()
+	resourcesDiskLabel := ui.NewLabel(xlate.Get("Disk size of new servers in GB (%d-%d):", limits.MinDiskSizeGB, limits.MaxDiskSizeGB))
+	resourcesDiskEntry := ui.NewEntry()
+	resourcesButtonSave := ui.NewButton(xlate.Get("Save"))
+	resourcesButtonCancel := ui.NewButton(xlate.Get("Cancel"))
+
+	resourcesCPUsEntry.SetText(formatResourceValue(config.GetVMCPUs()))
+	resourcesMemoryEntry.SetText(formatResourceValue(config.GetVMMemoryMB()))
+	resourcesVRamEntry.SetText(formatResourceValue(config.GetVMVRamMB()))
+	resourcesDiskEntry.SetText(formatResourceValue(config.GetVMDiskSizeGB()))
+
+	resourcesBox := ui.NewVerticalBox()
+	resourcesBox.SetPadded(true)
+	resourcesBox.Append(resourcesCPUsLabel, false)
+	resourcesBox.Append(resourcesCPUsEntry, false)
+	resourcesBox.Append(resourcesMemoryLabel, false)
+	resourcesBox.Append(resourcesMemoryEntry, false)
+	resourcesBox.Append(resourcesVRamLabel, false)
+	resourcesBox.Append(resourcesVRamEntry, false)
+	resourcesBox.Append(resourcesDiskLabel, false)
+	resourcesBox.Append(resourcesDiskEntry, false)
+	resourcesBox.Append(resourcesButtonSave, false)
+	resourcesBox.Append(resourcesButtonCancel, false)
+
+	resourcesWindow.SetMargined(true)
+	resourcesWindow.SetChild(resourcesBox)
+
+	resourcesButtonSave.OnClicked(func(*ui.Button) {
+		values := []uint64{}
+		for _, entry := range []*ui.Entry{resourcesCPUsEntry, resourcesMemoryEntry, resourcesVRamEntry, resourcesDiskEntry} {
+			value, err := parseResourceValue(entry.Text())
+			if err != nil {
+				mebroutines.ShowTranslatedErrorMessage("Please enter a number instead of '%s'", entry.Text())
+				return
+			}
+			values = append(values, value)
+		}
+
+		resources := box.Resources{
+			CPUs:       int(values[0]),
+			MemoryMB:   values[1],
+			VRamMB:     int(values[2]),
+			DiskSizeGB: values[3],
+		}
+
+		err := box.SetResources(resources)
+		if err != nil {
+			mebroutines.ShowTranslatedErrorMessage("Invalid server settings: %v", err)
+			return
+		}
+
+		log.Action("Changed server resources to %+v", resources)
+		resourcesWindow.Destroy()
+
+		go func() {
+			isInstalled, err := box.Installed()
+			if err == nil && isInstalled {
+				err = box.ApplyResources()
+				if err != nil {
+					mebroutines.ShowErrorMessage(box.AddErrorAdvice(xlate.Get("Could not change the settings of the installed server: %v", err), err))
+				} else {
+					progress.TranslateAndSetMessage("Server resources were changed")
+				}
+			}
+
+			enableUI(mainUIStatus)
+		}()
+	})
+
+	resourcesButtonCancel.OnClicked(func(*ui.Button) {
+		log.Action("Cancelling ServerResources dialog")
+		resourcesWindow.Destroy()
+		enableUI(mainUIStatus)
+	})
+
+	resourcesWindow.OnClosing(func(*ui.Window) bool {
+		log.Action("Closing ServerResources dialog")
+		enableUI(mainUIStatus)
+		return true
+	})
+
+	resourcesWindow.Show()
+}
+
+func bindOnServerResources(mainUIStatus chan string) {
+	buttonServerResources.OnClicked(func(*ui.Button) {
+		log.Action("Opening ServerResources dialog")
+		disableUI(mainUIStatus)
+
+		go func() {
+			limits, err := box.GetResourceLimits()
+			if err != nil {
+				mebroutines.ShowTranslatedErrorMessage("Could not read the resources of the computer: %v", err)
+				enableUI(mainUIStatus)
+				return
+			}
+
+			ui.QueueMain(func() {
+				showServerResourcesWindow(mainUIStatus, limits)
+			})
+		}()
+	})
+}
+
 func bindOnDestroyServer(mainUIStatus chan string) {
 	// Define actions for Destroy popup/window
 	buttonDestroyServer.OnClicked(func(*ui.Button) {
@@ -817,6 +2003,108 @@ func bindOnMakeBackup(mainUIStatus chan string) {
 	})
 }
 
+func bindOnRestoreBackup(mainUIStatus chan string) {
+	buttonRestoreBackup.OnClicked(func(*ui.Button) {
+		log.Action("Opening RestoreBackup dialog")
+		disableUI(mainUIStatus)
+		restoreWindow.Show()
+	})
+
+	restoreButtonBrowse.OnClicked(func(*ui.Button) {
+		backupPath := ui.OpenFile(restoreWindow)
+		if backupPath == "" {
+			return
+		}
+
+		restorePathEntry.SetText(backupPath)
+
+		// Prefill the server type and version from the backup manifest
+		manifest, err := backup.ReadManifest(backupPath)
+		if err != nil {
+			return
+		}
+
+		for n, boxType := range fileInstallBoxTypes {
+			if boxType == manifest.BoxType {
+				restoreTypeCombobox.SetSelected(n)
+			}
+		}
+		restoreVersionEntry.SetText(manifest.BoxVersion)
+	})
+
+	closeRestoreWindow := func() {
+		restoreWindow.Hide()
+		restorePathEntry.SetText("")
+		restoreVersionEntry.SetText("")
+	}
+
+	restoreButtonRestore.OnClicked(func(*ui.Button) {
+		backupPath := restorePathEntry.Text()
+		boxVersion := restoreVersionEntry.Text()
+		boxType := fileInstallBoxTypes[restoreTypeCombobox.Selected()]
+
+		if backupPath == "" {
+			mebroutines.ShowTranslatedErrorMessage("Please select the backup file")
+			return
+		}
+
+		closeRestoreWindow()
+
+		go func() {
+			log.Action("Restoring %s server from backup %s", boxType, backupPath)
+
+			err := restore.Backup(backupPath, boxType, boxVersion)
+			if err != nil {
+				log.Debug("Failed to restore backup: %v", err)
+				progress.SetMessage("")
+			} else {
+				progress.TranslateAndSetMessage("The backup was restored to a new server")
+			}
+
+			translateUILabels()
+			enableUI(mainUIStatus)
+		}()
+	})
+
+	restoreButtonCancel.OnClicked(func(*ui.Button) {
+		log.Action("Cancelling RestoreBackup dialog")
+		closeRestoreWindow()
+		enableUI(mainUIStatus)
+	})
+
+	restoreWindow.OnClosing(func(*ui.Window) bool {
+		log.Action("Closing RestoreBackup dialog")
+		closeRestoreWindow()
+		enableUI(mainUIStatus)
+		return false
+	})
+}
+
+func bindOnVerifyBackup(mainUIStatus chan string) {
+	buttonVerifyBackup.OnClicked(func(*ui.Button) {
+		backupPath := ui.OpenFile(window)
+		if backupPath == "" {
+			return
+		}
+
+		go func() {
+			log.Action("Verifying backup %s", backupPath)
+			disableUI(mainUIStatus)
+
+			err := backup.Verify(backupPath)
+			if err != nil {
+				log.Debug("Backup verification failed: %v", err)
+				progress.SetMessage("")
+			} else {
+				progress.TranslateAndSetMessage("Backup is intact")
+				mebroutines.ShowTranslatedInfoMessage("The backup %s matches its manifest and it is intact.", backupPath)
+			}
+
+			enableUI(mainUIStatus)
+		}()
+	})
+}
+
 func setLogDeliveryLabelTextInGoroutine(text string) {
 	log.Debug(fmt.Sprintf("Log delivery status: %s", text))
 	ui.QueueMain(func() {
@@ -1052,6 +2340,16 @@ func bindOnRemove(mainUIStatus chan string) {
 	})
 }
 
+// showHypervisorNotAvailableError tells the user that the selected virtualisation backend
+// has not been installed
+func showHypervisorNotAvailableError() {
+	if config.GetHypervisor() == "qemu" {
+		mebroutines.ShowTranslatedErrorMessage("Could not execute qemu-img or qemu-system-x86_64. Are you sure you have installed QEMU?")
+	} else {
+		mebroutines.ShowTranslatedErrorMessage("Could not execute VBoxManage. Are you sure you have installed Oracle VirtualBox?")
+	}
+}
+
 // RunUI sets up user interface and starts running it. function exists when application exits
 func RunUI() error {
 
@@ -1070,6 +2368,8 @@ func RunUI() error {
 		createBackupElements(backupMedia)
 		createLogDeliveryElements()
 		createExamInstallElements()
+		createFileInstallElements()
+		createRestoreElements()
 		createDestroyElements()
 		createRemoveElements()
 
@@ -1111,10 +2411,20 @@ func RunUI() error {
 		bindUIDisableOnStart(mainUIStatus)
 
 		// Bind buttons
+		bindOnShutdownServer(mainUIStatus)
+		bindOnRecoverServer(mainUIStatus)
 		bindOnInstallAbittiServer(mainUIStatus)
 		bindOnInstallExamServer(mainUIStatus)
+		bindOnInstallFromFile(mainUIStatus)
+		bindOnSelectServer(mainUIStatus)
+		bindOnSnapshots(mainUIStatus)
+		bindOnServerResources(mainUIStatus)
 		bindOnMakeBackup(mainUIStatus)
+		bindOnRestoreBackup(mainUIStatus)
+		bindOnVerifyBackup(mainUIStatus)
 		bindOnDeliverLogs(mainUIStatus)
+		bindOnDoctor(mainUIStatus)
+		bindOnStorage(mainUIStatus)
 		bindOnDestroyServer(mainUIStatus)
 		bindOnRemoveServer(mainUIStatus)
 		bindOnMebShare()
@@ -1139,11 +2449,18 @@ func RunUI() error {
 			RunSelfUpdate()
 		}()
 
-		// Make sure we have VBoxManage
-		if !vboxmanage.IsInstalled() {
-			mebroutines.ShowTranslatedErrorMessage("Could not execute VBoxManage. Are you sure you have installed Oracle VirtualBox?")
-			log.Debug("VBoxManage is missing, disabling UI")
+		// Make sure we have VBoxManage (or the tools of another virtualisation backend)
+		if !box.IsHypervisorAvailable() {
+			showHypervisorNotAvailableError()
+			log.Debug("%s is missing, disabling UI", box.HypervisorName())
 			disableUI(mainUIStatus)
+		} else {
+			// Finish or roll back an install interrupted e.g. by a power loss
+			go func() {
+				disableUI(mainUIStatus)
+				_ = install.RecoverInterruptedInstall()
+				enableUI(mainUIStatus)
+			}()
 		}
 
 		// Check VBoxManage version
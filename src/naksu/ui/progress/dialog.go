@@ -1,6 +1,7 @@
 package progress
 
 import (
+	"fmt"
 	"strconv"
 
 	"github.com/andlabs/ui"
@@ -16,8 +17,19 @@ type Dialog struct {
 	MessageString string
 }
 
-// ShowProgressDialog opens a progress dialog
+// lastConsoleProgress holds the last progress line printed by a dialog without
+// a window to avoid printing the same line over and over again
+var lastConsoleProgress string
+
+// ShowProgressDialog opens a progress dialog. If there is no GUI (see SetProgressLabel)
+// the returned dialog does not have a window and the progress is printed to the
+// standard output instead.
 func ShowProgressDialog(message string) Dialog {
+	if progressLabel == nil {
+		printConsoleProgress(message)
+		return Dialog{MessageString: message}
+	}
+
 	progressWindow := ui.NewWindow("", 400, 1, false)
 	//progressWindow.SetBorderless(true)
 	progressBox := ui.NewVerticalBox()
@@ -49,6 +61,19 @@ func UpdateProgressDialog(dialog Dialog, progress int, message *string) {
 		} else {
 			dialog.Message.SetText(dialog.MessageString + " (" + strconv.Itoa(progress) + "%)")
 		}
+	} else if dialog.Window == nil {
+		if message != nil {
+			printConsoleProgress(*message + " (" + strconv.Itoa(progress) + "%)")
+		} else {
+			printConsoleProgress(dialog.MessageString + " (" + strconv.Itoa(progress) + "%)")
+		}
+	}
+}
+
+func printConsoleProgress(line string) {
+	if line != lastConsoleProgress {
+		fmt.Println(line)
+		lastConsoleProgress = line
 	}
 }
 
@@ -17,9 +17,19 @@ func SetProgressLabel(newProgressLabel *ui.Label) {
 	lastMessage = ""
 }
 
-// setMessage does the actual message label updating
+// setMessage does the actual message label updating. If the label has not been
+// set (i.e. naksu is executed from the command line) the message is printed to
+// the standard output.
 func setMessage(message string) {
 	log.Debug(fmt.Sprintf("Progress message: %s", message))
+
+	if progressLabel == nil {
+		if message != "" {
+			fmt.Println(message)
+		}
+		return
+	}
+
 	ui.QueueMain(func() {
 		progressLabel.SetText(message)
 	})